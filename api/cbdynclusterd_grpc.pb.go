@@ -0,0 +1,863 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DynClusterClient is the client API for DynCluster service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DynClusterClient interface {
+	// Clusters
+	ListClusters(ctx context.Context, in *ListClustersRequest, opts ...grpc.CallOption) (*ListClustersResponse, error)
+	GetCluster(ctx context.Context, in *GetClusterRequest, opts ...grpc.CallOption) (*Cluster, error)
+	CreateCluster(ctx context.Context, in *CreateClusterRequest, opts ...grpc.CallOption) (*CreateClusterResponse, error)
+	SetupCluster(ctx context.Context, in *SetupClusterRequest, opts ...grpc.CallOption) (*SetupClusterResponse, error)
+	RefreshCluster(ctx context.Context, in *RefreshClusterRequest, opts ...grpc.CallOption) (*Empty, error)
+	KillCluster(ctx context.Context, in *KillClusterRequest, opts ...grpc.CallOption) (*Empty, error)
+	// GetClusterStatus returns the health of a cluster from ns_server.
+	GetClusterStatus(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*ClusterStatus, error)
+	// Lifecycle
+	HibernateCluster(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*Empty, error)
+	WakeCluster(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*Empty, error)
+	// WatchCluster streams the cluster every time it changes, starting with
+	// its current state, until the cluster is killed or the call is cancelled.
+	// This is how the progress of allocations and setup can be followed.
+	WatchCluster(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (DynCluster_WatchClusterClient, error)
+	// Nodes
+	ExecOnNode(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (*ExecResult, error)
+	// StreamNodeLogs streams the logs of a node, following them if requested.
+	StreamNodeLogs(ctx context.Context, in *NodeLogsRequest, opts ...grpc.CallOption) (DynCluster_StreamNodeLogsClient, error)
+	// ReplaceNode swap rebalances a new node in for a node, and removes the
+	// old one.
+	ReplaceNode(ctx context.Context, in *ReplaceNodeRequest, opts ...grpc.CallOption) (*Node, error)
+	// Jobs
+	StartCollectInfo(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*CollectInfo, error)
+	// StartLoad loads data into a bucket with cbc-pillowfight.
+	StartLoad(ctx context.Context, in *LoadRequest, opts ...grpc.CallOption) (*Job, error)
+	// StartBackup and StartRestore run cbbackupmgr against a cluster, using
+	// the daemon's backup archive.
+	StartBackup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*Job, error)
+	StartRestore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*Job, error)
+	GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// WatchJob streams the job every time its progress changes until it
+	// finishes.
+	WatchJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (DynCluster_WatchJobClient, error)
+}
+
+type dynClusterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDynClusterClient(cc grpc.ClientConnInterface) DynClusterClient {
+	return &dynClusterClient{cc}
+}
+
+func (c *dynClusterClient) ListClusters(ctx context.Context, in *ListClustersRequest, opts ...grpc.CallOption) (*ListClustersResponse, error) {
+	out := new(ListClustersResponse)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/ListClusters", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) GetCluster(ctx context.Context, in *GetClusterRequest, opts ...grpc.CallOption) (*Cluster, error) {
+	out := new(Cluster)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/GetCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) CreateCluster(ctx context.Context, in *CreateClusterRequest, opts ...grpc.CallOption) (*CreateClusterResponse, error) {
+	out := new(CreateClusterResponse)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/CreateCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) SetupCluster(ctx context.Context, in *SetupClusterRequest, opts ...grpc.CallOption) (*SetupClusterResponse, error) {
+	out := new(SetupClusterResponse)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/SetupCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) RefreshCluster(ctx context.Context, in *RefreshClusterRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/RefreshCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) KillCluster(ctx context.Context, in *KillClusterRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/KillCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) GetClusterStatus(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*ClusterStatus, error) {
+	out := new(ClusterStatus)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/GetClusterStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) HibernateCluster(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/HibernateCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) WakeCluster(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/WakeCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) WatchCluster(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (DynCluster_WatchClusterClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DynCluster_ServiceDesc.Streams[0], "/cbdynclusterd.DynCluster/WatchCluster", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dynClusterWatchClusterClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DynCluster_WatchClusterClient interface {
+	Recv() (*ClusterEvent, error)
+	grpc.ClientStream
+}
+
+type dynClusterWatchClusterClient struct {
+	grpc.ClientStream
+}
+
+func (x *dynClusterWatchClusterClient) Recv() (*ClusterEvent, error) {
+	m := new(ClusterEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dynClusterClient) ExecOnNode(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (*ExecResult, error) {
+	out := new(ExecResult)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/ExecOnNode", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) StreamNodeLogs(ctx context.Context, in *NodeLogsRequest, opts ...grpc.CallOption) (DynCluster_StreamNodeLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DynCluster_ServiceDesc.Streams[1], "/cbdynclusterd.DynCluster/StreamNodeLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dynClusterStreamNodeLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DynCluster_StreamNodeLogsClient interface {
+	Recv() (*LogChunk, error)
+	grpc.ClientStream
+}
+
+type dynClusterStreamNodeLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *dynClusterStreamNodeLogsClient) Recv() (*LogChunk, error) {
+	m := new(LogChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dynClusterClient) ReplaceNode(ctx context.Context, in *ReplaceNodeRequest, opts ...grpc.CallOption) (*Node, error) {
+	out := new(Node)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/ReplaceNode", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) StartCollectInfo(ctx context.Context, in *ClusterRef, opts ...grpc.CallOption) (*CollectInfo, error) {
+	out := new(CollectInfo)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/StartCollectInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) StartLoad(ctx context.Context, in *LoadRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/StartLoad", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) StartBackup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/StartBackup", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) StartRestore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/StartRestore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, "/cbdynclusterd.DynCluster/GetJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dynClusterClient) WatchJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (DynCluster_WatchJobClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DynCluster_ServiceDesc.Streams[2], "/cbdynclusterd.DynCluster/WatchJob", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dynClusterWatchJobClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DynCluster_WatchJobClient interface {
+	Recv() (*Job, error)
+	grpc.ClientStream
+}
+
+type dynClusterWatchJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *dynClusterWatchJobClient) Recv() (*Job, error) {
+	m := new(Job)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DynClusterServer is the server API for DynCluster service.
+// All implementations must embed UnimplementedDynClusterServer
+// for forward compatibility
+type DynClusterServer interface {
+	// Clusters
+	ListClusters(context.Context, *ListClustersRequest) (*ListClustersResponse, error)
+	GetCluster(context.Context, *GetClusterRequest) (*Cluster, error)
+	CreateCluster(context.Context, *CreateClusterRequest) (*CreateClusterResponse, error)
+	SetupCluster(context.Context, *SetupClusterRequest) (*SetupClusterResponse, error)
+	RefreshCluster(context.Context, *RefreshClusterRequest) (*Empty, error)
+	KillCluster(context.Context, *KillClusterRequest) (*Empty, error)
+	// GetClusterStatus returns the health of a cluster from ns_server.
+	GetClusterStatus(context.Context, *ClusterRef) (*ClusterStatus, error)
+	// Lifecycle
+	HibernateCluster(context.Context, *ClusterRef) (*Empty, error)
+	WakeCluster(context.Context, *ClusterRef) (*Empty, error)
+	// WatchCluster streams the cluster every time it changes, starting with
+	// its current state, until the cluster is killed or the call is cancelled.
+	// This is how the progress of allocations and setup can be followed.
+	WatchCluster(*ClusterRef, DynCluster_WatchClusterServer) error
+	// Nodes
+	ExecOnNode(context.Context, *ExecRequest) (*ExecResult, error)
+	// StreamNodeLogs streams the logs of a node, following them if requested.
+	StreamNodeLogs(*NodeLogsRequest, DynCluster_StreamNodeLogsServer) error
+	// ReplaceNode swap rebalances a new node in for a node, and removes the
+	// old one.
+	ReplaceNode(context.Context, *ReplaceNodeRequest) (*Node, error)
+	// Jobs
+	StartCollectInfo(context.Context, *ClusterRef) (*CollectInfo, error)
+	// StartLoad loads data into a bucket with cbc-pillowfight.
+	StartLoad(context.Context, *LoadRequest) (*Job, error)
+	// StartBackup and StartRestore run cbbackupmgr against a cluster, using
+	// the daemon's backup archive.
+	StartBackup(context.Context, *BackupRequest) (*Job, error)
+	StartRestore(context.Context, *RestoreRequest) (*Job, error)
+	GetJob(context.Context, *GetJobRequest) (*Job, error)
+	// WatchJob streams the job every time its progress changes until it
+	// finishes.
+	WatchJob(*GetJobRequest, DynCluster_WatchJobServer) error
+	mustEmbedUnimplementedDynClusterServer()
+}
+
+// UnimplementedDynClusterServer must be embedded to have forward compatible implementations.
+type UnimplementedDynClusterServer struct {
+}
+
+func (UnimplementedDynClusterServer) ListClusters(context.Context, *ListClustersRequest) (*ListClustersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListClusters not implemented")
+}
+func (UnimplementedDynClusterServer) GetCluster(context.Context, *GetClusterRequest) (*Cluster, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCluster not implemented")
+}
+func (UnimplementedDynClusterServer) CreateCluster(context.Context, *CreateClusterRequest) (*CreateClusterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateCluster not implemented")
+}
+func (UnimplementedDynClusterServer) SetupCluster(context.Context, *SetupClusterRequest) (*SetupClusterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetupCluster not implemented")
+}
+func (UnimplementedDynClusterServer) RefreshCluster(context.Context, *RefreshClusterRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefreshCluster not implemented")
+}
+func (UnimplementedDynClusterServer) KillCluster(context.Context, *KillClusterRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KillCluster not implemented")
+}
+func (UnimplementedDynClusterServer) GetClusterStatus(context.Context, *ClusterRef) (*ClusterStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClusterStatus not implemented")
+}
+func (UnimplementedDynClusterServer) HibernateCluster(context.Context, *ClusterRef) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HibernateCluster not implemented")
+}
+func (UnimplementedDynClusterServer) WakeCluster(context.Context, *ClusterRef) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WakeCluster not implemented")
+}
+func (UnimplementedDynClusterServer) WatchCluster(*ClusterRef, DynCluster_WatchClusterServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchCluster not implemented")
+}
+func (UnimplementedDynClusterServer) ExecOnNode(context.Context, *ExecRequest) (*ExecResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExecOnNode not implemented")
+}
+func (UnimplementedDynClusterServer) StreamNodeLogs(*NodeLogsRequest, DynCluster_StreamNodeLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamNodeLogs not implemented")
+}
+func (UnimplementedDynClusterServer) ReplaceNode(context.Context, *ReplaceNodeRequest) (*Node, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplaceNode not implemented")
+}
+func (UnimplementedDynClusterServer) StartCollectInfo(context.Context, *ClusterRef) (*CollectInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartCollectInfo not implemented")
+}
+func (UnimplementedDynClusterServer) StartLoad(context.Context, *LoadRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartLoad not implemented")
+}
+func (UnimplementedDynClusterServer) StartBackup(context.Context, *BackupRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartBackup not implemented")
+}
+func (UnimplementedDynClusterServer) StartRestore(context.Context, *RestoreRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartRestore not implemented")
+}
+func (UnimplementedDynClusterServer) GetJob(context.Context, *GetJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedDynClusterServer) WatchJob(*GetJobRequest, DynCluster_WatchJobServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJob not implemented")
+}
+func (UnimplementedDynClusterServer) mustEmbedUnimplementedDynClusterServer() {}
+
+// UnsafeDynClusterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DynClusterServer will
+// result in compilation errors.
+type UnsafeDynClusterServer interface {
+	mustEmbedUnimplementedDynClusterServer()
+}
+
+func RegisterDynClusterServer(s grpc.ServiceRegistrar, srv DynClusterServer) {
+	s.RegisterService(&DynCluster_ServiceDesc, srv)
+}
+
+func _DynCluster_ListClusters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListClustersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).ListClusters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/ListClusters",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).ListClusters(ctx, req.(*ListClustersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_GetCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).GetCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/GetCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).GetCluster(ctx, req.(*GetClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_CreateCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).CreateCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/CreateCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).CreateCluster(ctx, req.(*CreateClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_SetupCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetupClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).SetupCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/SetupCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).SetupCluster(ctx, req.(*SetupClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_RefreshCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).RefreshCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/RefreshCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).RefreshCluster(ctx, req.(*RefreshClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_KillCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KillClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).KillCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/KillCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).KillCluster(ctx, req.(*KillClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_GetClusterStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).GetClusterStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/GetClusterStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).GetClusterStatus(ctx, req.(*ClusterRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_HibernateCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).HibernateCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/HibernateCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).HibernateCluster(ctx, req.(*ClusterRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_WakeCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).WakeCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/WakeCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).WakeCluster(ctx, req.(*ClusterRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_WatchCluster_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ClusterRef)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DynClusterServer).WatchCluster(m, &dynClusterWatchClusterServer{stream})
+}
+
+type DynCluster_WatchClusterServer interface {
+	Send(*ClusterEvent) error
+	grpc.ServerStream
+}
+
+type dynClusterWatchClusterServer struct {
+	grpc.ServerStream
+}
+
+func (x *dynClusterWatchClusterServer) Send(m *ClusterEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DynCluster_ExecOnNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExecRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).ExecOnNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/ExecOnNode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).ExecOnNode(ctx, req.(*ExecRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_StreamNodeLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(NodeLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DynClusterServer).StreamNodeLogs(m, &dynClusterStreamNodeLogsServer{stream})
+}
+
+type DynCluster_StreamNodeLogsServer interface {
+	Send(*LogChunk) error
+	grpc.ServerStream
+}
+
+type dynClusterStreamNodeLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *dynClusterStreamNodeLogsServer) Send(m *LogChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DynCluster_ReplaceNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplaceNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).ReplaceNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/ReplaceNode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).ReplaceNode(ctx, req.(*ReplaceNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_StartCollectInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).StartCollectInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/StartCollectInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).StartCollectInfo(ctx, req.(*ClusterRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_StartLoad_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).StartLoad(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/StartLoad",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).StartLoad(ctx, req.(*LoadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_StartBackup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).StartBackup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/StartBackup",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).StartBackup(ctx, req.(*BackupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_StartRestore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).StartRestore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/StartRestore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).StartRestore(ctx, req.(*RestoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DynClusterServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cbdynclusterd.DynCluster/GetJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DynClusterServer).GetJob(ctx, req.(*GetJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DynCluster_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DynClusterServer).WatchJob(m, &dynClusterWatchJobServer{stream})
+}
+
+type DynCluster_WatchJobServer interface {
+	Send(*Job) error
+	grpc.ServerStream
+}
+
+type dynClusterWatchJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *dynClusterWatchJobServer) Send(m *Job) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// DynCluster_ServiceDesc is the grpc.ServiceDesc for DynCluster service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DynCluster_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cbdynclusterd.DynCluster",
+	HandlerType: (*DynClusterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListClusters",
+			Handler:    _DynCluster_ListClusters_Handler,
+		},
+		{
+			MethodName: "GetCluster",
+			Handler:    _DynCluster_GetCluster_Handler,
+		},
+		{
+			MethodName: "CreateCluster",
+			Handler:    _DynCluster_CreateCluster_Handler,
+		},
+		{
+			MethodName: "SetupCluster",
+			Handler:    _DynCluster_SetupCluster_Handler,
+		},
+		{
+			MethodName: "RefreshCluster",
+			Handler:    _DynCluster_RefreshCluster_Handler,
+		},
+		{
+			MethodName: "KillCluster",
+			Handler:    _DynCluster_KillCluster_Handler,
+		},
+		{
+			MethodName: "GetClusterStatus",
+			Handler:    _DynCluster_GetClusterStatus_Handler,
+		},
+		{
+			MethodName: "HibernateCluster",
+			Handler:    _DynCluster_HibernateCluster_Handler,
+		},
+		{
+			MethodName: "WakeCluster",
+			Handler:    _DynCluster_WakeCluster_Handler,
+		},
+		{
+			MethodName: "ExecOnNode",
+			Handler:    _DynCluster_ExecOnNode_Handler,
+		},
+		{
+			MethodName: "ReplaceNode",
+			Handler:    _DynCluster_ReplaceNode_Handler,
+		},
+		{
+			MethodName: "StartCollectInfo",
+			Handler:    _DynCluster_StartCollectInfo_Handler,
+		},
+		{
+			MethodName: "StartLoad",
+			Handler:    _DynCluster_StartLoad_Handler,
+		},
+		{
+			MethodName: "StartBackup",
+			Handler:    _DynCluster_StartBackup_Handler,
+		},
+		{
+			MethodName: "StartRestore",
+			Handler:    _DynCluster_StartRestore_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _DynCluster_GetJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchCluster",
+			Handler:       _DynCluster_WatchCluster_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamNodeLogs",
+			Handler:       _DynCluster_StreamNodeLogs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchJob",
+			Handler:       _DynCluster_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cbdynclusterd.proto",
+}
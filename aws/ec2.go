@@ -0,0 +1,172 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// EC2Client runs instances and cleans them up again.
+type EC2Client struct {
+	client *ec2.EC2
+}
+
+func NewEC2Client(endpoint, region string, creds Credentials) (*EC2Client, error) {
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	sess, err := newSession(endpoint, region, creds)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure ec2")
+	}
+
+	return &EC2Client{
+		client: ec2.New(sess),
+	}, nil
+}
+
+// Instance is the subset of the details of an EC2 instance that we use.
+type Instance struct {
+	ID               string
+	State            string
+	PrivateIPAddress string
+	PublicIPAddress  string
+	LaunchTime       time.Time
+	Tags             map[string]string
+}
+
+type RunInstancesOptions struct {
+	ImageID          string
+	InstanceType     string
+	SubnetID         string
+	SecurityGroupIDs []string
+	KeyName          string
+	// UserData is run by cloud-init when the instance first boots, it must
+	// already be base64 encoded.
+	UserData string
+	Tags     map[string]string
+}
+
+func toInstance(i *ec2.Instance) Instance {
+	instance := Instance{
+		ID:               awssdk.StringValue(i.InstanceId),
+		PrivateIPAddress: awssdk.StringValue(i.PrivateIpAddress),
+		PublicIPAddress:  awssdk.StringValue(i.PublicIpAddress),
+		LaunchTime:       awssdk.TimeValue(i.LaunchTime),
+		Tags:             make(map[string]string),
+	}
+	if i.State != nil {
+		instance.State = awssdk.StringValue(i.State.Name)
+	}
+	for _, tag := range i.Tags {
+		instance.Tags[awssdk.StringValue(tag.Key)] = awssdk.StringValue(tag.Value)
+	}
+	return instance
+}
+
+// RunInstance launches a single instance, it will still be pending when this
+// returns.
+func (c *EC2Client) RunInstance(ctx context.Context, opts RunInstancesOptions) (*Instance, error) {
+	input := &ec2.RunInstancesInput{
+		ImageId:      awssdk.String(opts.ImageID),
+		InstanceType: awssdk.String(opts.InstanceType),
+		MinCount:     awssdk.Int64(1),
+		MaxCount:     awssdk.Int64(1),
+	}
+	if opts.SubnetID != "" {
+		input.SubnetId = awssdk.String(opts.SubnetID)
+	}
+	if len(opts.SecurityGroupIDs) > 0 {
+		input.SecurityGroupIds = awssdk.StringSlice(opts.SecurityGroupIDs)
+	}
+	if opts.KeyName != "" {
+		input.KeyName = awssdk.String(opts.KeyName)
+	}
+	if opts.UserData != "" {
+		input.UserData = awssdk.String(opts.UserData)
+	}
+
+	if len(opts.Tags) > 0 {
+		var tagKeys []string
+		for key := range opts.Tags {
+			tagKeys = append(tagKeys, key)
+		}
+		sort.Strings(tagKeys)
+
+		tagSpec := &ec2.TagSpecification{
+			ResourceType: awssdk.String(ec2.ResourceTypeInstance),
+		}
+		for _, key := range tagKeys {
+			tagSpec.Tags = append(tagSpec.Tags, &ec2.Tag{
+				Key:   awssdk.String(key),
+				Value: awssdk.String(opts.Tags[key]),
+			})
+		}
+		input.TagSpecifications = []*ec2.TagSpecification{tagSpec}
+	}
+
+	reservation, err := c.client.RunInstancesWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrap(err, "ec2 RunInstances failed")
+	}
+	if len(reservation.Instances) != 1 {
+		return nil, fmt.Errorf("ec2 RunInstances returned %d instances", len(reservation.Instances))
+	}
+
+	instance := toInstance(reservation.Instances[0])
+	return &instance, nil
+}
+
+// DescribeInstances returns the instances matching all of filters, which map
+// filter names such as tag-key or instance-state-name to accepted values.
+func (c *EC2Client) DescribeInstances(ctx context.Context, filters map[string][]string) ([]Instance, error) {
+	var filterNames []string
+	for name := range filters {
+		filterNames = append(filterNames, name)
+	}
+	sort.Strings(filterNames)
+
+	input := &ec2.DescribeInstancesInput{}
+	for _, name := range filterNames {
+		input.Filters = append(input.Filters, &ec2.Filter{
+			Name:   awssdk.String(name),
+			Values: awssdk.StringSlice(filters[name]),
+		})
+	}
+
+	var instances []Instance
+	err := c.client.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				instances = append(instances, toInstance(instance))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "ec2 DescribeInstances failed")
+	}
+
+	return instances, nil
+}
+
+func (c *EC2Client) TerminateInstances(ctx context.Context, instanceIDs []string) error {
+	if len(instanceIDs) == 0 {
+		return nil
+	}
+
+	_, err := c.client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: awssdk.StringSlice(instanceIDs),
+	})
+	if err != nil {
+		return errors.Wrap(err, "ec2 TerminateInstances failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package aws
+
+import (
+	"context"
+	"io"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// S3Client stores objects in S3 compatible object storage (AWS S3, minio and
+// friends).  Buckets are always addressed path-style so that it works with
+// non-AWS endpoints.
+type S3Client struct {
+	Bucket string
+
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func NewS3Client(endpoint, region, bucket string, creds Credentials) (*S3Client, error) {
+	if bucket == "" {
+		return nil, errors.New("must specify an s3 bucket")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	sess, err := newSession(endpoint, region, creds)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure s3")
+	}
+
+	client := s3.New(sess, awssdk.NewConfig().WithS3ForcePathStyle(true))
+
+	return &S3Client{
+		Bucket:   bucket,
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+	}, nil
+}
+
+// PutObject uploads everything read from body to key.  Large objects are
+// uploaded in parts, so body can be streamed without knowing its length up
+// front.
+func (c *S3Client) PutObject(ctx context.Context, key string, body io.Reader) error {
+	_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      awssdk.String(c.Bucket),
+		Key:         awssdk.String(key),
+		Body:        body,
+		ContentType: awssdk.String("application/octet-stream"),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "s3 upload of %s failed", key)
+	}
+
+	return nil
+}
+
+// GetObject returns a reader for the object at key, which the caller must close.
+func (c *S3Client) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: awssdk.String(c.Bucket),
+		Key:    awssdk.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "s3 download of %s failed", key)
+	}
+
+	return resp.Body, nil
+}
+
+func (c *S3Client) DeleteObject(ctx context.Context, key string) error {
+	_, err := c.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: awssdk.String(c.Bucket),
+		Key:    awssdk.String(key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "s3 delete of %s failed", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package aws
+
+import (
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// maxRetries is how many times requests which fail in a way that is worth
+// retrying, such as being throttled, are retried with backoff.
+const maxRetries = 5
+
+// Credentials are static keys to authenticate with.  When they are empty the
+// default credential chain of the SDK is used instead: the AWS_* environment
+// variables (including AWS_SESSION_TOKEN), the shared credentials and config
+// files (including assuming a role), web identity tokens, and finally the
+// IAM role of the ECS task or EC2 instance profile the daemon runs under.
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+func newSession(endpoint, region string, creds Credentials) (*session.Session, error) {
+	config := awssdk.NewConfig().
+		WithRegion(region).
+		WithMaxRetries(maxRetries)
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if creds.AccessKey != "" || creds.SecretKey != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(creds.AccessKey, creds.SecretKey, ""))
+	}
+
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
@@ -0,0 +1,292 @@
+package capella
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Client is a minimal client for the Capella management API, covering the
+// parts needed to run clusters for testing.
+type Client struct {
+	Endpoint       string
+	OrganizationID string
+	APIKey         string
+	HTTPClient     *http.Client
+}
+
+func NewClient(endpoint, organizationID, apiKey string) (*Client, error) {
+	if endpoint == "" {
+		endpoint = "https://cloudapi.cloud.couchbase.com"
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, errors.Wrap(err, "invalid capella endpoint")
+	}
+	if organizationID == "" {
+		return nil, errors.New("must specify a capella organization")
+	}
+	if apiKey == "" {
+		return nil, errors.New("must specify a capella api key")
+	}
+
+	return &Client{
+		Endpoint:       strings.TrimSuffix(endpoint, "/"),
+		OrganizationID: organizationID,
+		APIKey:         apiKey,
+		HTTPClient:     &http.Client{},
+	}, nil
+}
+
+// Error is returned when the management API responds with an unexpected
+// status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("capella request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns whether err is the API reporting that a resource doesn't
+// exist.
+func IsNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) do(ctx context.Context, method, path string, reqBody, respBody interface{}, expectedCode int) error {
+	var body io.Reader
+	if reqBody != nil {
+		reqBytes, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(reqBytes)
+	}
+
+	req, err := http.NewRequest(method, c.Endpoint+"/v4/organizations/"+c.OrganizationID+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != expectedCode {
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		message := string(respBytes)
+		if json.Unmarshal(respBytes, &errResp) == nil && errResp.Message != "" {
+			message = errResp.Message
+		}
+		return errors.Wrapf(&Error{StatusCode: resp.StatusCode, Message: message}, "%s %s", method, path)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(respBytes, respBody)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse response to %s %s", method, path)
+	}
+
+	return nil
+}
+
+type listCursor struct {
+	Pages struct {
+		Next int `json:"next"`
+	} `json:"pages"`
+}
+
+type Project struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func (c *Client) ListProjects(ctx context.Context) ([]Project, error) {
+	var projects []Project
+	for page := 1; page != 0; {
+		var resp struct {
+			Data   []Project  `json:"data"`
+			Cursor listCursor `json:"cursor"`
+		}
+		err := c.do(ctx, "GET", fmt.Sprintf("/projects?page=%d&perPage=100", page), nil, &resp, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		projects = append(projects, resp.Data...)
+		page = resp.Cursor.Pages.Next
+	}
+
+	return projects, nil
+}
+
+func (c *Client) CreateProject(ctx context.Context, name string) (string, error) {
+	var resp struct {
+		ID string `json:"id"`
+	}
+	err := c.do(ctx, "POST", "/projects", map[string]string{
+		"name": name,
+	}, &resp, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.ID, nil
+}
+
+type CloudProvider struct {
+	Type   string `json:"type"`
+	Region string `json:"region"`
+	CIDR   string `json:"cidr"`
+}
+
+type Compute struct {
+	CPU int `json:"cpu"`
+	RAM int `json:"ram"`
+}
+
+type Disk struct {
+	Type    string `json:"type"`
+	Storage int    `json:"storage,omitempty"`
+	IOPS    int    `json:"iops,omitempty"`
+}
+
+type ServiceGroup struct {
+	Node struct {
+		Compute Compute `json:"compute"`
+		Disk    Disk    `json:"disk"`
+	} `json:"node"`
+	NumOfNodes int      `json:"numOfNodes"`
+	Services   []string `json:"services"`
+}
+
+type CreateClusterOptions struct {
+	Name            string
+	Description     string
+	CloudProvider   CloudProvider
+	ServerVersion   string
+	ServiceGroups   []ServiceGroup
+	SupportPlan     string
+	SupportTimezone string
+}
+
+func (c *Client) CreateCluster(ctx context.Context, projectID string, opts CreateClusterOptions) (string, error) {
+	reqBody := map[string]interface{}{
+		"name":          opts.Name,
+		"description":   opts.Description,
+		"cloudProvider": opts.CloudProvider,
+		"serviceGroups": opts.ServiceGroups,
+		"availability": map[string]string{
+			"type": "single",
+		},
+		"support": map[string]string{
+			"plan":     opts.SupportPlan,
+			"timezone": opts.SupportTimezone,
+		},
+	}
+	if opts.ServerVersion != "" {
+		reqBody["couchbaseServer"] = map[string]string{
+			"version": opts.ServerVersion,
+		}
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	err := c.do(ctx, "POST", "/projects/"+projectID+"/clusters", reqBody, &resp, http.StatusAccepted)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.ID, nil
+}
+
+type Cluster struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	CurrentState     string `json:"currentState"`
+	ConnectionString string `json:"connectionString"`
+}
+
+func (c *Client) GetCluster(ctx context.Context, projectID, clusterID string) (*Cluster, error) {
+	var cluster Cluster
+	err := c.do(ctx, "GET", "/projects/"+projectID+"/clusters/"+clusterID, nil, &cluster, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cluster, nil
+}
+
+func (c *Client) ListClusters(ctx context.Context, projectID string) ([]Cluster, error) {
+	var clusters []Cluster
+	for page := 1; page != 0; {
+		var resp struct {
+			Data   []Cluster  `json:"data"`
+			Cursor listCursor `json:"cursor"`
+		}
+		err := c.do(ctx, "GET", fmt.Sprintf("/projects/%s/clusters?page=%d&perPage=100", projectID, page), nil, &resp, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		clusters = append(clusters, resp.Data...)
+		page = resp.Cursor.Pages.Next
+	}
+
+	return clusters, nil
+}
+
+// DeleteCluster starts deleting a cluster, which carries on in the background.
+func (c *Client) DeleteCluster(ctx context.Context, projectID, clusterID string) error {
+	return c.do(ctx, "DELETE", "/projects/"+projectID+"/clusters/"+clusterID, nil, nil, http.StatusAccepted)
+}
+
+// AddAllowedCIDR allows connections to a cluster from a range of addresses.
+func (c *Client) AddAllowedCIDR(ctx context.Context, projectID, clusterID, cidr, comment string) error {
+	return c.do(ctx, "POST", "/projects/"+projectID+"/clusters/"+clusterID+"/allowedcidrs", map[string]string{
+		"cidr":    cidr,
+		"comment": comment,
+	}, nil, http.StatusCreated)
+}
+
+// CreateDatabaseUser creates credentials with read and write access to every
+// bucket of a cluster.
+func (c *Client) CreateDatabaseUser(ctx context.Context, projectID, clusterID, name, password string) error {
+	return c.do(ctx, "POST", "/projects/"+projectID+"/clusters/"+clusterID+"/users", map[string]interface{}{
+		"name":     name,
+		"password": password,
+		"access": []map[string]interface{}{
+			{
+				"privileges": []string{"data_reader", "data_writer"},
+			},
+		},
+	}, nil, http.StatusCreated)
+}
@@ -7,3 +7,37 @@ type Bucket struct {
 	ReplicaCount      int
 	EphEvictionPolicy string
 }
+
+type CollectionManifest struct {
+	UID    string                    `json:"uid"`
+	Scopes []CollectionManifestScope `json:"scopes"`
+}
+
+type CollectionManifestScope struct {
+	Name        string                         `json:"name"`
+	Collections []CollectionManifestCollection `json:"collections"`
+}
+
+type CollectionManifestCollection struct {
+	Name   string `json:"name"`
+	MaxTTL int    `json:"maxTTL"`
+}
+
+// HasCollection reports whether the manifest contains a collection, or just
+// the scope if collection is empty.
+func (m *CollectionManifest) HasCollection(scope, collection string) bool {
+	for _, s := range m.Scopes {
+		if s.Name != scope {
+			continue
+		}
+		if collection == "" {
+			return true
+		}
+		for _, c := range s.Collections {
+			if c.Name == collection {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -59,6 +59,7 @@ func (v *VersionTuple) String() string {
 type Config struct {
 	MemoryQuota   string
 	User          *helper.UserOption
+	Users         []*helper.UserOption
 	Version       VersionTuple
 	StorageMode   string
 	Bucket        *helper.BucketOption
@@ -287,6 +288,17 @@ func (m *Manager) setupNewCluster() (string, error) {
 		}
 	}
 
+	// create users once buckets exist, as their roles may be scoped to them
+	if len(m.Config.Users) > 0 && version.Major < 5 {
+		return "", errors.New("RBAC users require server 5.0 or later")
+	}
+	for _, user := range m.Config.Users {
+		glog.Infof("CreateUser %s", user.Name)
+		if err := epnode.CreateUser(user); err != nil {
+			return "", err
+		}
+	}
+
 	if m.Config.UseDevPreview {
 		if err = m.EnableDeveloperPreview(); err != nil {
 			return "", err
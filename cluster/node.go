@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"path"
@@ -47,17 +48,19 @@ type RespPoolsNodes struct {
 }
 
 type Node struct {
-	poolsNodes *RespPoolsNodes
-	session    *ssh.Session
-	SshLogin   *helper.Cred
-	RestLogin  *helper.Cred
-	N1qlLogin  *helper.Cred
-	FtsLogin   *helper.Cred
-	HostName   string
-	Port       string
-	Version    string
-	Services   string
-	OtpNode    string
+	poolsNodes    *RespPoolsNodes
+	session       *ssh.Session
+	SshLogin      *helper.Cred
+	RestLogin     *helper.Cred
+	N1qlLogin     *helper.Cred
+	FtsLogin      *helper.Cred
+	CbasLogin     *helper.Cred
+	EventingLogin *helper.Cred
+	HostName      string
+	Port          string
+	Version       string
+	Services      string
+	OtpNode       string
 }
 
 type OsInfo struct {
@@ -113,6 +116,66 @@ func (n *Node) Rebalance(remaining, failedOver, toRemove []Node) error {
 
 }
 
+// StartRebalance starts rebalancing the cluster onto knownNodes, removing
+// ejectedNodes from it.  Nodes are given by their otp node name, such as
+// ns_1@10.0.0.1, and every node which ns_server knows of must be given.
+func (n *Node) StartRebalance(knownNodes, ejectedNodes []string) error {
+	body := url.Values{
+		"knownNodes":   {strings.Join(knownNodes, ",")},
+		"ejectedNodes": {strings.Join(ejectedNodes, ",")},
+	}.Encode()
+
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PRebalance,
+		Cred:         n.RestLogin,
+		Body:         body,
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	// Retrying could start a second rebalance once the first has finished
+	_, err := helper.RestRetryer(1, restParam, helper.GetResponse)
+	return err
+}
+
+// FailOver fails a node over, gracefully moving its vbuckets off of it first
+// if graceful is set.  Graceful failovers run as a rebalance.
+func (n *Node) FailOver(otpNode string, graceful bool) error {
+	path := helper.PFailover
+	if graceful {
+		path = helper.PGracefulFailover
+	}
+
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         path,
+		Cred:         n.RestLogin,
+		Body:         url.Values{"otpNode": {otpNode}}.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(1, restParam, helper.GetResponse)
+	return err
+}
+
+// SetRecoveryType marks a failed over node to be added back to the cluster by
+// the next rebalance, with either full or delta recovery.
+func (n *Node) SetRecoveryType(otpNode, recoveryType string) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PRecoveryType,
+		Cred:         n.RestLogin,
+		Body:         url.Values{"otpNode": {otpNode}, "recoveryType": {recoveryType}}.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(1, restParam, helper.GetResponse)
+	return err
+}
+
 func (n *Node) AddNode(newNode *Node, services string) error {
 	body := fmt.Sprintf("user=%s&password=%s&hostname=%s&services=%s",
 		n.RestLogin.Username, n.RestLogin.Password, newNode.HostName, url.QueryEscape(newNode.Services))
@@ -349,6 +412,167 @@ func (n *Node) CreateN1qlIndex(name, fields, bucket string) error {
 
 }
 
+// ExecuteN1qlQuery runs a statement and returns its results.
+func (n *Node) ExecuteN1qlQuery(statement string) ([]json.RawMessage, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PN1ql,
+		Cred:         n.N1qlLogin,
+		Body:         url.Values{"statement": {statement}}.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+	resp, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var queryResp struct {
+		Results []json.RawMessage `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(resp), &queryResp); err != nil {
+		return nil, err
+	}
+	return queryResp.Results, nil
+}
+
+// GetServiceHostnames returns the hostnames of the nodes in the cluster which
+// run a service, such as n1ql.
+func (n *Node) GetServiceHostnames(service string) ([]string, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PPoolsDefault,
+		Cred:         n.RestLogin,
+	}
+	resp, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var pool struct {
+		Nodes []struct {
+			Hostname string   `json:"hostname"`
+			Services []string `json:"services"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal([]byte(resp), &pool); err != nil {
+		return nil, err
+	}
+
+	var hostnames []string
+	for _, node := range pool.Nodes {
+		for _, nodeService := range node.Services {
+			if nodeService == service {
+				hostname := node.Hostname
+				if host, _, err := net.SplitHostPort(hostname); err == nil {
+					hostname = host
+				}
+				hostnames = append(hostnames, hostname)
+				break
+			}
+		}
+	}
+	return hostnames, nil
+}
+
+// ExecuteAnalyticsStatement runs a statement against the analytics service.
+func (n *Node) ExecuteAnalyticsStatement(statement string) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PCbas,
+		Cred:         n.CbasLogin,
+		Body:         url.Values{"statement": {statement}}.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	return err
+}
+
+// CreateAnalyticsLink creates a link of the Default dataverse, the settings
+// of which depend on its type.
+func (n *Node) CreateAnalyticsLink(name, linkType string, settings map[string]string) error {
+	body := url.Values{}
+	for key, value := range settings {
+		body.Set(key, value)
+	}
+	body.Set("dataverse", "Default")
+	body.Set("name", name)
+	body.Set("type", linkType)
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PCbasLink,
+		Cred:         n.CbasLogin,
+		Body:         body.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	return err
+}
+
+// CreateEventingFunction creates, or replaces, an undeployed eventing function
+// from its definition, as exported from the UI.
+func (n *Node) CreateEventingFunction(name string, definition []byte) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PEventingFunctions + "/" + url.PathEscape(name),
+		Cred:         n.EventingLogin,
+		Body:         string(definition),
+		ContentType:  "application/json",
+	}
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	return err
+}
+
+// DeployEventingFunction deploys an eventing function, which then starts
+// processing mutations in the background.
+func (n *Node) DeployEventingFunction(name string) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PEventingFunctions + "/" + url.PathEscape(name) + "/settings",
+		Cred:         n.EventingLogin,
+		Body:         `{"deployment_status":true,"processing_status":true}`,
+		ContentType:  "application/json",
+	}
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	return err
+}
+
+// GetEventingFunctionStatuses returns the status of every eventing function,
+// such as deployed or deploying, by name.
+func (n *Node) GetEventingFunctionStatuses() (map[string]string, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PEventingStatus,
+		Cred:         n.EventingLogin,
+	}
+	resp, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var status struct {
+		Apps []struct {
+			Name            string `json:"name"`
+			CompositeStatus string `json:"composite_status"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal([]byte(resp), &status); err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string)
+	for _, app := range status.Apps {
+		statuses[app.Name] = app.CompositeStatus
+	}
+	return statuses, nil
+}
+
 func (n *Node) ChangeBucketCompression(bucket, mode string) error {
 	body := fmt.Sprintf("name=%s&compressionMode=%s", bucket, mode)
 	restParam := &helper.RestCall{
@@ -386,6 +610,60 @@ func (n *Node) CreateBucket(conf *Bucket) error {
 	return err
 }
 
+func (n *Node) GetCollectionManifest(bucket string) (*CollectionManifest, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PBuckets + "/" + url.PathEscape(bucket) + "/scopes",
+		Cred:         n.RestLogin,
+	}
+
+	resp, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest CollectionManifest
+	if err := json.Unmarshal([]byte(resp), &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (n *Node) CreateScope(bucket, scope string) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PBuckets + "/" + url.PathEscape(bucket) + "/scopes",
+		Cred:         n.RestLogin,
+		Body:         url.Values{"name": {scope}}.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
+func (n *Node) CreateCollection(bucket, scope, collection string, maxTTL int) error {
+	body := url.Values{"name": {collection}}
+	if maxTTL > 0 {
+		body.Set("maxTTL", strconv.Itoa(maxTTL))
+	}
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PBuckets + "/" + url.PathEscape(bucket) + "/scopes/" + url.PathEscape(scope) + "/collections",
+		Cred:         n.RestLogin,
+		Body:         body.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
 func (n *Node) WaitForBucketReady() error {
 	chRes := make(chan []RespNode)
 	for {
@@ -452,11 +730,15 @@ func (n *Node) CreateUser(user *helper.UserOption) error {
 		roles := []string{"admin"}
 		user.Roles = &roles
 	}
-	body := fmt.Sprintf("name=%s&password=%s&roles=%s", user.Name, user.Password, strings.Join(*user.Roles, ","))
+	body := url.Values{
+		"name":     {user.Name},
+		"password": {user.Password},
+		"roles":    {strings.Join(*user.Roles, ",")},
+	}.Encode()
 	restParam := &helper.RestCall{
 		ExpectedCode: 200,
 		Method:       "PUT",
-		Path:         helper.PRbacUsers + "/" + user.Name,
+		Path:         helper.PRbacUsers + "/" + url.PathEscape(user.Name),
 		Cred:         n.RestLogin,
 		Body:         body,
 		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
@@ -467,6 +749,89 @@ func (n *Node) CreateUser(user *helper.UserOption) error {
 	return err
 }
 
+// CreateExternalUser gives roles to a user who authenticates against an
+// external service such as LDAP.
+func (n *Node) CreateExternalUser(name string, roles []string) error {
+	body := url.Values{
+		"roles": {strings.Join(roles, ",")},
+	}.Encode()
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "PUT",
+		Path:         helper.PRbacExternalUsers + "/" + url.PathEscape(name),
+		Cred:         n.RestLogin,
+		Body:         body,
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
+// CreateGroup creates an RBAC group, whose roles are given to the members of
+// the LDAP group it refers to if ldapGroupRef is set.
+func (n *Node) CreateGroup(name string, roles []string, ldapGroupRef string) error {
+	body := url.Values{
+		"roles": {strings.Join(roles, ",")},
+	}
+	if ldapGroupRef != "" {
+		body.Set("ldap_group_ref", ldapGroupRef)
+	}
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "PUT",
+		Path:         helper.PRbacGroups + "/" + url.PathEscape(name),
+		Cred:         n.RestLogin,
+		Body:         body.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
+func (n *Node) AddRemoteCluster(name, hostname string, remoteLogin *helper.Cred) error {
+	body := url.Values{}
+	body.Set("name", name)
+	body.Set("hostname", hostname)
+	body.Set("username", remoteLogin.Username)
+	body.Set("password", remoteLogin.Password)
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PRemoteClusters,
+		Cred:         n.RestLogin,
+		Body:         body.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
+func (n *Node) CreateReplication(fromBucket, toCluster, toBucket string) error {
+	body := url.Values{}
+	body.Set("fromBucket", fromBucket)
+	body.Set("toCluster", toCluster)
+	body.Set("toBucket", toBucket)
+	body.Set("replicationType", "continuous")
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PReplication,
+		Cred:         n.RestLogin,
+		Body:         body.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
 func (n *Node) DeleteBucket(name string) error {
 	restParam := &helper.RestCall{
 		ExpectedCode: 200,
@@ -481,6 +846,88 @@ func (n *Node) DeleteBucket(name string) error {
 
 }
 
+func (n *Node) GetBucketNames() ([]string, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PBuckets,
+		Cred:         n.RestLogin,
+	}
+
+	resp, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(resp), &buckets); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	return names, nil
+}
+
+func (n *Node) FlushBucket(name string) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         helper.PBuckets + "/" + name + "/controller/doFlush",
+		Cred:         n.RestLogin,
+	}
+
+	// Flushing fails straight away if it isn't enabled on the bucket, so
+	// there is no point in retrying
+	_, err := helper.RestRetryer(1, restParam, helper.GetResponse)
+
+	return err
+}
+
+func (n *Node) GetLocalUserNames() ([]string, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PRbacUsers,
+		Cred:         n.RestLogin,
+	}
+
+	resp, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(resp), &users); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, user := range users {
+		names = append(names, user.ID)
+	}
+	return names, nil
+}
+
+func (n *Node) DeleteUser(name string) error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "DELETE",
+		Path:         helper.PRbacUsers + "/" + name,
+		Cred:         n.RestLogin,
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
 func (n *Node) PollJoinReady(chErr chan error) {
 	var err error
 	parsed := make(map[string]interface{})
@@ -1046,3 +1493,64 @@ func (n *Node) SetupCert(ca *x509.Certificate, caPrivateKey *rsa.PrivateKey, now
 
 	return nil
 }
+
+// SetupAlternateAddress sets the external address which ns_server gives to
+// clients outside of the network of the node, along with the external port of
+// each service, such as kv or mgmtSSL.  It must be called on the node itself.
+func (n *Node) SetupAlternateAddress(hostname string, ports map[string]int) error {
+	params := url.Values{}
+	params.Set("hostname", hostname)
+	for service, port := range ports {
+		params.Set(service, strconv.Itoa(port))
+	}
+
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "PUT",
+		Path:         helper.PAlternateAddress,
+		Cred:         n.RestLogin,
+		Body:         params.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	// Bad ports are rejected straight away, so there is no point in retrying
+	_, err := helper.RestRetryer(1, restParam, helper.GetResponse)
+
+	return err
+}
+
+func (n *Node) DeleteAlternateAddress() error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "DELETE",
+		Path:         helper.PAlternateAddress,
+		Cred:         n.RestLogin,
+	}
+
+	_, err := helper.RestRetryer(helper.RestRetry, restParam, helper.GetResponse)
+
+	return err
+}
+
+// UpdateSettings posts a form of settings to an ns_server endpoint, such as
+// /settings/maxParallelIndexers.
+func (n *Node) UpdateSettings(path string, values map[string]string) error {
+	params := url.Values{}
+	for key, value := range values {
+		params.Set(key, value)
+	}
+
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Path:         path,
+		Cred:         n.RestLogin,
+		Body:         params.Encode(),
+		Header:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+	}
+
+	// Bad settings are rejected straight away, so there is no point in retrying
+	_, err := helper.RestRetryer(1, restParam, helper.GetResponse)
+
+	return err
+}
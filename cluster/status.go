@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+)
+
+// statusRetry is how many times status calls are tried.  They are used to
+// check on clusters which may well be unhealthy, so they fail fast rather
+// than waiting for a node to come back.
+const statusRetry = 1
+
+// PoolStatus is the state of a cluster as ns_server sees it.
+type PoolStatus struct {
+	Balanced        bool             `json:"balanced"`
+	RebalanceStatus string           `json:"rebalanceStatus"`
+	Nodes           []PoolNodeStatus `json:"nodes"`
+}
+
+type PoolNodeStatus struct {
+	Hostname          string   `json:"hostname"`
+	OtpNode           string   `json:"otpNode"`
+	Status            string   `json:"status"`
+	ClusterMembership string   `json:"clusterMembership"`
+	RecoveryType      string   `json:"recoveryType"`
+	Version           string   `json:"version"`
+	Services          []string `json:"services"`
+}
+
+type BucketStatus struct {
+	Name  string             `json:"name"`
+	Nodes []BucketNodeStatus `json:"nodes"`
+}
+
+type BucketNodeStatus struct {
+	Hostname string `json:"hostname"`
+	Status   string `json:"status"`
+}
+
+// RebalanceProgress is the progress of a rebalance, as a percentage averaged
+// over the nodes being rebalanced.
+type RebalanceProgress struct {
+	Status   string
+	Progress float64
+	Error    string
+}
+
+func (n *Node) GetPoolStatus() (*PoolStatus, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PPoolsDefault,
+		Cred:         n.RestLogin,
+	}
+	resp, err := helper.RestRetryer(statusRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var status PoolStatus
+	if err := json.Unmarshal([]byte(resp), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// GetRawJSON returns the JSON of a REST endpoint as ns_server sent it, for
+// callers which want to keep everything in it.
+func (n *Node) GetRawJSON(path string) (json.RawMessage, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         path,
+		Cred:         n.RestLogin,
+	}
+	resp, err := helper.RestRetryer(statusRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid([]byte(resp)) {
+		return nil, fmt.Errorf("%s did not return valid JSON", path)
+	}
+	return json.RawMessage(resp), nil
+}
+
+func (n *Node) GetBucketStatuses() ([]BucketStatus, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PBuckets,
+		Cred:         n.RestLogin,
+	}
+	resp, err := helper.RestRetryer(statusRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []BucketStatus
+	if err := json.Unmarshal([]byte(resp), &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (n *Node) GetRebalanceProgress() (*RebalanceProgress, error) {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PRebalanceProgress,
+		Cred:         n.RestLogin,
+	}
+	resp, err := helper.RestRetryer(statusRetry, restParam, helper.GetResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	// Besides the status, the progress of every node is keyed by its otp
+	// node name, such as ns_1@10.0.0.1.
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil {
+		return nil, err
+	}
+
+	progress := &RebalanceProgress{}
+	var nodeCount int
+	for key, value := range parsed {
+		switch key {
+		case "status":
+			json.Unmarshal(value, &progress.Status)
+		case "errorMessage":
+			json.Unmarshal(value, &progress.Error)
+		default:
+			var nodeProgress struct {
+				Progress float64 `json:"progress"`
+			}
+			if json.Unmarshal(value, &nodeProgress) == nil {
+				progress.Progress += nodeProgress.Progress
+				nodeCount++
+			}
+		}
+	}
+	if nodeCount > 0 {
+		progress.Progress = progress.Progress / float64(nodeCount) * 100
+	}
+
+	return progress, nil
+}
+
+// Ping checks that ns_server is answering requests.
+func (n *Node) Ping() error {
+	restParam := &helper.RestCall{
+		ExpectedCode: 200,
+		Method:       "GET",
+		Path:         helper.PPools,
+		Cred:         n.RestLogin,
+	}
+	_, err := helper.RestRetryer(statusRetry, restParam, helper.GetResponse)
+	return err
+}
@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var aliasRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,62}$`)
+
+// clusterIDRegexp matches the IDs generated by newRandomClusterID, aliases
+// can't look like these or they could shadow real clusters.
+var clusterIDRegexp = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+func aliasKey(alias string) string {
+	return "alias-" + alias
+}
+
+// resolveClusterID turns an alias into the ID of the cluster it names, any
+// other reference is assumed to already be a cluster ID.
+func resolveClusterID(clusterRef string) string {
+	if clusterRef == "" || clusterIDRegexp.MatchString(clusterRef) {
+		return clusterRef
+	}
+
+	var clusterID string
+	err := metaStore.getRecord(aliasKey(clusterRef), &clusterID)
+	if err != nil {
+		return clusterRef
+	}
+
+	return clusterID
+}
+
+// clusterIDFromRequest reads the cluster from the route of a request, which
+// can be either its ID or its alias.
+func clusterIDFromRequest(r *http.Request) string {
+	return resolveClusterID(mux.Vars(r)["cluster_id"])
+}
+
+func validateAlias(alias string) error {
+	if !aliasRegexp.MatchString(alias) {
+		return errors.New("aliases must be 2-63 lowercase letters, numbers, dashes and underscores")
+	}
+	if clusterIDRegexp.MatchString(alias) {
+		return errors.New("aliases cannot look like cluster IDs")
+	}
+	return nil
+}
+
+// claimAlias points alias at clusterID, aliases left behind by clusters which
+// no longer exist are reclaimed.  Aliases are compared and swapped so that two
+// daemons can't give the same alias to different clusters.
+func claimAlias(alias, clusterID string) error {
+	aliasBytes, err := json.Marshal(clusterID)
+	if err != nil {
+		return err
+	}
+
+	return metaStore.createOrUpdateRawRecord(aliasKey(alias), func(recordBytes []byte) ([]byte, error) {
+		if recordBytes == nil {
+			return aliasBytes, nil
+		}
+
+		var existingID string
+		err := json.Unmarshal(recordBytes, &existingID)
+		if err == nil && existingID != clusterID {
+			_, err := getCluster(systemCtx, existingID)
+			if err == nil {
+				return nil, errors.Errorf("alias %s is already used by another cluster", alias)
+			}
+		}
+
+		return aliasBytes, nil
+	})
+}
+
+func releaseAlias(alias, clusterID string) {
+	aliasBytes, err := json.Marshal(clusterID)
+	if err != nil {
+		return
+	}
+
+	metaStore.deleteRawRecordIf(aliasKey(alias), aliasBytes)
+}
+
+func setClusterAlias(ctx context.Context, clusterID, alias string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Setting cluster alias to %s", alias)
+
+	if alias != "" {
+		err := validateAlias(alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !canManageCluster(ctx, cluster) {
+		return errors.New("cannot alias clusters you don't own")
+	}
+
+	if alias != "" {
+		err = claimAlias(alias, clusterID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var oldAlias string
+	err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		oldAlias = meta.Alias
+		meta.Alias = alias
+		return meta, nil
+	})
+	if err != nil {
+		if alias != "" {
+			releaseAlias(alias, clusterID)
+		}
+		return err
+	}
+
+	if oldAlias != "" && oldAlias != alias {
+		releaseAlias(oldAlias, clusterID)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// alternatePortNames are the services which ns_server accepts an external
+// port for.
+var alternatePortNames = map[string]bool{
+	"mgmt":              true,
+	"mgmtSSL":           true,
+	"kv":                true,
+	"kvSSL":             true,
+	"capi":              true,
+	"capiSSL":           true,
+	"n1ql":              true,
+	"n1qlSSL":           true,
+	"fts":               true,
+	"ftsSSL":            true,
+	"cbas":              true,
+	"cbasSSL":           true,
+	"eventingAdminPort": true,
+	"eventingSSL":       true,
+	"eventingDebug":     true,
+	"backupAPI":         true,
+	"backupAPIHTTPS":    true,
+}
+
+// AlternateAddress is the address which clients outside of the docker
+// network reach a node on, such as through NAT or mapped ports.
+type AlternateAddress struct {
+	Node     string
+	Hostname string
+	Ports    map[string]int
+}
+
+func validateAlternateAddress(address AlternateAddress) error {
+	if address.Hostname == "" {
+		return errors.Errorf("the alternate address of node %s needs a hostname", address.Node)
+	}
+	for service, port := range address.Ports {
+		if !alternatePortNames[service] {
+			return errors.Errorf("%q is not a service which can have an alternate port", service)
+		}
+		if port <= 0 || port > 65535 {
+			return errors.Errorf("%d is not a valid port for %s", port, service)
+		}
+	}
+	return nil
+}
+
+func alternateAddressCluster(ctx context.Context, clusterID string) (*Cluster, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot change the addresses of a hibernated cluster")
+	}
+
+	return c, nil
+}
+
+// setAlternateAddresses configures the external address of each of the
+// given nodes in ns_server, so that SDKs outside of the docker network can
+// bootstrap from it.  Each node only knows its own alternate address, so
+// they are set one at a time.
+func setAlternateAddresses(ctx context.Context, clusterID string, addresses []AlternateAddress) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Setting alternate addresses of %d nodes", len(addresses))
+
+	if len(addresses) == 0 {
+		return errors.New("no alternate addresses were given")
+	}
+
+	c, err := alternateAddressCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	// Check everything up front, so that a mistake doesn't leave only some
+	// of the nodes changed.
+	nodes := make([]*Node, len(addresses))
+	seen := make(map[*Node]bool)
+	for i, address := range addresses {
+		err = validateAlternateAddress(address)
+		if err != nil {
+			return err
+		}
+
+		nodes[i], err = findNode(c, address.Node)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find node %s", address.Node)
+		}
+		if seen[nodes[i]] {
+			return errors.Errorf("node %s is given more than once", address.Node)
+		}
+		seen[nodes[i]] = true
+	}
+
+	for i, address := range addresses {
+		logInfof(ContextWithNode(ctx, nodes[i].Name), "Setting alternate address to %s", address.Hostname)
+		err = restNodeOf(nodes[i]).SetupAlternateAddress(address.Hostname, address.Ports)
+		if err != nil {
+			return errors.Wrapf(err, "failed to set the alternate address of node %s", address.Node)
+		}
+	}
+
+	return nil
+}
+
+// clearAlternateAddresses removes the external address of every node of a
+// cluster, so that clients are given the internal addresses again.
+func clearAlternateAddresses(ctx context.Context, clusterID string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Clearing alternate addresses")
+
+	c, err := alternateAddressCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range c.Nodes {
+		err = restNodeOf(node).DeleteAlternateAddress()
+		if err != nil {
+			return errors.Wrapf(err, "failed to clear the alternate address of node %s", node.Name)
+		}
+	}
+
+	return nil
+}
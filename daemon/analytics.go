@@ -0,0 +1,170 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+// analyticsLocalLink is the link which every analytics service has to the
+// buckets of its own cluster.
+const analyticsLocalLink = "Local"
+
+type AddAnalyticsOptions struct {
+	Conf AddAnalyticsJSON
+}
+
+func validateAnalytics(conf *AddAnalyticsJSON) error {
+	linkNames := make(map[string]bool)
+	for _, link := range conf.Links {
+		if !indexNameRegexp.MatchString(link.Name) || link.Name == analyticsLocalLink {
+			return errors.Errorf("%q is not a valid analytics link name", link.Name)
+		}
+		if linkNames[link.Name] {
+			return errors.Errorf("analytics link %s is specified more than once", link.Name)
+		}
+		linkNames[link.Name] = true
+
+		if link.RemoteCluster == "" && link.Hostname == "" {
+			return errors.Errorf("analytics link %s must have a remote cluster or a hostname", link.Name)
+		}
+		if link.RemoteCluster != "" && link.Hostname != "" {
+			return errors.Errorf("analytics link %s cannot have both a remote cluster and a hostname", link.Name)
+		}
+	}
+
+	datasetNames := make(map[string]bool)
+	for _, dataset := range conf.Datasets {
+		if !indexNameRegexp.MatchString(dataset.Name) {
+			return errors.Errorf("%q is not a valid dataset name", dataset.Name)
+		}
+		if datasetNames[dataset.Name] {
+			return errors.Errorf("dataset %s is specified more than once", dataset.Name)
+		}
+		datasetNames[dataset.Name] = true
+
+		if dataset.Bucket == "" {
+			return errors.Errorf("dataset %s must have a bucket", dataset.Name)
+		}
+		for _, identifier := range []string{dataset.Bucket, dataset.Scope, dataset.Collection, dataset.Link} {
+			if strings.Contains(identifier, "`") {
+				return errors.Errorf("%q is not a valid keyspace for dataset %s", identifier, dataset.Name)
+			}
+		}
+		if (dataset.Scope == "") != (dataset.Collection == "") {
+			return errors.Errorf("dataset %s must specify both a scope and a collection, or neither", dataset.Name)
+		}
+	}
+
+	return nil
+}
+
+func datasetLink(dataset AnalyticsDatasetJSON) string {
+	if dataset.Link == "" {
+		return analyticsLocalLink
+	}
+	return dataset.Link
+}
+
+func createDatasetStatement(dataset AnalyticsDatasetJSON) string {
+	keyspace := "`" + dataset.Bucket + "`"
+	if dataset.Collection != "" {
+		keyspace = fmt.Sprintf("`%s`.`%s`.`%s`", dataset.Bucket, dataset.Scope, dataset.Collection)
+	}
+
+	statement := fmt.Sprintf("CREATE DATASET IF NOT EXISTS `%s` ON %s", dataset.Name, keyspace)
+	if dataset.Link != "" {
+		statement += " AT `" + dataset.Link + "`"
+	}
+	if dataset.Where != "" {
+		statement += " WHERE " + dataset.Where
+	}
+	return statement
+}
+
+// addAnalytics creates analytics links and datasets on a cluster, then
+// connects the links of the datasets so that they start ingesting data.
+func addAnalytics(ctx context.Context, clusterID string, opts AddAnalyticsOptions) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	if len(opts.Conf.Links) == 0 && len(opts.Conf.Datasets) == 0 {
+		return errors.New("must specify at least one link or dataset")
+	}
+	err := validateAnalytics(&opts.Conf)
+	if err != nil {
+		return err
+	}
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if c.Provider == ProviderCapella {
+		return errors.New("analytics cannot be set up on capella clusters")
+	}
+	if len(c.Nodes) == 0 {
+		return errors.New("no nodes available")
+	}
+
+	node, err := findServiceNode(c.Nodes, "cbas")
+	if err != nil {
+		return err
+	}
+	cbasNode := restNodeOf(node)
+
+	for _, link := range opts.Conf.Links {
+		settings := map[string]string{
+			"hostname":   link.Hostname,
+			"username":   link.Username,
+			"password":   link.Password,
+			"encryption": "none",
+		}
+		if link.RemoteCluster != "" {
+			remote, err := getCluster(ctx, resolveClusterID(link.RemoteCluster))
+			if err != nil {
+				return errors.Wrapf(err, "failed to find analytics link remote cluster %s", link.RemoteCluster)
+			}
+			if len(remote.Nodes) == 0 {
+				return errors.Errorf("analytics link remote cluster %s has no nodes", link.RemoteCluster)
+			}
+			settings["hostname"] = fmt.Sprintf("%s:%d", remote.Nodes[0].IPv4Address, helper.RestPort)
+			settings["username"] = helper.RestUser
+			settings["password"] = helper.RestPass
+		}
+
+		logInfof(ctx, "Creating analytics link %s to %s", link.Name, settings["hostname"])
+		err := cbasNode.CreateAnalyticsLink(link.Name, "couchbase", settings)
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return errors.Wrapf(err, "failed to create analytics link %s", link.Name)
+		}
+	}
+
+	var links []string
+	linksSeen := make(map[string]bool)
+	for _, dataset := range opts.Conf.Datasets {
+		logInfof(ctx, "Creating analytics dataset %s on %s", dataset.Name, dataset.Bucket)
+		err := cbasNode.ExecuteAnalyticsStatement(createDatasetStatement(dataset))
+		if err != nil {
+			return errors.Wrapf(err, "failed to create analytics dataset %s", dataset.Name)
+		}
+
+		link := datasetLink(dataset)
+		if !linksSeen[link] {
+			links = append(links, link)
+			linksSeen[link] = true
+		}
+	}
+
+	for _, link := range links {
+		logInfof(ctx, "Connecting analytics link %s", link)
+		err := cbasNode.ExecuteAnalyticsStatement("CONNECT LINK `" + link + "`")
+		if err != nil {
+			return errors.Wrapf(err, "failed to connect analytics link %s", link)
+		}
+	}
+
+	return nil
+}
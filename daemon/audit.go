@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// AuditEntry records a single mutating operation, entries are never updated
+// or removed once written.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	RequestID string    `json:"request_id,omitempty"`
+	Operation string    `json:"operation"`
+	ClusterID string    `json:"cluster_id,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditKey orders entries by the time they happened, the random suffix stops
+// entries written at the same instant from overwriting each other.
+func auditKey(entry *AuditEntry) string {
+	suffix, _ := uuid.NewRandom()
+	return fmt.Sprintf("audit-%020d-%s", entry.Time.UnixNano(), suffix.String()[0:8])
+}
+
+func recordAudit(ctx context.Context, operation, clusterID, node string, opErr error) {
+	entry := &AuditEntry{
+		Time:      time.Now(),
+		User:      ContextUser(ctx),
+		RequestID: ContextRequestID(ctx),
+		Operation: operation,
+		ClusterID: clusterID,
+		Node:      node,
+		Result:    AuditResultSuccess,
+	}
+	if opErr != nil {
+		entry.Result = AuditResultFailure
+		entry.Error = opErr.Error()
+	}
+
+	err := metaStore.setRecord(auditKey(entry), entry)
+	if err != nil {
+		logErrorf(ctx, "Failed to write audit entry for %s: %s", operation, err)
+	}
+}
+
+type auditContextKey struct{}
+
+// auditDetails lets handlers fill in details which aren't known from the
+// request itself, such as the ID of a newly allocated cluster.
+type auditDetails struct {
+	lock      sync.Mutex
+	clusterID string
+}
+
+func setAuditClusterID(ctx context.Context, clusterID string) {
+	if details, ok := ctx.Value(auditContextKey{}).(*auditDetails); ok {
+		details.lock.Lock()
+		details.clusterID = clusterID
+		details.lock.Unlock()
+	}
+}
+
+// auditRecorder captures the status of a response, and the body of error
+// responses so that the error can be included in the audit entry.
+type auditRecorder struct {
+	statusRecorder
+	errorBody bytes.Buffer
+}
+
+func (rec *auditRecorder) Write(p []byte) (int, error) {
+	if rec.status >= 400 && rec.errorBody.Len() < 4096 {
+		rec.errorBody.Write(p)
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// auditMiddleware writes an audit entry for every request which could change
+// something, ie. anything other than a GET.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Unauthenticated routes audit themselves, naming what authorized
+		// them in place of a user.
+		if route := mux.CurrentRoute(r); route != nil && unauthenticatedRoutes[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		operation := r.Method + " " + r.URL.Path
+		if currentRoute := mux.CurrentRoute(r); currentRoute != nil {
+			if template, err := currentRoute.GetPathTemplate(); err == nil {
+				operation = r.Method + " " + template
+			}
+		}
+
+		vars := mux.Vars(r)
+		details := &auditDetails{clusterID: resolveClusterID(vars["cluster_id"])}
+		ctx := context.WithValue(r.Context(), auditContextKey{}, details)
+
+		rec := &auditRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: 200}}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		var opErr error
+		if rec.status >= 400 {
+			var jsonErr ErrorJSON
+			if json.Unmarshal(rec.errorBody.Bytes(), &jsonErr) == nil && jsonErr.Error.Message != "" {
+				opErr = errors.New(jsonErr.Error.Message)
+			} else {
+				opErr = errHTTPStatus(rec.status)
+			}
+		}
+
+		details.lock.Lock()
+		clusterID := details.clusterID
+		details.lock.Unlock()
+
+		recordAudit(ctx, operation, clusterID, vars["node"], opErr)
+	})
+}
+
+type AuditFilter struct {
+	User      string
+	ClusterID string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// getAuditEntries returns the entries matching filter, oldest first.  Users
+// who aren't admins can only look at a single cluster, or at what they did.
+func getAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if !ContextIsAdmin(ctx) && filter.ClusterID == "" && filter.User != ContextUser(ctx) {
+		return nil, errors.New("must specify a cluster or yourself as the user")
+	}
+
+	var entries []AuditEntry
+	err := metaStore.forEachRecord("audit-", func(key string, recordBytes []byte) error {
+		var entry AuditEntry
+		err := json.Unmarshal(recordBytes, &entry)
+		if err != nil {
+			return err
+		}
+
+		if filter.User != "" && entry.User != filter.User {
+			return nil
+		}
+		if filter.ClusterID != "" && entry.ClusterID != filter.ClusterID {
+			return nil
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			return nil
+		}
+		if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+			return nil
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the most recent entries when there are more than the limit
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// adminUser is the identity of requests made with the bootstrap admin token.
+const adminUser = "admin"
+
+// APIToken is the stored form of a token, only a hash of the token itself is
+// kept so that a copy of the meta-data database can't be used to authenticate.
+type APIToken struct {
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func apiTokenKey(tokenHash string) string {
+	return "apitoken-" + tokenHash
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func newAPIToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return "cbdn_" + hex.EncodeToString(tokenBytes), nil
+}
+
+// authenticate resolves the bearer token of a request to the user it was
+// issued to.
+func authenticate(r *http.Request) (*APIToken, Role, error) {
+	return authenticateBearer(r.Header.Get("Authorization"))
+}
+
+// authenticateBearer resolves an authorization of the form "Bearer <token>",
+// as sent both in the header of REST requests and the metadata of gRPC calls.
+func authenticateBearer(authHeader string) (*APIToken, Role, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, "", errors.New("must specify an API token")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return &APIToken{User: adminUser}, RoleAdmin, nil
+	}
+
+	var apiToken APIToken
+	err := metaStore.getRecord(apiTokenKey(hashAPIToken(token)), &apiToken)
+	if err != nil {
+		return nil, "", errors.New("invalid API token")
+	}
+
+	role, err := getUserRole(apiToken.User)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &apiToken, role, nil
+}
+
+// unauthenticatedRoutes names the routes which carry their own proof of
+// authorization, such as signed links, or which only document the API.
+var unauthenticatedRoutes = map[string]bool{
+	"refresh-link":         true,
+	"refresh-link-confirm": true,
+	"openapi":              true,
+	"docs":                 true,
+	"docs-asset":           true,
+}
+
+// authMiddleware rejects any request which doesn't carry a valid API token,
+// and otherwise stores the authenticated identity in the request context.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && unauthenticatedRoutes[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiToken, role, err := authenticate(r)
+		if err != nil {
+			writeJSONErrorStatus(w, 401, err)
+			return
+		}
+
+		ctx := ContextWithRole(NewContext(r.Context(), apiToken.User, false), role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getAPITokens() ([]APIToken, error) {
+	var tokens []APIToken
+	err := metaStore.forEachRecord("apitoken-", func(key string, recordBytes []byte) error {
+		var token APIToken
+		err := json.Unmarshal(recordBytes, &token)
+		if err != nil {
+			return err
+		}
+
+		tokens = append(tokens, token)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// revokeAPIToken removes every token issued to user, returning whether there
+// were any.
+func revokeAPIToken(user string) (bool, error) {
+	var keys []string
+	err := metaStore.forEachRecord("apitoken-", func(key string, recordBytes []byte) error {
+		var token APIToken
+		err := json.Unmarshal(recordBytes, &token)
+		if err != nil {
+			return err
+		}
+
+		if token.User == user {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		err := metaStore.deleteRecord(key)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return len(keys) > 0, nil
+}
+
+// issueAPIToken creates a new token for user, replacing any token they were
+// previously issued.
+func issueAPIToken(ctx context.Context, user string) (string, *APIToken, error) {
+	if !ContextIsAdmin(ctx) {
+		return "", nil, errors.New("only admins can issue API tokens")
+	}
+
+	if !strings.HasSuffix(user, "@couchbase.com") {
+		return "", nil, errors.New("user must be a @couchbase.com email")
+	}
+
+	_, err := revokeAPIToken(user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := newAPIToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiToken := &APIToken{
+		User:      user,
+		CreatedAt: time.Now(),
+	}
+	err = metaStore.setRecord(apiTokenKey(hashAPIToken(token)), apiToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	logInfof(ctx, "Issued API token for %s", user)
+
+	return token, apiToken, nil
+}
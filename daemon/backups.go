@@ -0,0 +1,282 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+// backupVolume is the docker volume which backup archives are kept in, on
+// each docker host.  It is created by docker the first time it is used.
+var backupVolume = "cbdyncluster-backups"
+
+const backupArchivePath = "/backups"
+
+// backupTimeout bounds how long a single backup or restore can run for.
+const backupTimeout = 2 * time.Hour
+
+var backupRepositoryRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// BackupRepository is a cbbackupmgr repository in the backup archive.  A
+// repository can hold many backups of the same cluster, and can be restored
+// into any cluster on the same docker host, by anybody.
+type BackupRepository struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Host      string    `json:"host"`
+	Image     string    `json:"image"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastBackupAt is unset until the first backup into it has finished.
+	LastBackupAt *time.Time `json:"last_backup_at,omitempty"`
+}
+
+type BackupOptions struct {
+	Conf BackupJSON
+}
+
+type RestoreOptions struct {
+	Conf RestoreJSON
+}
+
+func backupRepositoryKey(name string) string {
+	return fmt.Sprintf("backuprepo-%s", name)
+}
+
+func getBackupRepository(name string) (*BackupRepository, error) {
+	var repo BackupRepository
+	err := metaStore.getRecord(backupRepositoryKey(name), &repo)
+	if err != nil {
+		return nil, errors.Errorf("backup repository %s not found", name)
+	}
+	return &repo, nil
+}
+
+func cbbackupmgrArgs(command, repo string, args ...string) []string {
+	return append([]string{command, "--archive", backupArchivePath, "--repo", repo}, args...)
+}
+
+func cbbackupmgrClusterArgs(node *Node) []string {
+	return []string{
+		"--cluster", "couchbase://" + node.IPv4Address,
+		"--username", helper.RestUser,
+		"--password", helper.RestPass,
+		"--no-progress-bar",
+	}
+}
+
+// runCbbackupmgr runs cbbackupmgr in a sidecar with the backup archive
+// mounted, using a couchbase server image so that it matches the cluster.
+func runCbbackupmgr(ctx context.Context, host *DockerHost, name, image string, args []string) (string, error) {
+	result, err := runSidecar(ctx, host, SidecarOptions{
+		Name:       name,
+		Image:      image,
+		Entrypoint: []string{"/opt/couchbase/bin/cbbackupmgr"},
+		Args:       args,
+		Binds:      []string{backupVolume + ":" + backupArchivePath},
+		Timeout:    backupTimeout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if result.TimedOut {
+		return result.Output, errors.Errorf("cbbackupmgr %s did not finish within %s", args[0], backupTimeout)
+	}
+	if result.ExitCode != 0 {
+		return result.Output, errors.Errorf("cbbackupmgr %s exited with %d", args[0], result.ExitCode)
+	}
+	return result.Output, nil
+}
+
+// backupClusterOf returns a cluster which can be backed up or restored into,
+// along with the image of its nodes.
+func backupClusterOf(ctx context.Context, clusterID string) (*Cluster, string, error) {
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, "", err
+	}
+	if cluster.Hibernated {
+		return nil, "", errors.New("cannot back up or restore a hibernated cluster")
+	}
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(cluster.Nodes) == 0 {
+		return nil, "", errors.New("no nodes available")
+	}
+
+	containerJSON, err := dockerFor(cluster.Nodes[0].ContainerID).ContainerInspect(ctx, cluster.Nodes[0].ContainerID)
+	if err != nil {
+		return nil, "", trackDockerError("container_inspect", err)
+	}
+
+	return cluster, containerJSON.Config.Image, nil
+}
+
+// startBackup starts a job which backs a cluster up into a repository of the
+// backup archive, creating the repository if it doesn't exist yet.
+func startBackup(ctx context.Context, clusterID string, opts BackupOptions) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	repoName := opts.Conf.Repository
+	if !backupRepositoryRegexp.MatchString(repoName) {
+		return nil, errors.Errorf("%q is not a valid backup repository name", repoName)
+	}
+	for _, bucket := range opts.Conf.Buckets {
+		if bucket == "" || strings.Contains(bucket, ",") {
+			return nil, errors.Errorf("%q is not a valid bucket name", bucket)
+		}
+	}
+
+	cluster, image, err := backupClusterOf(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	host := dockerHostOf(cluster.Nodes[0].ContainerID)
+
+	repo, err := getBackupRepository(repoName)
+	createRepo := err != nil
+	if createRepo {
+		repo = &BackupRepository{
+			Name:      repoName,
+			Owner:     ContextUser(ctx),
+			Host:      host.Name,
+			Image:     image,
+			CreatedAt: time.Now(),
+		}
+		err = metaStore.setRecord(backupRepositoryKey(repoName), repo)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !ContextIgnoreOwnership(ctx) && repo.Owner != ContextUser(ctx) {
+			return nil, errors.Errorf("backup repository %s belongs to %s", repoName, repo.Owner)
+		}
+		if repo.Host != host.Name {
+			return nil, errors.Errorf("backup repository %s is on docker host %s", repoName, repo.Host)
+		}
+	}
+
+	var backupArgs []string
+	if len(opts.Conf.Buckets) > 0 {
+		backupArgs = append(backupArgs, "--include-data", strings.Join(opts.Conf.Buckets, ","))
+	}
+	backupArgs = append(backupArgs, cbbackupmgrClusterArgs(cluster.Nodes[0])...)
+
+	return startJob(ctx, JobTypeBackup, cluster, func(ctx context.Context, job Job) (string, error) {
+		if createRepo {
+			logInfof(ctx, "Creating backup repository %s", repoName)
+			output, err := runCbbackupmgr(ctx, host, "dynclsr-backup-"+job.ID, image, cbbackupmgrArgs("config", repoName))
+			if err != nil {
+				metaStore.deleteRecord(backupRepositoryKey(repoName))
+				return output, err
+			}
+		}
+
+		logInfof(ctx, "Backing up into repository %s", repoName)
+		output, err := runCbbackupmgr(ctx, host, "dynclsr-backup-"+job.ID, image, cbbackupmgrArgs("backup", repoName, backupArgs...))
+		if err != nil {
+			return output, err
+		}
+
+		backedUpAt := time.Now()
+		repo.LastBackupAt = &backedUpAt
+		return output, metaStore.setRecord(backupRepositoryKey(repoName), repo)
+	})
+}
+
+// startRestore starts a job which restores the latest backup of a repository
+// into a cluster, or a particular backup if one is given.
+func startRestore(ctx context.Context, clusterID string, opts RestoreOptions) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	repo, err := getBackupRepository(opts.Conf.Repository)
+	if err != nil {
+		return nil, err
+	}
+	if repo.LastBackupAt == nil {
+		return nil, errors.Errorf("backup repository %s has no backups", repo.Name)
+	}
+	if strings.HasPrefix(opts.Conf.Backup, "-") {
+		return nil, errors.Errorf("%q is not a valid backup", opts.Conf.Backup)
+	}
+
+	cluster, image, err := backupClusterOf(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	host := dockerHostOf(cluster.Nodes[0].ContainerID)
+	if repo.Host != host.Name {
+		return nil, errors.Errorf("backup repository %s is on docker host %s", repo.Name, repo.Host)
+	}
+
+	var restoreArgs []string
+	if opts.Conf.Backup != "" {
+		restoreArgs = append(restoreArgs, "--start", opts.Conf.Backup, "--end", opts.Conf.Backup)
+	}
+	if opts.Conf.AutoCreateBuckets {
+		restoreArgs = append(restoreArgs, "--auto-create-buckets")
+	}
+	restoreArgs = append(restoreArgs, cbbackupmgrClusterArgs(cluster.Nodes[0])...)
+
+	return startJob(ctx, JobTypeRestore, cluster, func(ctx context.Context, job Job) (string, error) {
+		logInfof(ctx, "Restoring from repository %s", repo.Name)
+		return runCbbackupmgr(ctx, host, "dynclsr-restore-"+job.ID, image, cbbackupmgrArgs("restore", repo.Name, restoreArgs...))
+	})
+}
+
+func getBackupRepositories() ([]BackupRepository, error) {
+	var repos []BackupRepository
+	err := metaStore.forEachRecord("backuprepo-", func(key string, recordBytes []byte) error {
+		var repo BackupRepository
+		err := json.Unmarshal(recordBytes, &repo)
+		if err != nil {
+			return err
+		}
+
+		repos = append(repos, repo)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// deleteBackupRepository removes a repository and all of its backups from
+// the backup archive.
+func deleteBackupRepository(ctx context.Context, name string) error {
+	repo, err := getBackupRepository(name)
+	if err != nil {
+		return err
+	}
+	if !ContextIgnoreOwnership(ctx) && repo.Owner != ContextUser(ctx) {
+		return errors.Errorf("backup repository %s belongs to %s", name, repo.Owner)
+	}
+
+	var host *DockerHost
+	for _, dockerHost := range getDockerHosts() {
+		if dockerHost.Name == repo.Host {
+			host = dockerHost
+		}
+	}
+	if host == nil {
+		return errors.Errorf("docker host %s of backup repository %s is not available", repo.Host, name)
+	}
+
+	logInfof(ctx, "Removing backup repository %s", name)
+	output, err := runCbbackupmgr(ctx, host, "dynclsr-backup-remove-"+name, repo.Image, cbbackupmgrArgs("remove", name))
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove backup repository: %s", output)
+	}
+
+	return metaStore.deleteRecord(backupRepositoryKey(name))
+}
@@ -2,7 +2,6 @@ package daemon
 
 import (
 	"context"
-	"log"
 	"strconv"
 
 	"github.com/couchbaselabs/cbdynclusterd/helper"
@@ -17,7 +16,13 @@ type AddBucketOptions struct {
 }
 
 func addBucket(ctx context.Context, clusterID string, opts AddBucketOptions) error {
-	log.Printf("Adding bucket %s to cluster %s (requested by: %s)", opts.Conf.Name, clusterID, ContextUser(ctx))
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Adding bucket %s", opts.Conf.Name)
+
+	err := validateCollectionScopes(opts.Conf.Scopes)
+	if err != nil {
+		return err
+	}
 
 	c, err := getCluster(ctx, clusterID)
 	if err != nil {
@@ -31,8 +36,8 @@ func addBucket(ctx context.Context, clusterID string, opts AddBucketOptions) err
 	n := c.Nodes[0]
 	ipv4 := n.IPv4Address
 	hostname := ipv4
-	if opts.Conf.UseHostname {
-		hostname = n.ContainerName[1:] + helper.DomainPostfix
+	if opts.Conf.UseHostname || c.UseHostname {
+		hostname = n.Hostname
 	}
 
 	node := &cluster.Node{
@@ -42,10 +47,30 @@ func addBucket(ctx context.Context, clusterID string, opts AddBucketOptions) err
 		RestLogin: &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.RestPort},
 	}
 
-	return node.CreateBucket(&cluster.Bucket{
+	err = node.CreateBucket(&cluster.Bucket{
 		Name:         opts.Conf.Name,
 		Type:         opts.Conf.BucketType,
 		ReplicaCount: opts.Conf.ReplicaCount,
 		RamQuotaMB:   strconv.Itoa(opts.Conf.RamQuota),
 	})
+	if err != nil || len(opts.Conf.Scopes) == 0 {
+		return err
+	}
+
+	// Buckets are created asynchronously, so wait for every node to know
+	// about the bucket before adding to it.
+	waitCtx, cancel := context.WithTimeout(ctx, collectionsWaitTimeout)
+	defer cancel()
+
+	err = waitForCollections(waitCtx, c.Nodes, opts.Conf.Name, nil)
+	if err != nil {
+		return err
+	}
+
+	err = createCollections(ctx, node, opts.Conf.Name, opts.Conf.Scopes)
+	if err != nil {
+		return err
+	}
+
+	return waitForCollections(waitCtx, c.Nodes, opts.Conf.Name, opts.Conf.Scopes)
 }
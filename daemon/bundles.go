@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+// Reproduction bundles capture everything about a cluster that is needed to
+// build the same environment again once it has expired: how its containers
+// were created, its meta-data, how couchbase server was configured and what
+// the daemon did to it.  Parts which can't be gathered, such as the config of
+// a cluster which was never set up, are listed in errors.txt rather than
+// failing the whole bundle.
+
+// redactedValue replaces secrets in bundles, since they tend to be attached
+// to bug reports.
+const redactedValue = "<redacted>"
+
+type BundleFile struct {
+	Name     string
+	Contents []byte
+}
+
+type reproductionBundle struct {
+	files  []BundleFile
+	errors []string
+}
+
+func (bundle *reproductionBundle) addJSON(name string, value interface{}) {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		bundle.addError(name, err)
+		return
+	}
+	bundle.files = append(bundle.files, BundleFile{Name: name, Contents: contents})
+}
+
+func (bundle *reproductionBundle) addError(name string, err error) {
+	bundle.errors = append(bundle.errors, fmt.Sprintf("%s: %s", name, err))
+}
+
+// addCouchbaseConfig asks ns_server how the cluster is configured.  Users
+// are included without their passwords, which ns_server never returns.
+func (bundle *reproductionBundle) addCouchbaseConfig(c *Cluster) {
+	restNode := restNodeOf(c.Nodes[0])
+	configPaths := map[string]string{
+		"couchbase/pool.json":    helper.PPoolsDefault,
+		"couchbase/buckets.json": helper.PBuckets,
+		"couchbase/users.json":   helper.PRbacUsers,
+	}
+	for name, configPath := range configPaths {
+		config, err := restNode.GetRawJSON(configPath)
+		if err != nil {
+			bundle.addError(name, err)
+			continue
+		}
+		bundle.files = append(bundle.files, BundleFile{Name: name, Contents: config})
+	}
+}
+
+// getReproductionBundle gathers the files of the bundle of a cluster.
+func getReproductionBundle(ctx context.Context, clusterID string) ([]BundleFile, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Creating reproduction bundle")
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isClusterOwner(ctx, c) {
+		return nil, errors.New("cannot create bundles of clusters you don't own")
+	}
+
+	bundle := &reproductionBundle{}
+
+	clusterCopy := *c
+	if clusterCopy.Credentials != nil {
+		credentials := *clusterCopy.Credentials
+		credentials.Password = redactedValue
+		clusterCopy.Credentials = &credentials
+	}
+	bundle.addJSON("cluster.json", clusterCopy)
+
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err != nil {
+		bundle.addError("meta.json", err)
+	} else {
+		if meta.Capella != nil {
+			capella := *meta.Capella
+			capella.EncryptedPassword = redactedValue
+			meta.Capella = &capella
+		}
+		bundle.addJSON("meta.json", meta)
+	}
+
+	if c.Provider == ProviderDocker {
+		for _, node := range c.Nodes {
+			name := fmt.Sprintf("nodes/%s/inspect.json", node.Name)
+			containerJSON, err := dockerFor(node.ContainerID).ContainerInspect(ctx, node.ContainerID)
+			if err != nil {
+				bundle.addError(name, trackDockerError("container_inspect", err))
+				continue
+			}
+			bundle.addJSON(name, containerJSON)
+		}
+
+		if !c.Hibernated && len(c.Nodes) > 0 {
+			bundle.addCouchbaseConfig(c)
+		}
+	}
+
+	logs, err := getRecentLogs(ctx, clusterID, 0)
+	if err != nil {
+		bundle.addError("daemon.log", err)
+	} else {
+		var logLines strings.Builder
+		for _, entry := range logs {
+			logLines.WriteString(entry.String())
+			logLines.WriteString("\n")
+		}
+		bundle.files = append(bundle.files, BundleFile{Name: "daemon.log", Contents: []byte(logLines.String())})
+	}
+
+	if len(bundle.errors) > 0 {
+		bundle.files = append(bundle.files, BundleFile{
+			Name:     "errors.txt",
+			Contents: []byte(strings.Join(bundle.errors, "\n") + "\n"),
+		})
+	}
+
+	return bundle.files, nil
+}
+
+// writeBundleZip writes the files of a bundle into a zip archive, under a
+// directory named after the cluster.
+func writeBundleZip(clusterID string, files []BundleFile, w io.Writer) error {
+	zipWriter := zip.NewWriter(w)
+	modified := time.Now()
+	for _, file := range files {
+		fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     clusterID + "/" + file.Name,
+			Method:   zip.Deflate,
+			Modified: modified,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = fileWriter.Write(file.Contents)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zipWriter.Close()
+}
@@ -0,0 +1,413 @@
+package daemon
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/capella"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// The Capella provider is only enabled when an organization and API key are
+// configured.  Clusters are created in capellaProject, or in a project named
+// cbdyncluster if none is given.
+var capellaEndpoint, capellaOrganization, capellaAPIKey, capellaProject string
+var capellaAllowedCIDR string
+var capellaCloud = "aws"
+var capellaRegion = "us-east-1"
+var capellaCPU = 4
+var capellaRAM = 16
+
+// capellaPasswordKey encrypts the passwords of Capella clusters, so that
+// they can't be read from the meta-data store or its backups by anyone
+// without the config of the daemon.
+var capellaPasswordKey []byte
+
+const (
+	capellaProjectName  = "cbdyncluster"
+	capellaDatabaseUser = "cbdyncluster"
+)
+
+// capellaDeployTimeout bounds how long clusters have to deploy before
+// allocation is given up on.
+const capellaDeployTimeout = 45 * time.Minute
+
+var capellaDiskTypes = map[string]string{
+	"aws":   "gp3",
+	"gcp":   "pd-ssd",
+	"azure": "P6",
+}
+
+type capellaProvider struct {
+	client    *capella.Client
+	projectID string
+
+	// metaLock serializes updates to the meta-data of clusters.
+	metaLock sync.Mutex
+}
+
+func connectCapella() error {
+	if capellaOrganization == "" || capellaAPIKey == "" {
+		return nil
+	}
+
+	if _, ok := capellaDiskTypes[capellaCloud]; !ok {
+		return fmt.Errorf("%s is not a capella cloud provider", capellaCloud)
+	}
+	if len(capellaPasswordKey) != 32 {
+		return errors.New("capella-password-key must be 32 hex encoded bytes")
+	}
+
+	client, err := capella.NewClient(capellaEndpoint, capellaOrganization, capellaAPIKey)
+	if err != nil {
+		return err
+	}
+
+	projectID := capellaProject
+	if projectID == "" {
+		projectID, err = findCapellaProject(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	clusterProviders[ProviderCapella] = &capellaProvider{
+		client:    client,
+		projectID: projectID,
+	}
+	return nil
+}
+
+func findCapellaProject(client *capella.Client) (string, error) {
+	projects, err := client.ListProjects(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	for _, project := range projects {
+		if project.Name == capellaProjectName {
+			return project.ID, nil
+		}
+	}
+
+	return client.CreateProject(context.Background(), capellaProjectName)
+}
+
+func getCapellaProvider() *capellaProvider {
+	provider, _ := clusterProviders[ProviderCapella].(*capellaProvider)
+	return provider
+}
+
+// capellaCluster builds a cluster from the meta-data of a cluster run on
+// Capella.  Capella doesn't expose its nodes, so they are only placeholders.
+func capellaCluster(clusterID string, meta ClusterMeta) *Cluster {
+	var nodes []*Node
+	for _, node := range meta.Capella.Nodes {
+		nodes = append(nodes, &Node{
+			State:                meta.Capella.State,
+			Name:                 node.Name,
+			InitialServerVersion: node.ServerVersion,
+		})
+	}
+
+	cluster := &Cluster{
+		ID:         clusterID,
+		Creator:    meta.Capella.Creator,
+		Owner:      meta.Owner,
+		Timeout:    meta.Timeout,
+		Nodes:      nodes,
+		EntryPoint: meta.Capella.ConnectionString,
+		SharedWith: meta.SharedWith,
+		Team:       meta.Team,
+		Tags:       meta.Tags,
+		Alias:      meta.Alias,
+		Pool:       meta.Pool,
+		Provider:   ProviderCapella,
+	}
+	if meta.Capella.EncryptedPassword != "" {
+		password, err := decryptCapellaPassword(meta.Capella.EncryptedPassword)
+		if err != nil {
+			logWarnf(ContextWithClusterID(context.Background(), clusterID), "Failed to decrypt capella password: %s", err)
+		} else {
+			cluster.Credentials = &ClusterCredentials{
+				Username: meta.Capella.Username,
+				Password: password,
+			}
+		}
+	}
+
+	return cluster
+}
+
+func capellaPasswordCipher() (cipher.AEAD, error) {
+	if len(capellaPasswordKey) == 0 {
+		return nil, errors.New("no capella-password-key is configured")
+	}
+
+	block, err := aes.NewCipher(capellaPasswordKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptCapellaPassword returns the password sealed with AES-GCM, with the
+// nonce in front, base64 encoded.
+func encryptCapellaPassword(password string) (string, error) {
+	aead, err := capellaPasswordCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = cryptorand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(password), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptCapellaPassword(encrypted string) (string, error) {
+	aead, err := capellaPasswordCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted password is too short")
+	}
+
+	password, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(password), nil
+}
+
+func capellaClusterName(clusterID string) string {
+	return "dynclsr-" + clusterID
+}
+
+// capellaServerVersion turns a server version into the major.minor version
+// which Capella deploys, it can't deploy specific builds.
+func capellaServerVersion(serverVersion string) (string, error) {
+	if strings.Contains(serverVersion, "-") {
+		return "", errors.New("capella clusters can only use released server versions")
+	}
+
+	versionParts := strings.Split(serverVersion, ".")
+	if len(versionParts) < 2 {
+		return "", fmt.Errorf("%s is not a valid server version", serverVersion)
+	}
+
+	return versionParts[0] + "." + versionParts[1], nil
+}
+
+// randomCapellaCIDR picks a network for a cluster, every cluster in a project
+// needs a different one.
+func randomCapellaCIDR() string {
+	return fmt.Sprintf("10.%d.%d.0/23", rand.Intn(256), rand.Intn(128)*2)
+}
+
+func (p *capellaProvider) updateMeta(clusterID string, updateFunc func(capellaMeta *CapellaMeta)) error {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		if meta.Capella == nil {
+			return meta, errors.New("cluster is not a capella cluster")
+		}
+
+		updateFunc(meta.Capella)
+		return meta, nil
+	})
+}
+
+func (p *capellaProvider) allocateNodes(ctx context.Context, clusterID string, timeout time.Time, nodes []NodeOptions) error {
+	serverVersion, err := capellaServerVersion(nodes[0].ServerVersion)
+	if err != nil {
+		return err
+	}
+
+	capellaMeta := &CapellaMeta{
+		Creator:   ContextUser(ctx),
+		ProjectID: p.projectID,
+		State:     "pending",
+	}
+	for _, node := range nodes {
+		capellaMeta.Nodes = append(capellaMeta.Nodes, CapellaNode{
+			Name:          node.Name,
+			ServerVersion: node.ServerVersion,
+		})
+	}
+
+	err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Capella = capellaMeta
+		return meta, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	serviceGroup := capella.ServiceGroup{
+		NumOfNodes: len(nodes),
+		Services:   []string{"data", "index", "query"},
+	}
+	serviceGroup.Node.Compute = capella.Compute{
+		CPU: capellaCPU,
+		RAM: capellaRAM,
+	}
+	serviceGroup.Node.Disk = capella.Disk{
+		Type: capellaDiskTypes[capellaCloud],
+	}
+	if capellaCloud == "aws" {
+		serviceGroup.Node.Disk.Storage = 50
+		serviceGroup.Node.Disk.IOPS = 3000
+	}
+
+	logInfof(ctx, "Creating capella cluster")
+	capellaID, err := p.client.CreateCluster(ctx, p.projectID, capella.CreateClusterOptions{
+		Name:        capellaClusterName(clusterID),
+		Description: fmt.Sprintf("cbdyncluster cluster for %s", ContextUser(ctx)),
+		CloudProvider: capella.CloudProvider{
+			Type:   capellaCloud,
+			Region: capellaRegion,
+			CIDR:   randomCapellaCIDR(),
+		},
+		ServerVersion:   serverVersion,
+		ServiceGroups:   []capella.ServiceGroup{serviceGroup},
+		SupportPlan:     "developer pro",
+		SupportTimezone: "PT",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.updateMeta(clusterID, func(capellaMeta *CapellaMeta) {
+		capellaMeta.ClusterID = capellaID
+		capellaMeta.State = "deploying"
+	})
+	if err != nil {
+		return err
+	}
+
+	deployCtx, cancel := context.WithTimeout(ctx, capellaDeployTimeout)
+	defer cancel()
+
+	deployed, err := p.waitForCluster(deployCtx, capellaID)
+	if err != nil {
+		return err
+	}
+
+	if capellaAllowedCIDR != "" {
+		err = p.client.AddAllowedCIDR(ctx, p.projectID, capellaID, capellaAllowedCIDR, "cbdyncluster")
+		if err != nil {
+			return errors.Wrap(err, "failed to add allowed cidr")
+		}
+	}
+
+	password := fmt.Sprintf("Dyn-%s-1", uuid.New().String())
+	encryptedPassword, err := encryptCapellaPassword(password)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt database password")
+	}
+
+	err = p.client.CreateDatabaseUser(ctx, p.projectID, capellaID, capellaDatabaseUser, password)
+	if err != nil {
+		return errors.Wrap(err, "failed to create database credentials")
+	}
+
+	return p.updateMeta(clusterID, func(capellaMeta *CapellaMeta) {
+		capellaMeta.State = deployed.CurrentState
+		capellaMeta.ConnectionString = deployed.ConnectionString
+		capellaMeta.Username = capellaDatabaseUser
+		capellaMeta.EncryptedPassword = encryptedPassword
+	})
+}
+
+func (p *capellaProvider) waitForCluster(ctx context.Context, capellaID string) (*capella.Cluster, error) {
+	for {
+		cluster, err := p.client.GetCluster(ctx, p.projectID, capellaID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch cluster.CurrentState {
+		case "healthy":
+			return cluster, nil
+		case "deploymentFailed", "destroying", "destroyFailed":
+			return nil, errors.Errorf("capella cluster %s is %s", capellaID, cluster.CurrentState)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "capella cluster %s did not deploy", capellaID)
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+func (p *capellaProvider) killNodes(ctx context.Context, cluster *Cluster) error {
+	meta, err := metaStore.GetClusterMeta(cluster.ID)
+	if err != nil {
+		return err
+	}
+	if meta.Capella == nil || meta.Capella.ClusterID == "" {
+		return nil
+	}
+
+	logInfof(ctx, "Deleting capella cluster %s", meta.Capella.ClusterID)
+	err = p.client.DeleteCluster(ctx, meta.Capella.ProjectID, meta.Capella.ClusterID)
+	if err != nil && !capella.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// deleteOrphanedClusters deletes Capella clusters which we created for
+// clusters that no longer have any meta-data.
+func (p *capellaProvider) deleteOrphanedClusters(ctx context.Context, metas map[string]ClusterMeta) ([]string, error) {
+	capellaClusters, err := p.client.ListClusters(ctx, p.projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, cluster := range capellaClusters {
+		if !strings.HasPrefix(cluster.Name, "dynclsr-") || strings.HasPrefix(cluster.CurrentState, "destroy") {
+			continue
+		}
+
+		clusterID := strings.TrimPrefix(cluster.Name, "dynclsr-")
+		if meta, ok := metas[clusterID]; ok && meta.Capella != nil {
+			continue
+		}
+
+		logWarnf(ContextWithClusterID(ctx, clusterID), "Found capella cluster %s without meta-data", cluster.ID)
+		err := p.client.DeleteCluster(ctx, p.projectID, cluster.ID)
+		if err != nil && !capella.IsNotFound(err) {
+			return orphans, err
+		}
+		orphans = append(orphans, cluster.ID)
+	}
+
+	return orphans, nil
+}
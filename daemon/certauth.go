@@ -18,6 +18,9 @@ import (
 type SetupClientCertAuthOptions struct {
 	Nodes []*Node
 	Conf  SetupClientCertAuthJSON
+	// UseHostname issues the certificates of nodes for their hostnames
+	// rather than their IP addresses.
+	UseHostname bool
 }
 
 type CertAuthResult struct {
@@ -32,6 +35,9 @@ func SetupCertAuth(opts SetupClientCertAuthOptions) (*CertAuthResult, error) {
 	for i := 0; i < len(initialNodes); i++ {
 		ipv4 := initialNodes[i].IPv4Address
 		hostname := ipv4
+		if opts.UseHostname {
+			hostname = initialNodes[i].Hostname
+		}
 
 		nodeHost := cluster.Node{
 			HostName:  hostname,
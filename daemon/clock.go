@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Nodes built from the centos7 image preload libfaketime into every process,
+// which shifts the clock by whatever offset is in faketimeConfigPath, or
+// leaves it alone if there is no such file.  libfaketime only rereads the
+// file every few seconds, so a new offset doesn't apply straight away.
+//
+// libfaketime only shifts the clock of processes which read it through libc,
+// which are ns_server, memcached and the JVM of the analytics service.  The
+// services written in Go, such as the indexer, projector, query, search,
+// eventing and goxdcr, read the clock from the vDSO themselves and keep the
+// real time.
+
+const faketimeConfigPath = "/etc/faketimerc"
+
+// maxClockSkew is the furthest that the clock of a node can be shifted, far
+// enough to take certificates past their expiry.
+var maxClockSkew = 10 * 365 * 24 * time.Hour
+
+func clockSkewNode(ctx context.Context, clusterID, nodeRef string) (*Node, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot change the clock of a hibernated cluster")
+	}
+
+	return findNode(c, nodeRef)
+}
+
+// runClockCommand runs a shell command on a node, returning its output.
+func runClockCommand(ctx context.Context, node *Node, script string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execStream(ctx, node.ContainerID, []string{"sh", "-c", script}, &stdout, &stderr)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", errors.Errorf("failed with exit code %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// requireFaketime checks that a node was built with libfaketime preloaded,
+// since nodes built from older images have no way to shift their clock.
+func requireFaketime(ctx context.Context, node *Node) error {
+	_, err := runClockCommand(ctx, node, "grep -q faketime /etc/ld.so.preload")
+	if err != nil {
+		return errors.Errorf("node %s was built from an image without libfaketime, allocate a new cluster to shift its clock, which rebuilds out of date images", node.Name)
+	}
+	return nil
+}
+
+// setClockSkew shifts the clock of a node by offset, replacing any offset it
+// already had.  An offset of zero puts the clock back.
+func setClockSkew(ctx context.Context, clusterID, nodeRef string, offset time.Duration) error {
+	ctx = ContextWithNode(ContextWithClusterID(ctx, clusterID), nodeRef)
+
+	if offset > maxClockSkew || offset < -maxClockSkew {
+		return errors.Errorf("clocks can be shifted by at most %s", maxClockSkew)
+	}
+
+	node, err := clockSkewNode(ctx, clusterID, nodeRef)
+	if err != nil {
+		return err
+	}
+
+	err = requireFaketime(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	seconds := int64(offset / time.Second)
+	if seconds == 0 {
+		logInfof(ctx, "Restoring clock")
+		_, err = runClockCommand(ctx, node, "rm -f "+faketimeConfigPath)
+	} else {
+		logInfof(ctx, "Shifting clock by %s", offset)
+		_, err = runClockCommand(ctx, node, fmt.Sprintf("echo %+d > %s", seconds, faketimeConfigPath))
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to change the clock")
+	}
+
+	return nil
+}
+
+// getClockSkew returns how far the clock of a node is shifted.
+func getClockSkew(ctx context.Context, clusterID, nodeRef string) (time.Duration, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return 0, err
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return 0, err
+	}
+	node, err := findNode(c, nodeRef)
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := runClockCommand(ctx, node, "cat "+faketimeConfigPath+" 2>/dev/null || true")
+	if err != nil {
+		return 0, err
+	}
+	if output == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(output, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("node has an offset which was not set by the daemon: %s", output)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,464 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var clusterPoolNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// clusterPoolOwner owns the clusters of check-out pools while they are
+// checked in, which keeps them hidden from users.
+const clusterPoolOwner = "system"
+
+// ClusterPool is a set of identical, already set up clusters which jobs can
+// check out and back in, rather than allocating their own.
+type ClusterPool struct {
+	Name          string                 `json:"name"`
+	ServerVersion string                 `json:"server_version"`
+	Size          int                    `json:"size"`
+	Setup         CreateClusterSetupJSON `json:"setup"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+	UpdatedBy     string                 `json:"updated_by"`
+}
+
+// ClusterPoolStatus is a pool along with how many of its clusters are in use.
+type ClusterPoolStatus struct {
+	ClusterPool
+	Available  int
+	CheckedOut int
+}
+
+func clusterPoolKey(name string) string {
+	return "checkout-pool-" + name
+}
+
+func getClusterPool(name string) (*ClusterPool, error) {
+	var pool ClusterPool
+	err := metaStore.getRecord(clusterPoolKey(name), &pool)
+	if err == ErrMetaNotFound {
+		return nil, errors.Errorf("pool %s not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &pool, nil
+}
+
+func getAllClusterPools() ([]ClusterPool, error) {
+	var pools []ClusterPool
+	err := metaStore.forEachRecord("checkout-pool-", func(key string, recordBytes []byte) error {
+		var pool ClusterPool
+		err := json.Unmarshal(recordBytes, &pool)
+		if err != nil {
+			return err
+		}
+
+		pools = append(pools, pool)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pools, nil
+}
+
+func getPoolClusters(ctx context.Context) (map[string][]*Cluster, error) {
+	clusters, err := getAllClusters(ContextWithRole(NewContext(ctx, clusterPoolOwner, true), RoleAdmin))
+	if err != nil {
+		return nil, err
+	}
+
+	poolClusters := make(map[string][]*Cluster)
+	for _, cluster := range clusters {
+		if cluster.Pool != "" {
+			poolClusters[cluster.Pool] = append(poolClusters[cluster.Pool], cluster)
+		}
+	}
+
+	return poolClusters, nil
+}
+
+func getClusterPoolStatuses(ctx context.Context) ([]ClusterPoolStatus, error) {
+	pools, err := getAllClusterPools()
+	if err != nil {
+		return nil, err
+	}
+
+	poolClusters, err := getPoolClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []ClusterPoolStatus
+	for _, pool := range pools {
+		status := ClusterPoolStatus{ClusterPool: pool}
+		for _, cluster := range poolClusters[pool.Name] {
+			if cluster.Owner == clusterPoolOwner {
+				status.Available++
+			} else {
+				status.CheckedOut++
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func setClusterPool(ctx context.Context, pool ClusterPool) (*ClusterPool, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can manage pools")
+	}
+
+	if !clusterPoolNameRegexp.MatchString(pool.Name) {
+		return nil, errors.New("pool names must be lowercase letters, numbers, dots, dashes and underscores")
+	}
+
+	_, err := parseServerVersion(pool.ServerVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pool.Setup.Services) == 0 {
+		return nil, errors.New("pools must have at least one node")
+	}
+
+	if pool.Size < 0 {
+		return nil, errors.New("pool size cannot be negative")
+	}
+
+	pool.UpdatedAt = time.Now()
+	pool.UpdatedBy = ContextUser(ctx)
+
+	err = metaStore.setRecord(clusterPoolKey(pool.Name), &pool)
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Saved cluster pool %s", pool.Name)
+	signalClusterPools()
+
+	return &pool, nil
+}
+
+func deleteClusterPool(ctx context.Context, name string) error {
+	if !ContextIsAdmin(ctx) {
+		return errors.New("only admins can manage pools")
+	}
+
+	_, err := getClusterPool(name)
+	if err != nil {
+		return err
+	}
+
+	err = metaStore.deleteRecord(clusterPoolKey(name))
+	if err != nil {
+		return err
+	}
+
+	logInfof(ctx, "Deleted cluster pool %s", name)
+
+	// The clusters of the pool which are checked out are killed when they
+	// are checked back in.
+	signalClusterPools()
+
+	return nil
+}
+
+var clusterPoolsSig = make(chan struct{}, 1)
+
+var errClusterCheckedOut = errors.New("cluster has already been checked out")
+
+func signalClusterPools() {
+	select {
+	case clusterPoolsSig <- struct{}{}:
+	default:
+	}
+}
+
+func checkOutCluster(ctx context.Context, poolName string, timeout time.Duration) (*Cluster, error) {
+	if maxTimeout := getRuntimeConfig().MaxClusterTimeout; timeout > maxTimeout {
+		return nil, fmt.Errorf("cannot check out clusters for longer than %s", maxTimeout)
+	}
+
+	_, err := getClusterPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	poolClusters, err := getPoolClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The owner is compared and swapped, so that when jobs on several daemons
+	// race for the same cluster only one of them gets it and the others move
+	// on to the next.
+	var cluster *Cluster
+	for _, poolCluster := range poolClusters[poolName] {
+		if poolCluster.Owner != clusterPoolOwner || poolCluster.State() != ClusterStateRunning {
+			continue
+		}
+
+		err = checkOutPoolCluster(ctx, poolCluster, timeout)
+		if err == errClusterCheckedOut {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		cluster = poolCluster
+		break
+	}
+	if cluster == nil {
+		return nil, errors.Errorf("no clusters are available in pool %s", poolName)
+	}
+
+	logInfof(ContextWithClusterID(ctx, cluster.ID), "Checked out cluster from pool %s", poolName)
+	signalClusterPools()
+
+	return getCluster(ctx, cluster.ID)
+}
+
+func checkOutPoolCluster(ctx context.Context, cluster *Cluster, timeout time.Duration) error {
+	releaseQuota, err := reserveQuota(ctx, len(cluster.Nodes))
+	if err != nil {
+		return err
+	}
+	defer releaseQuota()
+
+	return metaStore.UpdateClusterMeta(cluster.ID, func(meta ClusterMeta) (ClusterMeta, error) {
+		if meta.Owner != clusterPoolOwner {
+			return meta, errClusterCheckedOut
+		}
+		meta.Owner = ContextUser(ctx)
+		meta.Timeout = time.Now().Add(timeout)
+		return meta, nil
+	})
+}
+
+// resetPoolCluster undoes whatever a job did to a pooled cluster, by
+// flushing its buckets and removing any users the pool didn't create.
+func resetPoolCluster(ctx context.Context, cluster *Cluster, pool *ClusterPool) error {
+	if len(cluster.Nodes) == 0 {
+		return errors.New("no nodes available")
+	}
+	restNode := restNodeOf(cluster.Nodes[0])
+
+	bucketNames, err := restNode.GetBucketNames()
+	if err != nil {
+		return err
+	}
+	for _, bucketName := range bucketNames {
+		if pool.Setup.Bucket != nil && bucketName == pool.Setup.Bucket.Name {
+			err = restNode.FlushBucket(bucketName)
+		} else {
+			err = restNode.DeleteBucket(bucketName)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to reset bucket %s", bucketName)
+		}
+	}
+
+	userNames, err := restNode.GetLocalUserNames()
+	if err != nil {
+		return err
+	}
+	for _, userName := range userNames {
+		if pool.Setup.User != nil && userName == pool.Setup.User.Name {
+			continue
+		}
+		err = restNode.DeleteUser(userName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove user %s", userName)
+		}
+	}
+
+	if pool.Setup.User != nil {
+		// Recreating the user puts back its password and roles
+		user := *pool.Setup.User
+		err = restNode.CreateUser(&user)
+		if err != nil {
+			return errors.Wrapf(err, "failed to reset user %s", user.Name)
+		}
+	}
+
+	return nil
+}
+
+func checkInCluster(ctx context.Context, clusterID string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if cluster.Pool == "" {
+		return errors.New("cluster was not checked out from a pool")
+	}
+	if cluster.Owner == clusterPoolOwner {
+		return errors.New("cluster is already checked in")
+	}
+	if !isClusterOwner(ctx, cluster) {
+		return errors.New("cannot check in clusters you don't own")
+	}
+
+	pool, err := getClusterPool(cluster.Pool)
+	if err == nil {
+		err = resetPoolCluster(ctx, cluster, pool)
+	}
+	if err != nil {
+		// A cluster which can't be reset can't be handed to anyone else, so
+		// get rid of it and let the pool replace it.
+		logWarnf(ctx, "Killing cluster which could not be returned to pool %s: %s", cluster.Pool, err)
+		signalClusterPools()
+		return killCluster(ContextWithRole(NewContext(ctx, clusterPoolOwner, true), RoleAdmin), clusterID)
+	}
+
+	err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Owner = clusterPoolOwner
+		meta.Timeout = time.Now().Add(getRuntimeConfig().MaxClusterTimeout)
+		meta.SharedWith = nil
+		meta.Team = ""
+		meta.Tags = nil
+		return meta, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if cluster.Alias != "" {
+		err = setClusterAlias(ctx, clusterID, "")
+		if err != nil {
+			logWarnf(ctx, "Failed to remove alias of checked in cluster: %s", err)
+		}
+	}
+
+	logInfof(ctx, "Checked in cluster to pool %s", cluster.Pool)
+
+	return nil
+}
+
+func allocatePoolCluster(ctx context.Context, pool *ClusterPool) error {
+	nodeVersion, err := parseServerVersion(pool.ServerVersion)
+	if err != nil {
+		return err
+	}
+
+	clusterOpts := ClusterOptions{
+		Timeout: getRuntimeConfig().MaxClusterTimeout,
+		Pool:    pool.Name,
+	}
+	for i := range pool.Setup.Services {
+		clusterOpts.Nodes = append(clusterOpts.Nodes, NodeOptions{
+			Name:          fmt.Sprintf("node_%d", i+1),
+			ServerVersion: pool.ServerVersion,
+			VersionInfo:   nodeVersion,
+		})
+	}
+
+	clusterID, err := allocateCluster(ctx, clusterOpts)
+	if err != nil {
+		return err
+	}
+
+	_, err = setupCluster(ctx, clusterID, pool.Setup)
+	if err != nil {
+		killCluster(ctx, clusterID)
+		return err
+	}
+
+	return nil
+}
+
+// replenishClusterPools tops up pools which have had clusters checked out,
+// keeps the checked in clusters from expiring, and gets rid of the clusters
+// of pools which have been removed.
+func replenishClusterPools() error {
+	ctx := ContextWithRole(NewContext(systemCtx, clusterPoolOwner, true), RoleAdmin)
+
+	pools, err := getAllClusterPools()
+	if err != nil {
+		return err
+	}
+
+	poolClusters, err := getPoolClusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	poolsByName := make(map[string]*ClusterPool)
+	for i := range pools {
+		poolsByName[pools[i].Name] = &pools[i]
+	}
+
+	for poolName, clusters := range poolClusters {
+		_, poolExists := poolsByName[poolName]
+		for _, cluster := range clusters {
+			if cluster.Owner != clusterPoolOwner {
+				continue
+			}
+
+			if !poolExists {
+				err := killCluster(ctx, cluster.ID)
+				if err != nil {
+					logWarnf(ctx, "Failed to kill cluster of removed pool %s: %s", poolName, err)
+				}
+				continue
+			}
+
+			err := metaStore.UpdateClusterMeta(cluster.ID, func(meta ClusterMeta) (ClusterMeta, error) {
+				meta.Timeout = time.Now().Add(getRuntimeConfig().MaxClusterTimeout)
+				return meta, nil
+			})
+			if err != nil {
+				logWarnf(ctx, "Failed to extend cluster of pool %s: %s", poolName, err)
+			}
+		}
+	}
+
+	for _, pool := range pools {
+		available := 0
+		for _, cluster := range poolClusters[pool.Name] {
+			if cluster.Owner == clusterPoolOwner {
+				available++
+			}
+		}
+
+		for i := available; i < pool.Size; i++ {
+			logInfof(ctx, "Allocating cluster for pool %s", pool.Name)
+			err := allocatePoolCluster(ctx, &pool)
+			if err != nil {
+				return errors.Wrapf(err, "failed to allocate cluster for pool %s", pool.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func runClusterPools(shutdownSig chan struct{}) {
+	for {
+		if isLeader() {
+			err := replenishClusterPools()
+			if err != nil {
+				logErrorf(systemCtx, "Failed to replenish cluster pools: %s", err)
+			}
+		}
+
+		select {
+		case <-shutdownSig:
+			return
+		case <-clusterPoolsSig:
+		case <-time.After(5 * time.Minute):
+		}
+	}
+}
@@ -3,15 +3,14 @@ package daemon
 import (
 	"context"
 	"fmt"
-	"log"
-	"net/http"
+	"strings"
 	"time"
 
-	"github.com/couchbaselabs/cbdynclusterd/helper"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func newRandomClusterID() string {
@@ -20,8 +19,19 @@ func newRandomClusterID() string {
 }
 
 type ClusterOptions struct {
-	Timeout time.Duration
-	Nodes   []NodeOptions
+	Timeout   time.Duration
+	Nodes     []NodeOptions
+	Team      string
+	Tags      map[string]string
+	Alias     string
+	Pool      string
+	Provider  string
+	KeepAlive bool
+	// ContiguousIPs reserves a block of consecutive addresses from the IP
+	// pool for the nodes.
+	ContiguousIPs bool
+	// Lease ties the cluster to a CI job, see completeLease.
+	Lease *LeaseOptions
 }
 
 type Node struct {
@@ -32,6 +42,11 @@ type Node struct {
 	InitialServerVersion string
 	IPv4Address          string
 	IPv6Address          string
+	// Hostname is the DNS name of the node, which clusters set up with
+	// use_hostname know it by rather than its IP address.
+	Hostname string
+	// Health is whether the node answered when it was last probed.
+	Health string
 }
 
 type Cluster struct {
@@ -41,20 +56,96 @@ type Cluster struct {
 	Timeout    time.Time
 	Nodes      []*Node
 	EntryPoint string
+	Hibernated bool
+	SharedWith []string
+	Team       string
+	Tags       map[string]string
+	Alias      string
+	Pool       string
+	Host       string
+	Provider   string
+	KeepAlive  bool
+	// UseHostname is set for clusters whose nodes were added to the cluster by
+	// their hostname rather than their IP address.
+	UseHostname bool
+	// Credentials are set for clusters which don't use the default
+	// credentials of our images.
+	Credentials *ClusterCredentials
 }
 
-func checkBuildExists(url string) error {
-	resp, err := http.Head(url)
-	if err != nil {
-		return errors.Wrap(err, "Could not locate build")
+type ClusterCredentials struct {
+	Username string
+	Password string
+}
+
+const maxClusterTags = 50
+
+func validateClusterTags(tags map[string]string) error {
+	if len(tags) > maxClusterTags {
+		return fmt.Errorf("clusters cannot have more than %d tags", maxClusterTags)
 	}
-	if resp.StatusCode != 200 {
-		return errors.New("Could not locate build")
+	for key, value := range tags {
+		if key == "" || len(key) > 64 || strings.ContainsAny(key, "=,") {
+			return fmt.Errorf("invalid tag name %q", key)
+		}
+		if len(value) > 256 {
+			return fmt.Errorf("value of tag %s is too long", key)
+		}
 	}
-
 	return nil
 }
 
+// hasTags checks that the cluster has every tag in tags, an empty value
+// matches any value of the tag.
+func (cluster *Cluster) hasTags(tags map[string]string) bool {
+	for key, value := range tags {
+		clusterValue, ok := cluster.Tags[key]
+		if !ok || (value != "" && clusterValue != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// canSeeCluster decides whether the user in ctx can see a cluster, which
+// they can if they created it, own it, are in the team that owns it or it has
+// been shared with them.
+func canSeeCluster(ctx context.Context, creator string, meta ClusterMeta, userTeams map[string]bool) bool {
+	if ContextIgnoreOwnership(ctx) {
+		return true
+	}
+
+	user := ContextUser(ctx)
+	return creator == user || meta.Owner == user || containsString(meta.SharedWith, user) ||
+		(meta.Team != "" && userTeams[meta.Team])
+}
+
+// isClusterOwner decides whether the user in ctx has the rights of the owner
+// of a cluster, either by owning it or by being in the team that owns it.
+func isClusterOwner(ctx context.Context, cluster *Cluster) bool {
+	if ContextIgnoreOwnership(ctx) {
+		return true
+	}
+
+	user := ContextUser(ctx)
+	return cluster.Owner == user || isTeamMember(cluster.Team, user)
+}
+
+// canManageCluster decides whether the user in ctx can refresh or kill a
+// cluster, which the owners and anyone it was shared with can do.
+func canManageCluster(ctx context.Context, cluster *Cluster) bool {
+	return isClusterOwner(ctx, cluster) || containsString(cluster.SharedWith, ContextUser(ctx))
+}
+
 func getCluster(ctx context.Context, clusterID string) (*Cluster, error) {
 	clusters, err := getAllClusters(ctx)
 	if err != nil {
@@ -71,9 +162,22 @@ func getCluster(ctx context.Context, clusterID string) (*Cluster, error) {
 }
 
 func getAllClusters(ctx context.Context) ([]*Cluster, error) {
-	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{
+	containers, err := listContainers(ctx, types.ContainerListOptions{
 		All: true,
-	})
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var userTeams map[string]bool
+	if !ContextIgnoreOwnership(ctx) {
+		userTeams, err = getTeamsOfUser(ContextUser(ctx))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	poolClaims, err := getPoolClaims()
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +185,7 @@ func getAllClusters(ctx context.Context) ([]*Cluster, error) {
 	clusterMap := make(map[string][]types.Container)
 
 	for _, container := range containers {
+		container.Labels = effectiveLabels(container, poolClaims)
 		clusterID := container.Labels["com.couchbase.dyncluster.cluster_id"]
 		if clusterID != "" {
 			clusterMap[clusterID] = append(clusterMap[clusterID], container)
@@ -91,7 +196,7 @@ func getAllClusters(ctx context.Context) ([]*Cluster, error) {
 	for clusterID, containers := range clusterMap {
 		meta, err := metaStore.GetClusterMeta(clusterID)
 		if err != nil {
-			log.Printf("Encountered unregistered cluster: %s", clusterID)
+			logWarnf(ContextWithClusterID(ctx, clusterID), "Encountered unregistered cluster")
 		}
 
 		clusterCreator := ""
@@ -119,6 +224,8 @@ func getAllClusters(ctx context.Context) ([]*Cluster, error) {
 				InitialServerVersion: container.Labels["com.couchbase.dyncluster.initial_server_version"],
 				IPv4Address:          eth0Net.IPAddress,
 				IPv6Address:          eth0Net.GlobalIPv6Address,
+				Hostname:             nodeHostname(container.Names[0]),
+				Health:               nodeHealthOf(container.ID, container.State),
 			})
 		}
 
@@ -126,50 +233,211 @@ func getAllClusters(ctx context.Context) ([]*Cluster, error) {
 			clusterCreator = "unknown"
 		}
 
+		// Clusters from before there were multiple hosts don't have one
+		// recorded, so go by where their nodes are.
+		clusterHost := meta.Host
+		if clusterHost == "" {
+			clusterHost = dockerHostOf(containers[0].ID).Name
+		}
+
 		// Don't include clusters that we don't actually own
-		if !ContextIgnoreOwnership(ctx) && clusterCreator != ContextUser(ctx) {
+		if !canSeeCluster(ctx, clusterCreator, meta, userTeams) {
+			continue
+		}
+
+		clusters = append(clusters, &Cluster{
+			ID:         clusterID,
+			Creator:    clusterCreator,
+			Owner:      meta.Owner,
+			Timeout:    meta.Timeout,
+			Nodes:      nodes,
+			SharedWith: meta.SharedWith,
+			Team:       meta.Team,
+			Tags:       meta.Tags,
+			Alias:      meta.Alias,
+			Pool:       meta.Pool,
+			Host:       clusterHost,
+			Provider:   ProviderDocker,
+			KeepAlive:  meta.KeepAlive,
+
+			UseHostname: meta.UseHostname,
+		})
+	}
+
+	metas, err := metaStore.GetAllClusterMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	for clusterID, meta := range metas {
+		if meta.EC2 != nil {
+			if canSeeCluster(ctx, meta.EC2.Creator, meta, userTeams) {
+				clusters = append(clusters, ec2Cluster(clusterID, meta))
+			}
 			continue
 		}
 
+		if meta.Capella != nil {
+			if canSeeCluster(ctx, meta.Capella.Creator, meta, userTeams) {
+				clusters = append(clusters, capellaCluster(clusterID, meta))
+			}
+			continue
+		}
+
+		// Hibernated clusters have no containers, so they are only known about
+		// through their meta-data.
+		if meta.Hibernation == nil || clusterMap[clusterID] != nil {
+			continue
+		}
+
+		if !canSeeCluster(ctx, meta.Hibernation.Creator, meta, userTeams) {
+			continue
+		}
+
+		var nodes []*Node
+		for _, node := range meta.Hibernation.Nodes {
+			nodes = append(nodes, &Node{
+				State:                "hibernated",
+				Name:                 node.Name,
+				InitialServerVersion: node.ServerVersion,
+			})
+		}
+
 		clusters = append(clusters, &Cluster{
-			ID:      clusterID,
-			Creator: clusterCreator,
-			Owner:   meta.Owner,
-			Timeout: meta.Timeout,
-			Nodes:   nodes,
+			ID:         clusterID,
+			Creator:    meta.Hibernation.Creator,
+			Owner:      meta.Owner,
+			Timeout:    meta.Timeout,
+			Nodes:      nodes,
+			Hibernated: true,
+			SharedWith: meta.SharedWith,
+			Team:       meta.Team,
+			Tags:       meta.Tags,
+			Alias:      meta.Alias,
+			Pool:       meta.Pool,
+			Host:       meta.Host,
+			Provider:   ProviderDocker,
+			KeepAlive:  meta.KeepAlive,
+
+			UseHostname: meta.UseHostname,
 		})
 	}
 
 	return clusters, nil
 }
 
-func allocateCluster(ctx context.Context, opts ClusterOptions) (string, error) {
-	log.Printf("Allocating cluster (requested by: %s)", ContextUser(ctx))
+func allocateCluster(ctx context.Context, opts ClusterOptions) (clusterID string, err error) {
+	logInfof(ctx, "Allocating cluster")
+
+	ctx, span := startSpan(ctx, "allocateCluster", attribute.Int("cbdyncluster.node_count", len(opts.Nodes)))
+	startTime := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		clustersAllocatedTotal.WithLabelValues(result).Inc()
+		allocationDurationSeconds.WithLabelValues(result).Observe(time.Since(startTime).Seconds())
+		endSpan(span, err)
+	}()
 
 	if opts.Timeout < 0 {
 		return "", errors.New("must specify a valid timeout for the cluster")
 	}
-	if opts.Timeout > 2*7*24*time.Hour {
-		return "", errors.New("cannot allocate clusters for longer than 2 weeks")
+	if maxTimeout := getRuntimeConfig().MaxClusterTimeout; opts.Timeout > maxTimeout {
+		return "", fmt.Errorf("cannot allocate clusters for longer than %s", maxTimeout)
 	}
 	if len(opts.Nodes) == 0 {
 		return "", errors.New("must specify at least a single node for the cluster")
 	}
-	if len(opts.Nodes) > 10 {
-		return "", errors.New("cannot allocate clusters with more than 10 nodes")
+	provider, err := getClusterProvider(opts.Provider)
+	if err != nil {
+		return "", err
+	}
+	err = validateClusterTags(opts.Tags)
+	if err != nil {
+		return "", err
+	}
+	if opts.Alias != "" {
+		err = validateAlias(opts.Alias)
+		if err != nil {
+			return "", err
+		}
+	}
+	if opts.Team != "" {
+		_, err = getTeam(opts.Team)
+		if err != nil {
+			return "", err
+		}
+		if !ContextIgnoreOwnership(ctx) && !isTeamMember(opts.Team, ContextUser(ctx)) {
+			return "", errors.New("cannot allocate clusters for teams you aren't in")
+		}
 	}
 
-	clusterID := newRandomClusterID()
-	timeoutTime := time.Now().Add(1 * time.Hour) // TODO: use the opts.Timeout
+	// Docker hosts are shared, so clusters on them are kept small, which is
+	// one of the reasons to use another provider.
+	if opts.Provider == "" || opts.Provider == ProviderDocker {
+		err = checkNodesPerCluster(ctx, len(opts.Nodes))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		for _, node := range opts.Nodes {
+			if node.IPv4Address != "" || !node.Overrides.empty() {
+				return "", errors.New("only docker nodes can be given addresses or overrides")
+			}
+		}
+	}
+	for _, node := range opts.Nodes {
+		err = validateNodeOverrides(node.Overrides)
+		if err != nil {
+			return "", err
+		}
+	}
 
-	meta := ClusterMeta{
-		Owner:   ContextUser(ctx),
-		Timeout: timeoutTime,
+	releaseQuota, err := reserveQuota(ctx, len(opts.Nodes))
+	if err != nil {
+		return "", err
 	}
-	err := metaStore.CreateClusterMeta(clusterID, meta)
+	// Once this returns the nodes either exist, and so count towards the usage
+	// of the user, or have been killed.
+	defer releaseQuota()
+
+	clusterID = newRandomClusterID()
+	ctx = ContextWithClusterID(ctx, clusterID)
+	setAuditClusterID(ctx, clusterID)
+	span.SetAttributes(attribute.String("cbdyncluster.cluster_id", clusterID))
+	logInfof(ctx, "Allocated cluster ID for new cluster")
+
+	finishOperation, err := beginOperation(ctx, OperationAllocate, clusterID)
 	if err != nil {
 		return "", err
 	}
+	defer finishOperation()
+
+	clusterTimeout := opts.Timeout
+	if clusterTimeout == 0 {
+		clusterTimeout = getRuntimeConfig().DefaultClusterTimeout
+	}
+	timeoutTime := time.Now().Add(clusterTimeout)
+
+	meta := ClusterMeta{
+		Owner:     ContextUser(ctx),
+		Timeout:   timeoutTime,
+		Team:      opts.Team,
+		Tags:      opts.Tags,
+		Alias:     opts.Alias,
+		Pool:      opts.Pool,
+		Provider:  opts.Provider,
+		KeepAlive: opts.KeepAlive,
+	}
+
+	if opts.Lease != nil {
+		meta.Lease, err = newLeaseMeta(*opts.Lease)
+		if err != nil {
+			return "", err
+		}
+	}
 
 	var nodesToAllocate []NodeOptions
 	for nodeIdx, node := range opts.Nodes {
@@ -177,98 +445,98 @@ func allocateCluster(ctx context.Context, opts ClusterOptions) (string, error) {
 			node.Name = fmt.Sprintf("node_%d", nodeIdx+1)
 		}
 
+		if !node.Overrides.empty() {
+			if meta.NodeOverrides == nil {
+				meta.NodeOverrides = make(map[string]NodeOverrides)
+			}
+			meta.NodeOverrides[node.Name] = node.Overrides
+		}
+
 		nodesToAllocate = append(nodesToAllocate, node)
 	}
 
-	if len(nodesToAllocate) > 0 {
-		// We assume that all nodes are using the same server version.
-		node := nodesToAllocate[0]
-		containerImage := node.VersionInfo.toImageName()
-
-		if dockerRegistry == "" {
-			err = checkBuildExists(fmt.Sprintf("%s/%s", node.VersionInfo.toURL(), node.VersionInfo.toPkgName()))
-			if err != nil {
-				return "", err
-			}
-
-			// If the image is already built then this will won't rebuild
-			log.Printf("Building %s image for cluster %s (requested by: %s)", containerImage, clusterID, ContextUser(ctx))
-			err = imageBuild(ctx, node.VersionInfo, helper.DockerFilePath+"couchbase/centos7") // TODO: might want this to be a config too
-			if err != nil {
-				return "", err
-			}
-		} else {
-			log.Printf("Pulling %s image for cluster %s (requested by: %s)", containerImage, clusterID, ContextUser(ctx))
-			err = imagePull(ctx, containerImage)
-			if err != nil {
-				// assume that pull failed because the image didn't exist on the registry
-				// check the build exists and then build the image
-				err = checkBuildExists(fmt.Sprintf("%s/%s", node.VersionInfo.toURL(), node.VersionInfo.toPkgName()))
-				if err != nil {
-					return "", err
-				}
-
-				log.Printf("Building %s image for cluster %s (requested by: %s)", containerImage, clusterID, ContextUser(ctx))
-				err = imageBuild(ctx, node.VersionInfo, helper.DockerFilePath+"couchbase/centos7") // TODO: might want this to be a config too
-				if err != nil {
-					return "", err
-				}
-
-				log.Printf("Pushing %s image for cluster %s (requested by: %s)", containerImage, clusterID, ContextUser(ctx))
-				err = imagePush(ctx, node.VersionInfo)
-				if err != nil {
-					return "", err
-				}
-			}
+	if opts.Alias != "" {
+		err = claimAlias(opts.Alias, clusterID)
+		if err != nil {
+			return "", err
 		}
 	}
 
-	signal := make(chan error)
-
-	for _, node := range nodesToAllocate {
-		go func(clusterID string, node NodeOptions) {
-			_, err := allocateNode(ctx, clusterID, timeoutTime, node)
-			signal <- err
-		}(clusterID, node)
+	err = metaStore.CreateClusterMeta(clusterID, meta)
+	if err != nil {
+		return "", err
 	}
 
-	var createError error
-	for range nodesToAllocate {
-		err := <-signal
-		if err != nil && createError == nil {
-			createError = err
+	if opts.Provider == "" || opts.Provider == ProviderDocker {
+		err = reserveNodeIPs(ctx, clusterID, nodesToAllocate, opts.ContiguousIPs)
+		if err != nil {
+			killCluster(ctx, clusterID)
+			return "", err
 		}
 	}
-	if createError != nil {
+
+	err = provider.allocateNodes(ctx, clusterID, timeoutTime, nodesToAllocate)
+	if err != nil {
 		killCluster(ctx, clusterID)
-		return "", createError
+		return "", err
 	}
 
+	publishClusterEvent(ctx, newClusterEvent(ctx, ClusterEventAllocated, &Cluster{
+		ID:      clusterID,
+		Owner:   meta.Owner,
+		Team:    meta.Team,
+		Timeout: meta.Timeout,
+	}))
+
 	return clusterID, nil
 }
 
 func refreshCluster(ctx context.Context, clusterID string, newTimeout time.Duration) error {
-	log.Printf("Refreshing cluster %s (requested by: %s)", clusterID, ContextUser(ctx))
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Refreshing cluster")
+
+	if maxTimeout := getRuntimeConfig().MaxClusterTimeout; newTimeout > maxTimeout {
+		return fmt.Errorf("cannot refresh clusters for longer than %s", maxTimeout)
+	}
 
 	// Check the cluster actuall exists
-	_, err := getCluster(ctx, clusterID)
+	cluster, err := getCluster(ctx, clusterID)
 	if err != nil {
 		return err
 	}
 
+	return extendCluster(ctx, cluster, newTimeout)
+}
+
+// extendCluster pushes the timeout of a cluster out to newTimeout from now,
+// unless it already lasts longer than that.
+func extendCluster(ctx context.Context, cluster *Cluster, newTimeout time.Duration) error {
+	clusterID := cluster.ID
+
+	// Creators can still claim clusters which nobody owns, such as those which
+	// lost their meta-data.
+	unclaimed := cluster.Owner == "" || cluster.Owner == DEFAULT_CLUSTER_META.Owner
+	if !canManageCluster(ctx, cluster) && !(unclaimed && cluster.Creator == ContextUser(ctx)) {
+		return errors.New("cannot refresh clusters you don't own")
+	}
+
 	newMeta := ClusterMeta{
 		Owner:   ContextUser(ctx),
 		Timeout: time.Now().Add(newTimeout),
 	}
 
-	_, err = metaStore.GetClusterMeta(clusterID)
+	_, err := metaStore.GetClusterMeta(clusterID)
 	if err != nil {
 		// If we failed to fetch the cluster metadata, just insert some instead
 		return metaStore.CreateClusterMeta(clusterID, newMeta)
 	}
 
 	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
-		meta.Owner = newMeta.Owner
+		// Users the cluster is shared with can keep it alive without taking it
+		// over, that has to be done explicitly by transferring it.
+		if !containsString(meta.SharedWith, newMeta.Owner) && !isTeamMember(meta.Team, newMeta.Owner) {
+			meta.Owner = newMeta.Owner
+		}
 		if meta.Timeout.Before(newMeta.Timeout) {
 			meta.Timeout = newMeta.Timeout
 		}
@@ -276,47 +544,87 @@ func refreshCluster(ctx context.Context, clusterID string, newTimeout time.Durat
 	})
 }
 
-func killCluster(ctx context.Context, clusterID string) error {
-	log.Printf("Killing cluster %s (requested by: %s)", clusterID, ContextUser(ctx))
+func killCluster(ctx context.Context, clusterID string) (err error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Killing cluster")
+
+	ctx, span := startSpan(ctx, "killCluster")
+	defer func() {
+		endSpan(span, err)
+	}()
 
 	cluster, err := getCluster(ctx, clusterID)
 	if err != nil {
 		return err
 	}
 
-	if !ContextIgnoreOwnership(ctx) && cluster.Owner != ContextUser(ctx) {
+	if !canManageCluster(ctx, cluster) {
 		return errors.New("cannot kill clusters you don't own")
 	}
 
-	var nodesToKill []string
-	for _, node := range cluster.Nodes {
-		nodesToKill = append(nodesToKill, node.ContainerID)
+	finishOperation, err := beginOperation(ctx, OperationKill, clusterID)
+	if err != nil {
+		return err
 	}
+	defer finishOperation()
 
-	signal := make(chan error)
+	if cluster.Hibernated {
+		meta, err := metaStore.GetClusterMeta(clusterID)
+		if err != nil {
+			return err
+		}
 
-	for _, nodeID := range nodesToKill {
-		go func(nodeID string) {
-			signal <- killNode(ctx, nodeID)
-		}(nodeID)
+		if objectStore != nil {
+			deleteHibernationArchives(ctx, meta.Hibernation)
+		}
+		err = metaStore.DeleteClusterMeta(clusterID)
+		if err != nil {
+			return err
+		}
+
+		if cluster.Alias != "" {
+			releaseAlias(cluster.Alias, clusterID)
+		}
+		releaseClusterIPs(ctx, clusterID)
+		removeClusterFixtures(ctx, clusterID)
+
+		clustersKilledTotal.Inc()
+		publishClusterEvent(ctx, newClusterEvent(ctx, ClusterEventKilled, cluster))
+		return nil
 	}
 
-	var killError error
-	for range nodesToKill {
-		err := <-signal
-		if err != nil && killError == nil {
-			killError = err
+	provider, err := getClusterProvider(cluster.Provider)
+	if err != nil {
+		return err
+	}
+
+	err = provider.killNodes(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	// Only docker clusters can be found from their nodes, other clusters are
+	// only known about through their meta-data.
+	if cluster.Provider != ProviderDocker {
+		err = metaStore.DeleteClusterMeta(clusterID)
+		if err != nil {
+			return err
 		}
 	}
-	if killError != nil {
-		return killError
+
+	if cluster.Alias != "" {
+		releaseAlias(cluster.Alias, clusterID)
 	}
+	releaseClusterIPs(ctx, clusterID)
+	removeClusterFixtures(ctx, clusterID)
 
+	clustersKilledTotal.Inc()
+	publishClusterEvent(ctx, newClusterEvent(ctx, ClusterEventKilled, cluster))
 	return nil
 }
 
 func killAllClusters(ctx context.Context) error {
-	log.Printf("Killing all clusters")
+	logInfof(ctx, "Killing all clusters")
 
 	var clustersToKill []string
 
@@ -350,3 +658,170 @@ func killAllClusters(ctx context.Context) error {
 
 	return nil
 }
+
+func transferCluster(ctx context.Context, clusterID, newOwner string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Transferring cluster to %s", newOwner)
+
+	if !strings.HasSuffix(newOwner, "@couchbase.com") {
+		return errors.New("new owner must be a @couchbase.com email")
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !isClusterOwner(ctx, cluster) {
+		return errors.New("cannot transfer clusters you don't own")
+	}
+
+	_, err = metaStore.GetClusterMeta(clusterID)
+	if err != nil {
+		meta := DEFAULT_CLUSTER_META
+		meta.Owner = newOwner
+		return metaStore.CreateClusterMeta(clusterID, meta)
+	}
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Owner = newOwner
+
+		// The new owner doesn't need to be on the shared list anymore
+		var sharedWith []string
+		for _, user := range meta.SharedWith {
+			if user != newOwner {
+				sharedWith = append(sharedWith, user)
+			}
+		}
+		meta.SharedWith = sharedWith
+
+		return meta, nil
+	})
+}
+
+func shareCluster(ctx context.Context, clusterID string, users []string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Sharing cluster with %v", users)
+
+	var sharedWith []string
+	for _, user := range users {
+		if !strings.HasSuffix(user, "@couchbase.com") {
+			return fmt.Errorf("%s must be a @couchbase.com email", user)
+		}
+		if !containsString(sharedWith, user) {
+			sharedWith = append(sharedWith, user)
+		}
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !isClusterOwner(ctx, cluster) {
+		return errors.New("cannot share clusters you don't own")
+	}
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.SharedWith = sharedWith
+		return meta, nil
+	})
+}
+
+// setClusterTeam hands a cluster over to a team, or takes it back from its
+// team if teamName is empty.
+func setClusterTeam(ctx context.Context, clusterID, teamName string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Assigning cluster to team %s", teamName)
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !isClusterOwner(ctx, cluster) {
+		return errors.New("cannot change the team of clusters you don't own")
+	}
+
+	if teamName != "" {
+		_, err = getTeam(teamName)
+		if err != nil {
+			return err
+		}
+		if !ContextIgnoreOwnership(ctx) && !isTeamMember(teamName, ContextUser(ctx)) {
+			return errors.New("cannot assign clusters to teams you aren't in")
+		}
+	}
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Team = teamName
+		return meta, nil
+	})
+}
+
+func setClusterTags(ctx context.Context, clusterID string, tags map[string]string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Setting cluster tags")
+
+	err := validateClusterTags(tags)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !canManageCluster(ctx, cluster) {
+		return errors.New("cannot tag clusters you don't own")
+	}
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Tags = tags
+		return meta, nil
+	})
+}
+
+type RefreshAllResult struct {
+	Refreshed []string
+	Failed    map[string]error
+}
+
+// refreshAllClusters refreshes every cluster owned by the user in ctx, either
+// directly or through one of their teams.
+func refreshAllClusters(ctx context.Context, newTimeout time.Duration) (*RefreshAllResult, error) {
+	logInfof(ctx, "Refreshing all clusters")
+
+	if maxTimeout := getRuntimeConfig().MaxClusterTimeout; newTimeout > maxTimeout {
+		return nil, fmt.Errorf("cannot refresh clusters for longer than %s", maxTimeout)
+	}
+
+	// Only ever refresh the clusters the user owns, even for admins who can
+	// see everybody's clusters.
+	user := ContextUser(ctx)
+	ownerCtx := NewContext(ctx, user, false)
+
+	clusters, err := getAllClusters(ownerCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RefreshAllResult{
+		Failed: make(map[string]error),
+	}
+	for _, cluster := range clusters {
+		if cluster.Owner != user && !isTeamMember(cluster.Team, user) {
+			continue
+		}
+
+		err := extendCluster(ContextWithClusterID(ownerCtx, cluster.ID), cluster, newTimeout)
+		if err != nil {
+			result.Failed[cluster.ID] = err
+			continue
+		}
+		result.Refreshed = append(result.Refreshed, cluster.ID)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,267 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var collectInfoDir = "./collectinfo"
+
+// collectInfoRetention is how long collected logs are kept around after they
+// were collected, they are expected to outlive the clusters they came from.
+var collectInfoRetention = 24 * time.Hour
+
+const (
+	CollectInfoRunning   = "running"
+	CollectInfoCompleted = "completed"
+	CollectInfoFailed    = "failed"
+)
+
+type CollectInfoNode struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type CollectInfo struct {
+	ID        string            `json:"id"`
+	ClusterID string            `json:"cluster_id"`
+	Owner     string            `json:"owner"`
+	Requester string            `json:"requester"`
+	StartedAt time.Time         `json:"started_at"`
+	Nodes     []CollectInfoNode `json:"nodes"`
+}
+
+// collectInfoLock serializes updates to collection records, since every node
+// of a collection updates the same record as it finishes.
+var collectInfoLock sync.Mutex
+
+func collectInfoKey(collectionID string) string {
+	return fmt.Sprintf("collectinfo-%s", collectionID)
+}
+
+func collectInfoPath(collectionID, nodeName string) string {
+	return filepath.Join(collectInfoDir, collectionID, nodeName+".zip")
+}
+
+func updateCollectInfoNode(collectionID, nodeName, status string, nodeErr error) {
+	collectInfoLock.Lock()
+	defer collectInfoLock.Unlock()
+
+	var collection CollectInfo
+	err := metaStore.getRecord(collectInfoKey(collectionID), &collection)
+	if err != nil {
+		logErrorf(context.Background(), "Failed to load collection %s: %s", collectionID, err)
+		return
+	}
+
+	for i := range collection.Nodes {
+		if collection.Nodes[i].Name == nodeName {
+			collection.Nodes[i].Status = status
+			if nodeErr != nil {
+				collection.Nodes[i].Error = nodeErr.Error()
+			}
+		}
+	}
+
+	err = metaStore.setRecord(collectInfoKey(collectionID), collection)
+	if err != nil {
+		logErrorf(context.Background(), "Failed to update collection %s: %s", collectionID, err)
+	}
+}
+
+func startCollectInfo(ctx context.Context, clusterID string) (*CollectInfo, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Starting cbcollect_info")
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cluster.Hibernated {
+		return nil, errors.New("cannot collect logs from a hibernated cluster")
+	}
+
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	collectionID, _ := uuid.NewRandom()
+	collection := &CollectInfo{
+		ID:        collectionID.String()[0:8],
+		ClusterID: clusterID,
+		Owner:     cluster.Owner,
+		Requester: ContextUser(ctx),
+		StartedAt: time.Now(),
+	}
+	for _, node := range cluster.Nodes {
+		collection.Nodes = append(collection.Nodes, CollectInfoNode{
+			Name:   node.Name,
+			Status: CollectInfoRunning,
+		})
+	}
+
+	err = os.MkdirAll(filepath.Join(collectInfoDir, collection.ID), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = metaStore.setRecord(collectInfoKey(collection.ID), collection)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collection takes minutes, so it must outlive the request that started it.
+	collectCtx := NewContext(context.Background(), ContextUser(ctx), ContextIgnoreOwnership(ctx))
+	collectCtx = ContextWithRequestID(collectCtx, ContextRequestID(ctx))
+	collectCtx = ContextWithClusterID(collectCtx, clusterID)
+	for _, node := range cluster.Nodes {
+		go func(node *Node) {
+			nodeCtx := ContextWithNode(collectCtx, node.Name)
+			err := collectNodeInfo(nodeCtx, collection.ID, node)
+			if err != nil {
+				logErrorf(nodeCtx, "Failed to collect info: %s", err)
+				updateCollectInfoNode(collection.ID, node.Name, CollectInfoFailed, err)
+				return
+			}
+
+			updateCollectInfoNode(collection.ID, node.Name, CollectInfoCompleted, nil)
+		}(node)
+	}
+
+	return collection, nil
+}
+
+func collectNodeInfo(ctx context.Context, collectionID string, node *Node) error {
+	remotePath := fmt.Sprintf("/tmp/cbcollect-%s.zip", collectionID)
+
+	var output bytes.Buffer
+	exitCode, err := execStream(ctx, node.ContainerID, []string{"/opt/couchbase/bin/cbcollect_info", remotePath}, &output, &output)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return errors.Errorf("cbcollect_info exited with %d: %s", exitCode, output.String())
+	}
+
+	localFile, err := os.Create(collectInfoPath(collectionID, node.Name))
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	err = copyFileFromContainer(ctx, node.ContainerID, remotePath, localFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = execStream(ctx, node.ContainerID, []string{"rm", "-f", remotePath}, &output, &output)
+	if err != nil {
+		logWarnf(ctx, "Failed to remove %s: %s", remotePath, err)
+	}
+
+	return nil
+}
+
+// copyFileFromContainer copies a single file out of a container.
+func copyFileFromContainer(ctx context.Context, containerID, srcPath string, dest io.Writer) error {
+	content, _, err := dockerFor(containerID).CopyFromContainer(ctx, containerID, srcPath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	tarReader := tar.NewReader(content)
+	_, err = tarReader.Next()
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s from container", srcPath)
+	}
+
+	_, err = io.Copy(dest, tarReader)
+	return err
+}
+
+func getCollectInfo(ctx context.Context, collectionID string) (*CollectInfo, error) {
+	var collection CollectInfo
+	err := metaStore.getRecord(collectInfoKey(collectionID), &collection)
+	if err != nil {
+		return nil, errors.New("collection not found")
+	}
+
+	if !ContextIgnoreOwnership(ctx) && collection.Requester != ContextUser(ctx) && collection.Owner != ContextUser(ctx) {
+		return nil, errors.New("collection not found")
+	}
+
+	return &collection, nil
+}
+
+// openCollectInfoFile opens the collected zip file of a single node, the
+// caller is responsible for closing it.
+func openCollectInfoFile(ctx context.Context, collectionID, nodeName string) (*os.File, error) {
+	collection, err := getCollectInfo(ctx, collectionID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range collection.Nodes {
+		if node.Name != nodeName {
+			continue
+		}
+
+		if node.Status != CollectInfoCompleted {
+			return nil, fmt.Errorf("collection for node %s is %s", nodeName, node.Status)
+		}
+
+		return os.Open(collectInfoPath(collection.ID, node.Name))
+	}
+
+	return nil, errors.New("node not found")
+}
+
+func cleanupCollectInfo() error {
+	var expired []string
+	err := metaStore.forEachRecord("collectinfo-", func(key string, recordBytes []byte) error {
+		var collection CollectInfo
+		err := json.Unmarshal(recordBytes, &collection)
+		if err != nil {
+			return err
+		}
+
+		if collection.StartedAt.Add(collectInfoRetention).Before(time.Now()) {
+			expired = append(expired, collection.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, collectionID := range expired {
+		logInfof(systemCtx, "Removing expired collection %s", collectionID)
+
+		err = os.RemoveAll(filepath.Join(collectInfoDir, collectionID))
+		if err != nil {
+			return err
+		}
+
+		err = metaStore.deleteRecord(collectInfoKey(collectionID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
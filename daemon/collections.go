@@ -0,0 +1,152 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/pkg/errors"
+)
+
+// collectionsWaitTimeout bounds how long we wait for new scopes and
+// collections to be visible on every node.
+const collectionsWaitTimeout = 2 * time.Minute
+
+type AddCollectionsOptions struct {
+	Conf AddCollectionsJSON
+}
+
+func validateCollectionScopes(scopes []CollectionScopeJSON) error {
+	scopeNames := make(map[string]bool)
+	for _, scope := range scopes {
+		if scope.Name == "" {
+			return errors.New("scopes must have a name")
+		}
+		if scopeNames[scope.Name] {
+			return errors.Errorf("scope %s is specified more than once", scope.Name)
+		}
+		scopeNames[scope.Name] = true
+
+		collectionNames := make(map[string]bool)
+		for _, collection := range scope.Collections {
+			if collection.Name == "" {
+				return errors.Errorf("collections of scope %s must have a name", scope.Name)
+			}
+			if collectionNames[collection.Name] {
+				return errors.Errorf("collection %s is specified more than once in scope %s", collection.Name, scope.Name)
+			}
+			if collection.MaxTTL < 0 {
+				return errors.Errorf("collection %s cannot have a negative max ttl", collection.Name)
+			}
+			collectionNames[collection.Name] = true
+		}
+	}
+
+	return nil
+}
+
+// addCollections creates the scopes and collections of a bucket which don't
+// already exist.
+func addCollections(ctx context.Context, clusterID string, opts AddCollectionsOptions) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	if opts.Conf.Bucket == "" {
+		return errors.New("must specify a bucket")
+	}
+	err := validateCollectionScopes(opts.Conf.Scopes)
+	if err != nil {
+		return err
+	}
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if c.Provider == ProviderCapella {
+		return errors.New("collections cannot be added to capella clusters")
+	}
+	if len(c.Nodes) == 0 {
+		return errors.New("no nodes available")
+	}
+
+	err = createCollections(ctx, restNodeOf(c.Nodes[0]), opts.Conf.Bucket, opts.Conf.Scopes)
+	if err != nil {
+		return err
+	}
+
+	if !opts.Conf.Wait {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, collectionsWaitTimeout)
+	defer cancel()
+	return waitForCollections(waitCtx, c.Nodes, opts.Conf.Bucket, opts.Conf.Scopes)
+}
+
+func createCollections(ctx context.Context, node *cluster.Node, bucket string, scopes []CollectionScopeJSON) error {
+	manifest, err := node.GetCollectionManifest(bucket)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the collections of bucket %s", bucket)
+	}
+
+	for _, scope := range scopes {
+		if !manifest.HasCollection(scope.Name, "") {
+			logInfof(ctx, "Creating scope %s.%s", bucket, scope.Name)
+			err := node.CreateScope(bucket, scope.Name)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create scope %s", scope.Name)
+			}
+		}
+
+		for _, collection := range scope.Collections {
+			if manifest.HasCollection(scope.Name, collection.Name) {
+				continue
+			}
+
+			logInfof(ctx, "Creating collection %s.%s.%s", bucket, scope.Name, collection.Name)
+			err := node.CreateCollection(bucket, scope.Name, collection.Name, collection.MaxTTL)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create collection %s.%s", scope.Name, collection.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// waitForCollections waits until every node reports every scope and
+// collection, since they are created asynchronously across the cluster.
+func waitForCollections(ctx context.Context, nodes []*Node, bucket string, scopes []CollectionScopeJSON) error {
+	for _, node := range nodes {
+		restNode := restNodeOf(node)
+
+		for {
+			manifest, err := restNode.GetCollectionManifest(bucket)
+			if err == nil && manifestHasScopes(manifest, scopes) {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return errors.Wrapf(ctx.Err(), "collections of bucket %s were not visible on node %s", bucket, node.Name)
+			case <-time.After(time.Second):
+			}
+		}
+	}
+
+	return nil
+}
+
+func manifestHasScopes(manifest *cluster.CollectionManifest, scopes []CollectionScopeJSON) bool {
+	for _, scope := range scopes {
+		if !manifest.HasCollection(scope.Name, "") {
+			return false
+		}
+		for _, collection := range scope.Collections {
+			if !manifest.HasCollection(scope.Name, collection.Name) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package daemon
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Settings can be given as flags, in the config file, or as environment
+// variables named after the flag with this prefix (i.e. the docker-registry
+// setting can be given as CBDYNCLUSTERD_DOCKER_REGISTRY).
+const configEnvPrefix = "CBDYNCLUSTERD"
+
+// RuntimeConfig holds the settings which can be changed while the daemon is
+// running, by editing the config file and sending the daemon SIGHUP.  Every
+// other setting is only read at startup.
+type RuntimeConfig struct {
+	// MaxClusterTimeout is the longest that a cluster can be allocated or
+	// refreshed for in one go.
+	MaxClusterTimeout time.Duration
+	// DefaultClusterTimeout is used for clusters allocated without a timeout.
+	DefaultClusterTimeout time.Duration
+	// DefaultReadyTimeout is how long allocations wait for clusters to be
+	// ready, when they are asked to wait without a timeout.
+	DefaultReadyTimeout time.Duration
+	// HibernationRetention is how long hibernated clusters are kept before
+	// they are reaped along with their archives.
+	HibernationRetention time.Duration
+	// DefaultQuota applies to every user who hasn't been given their own
+	// quota.
+	DefaultQuota Quota
+	// DockerRegistry is where images are pulled from, if empty images are
+	// built on the docker hosts instead.
+	DockerRegistry string
+	// ContainerAllowlist is which security settings of nodes users can
+	// loosen when allocating them.
+	ContainerAllowlist ContainerAllowlist
+}
+
+type ContainerAllowlist struct {
+	Ulimits      []string
+	Sysctls      []string
+	Capabilities []string
+	Privileged   bool
+}
+
+var defaultRuntimeConfig = RuntimeConfig{
+	MaxClusterTimeout:     2 * 7 * 24 * time.Hour,
+	DefaultClusterTimeout: 1 * time.Hour,
+	DefaultReadyTimeout:   5 * time.Minute,
+	HibernationRetention:  30 * 24 * time.Hour,
+	DefaultQuota: Quota{
+		MaxClusters:        0,
+		MaxNodes:           0,
+		MaxNodesPerCluster: 10,
+	},
+	DockerRegistry: "dockerhub.build.couchbase.com",
+	ContainerAllowlist: ContainerAllowlist{
+		Ulimits: []string{"core", "memlock", "nofile", "nproc"},
+	},
+}
+
+var runtimeConfig atomic.Value
+
+// configFlags are the flags of the daemon command, which override every other
+// source of settings.
+var configFlags *pflag.FlagSet
+
+// configLoadedAt is when the config was last read, for reporting.
+var configLoadedAt time.Time
+var configLoadedAtLock sync.Mutex
+
+// secretSettings are never reported by the config endpoint.
+var secretSettings = map[string]bool{
+	"admin-token":          true,
+	"s3-access-key":        true,
+	"s3-secret-key":        true,
+	"ec2-access-key":       true,
+	"ec2-secret-key":       true,
+	"capella-api-key":      true,
+	"capella-password-key": true,
+	// Postgres connection strings can have a password in them.
+	"meta-store-source": true,
+}
+
+func getRuntimeConfig() *RuntimeConfig {
+	config, ok := runtimeConfig.Load().(*RuntimeConfig)
+	if !ok {
+		return &defaultRuntimeConfig
+	}
+	return config
+}
+
+func setupConfigEnv() {
+	viper.SetEnvPrefix(configEnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+}
+
+// configString returns the value of a setting, preferring flags given on the
+// command line to the environment and config file.
+func configString(arg string) string {
+	if configFlags.Changed(arg) {
+		val, _ := configFlags.GetString(arg)
+		return val
+	}
+	return viper.GetString(arg)
+}
+
+func configInt32(arg string) int32 {
+	// Fall back to the flag default for settings missing from the config,
+	// rather than to zero which may mean something different.
+	if configFlags.Changed(arg) || !viper.IsSet(arg) {
+		val, _ := configFlags.GetInt32(arg)
+		return val
+	}
+	return viper.GetInt32(arg)
+}
+
+func configBool(arg string) bool {
+	if configFlags.Changed(arg) || !viper.IsSet(arg) {
+		val, _ := configFlags.GetBool(arg)
+		return val
+	}
+	return viper.GetBool(arg)
+}
+
+// configList splits a comma separated setting, such as allowed-ulimits.
+func configList(arg string) []string {
+	var list []string
+	for _, item := range strings.Split(configString(arg), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func readRuntimeConfig() (*RuntimeConfig, error) {
+	config := &RuntimeConfig{
+		MaxClusterTimeout:     time.Duration(configInt32("max-cluster-timeout")) * time.Hour,
+		DefaultClusterTimeout: time.Duration(configInt32("default-cluster-timeout")) * time.Minute,
+		DefaultReadyTimeout:   time.Duration(configInt32("ready-timeout")) * time.Second,
+		HibernationRetention:  time.Duration(configInt32("hibernation-retention")) * time.Hour,
+		DefaultQuota: Quota{
+			MaxClusters:        int(configInt32("quota-max-clusters")),
+			MaxNodes:           int(configInt32("quota-max-nodes")),
+			MaxNodesPerCluster: int(configInt32("quota-max-nodes-per-cluster")),
+		},
+		DockerRegistry: configString("docker-registry"),
+		ContainerAllowlist: ContainerAllowlist{
+			Ulimits:      configList("allowed-ulimits"),
+			Sysctls:      configList("allowed-sysctls"),
+			Capabilities: configList("allowed-capabilities"),
+			Privileged:   configBool("allow-privileged"),
+		},
+	}
+	for i, capability := range config.ContainerAllowlist.Capabilities {
+		config.ContainerAllowlist.Capabilities[i] = strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+	}
+
+	if config.MaxClusterTimeout <= 0 {
+		return nil, errors.New("max-cluster-timeout must be positive")
+	}
+	if config.DefaultClusterTimeout <= 0 || config.DefaultClusterTimeout > config.MaxClusterTimeout {
+		return nil, errors.New("default-cluster-timeout must be positive and no longer than max-cluster-timeout")
+	}
+	if config.DefaultReadyTimeout <= 0 {
+		return nil, errors.New("ready-timeout must be positive")
+	}
+	if config.HibernationRetention <= 0 {
+		return nil, errors.New("hibernation-retention must be positive")
+	}
+	quota := config.DefaultQuota
+	if quota.MaxClusters < 0 || quota.MaxNodes < 0 || quota.MaxNodesPerCluster < 0 {
+		return nil, errors.New("quota limits cannot be negative")
+	}
+
+	return config, nil
+}
+
+func storeRuntimeConfig(config *RuntimeConfig) {
+	runtimeConfig.Store(config)
+
+	configLoadedAtLock.Lock()
+	configLoadedAt = time.Now()
+	configLoadedAtLock.Unlock()
+}
+
+// reloadConfig rereads the config file and applies any runtime settings which
+// have changed.  Invalid config is rejected as a whole, leaving the current
+// config in place.
+func reloadConfig() error {
+	err := viper.ReadInConfig()
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+
+	config, err := readRuntimeConfig()
+	if err != nil {
+		return err
+	}
+
+	storeRuntimeConfig(config)
+	return nil
+}
+
+// watchConfigReloads reloads the config whenever the daemon is sent SIGHUP.
+func watchConfigReloads(shutdownSig chan struct{}) {
+	reloadSig := make(chan os.Signal, 1)
+	signal.Notify(reloadSig, syscall.SIGHUP)
+	defer signal.Stop(reloadSig)
+
+	for {
+		select {
+		case <-reloadSig:
+			logInfof(systemCtx, "Reloading config")
+			err := reloadConfig()
+			if err != nil {
+				logErrorf(systemCtx, "Failed to reload config, keeping the current config: %s", err)
+				continue
+			}
+
+			config := getRuntimeConfig()
+			logInfof(systemCtx, "Reloaded config: max cluster timeout %s, default cluster timeout %s, ready timeout %s, default quota %+v, docker registry %q",
+				config.MaxClusterTimeout, config.DefaultClusterTimeout, config.DefaultReadyTimeout, config.DefaultQuota, config.DockerRegistry)
+		case <-shutdownSig:
+			return
+		}
+	}
+}
+
+// startupSettings is the value of every setting as the daemon read it when
+// it started, with secrets hidden.
+var startupSettings map[string]string
+
+func readStartupSettings() map[string]string {
+	settings := make(map[string]string)
+	configFlags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Deprecated != "" || flag.Name == "config" {
+			return
+		}
+
+		value := flag.DefValue
+		if flag.Changed {
+			value = flag.Value.String()
+		} else if viper.IsSet(flag.Name) {
+			value = viper.GetString(flag.Name)
+		}
+
+		if secretSettings[flag.Name] && value != "" {
+			value = "<redacted>"
+		}
+		settings[flag.Name] = value
+	})
+
+	return settings
+}
+
+// effectiveSettings returns the value of every setting which the daemon is
+// currently using.
+func effectiveSettings() map[string]string {
+	config := getRuntimeConfig()
+
+	settings := make(map[string]string)
+	for name, value := range startupSettings {
+		settings[name] = value
+	}
+	settings["max-cluster-timeout"] = strconv.Itoa(int(config.MaxClusterTimeout / time.Hour))
+	settings["default-cluster-timeout"] = strconv.Itoa(int(config.DefaultClusterTimeout / time.Minute))
+	settings["ready-timeout"] = strconv.Itoa(int(config.DefaultReadyTimeout / time.Second))
+	settings["hibernation-retention"] = strconv.Itoa(int(config.HibernationRetention / time.Hour))
+	settings["quota-max-clusters"] = strconv.Itoa(config.DefaultQuota.MaxClusters)
+	settings["quota-max-nodes"] = strconv.Itoa(config.DefaultQuota.MaxNodes)
+	settings["quota-max-nodes-per-cluster"] = strconv.Itoa(config.DefaultQuota.MaxNodesPerCluster)
+	settings["docker-registry"] = config.DockerRegistry
+	settings["allowed-ulimits"] = strings.Join(config.ContainerAllowlist.Ulimits, ",")
+	settings["allowed-sysctls"] = strings.Join(config.ContainerAllowlist.Sysctls, ",")
+	settings["allowed-capabilities"] = strings.Join(config.ContainerAllowlist.Capabilities, ",")
+	settings["allow-privileged"] = strconv.FormatBool(config.ContainerAllowlist.Privileged)
+
+	return settings
+}
+
+// runtimeSettings are the settings which are applied by reloadConfig.
+var runtimeSettings = []string{
+	"allow-privileged",
+	"allowed-capabilities",
+	"allowed-sysctls",
+	"allowed-ulimits",
+	"default-cluster-timeout",
+	"docker-registry",
+	"hibernation-retention",
+	"max-cluster-timeout",
+	"quota-max-clusters",
+	"quota-max-nodes",
+	"quota-max-nodes-per-cluster",
+	"ready-timeout",
+}
+
+func getConfigLoadedAt() time.Time {
+	configLoadedAtLock.Lock()
+	defer configLoadedAtLock.Unlock()
+	return configLoadedAt
+}
@@ -29,3 +29,61 @@ func ContextIgnoreOwnership(ctx context.Context) bool {
 	}
 	return false
 }
+
+const (
+	ContextKeyRequestID = cbdcContextKey("request_id")
+	ContextKeyClusterID = cbdcContextKey("cluster_id")
+	ContextKeyNode      = cbdcContextKey("node")
+)
+
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, ContextKeyRequestID, requestID)
+}
+
+func ContextRequestID(ctx context.Context) string {
+	if requestID, ok := ctx.Value(ContextKeyRequestID).(string); ok {
+		return requestID
+	}
+	return ""
+}
+
+func ContextWithClusterID(ctx context.Context, clusterID string) context.Context {
+	return context.WithValue(ctx, ContextKeyClusterID, clusterID)
+}
+
+func ContextClusterID(ctx context.Context) string {
+	if clusterID, ok := ctx.Value(ContextKeyClusterID).(string); ok {
+		return clusterID
+	}
+	return ""
+}
+
+func ContextWithNode(ctx context.Context, node string) context.Context {
+	return context.WithValue(ctx, ContextKeyNode, node)
+}
+
+func ContextNode(ctx context.Context) string {
+	if node, ok := ctx.Value(ContextKeyNode).(string); ok {
+		return node
+	}
+	return ""
+}
+
+const ContextKeyRole = cbdcContextKey("role")
+
+func ContextWithRole(ctx context.Context, role Role) context.Context {
+	return context.WithValue(ctx, ContextKeyRole, role)
+}
+
+func ContextRole(ctx context.Context) Role {
+	if role, ok := ctx.Value(ContextKeyRole).(Role); ok {
+		return role
+	}
+	return RoleUser
+}
+
+// ContextIsAdmin reports whether the authenticated user is an admin, admins
+// still have to explicitly ask to ignore ownership of clusters.
+func ContextIsAdmin(ctx context.Context) bool {
+	return ContextRole(ctx) == RoleAdmin
+}
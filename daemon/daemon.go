@@ -2,10 +2,12 @@ package daemon
 
 import (
 	"context"
-	"log"
+	"encoding/hex"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	goflag "flag"
@@ -13,6 +15,7 @@ import (
 	"io/ioutil"
 	"path"
 
+	"github.com/couchbaselabs/cbdynclusterd/aws"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/mitchellh/go-homedir"
@@ -20,21 +23,54 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
 )
 
 var defaultCfgFileName = ".cbdynclusterd.toml"
 
 var docker *client.Client
 var metaStore *MetaDataStore
+var objectStore *aws.S3Client
 var systemCtx context.Context
 
-var dockerRegistry = "dockerhub.build.couchbase.com"
 var dockerHost = "/var/run/docker.sock"
 var dnsSvcHost = ""
+var s3Endpoint, s3Region, s3Bucket, s3AccessKey, s3SecretKey string
+var otlpEndpoint = ""
+var grpcAddress = ":19924"
+var adminToken = ""
 
 var cfgFileFlag string
 var dockerRegistryFlag, dockerHostFlag, dnsSvcHostFlag string
+var s3EndpointFlag, s3RegionFlag, s3BucketFlag, s3AccessKeyFlag, s3SecretKeyFlag string
+var ec2EndpointFlag, ec2RegionFlag, ec2AccessKeyFlag, ec2SecretKeyFlag string
+var ec2AMIFlag, ec2InstanceTypeFlag, ec2SubnetIDFlag, ec2SecurityGroupsFlag, ec2KeyNameFlag string
+var capellaEndpointFlag, capellaOrganizationFlag, capellaAPIKeyFlag, capellaProjectFlag string
+var capellaAllowedCIDRFlag, capellaCloudFlag, capellaRegionFlag string
+var capellaCPUFlag, capellaRAMFlag int32
+var capellaPasswordKeyFlag string
+var otlpEndpointFlag, adminTokenFlag string
+var grpcAddressFlag string
+var loaderImageFlag, backupVolumeFlag string
+var metaStoreFlag, metaStoreSourceFlag string
+var publicURLFlag, smtpHostFlag, smtpFromFlag string
+var warmPoolFlag, orphanPolicyFlag string
+var ipRangesFlag string
+var dockerHostsFlag, dockerHostsSRVFlag string
+var expiryWarningFlag int32
+var keepAliveMinTrafficFlag int32
 var dockerPortFlag int32
+var dockerConcurrencyFlag, nodeAllocationConcurrencyFlag int32
+var rateLimitFlag, rateLimitBurstFlag int32
+var shutdownTimeoutFlag int32
+var quotaMaxClustersFlag, quotaMaxNodesFlag, quotaMaxNodesPerClusterFlag int32
+var maxClusterTimeoutFlag, defaultClusterTimeoutFlag int32
+var readyTimeoutFlag int32
+var hibernationRetentionFlag int32
+var allowedUlimitsFlag, allowedSysctlsFlag, allowedCapabilitiesFlag string
+var allowPrivilegedFlag bool
+var dockerNetworkFlag string
 
 var rootCmd = &cobra.Command{
 	Use:   "cbdynclusterd",
@@ -58,10 +94,70 @@ func init() {
 
 	pflag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	goflag.CommandLine.Parse([]string{})
+	configFlags = rootCmd.PersistentFlags()
 	rootCmd.PersistentFlags().StringVar(&cfgFileFlag, "config", "", "config file (default is $HOME/"+defaultCfgFileName+")")
-	rootCmd.PersistentFlags().StringVar(&dockerRegistryFlag, "docker-registry", dockerRegistry, "docker registry to pull/push images")
+	rootCmd.PersistentFlags().StringVar(&dockerRegistryFlag, "docker-registry", defaultRuntimeConfig.DockerRegistry, "docker registry to pull/push images")
+	rootCmd.PersistentFlags().StringVar(&dockerNetworkFlag, "docker-network", NetworkName, "docker network to attach nodes to, nodes must be reachable on it")
 	rootCmd.PersistentFlags().StringVar(&dockerHostFlag, "docker-host", dockerHost, "docker host where containers are running (i.e. tcp://127.0.0.1:2376)")
+	rootCmd.PersistentFlags().StringVar(&dockerHostsFlag, "docker-hosts", dockerHostsConfig, "additional docker hosts to spread clusters over (i.e. host2=tcp://10.0.0.2:2376,host3=tcp://10.0.0.3:2376)")
+	rootCmd.PersistentFlags().StringVar(&dockerHostsSRVFlag, "docker-hosts-srv", dockerHostsSRV, "DNS SRV record to discover additional docker hosts from")
 	rootCmd.PersistentFlags().StringVar(&dnsSvcHostFlag, "dns-host", dnsSvcHost, "Restful DNS server IP")
+	rootCmd.PersistentFlags().StringVar(&s3EndpointFlag, "s3-endpoint", s3Endpoint, "S3 compatible endpoint used to store hibernated clusters (default is AWS)")
+	rootCmd.PersistentFlags().StringVar(&s3RegionFlag, "s3-region", s3Region, "S3 region used to store hibernated clusters")
+	rootCmd.PersistentFlags().StringVar(&s3BucketFlag, "s3-bucket", s3Bucket, "S3 bucket used to store hibernated clusters, hibernation is disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&s3AccessKeyFlag, "s3-access-key", s3AccessKey, "S3 access key, the default AWS credential chain (such as an instance profile) is used if empty")
+	rootCmd.PersistentFlags().StringVar(&s3SecretKeyFlag, "s3-secret-key", s3SecretKey, "S3 secret key")
+	rootCmd.PersistentFlags().StringVar(&ec2EndpointFlag, "ec2-endpoint", ec2Endpoint, "EC2 endpoint used to run clusters on instances (default is AWS)")
+	rootCmd.PersistentFlags().StringVar(&ec2RegionFlag, "ec2-region", ec2Region, "EC2 region used to run clusters on instances")
+	rootCmd.PersistentFlags().StringVar(&ec2AccessKeyFlag, "ec2-access-key", ec2AccessKey, "EC2 access key, the default AWS credential chain (such as an instance profile) is used if empty")
+	rootCmd.PersistentFlags().StringVar(&ec2SecretKeyFlag, "ec2-secret-key", ec2SecretKey, "EC2 secret key")
+	rootCmd.PersistentFlags().StringVar(&ec2AMIFlag, "ec2-ami", ec2AMI, "AMI prepared for couchbase server to launch instances from, the ec2 provider is disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&ec2InstanceTypeFlag, "ec2-instance-type", ec2InstanceType, "EC2 instance type to launch")
+	rootCmd.PersistentFlags().StringVar(&ec2SubnetIDFlag, "ec2-subnet", ec2SubnetID, "EC2 subnet to launch instances into")
+	rootCmd.PersistentFlags().StringVar(&ec2SecurityGroupsFlag, "ec2-security-groups", ec2SecurityGroups, "Comma separated EC2 security groups to give instances")
+	rootCmd.PersistentFlags().StringVar(&ec2KeyNameFlag, "ec2-key-name", ec2KeyName, "EC2 key pair to give instances")
+	rootCmd.PersistentFlags().StringVar(&capellaEndpointFlag, "capella-endpoint", capellaEndpoint, "Capella management API endpoint (default is Couchbase Cloud)")
+	rootCmd.PersistentFlags().StringVar(&capellaOrganizationFlag, "capella-organization", capellaOrganization, "Capella organization used to run clusters, the capella provider is disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&capellaAPIKeyFlag, "capella-api-key", capellaAPIKey, "Capella API key")
+	rootCmd.PersistentFlags().StringVar(&capellaProjectFlag, "capella-project", capellaProject, "Capella project to create clusters in (default is a project named cbdyncluster)")
+	rootCmd.PersistentFlags().StringVar(&capellaAllowedCIDRFlag, "capella-allowed-cidr", capellaAllowedCIDR, "Addresses which are allowed to connect to Capella clusters")
+	rootCmd.PersistentFlags().StringVar(&capellaCloudFlag, "capella-cloud", capellaCloud, "Cloud provider which Capella clusters are deployed to: aws, gcp or azure")
+	rootCmd.PersistentFlags().StringVar(&capellaRegionFlag, "capella-region", capellaRegion, "Region which Capella clusters are deployed to")
+	rootCmd.PersistentFlags().Int32Var(&capellaCPUFlag, "capella-cpu", int32(capellaCPU), "CPUs of each Capella node")
+	rootCmd.PersistentFlags().Int32Var(&capellaRAMFlag, "capella-ram", int32(capellaRAM), "GB of memory of each Capella node")
+	rootCmd.PersistentFlags().StringVar(&capellaPasswordKeyFlag, "capella-password-key", "", "Hex encoded 32 byte key which the passwords of Capella clusters are encrypted with, required by the capella provider (i.e. the output of openssl rand -hex 32)")
+	rootCmd.PersistentFlags().StringVar(&metaStoreFlag, "meta-store", MetaStoreBadger, "Where meta-data is stored: badger, sqlite or postgres, which several daemons can share")
+	rootCmd.PersistentFlags().StringVar(&metaStoreSourceFlag, "meta-store-source", "", "Directory of the badger store (default ./data), file of the sqlite store (default ./data.sqlite) or postgres connection string")
+	rootCmd.PersistentFlags().StringVar(&loaderImageFlag, "loader-image", loaderImage, "Image with cbc-pillowfight which data is loaded into clusters from")
+	rootCmd.PersistentFlags().StringVar(&backupVolumeFlag, "backup-volume", backupVolume, "Docker volume which cbbackupmgr archives are kept in on each docker host")
+	rootCmd.PersistentFlags().StringVar(&otlpEndpointFlag, "otlp-endpoint", otlpEndpoint, "OTLP/HTTP collector to export traces to (i.e. http://127.0.0.1:4318), tracing is disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&adminTokenFlag, "admin-token", adminToken, "Bootstrap API token with admin privileges, used to issue tokens to users")
+	rootCmd.PersistentFlags().StringVar(&grpcAddressFlag, "grpc-address", grpcAddress, "Address to serve the gRPC API on, the gRPC API is disabled if empty")
+
+	rootCmd.PersistentFlags().StringVar(&publicURLFlag, "public-url", publicURL, "URL users reach the daemon on, used for links in notifications (i.e. http://cbdyncluster.example.com:19923)")
+	rootCmd.PersistentFlags().StringVar(&smtpHostFlag, "smtp-host", smtpHost, "SMTP server used to email expiry warnings (i.e. smtp.example.com:25), email is disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&smtpFromFlag, "smtp-from", smtpFrom, "Address that expiry warnings are emailed from")
+	rootCmd.PersistentFlags().Int32Var(&expiryWarningFlag, "expiry-warning", int32(expiryWarningPeriod/time.Minute), "Minutes before a cluster expires that its owner is warned")
+	rootCmd.PersistentFlags().Int32Var(&keepAliveMinTrafficFlag, "keep-alive-min-traffic", int32(keepAliveMinTraffic/(1024*1024)), "MiB of network traffic in 5 minutes for a keep-alive cluster to count as in use")
+	rootCmd.PersistentFlags().Int32Var(&dockerConcurrencyFlag, "docker-concurrency", int32(dockerConcurrency), "Maximum number of image pulls, builds and container starts to run at once, 0 for no limit")
+	rootCmd.PersistentFlags().Int32Var(&nodeAllocationConcurrencyFlag, "max-concurrent-node-allocations", int32(nodeAllocationConcurrency), "Maximum number of nodes to allocate at once across all clusters, 0 for no limit")
+	rootCmd.PersistentFlags().Int32Var(&rateLimitFlag, "rate-limit", int32(rateLimitPerMinute), "Maximum number of requests a minute per user, 0 for no limit")
+	rootCmd.PersistentFlags().Int32Var(&rateLimitBurstFlag, "rate-limit-burst", int32(rateLimitBurst), "Maximum number of requests a user can make at once before being rate limited")
+	rootCmd.PersistentFlags().StringVar(&orphanPolicyFlag, "orphaned-clusters", orphanPolicy, "What to do with clusters found at startup without meta-data, adopt or kill")
+	rootCmd.PersistentFlags().Int32Var(&shutdownTimeoutFlag, "shutdown-timeout", int32(shutdownTimeout/time.Second), "Seconds to wait for in-flight allocations and kills, and then again for in-flight requests, when shutting down")
+	rootCmd.PersistentFlags().StringVar(&warmPoolFlag, "warm-pool", "", "Number of idle nodes to keep started per server version, which can't be used with ip-ranges (i.e. 7.0.2=2,6.6.5=1)")
+	rootCmd.PersistentFlags().StringVar(&ipRangesFlag, "ip-ranges", "", "Addresses of the docker network to give nodes from rather than using docker's IPAM, which must not hand them out (i.e. 10.112.200.10-10.112.200.99,10.112.201.0/25)")
+	rootCmd.PersistentFlags().Int32Var(&quotaMaxClustersFlag, "quota-max-clusters", int32(defaultRuntimeConfig.DefaultQuota.MaxClusters), "Default maximum number of clusters per user, 0 for no limit")
+	rootCmd.PersistentFlags().Int32Var(&quotaMaxNodesFlag, "quota-max-nodes", int32(defaultRuntimeConfig.DefaultQuota.MaxNodes), "Default maximum number of nodes across all clusters per user, 0 for no limit")
+	rootCmd.PersistentFlags().Int32Var(&quotaMaxNodesPerClusterFlag, "quota-max-nodes-per-cluster", int32(defaultRuntimeConfig.DefaultQuota.MaxNodesPerCluster), "Default maximum number of nodes in a single cluster, 0 for no limit")
+	rootCmd.PersistentFlags().Int32Var(&maxClusterTimeoutFlag, "max-cluster-timeout", int32(defaultRuntimeConfig.MaxClusterTimeout/time.Hour), "Hours that a cluster can be allocated or refreshed for at most")
+	rootCmd.PersistentFlags().Int32Var(&defaultClusterTimeoutFlag, "default-cluster-timeout", int32(defaultRuntimeConfig.DefaultClusterTimeout/time.Minute), "Minutes that a cluster is allocated for when no timeout is given")
+	rootCmd.PersistentFlags().Int32Var(&readyTimeoutFlag, "ready-timeout", int32(defaultRuntimeConfig.DefaultReadyTimeout/time.Second), "Seconds that allocations wait for clusters to be ready when asked to, if they don't give their own timeout")
+	rootCmd.PersistentFlags().Int32Var(&hibernationRetentionFlag, "hibernation-retention", int32(defaultRuntimeConfig.HibernationRetention/time.Hour), "Hours that hibernated clusters are kept before they are reaped along with their archives")
+	rootCmd.PersistentFlags().StringVar(&allowedUlimitsFlag, "allowed-ulimits", strings.Join(defaultRuntimeConfig.ContainerAllowlist.Ulimits, ","), "Comma separated ulimits which users can set on nodes")
+	rootCmd.PersistentFlags().StringVar(&allowedSysctlsFlag, "allowed-sysctls", "", "Comma separated namespaced sysctls which users can set on nodes (i.e. net.core.somaxconn)")
+	rootCmd.PersistentFlags().StringVar(&allowedCapabilitiesFlag, "allowed-capabilities", "", "Comma separated capabilities which users can add to nodes (i.e. SYS_PTRACE,IPC_LOCK)")
+	rootCmd.PersistentFlags().BoolVar(&allowPrivilegedFlag, "allow-privileged", false, "Allow users to run nodes as privileged containers")
 
 	rootCmd.PersistentFlags().Int32Var(&dockerPortFlag, "docker-port", 0, "")
 	rootCmd.PersistentFlags().MarkDeprecated("docker-port", "Deprecated flag to specify the port of the docker host")
@@ -93,37 +189,160 @@ func initConfig() {
 
 	}
 
-	viper.AutomaticEnv()
-	viper.ReadInConfig()
+	setupConfigEnv()
 
-	getStringArg := func(arg string) string {
-		if rootCmd.PersistentFlags().Changed(arg) {
-			val, _ := rootCmd.PersistentFlags().GetString(arg)
-			return val
-		}
-		return viper.GetString(arg)
+	// Unlike reloads, which keep the config the daemon is already running
+	// with, there is nothing to fall back to at startup.
+	err := viper.ReadInConfig()
+	if err != nil {
+		fmt.Printf("Failed to read config file: %s\n", err)
+		os.Exit(1)
 	}
 
-	getInt32Arg := func(arg string) int32 {
-		if rootCmd.PersistentFlags().Changed(arg) {
-			val, _ := rootCmd.PersistentFlags().GetInt32(arg)
-			return val
-		}
-		return viper.GetInt32(arg)
+	dockerNetworkFlag = configString("docker-network")
+	dockerHostFlag = configString("docker-host")
+	dockerHostsFlag = configString("docker-hosts")
+	dockerHostsSRVFlag = configString("docker-hosts-srv")
+	dockerPortFlag = configInt32("docker-port")
+	dnsSvcHostFlag = configString("dns-host")
+	s3EndpointFlag = configString("s3-endpoint")
+	s3RegionFlag = configString("s3-region")
+	s3BucketFlag = configString("s3-bucket")
+	s3AccessKeyFlag = configString("s3-access-key")
+	s3SecretKeyFlag = configString("s3-secret-key")
+	ec2EndpointFlag = configString("ec2-endpoint")
+	ec2RegionFlag = configString("ec2-region")
+	ec2AccessKeyFlag = configString("ec2-access-key")
+	ec2SecretKeyFlag = configString("ec2-secret-key")
+	ec2AMIFlag = configString("ec2-ami")
+	ec2InstanceTypeFlag = configString("ec2-instance-type")
+	ec2SubnetIDFlag = configString("ec2-subnet")
+	ec2SecurityGroupsFlag = configString("ec2-security-groups")
+	ec2KeyNameFlag = configString("ec2-key-name")
+	capellaEndpointFlag = configString("capella-endpoint")
+	capellaOrganizationFlag = configString("capella-organization")
+	capellaAPIKeyFlag = configString("capella-api-key")
+	capellaProjectFlag = configString("capella-project")
+	capellaAllowedCIDRFlag = configString("capella-allowed-cidr")
+	capellaCloudFlag = configString("capella-cloud")
+	capellaRegionFlag = configString("capella-region")
+	capellaCPUFlag = configInt32("capella-cpu")
+	capellaRAMFlag = configInt32("capella-ram")
+	capellaPasswordKeyFlag = configString("capella-password-key")
+	metaStoreFlag = configString("meta-store")
+	metaStoreSourceFlag = configString("meta-store-source")
+	loaderImageFlag = configString("loader-image")
+	backupVolumeFlag = configString("backup-volume")
+	otlpEndpointFlag = configString("otlp-endpoint")
+	adminTokenFlag = configString("admin-token")
+	grpcAddressFlag = configString("grpc-address")
+	publicURLFlag = configString("public-url")
+	smtpHostFlag = configString("smtp-host")
+	smtpFromFlag = configString("smtp-from")
+	warmPoolFlag = configString("warm-pool")
+	ipRangesFlag = configString("ip-ranges")
+	orphanPolicyFlag = configString("orphaned-clusters")
+	dockerConcurrencyFlag = configInt32("docker-concurrency")
+	nodeAllocationConcurrencyFlag = configInt32("max-concurrent-node-allocations")
+	rateLimitFlag = configInt32("rate-limit")
+	rateLimitBurstFlag = configInt32("rate-limit-burst")
+	shutdownTimeoutFlag = configInt32("shutdown-timeout")
+	expiryWarningFlag = configInt32("expiry-warning")
+	keepAliveMinTrafficFlag = configInt32("keep-alive-min-traffic")
+
+	NetworkName = dockerNetworkFlag
+	dockerHost = dockerHostFlag
+	dockerHostsConfig = dockerHostsFlag
+	dockerHostsSRV = dockerHostsSRVFlag
+	dnsSvcHost = dnsSvcHostFlag
+	s3Endpoint = s3EndpointFlag
+	s3Region = s3RegionFlag
+	s3Bucket = s3BucketFlag
+	s3AccessKey = s3AccessKeyFlag
+	s3SecretKey = s3SecretKeyFlag
+	ec2Endpoint = ec2EndpointFlag
+	ec2Region = ec2RegionFlag
+	ec2AccessKey = ec2AccessKeyFlag
+	ec2SecretKey = ec2SecretKeyFlag
+	ec2AMI = ec2AMIFlag
+	ec2InstanceType = ec2InstanceTypeFlag
+	ec2SubnetID = ec2SubnetIDFlag
+	ec2SecurityGroups = ec2SecurityGroupsFlag
+	ec2KeyName = ec2KeyNameFlag
+	capellaEndpoint = capellaEndpointFlag
+	capellaOrganization = capellaOrganizationFlag
+	capellaAPIKey = capellaAPIKeyFlag
+	capellaProject = capellaProjectFlag
+	capellaAllowedCIDR = capellaAllowedCIDRFlag
+	capellaCloud = capellaCloudFlag
+	capellaRegion = capellaRegionFlag
+	capellaCPU = int(capellaCPUFlag)
+	capellaRAM = int(capellaRAMFlag)
+	loaderImage = loaderImageFlag
+	backupVolume = backupVolumeFlag
+	otlpEndpoint = otlpEndpointFlag
+	adminToken = adminTokenFlag
+	grpcAddress = grpcAddressFlag
+	publicURL = publicURLFlag
+	smtpHost = smtpHostFlag
+	smtpFrom = smtpFromFlag
+	expiryWarningPeriod = time.Duration(expiryWarningFlag) * time.Minute
+	keepAliveMinTraffic = uint64(keepAliveMinTrafficFlag) * 1024 * 1024
+	dockerConcurrency = int(dockerConcurrencyFlag)
+	nodeAllocationConcurrency = int(nodeAllocationConcurrencyFlag)
+	rateLimitPerMinute = int(rateLimitFlag)
+	rateLimitBurst = int(rateLimitBurstFlag)
+	shutdownTimeout = time.Duration(shutdownTimeoutFlag) * time.Second
+
+	config, err := readRuntimeConfig()
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s\n", err)
+		os.Exit(1)
 	}
+	storeRuntimeConfig(config)
 
-	dockerRegistryFlag = getStringArg("docker-registry")
-	dockerHostFlag = getStringArg("docker-host")
-	dockerPortFlag = getInt32Arg("docker-port")
-	dnsSvcHostFlag = getStringArg("dns-host")
+	poolSizes, err := parseWarmPoolSizes(warmPoolFlag)
+	if err != nil {
+		fmt.Printf("Invalid warm pool configuration: %s\n", err)
+		os.Exit(1)
+	}
+	warmPoolSizes = poolSizes
 
-	dockerRegistry = dockerRegistryFlag
-	dockerHost = dockerHostFlag
-	dnsSvcHost = dnsSvcHostFlag
+	ranges, err := parseIPRanges(ipRangesFlag)
+	if err != nil {
+		fmt.Printf("Invalid ip ranges: %s\n", err)
+		os.Exit(1)
+	}
+	ipRanges = ranges
+
+	// Pooled nodes are started before anyone asks for them, so they are
+	// addressed by docker's IPAM, which must not hand out the ip ranges.
+	// Nodes are never taken from the pool when the daemon gives out their
+	// addresses, so the pool would only waste the hosts.
+	if len(warmPoolSizes) > 0 && len(ipRanges) > 0 {
+		fmt.Println("warm-pool can't be used with ip-ranges")
+		os.Exit(1)
+	}
+
+	err = validateOrphanPolicy(orphanPolicyFlag)
+	if err != nil {
+		fmt.Printf("Invalid orphaned cluster policy: %s\n", err)
+		os.Exit(1)
+	}
+	orphanPolicy = orphanPolicyFlag
+
+	passwordKey, err := hex.DecodeString(capellaPasswordKeyFlag)
+	if err != nil {
+		fmt.Printf("Invalid capella password key: %s\n", err)
+		os.Exit(1)
+	}
+	capellaPasswordKey = passwordKey
 
 	if dockerPortFlag > 0 {
 		dockerHost = fmt.Sprintf("tcp://%s:%d", dockerHostFlag, dockerPortFlag)
 	}
+
+	startupSettings = readStartupSettings()
 }
 
 func createConfigFile(configFile string) error {
@@ -146,7 +365,7 @@ func createConfigFile(configFile string) error {
 func openMeta() error {
 	meta := &MetaDataStore{}
 
-	err := meta.Open("./data")
+	err := meta.Open(metaStoreFlag, metaStoreSourceFlag)
 	if err != nil {
 		return err
 	}
@@ -162,6 +381,41 @@ func connectDocker() error {
 	}
 
 	docker = cli
+	dockerHosts = []*DockerHost{{
+		Name:    "default",
+		Address: dockerHost,
+		Client:  cli,
+	}}
+
+	// Any other hosts are optional, the daemon can run without them.
+	hosts, err := parseDockerHosts(dockerHostsConfig)
+	if err != nil {
+		return err
+	}
+	addDockerHosts(context.Background(), hosts)
+
+	err = discoverDockerHosts(context.Background())
+	if err != nil {
+		logErrorf(context.Background(), "Failed to discover docker hosts: %s", err)
+	}
+
+	return nil
+}
+
+func connectObjectStore() error {
+	if s3Bucket == "" {
+		return nil
+	}
+
+	store, err := aws.NewS3Client(s3Endpoint, s3Region, s3Bucket, aws.Credentials{
+		AccessKey: s3AccessKey,
+		SecretKey: s3SecretKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	objectStore = store
 	return nil
 }
 
@@ -176,14 +430,14 @@ func connectRegistry(ctx context.Context, uri string) error {
 	return nil
 }
 
-func hasMacvlan0() bool {
+func hasDockerNetwork() bool {
 	networks, err := docker.NetworkList(context.Background(), types.NetworkListOptions{})
 	if err != nil {
 		panic(err)
 	}
 
 	for _, network := range networks {
-		if network.Name == "macvlan0" {
+		if network.Name == NetworkName {
 			return true
 		}
 	}
@@ -192,16 +446,32 @@ func hasMacvlan0() bool {
 }
 
 func cleanupClusters() error {
-	log.Printf("Cleaning up dead clusters")
+	logInfof(systemCtx, "Cleaning up dead clusters")
 
 	clusters, err := getAllClusters(systemCtx)
 	if err != nil {
+		reaperRunsTotal.WithLabelValues("failure").Inc()
 		return err
 	}
 
+	warnExpiringClusters(clusters)
+
+	err = releaseStaleIPReservations(systemCtx)
+	if err != nil {
+		logWarnf(systemCtx, "Failed to release stale ip reservations: %s", err)
+	}
+
+	err = removeStaleFixtures(systemCtx)
+	if err != nil {
+		logWarnf(systemCtx, "Failed to remove stale fixtures: %s", err)
+	}
+
+	// Hibernated clusters have their timeout set to the end of their
+	// retention period, so their archives are only deleted once it is over.
 	var clustersToKill []string
 	for _, cluster := range clusters {
 		if cluster.Timeout.Before(time.Now()) {
+			publishClusterEvent(systemCtx, newClusterEvent(systemCtx, ClusterEventExpired, cluster))
 			clustersToKill = append(clustersToKill, cluster.ID)
 		}
 	}
@@ -210,34 +480,40 @@ func cleanupClusters() error {
 
 	for _, clusterID := range clustersToKill {
 		go func(clusterID string) {
-			signal <- killCluster(systemCtx, clusterID)
+			err := killCluster(systemCtx, clusterID)
+			recordAudit(systemCtx, "reap expired cluster", clusterID, "", err)
+			signal <- err
 		}(clusterID)
 	}
 
 	var killError error
 	for range clustersToKill {
 		err := <-signal
-		if err != nil && killError == nil {
+		if err == nil {
+			reaperKilledTotal.Inc()
+		} else if killError == nil {
 			killError = err
 		}
 	}
 	if killError != nil {
+		reaperRunsTotal.WithLabelValues("failure").Inc()
 		return killError
 	}
 
+	reaperRunsTotal.WithLabelValues("success").Inc()
 	return nil
 }
 
 func getAndPrintClusters(ctx context.Context) {
 	clusters, err := getAllClusters(ctx)
 	if err != nil {
-		log.Printf("Failed to fetch all clusters: %+v", err)
+		logErrorf(ctx, "Failed to fetch all clusters: %+v", err)
 	} else {
-		log.Printf("Clusters:")
+		logInfof(ctx, "Clusters:")
 		for _, cluster := range clusters {
-			log.Printf("  %s [Owner: %s, Creator: %s, Timeout: %s]", cluster.ID, cluster.Owner, cluster.Creator, cluster.Timeout.Sub(time.Now()).Round(time.Second))
+			logInfof(ctx, "  %s [Owner: %s, Creator: %s, Timeout: %s]", cluster.ID, cluster.Owner, cluster.Creator, cluster.Timeout.Sub(time.Now()).Round(time.Second))
 			for _, node := range cluster.Nodes {
-				log.Printf("    %-16s  %-20s %-10s %-20s", node.ContainerID, node.Name, node.InitialServerVersion, node.IPv4Address)
+				logInfof(ctx, "    %-16s  %-20s %-10s %-20s", node.ContainerID, node.Name, node.InitialServerVersion, node.IPv4Address)
 			}
 		}
 	}
@@ -247,22 +523,59 @@ func startDaemon() {
 	// Open the meta-data database used to tracker ownership and expiry of clusters
 	err := openMeta()
 	if err != nil {
-		log.Printf("Failed to open meta db: %s", err)
+		logErrorf(context.Background(), "Failed to open meta db: %s", err)
+		return
+	}
+
+	err = loadRefreshLinkSecret()
+	if err != nil {
+		logErrorf(context.Background(), "Failed to load refresh link secret: %s", err)
 		return
 	}
 
 	// Connect to docker
+	initSlotLimiters()
 	err = connectDocker()
 	if err != nil {
-		log.Printf("Failed to connect to docker: %s", err)
+		logErrorf(context.Background(), "Failed to connect to docker: %s", err)
+		return
+	}
+
+	// Set up exporting of traces if a collector is configured
+	var traceProvider *sdktrace.TracerProvider
+	if otlpEndpoint != "" {
+		traceProvider, err = newTraceProvider(context.Background(), otlpEndpoint)
+		if err != nil {
+			logErrorf(context.Background(), "Failed to set up tracing: %s", err)
+			return
+		}
+	}
+
+	// Set up object storage, used for hibernating clusters
+	err = connectObjectStore()
+	if err != nil {
+		logErrorf(context.Background(), "Failed to set up object storage: %s", err)
 		return
 	}
 
-	// Check to make sure that the macvlan0 network is available in docker,
+	// Set up EC2, used to run clusters which are too big for docker
+	err = connectEC2()
+	if err != nil {
+		logErrorf(context.Background(), "Failed to set up ec2: %s", err)
+		return
+	}
+
+	err = connectCapella()
+	if err != nil {
+		logErrorf(context.Background(), "Failed to set up capella: %s", err)
+		return
+	}
+
+	// Check to make sure that our network is available in docker,
 	// this is neccessary for the server instances we create to be available
 	// on the public network.
-	if !hasMacvlan0() {
-		log.Printf("Failed to locate `macvlan0` network on docker host")
+	if !hasDockerNetwork() {
+		logErrorf(context.Background(), "Failed to locate `%s` network on docker host", NetworkName)
 		return
 	}
 
@@ -272,6 +585,13 @@ func startDaemon() {
 	shutdownSig := make(chan struct{})
 	cleanupClosedSig := make(chan struct{})
 
+	// Other daemons may share the docker hosts and meta-data store, only the
+	// leader runs background work.  Whichever daemon becomes leader first
+	// rolls back or finishes anything which was interrupted, and makes sure
+	// that every cluster on the docker hosts is known about.
+	initDaemonInstance()
+	leaderClosedSig := startLeaderElection(shutdownSig)
+
 	// Start our cleanup routine which automatically cleans up clusters every 5 minutes
 	go func() {
 		for {
@@ -282,13 +602,74 @@ func startDaemon() {
 			case <-time.After(5 * time.Minute):
 			}
 
-			err := cleanupClusters()
+			err := discoverDockerHosts(systemCtx)
+			if err != nil {
+				logErrorf(systemCtx, "Failed to discover docker hosts: %s", err)
+			}
+
+			if !isLeader() {
+				continue
+			}
+
+			err = cleanupClusters()
 			if err != nil {
-				log.Printf("Failed to cleanup old clusters: %s", err)
+				logErrorf(systemCtx, "Failed to cleanup old clusters: %s", err)
+			}
+
+			err = cleanupCollectInfo()
+			if err != nil {
+				logErrorf(systemCtx, "Failed to cleanup old collections: %s", err)
+			}
+
+			err = cleanupJobs()
+			if err != nil {
+				logErrorf(systemCtx, "Failed to cleanup old jobs: %s", err)
+			}
+
+			err = cleanupInstances()
+			if err != nil {
+				logErrorf(systemCtx, "Failed to clean up stopped daemons: %s", err)
+			}
+
+			err = cleanupUsedRefreshLinks()
+			if err != nil {
+				logErrorf(systemCtx, "Failed to clean up used refresh links: %s", err)
 			}
 		}
 	}()
 
+	// Apply changes to the config file when we are sent SIGHUP
+	go watchConfigReloads(shutdownSig)
+
+	// Count the clusters which are running towards the usage of their owners
+	go runUsageAccounting(shutdownSig)
+
+	// Extend the timeout of keep-alive clusters which are in use
+	go runKeepAlive(shutdownSig)
+
+	// Create and kill the clusters of schedules as they come due
+	go runClusterSchedules(shutdownSig)
+
+	// Keep the check-out pools topped up with set up clusters
+	go runClusterPools(shutdownSig)
+
+	// Tell event streams and webhooks about nodes which die unexpectedly
+	go runNodeDeathWatch(shutdownSig)
+
+	// Probe nodes so that listings can show which of them are broken
+	go runNodeHealthProbe(shutdownSig)
+
+	// Unblock the ports of nodes once their firewall rules expire
+	go runFirewallExpiry(shutdownSig)
+
+	// Reap leased clusters whose CI jobs have gone away
+	go runLeaseChecks(shutdownSig)
+
+	// Keep the warm pool topped up, if one is configured
+	if len(warmPoolSizes) > 0 {
+		go runWarmPool(shutdownSig)
+	}
+
 	getAndPrintClusters(systemCtx)
 
 	/*
@@ -298,7 +679,7 @@ func startDaemon() {
 
 		err = killAllClusters(systemCtx)
 		if err != nil {
-			log.Printf("Failed to kill all clusters: %s", err)
+			logErrorf(systemCtx, "Failed to kill all clusters: %s", err)
 			return
 		}
 
@@ -321,9 +702,9 @@ func startDaemon() {
 
 		clusterID, err := allocateCluster(userCtx, clusterOpts)
 		if err != nil {
-			log.Printf("Failed to create new cluster: %s", err)
+			logErrorf(userCtx, "Failed to create new cluster: %s", err)
 		} else {
-			log.Printf("New Cluster: %s", clusterID)
+			logInfof(userCtx, "New Cluster: %s", clusterID)
 		}
 
 		getAndPrintClusters(userCtx)
@@ -335,35 +716,84 @@ func startDaemon() {
 		Handler: createRESTRouter(),
 	}
 
-	// Set up a signal watcher for graceful shutdown
+	// The gRPC API is served alongside the REST API
+	var grpcSrv *grpc.Server
+	if grpcAddress != "" {
+		grpcSrv = newGRPCServer()
+		go func() {
+			logInfof(systemCtx, "Serving gRPC API on %s", grpcAddress)
+			err := serveGRPC(grpcSrv, grpcAddress)
+			if err != nil {
+				logErrorf(systemCtx, "Failed to serve gRPC API: %s", err)
+			}
+		}()
+	}
+
+	// Set up a signal watcher for graceful shutdown.  We stop accepting new
+	// requests and allocations, then give those in flight a chance to finish
+	// so that clusters aren't left half built.
+	drainedSig := make(chan struct{})
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		log.Printf("")
-		log.Printf("Received shutdown signal.  Shutting down daemon.")
+		logInfof(systemCtx, "Received shutdown signal.  Shutting down daemon.")
+
+		if !drainOperations(shutdownTimeout) {
+			logWarnf(systemCtx, "Timed out waiting for in-flight operations, they will be recovered on startup")
+		}
+
+		// Requests get their own deadline, since draining may have used up
+		// all of the shutdown timeout.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := restServer.Shutdown(shutdownCtx)
+		if err != nil {
+			logWarnf(systemCtx, "Failed to gracefully shut down REST server: %s", err)
+			restServer.Close()
+		}
+		if grpcSrv != nil {
+			// Streams such as followed node logs never finish by themselves.
+			grpcSrv.Stop()
+		}
 
-		restServer.Close()
+		close(drainedSig)
 	}()
 
 	// Start listening now
-	log.Printf("Daemon is starting on %s", restServer.Addr)
-	if err = restServer.ListenAndServe(); err != nil {
-		log.Printf("Error:%s", err)
+	logInfof(systemCtx, "Daemon is starting on %s", restServer.Addr)
+	if err = restServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logErrorf(systemCtx, "Error:%s", err)
+	} else {
+		<-drainedSig
 	}
 
 	// Signal all our running goroutines to shut down
-	shutdownSig <- struct{}{}
+	close(shutdownSig)
 
 	// Wait for the periodic cleanup routine to finish
 	<-cleanupClosedSig
 
+	// Wait for leadership to be given up, so another daemon can take over
+	<-leaderClosedSig
+
+	// Flush any traces which haven't been exported yet
+	if traceProvider != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = traceProvider.Shutdown(shutdownCtx)
+		cancel()
+		if err != nil {
+			logErrorf(systemCtx, "Failed to flush traces: %s", err)
+		}
+	}
+
 	// Close the meta-data database
 	err = metaStore.Close()
 	if err != nil {
-		log.Printf("Failed to close meta db: %s", err)
+		logErrorf(systemCtx, "Failed to close meta db: %s", err)
 	}
 
 	// Let everyone know everything worked good
-	log.Printf("Graceful shutdown completed.")
+	logInfof(systemCtx, "Graceful shutdown completed.")
 }
@@ -0,0 +1,292 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// DockerHost is one of the docker daemons which nodes are run on.
+type DockerHost struct {
+	Name    string
+	Address string
+	Client  *client.Client
+}
+
+// dockerHostsConfig lists extra docker hosts in the form name=address, and
+// dockerHostsSRV is a DNS SRV record to discover them from.  When neither is
+// set the daemon only uses dockerHost.
+var dockerHostsConfig = ""
+var dockerHostsSRV = ""
+
+var dockerHosts []*DockerHost
+var dockerHostsLock sync.RWMutex
+
+// containerHosts remembers which host each container is on, so that
+// operations on existing containers are sent to the right docker daemon.
+var containerHosts = make(map[string]*DockerHost)
+var containerHostsLock sync.Mutex
+
+// pendingPlacements counts the nodes which are being created on each host,
+// so that concurrent allocations don't all pick the same host.
+var pendingPlacements = make(map[string]int)
+var pendingPlacementsLock sync.Mutex
+
+// parseDockerHosts parses docker hosts in the form
+// host1=tcp://10.0.0.1:2376,host2=tcp://10.0.0.2:2376.
+func parseDockerHosts(hostsStr string) ([]*DockerHost, error) {
+	var hosts []*DockerHost
+	if hostsStr == "" {
+		return hosts, nil
+	}
+
+	names := make(map[string]bool)
+	for _, hostStr := range strings.Split(hostsStr, ",") {
+		hostParts := strings.SplitN(strings.TrimSpace(hostStr), "=", 2)
+		if len(hostParts) != 2 || hostParts[0] == "" || hostParts[1] == "" {
+			return nil, fmt.Errorf("docker hosts must be name=address, not %s", hostStr)
+		}
+		if names[hostParts[0]] {
+			return nil, fmt.Errorf("docker host %s is specified more than once", hostParts[0])
+		}
+		names[hostParts[0]] = true
+
+		hosts = append(hosts, &DockerHost{
+			Name:    hostParts[0],
+			Address: hostParts[1],
+		})
+	}
+
+	return hosts, nil
+}
+
+func lookupDockerHosts(srvName string) ([]*DockerHost, error) {
+	_, records, err := net.LookupSRV("", "", srvName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up docker hosts from %s", srvName)
+	}
+
+	var hosts []*DockerHost
+	for _, record := range records {
+		hostname := strings.TrimSuffix(record.Target, ".")
+		hosts = append(hosts, &DockerHost{
+			Name:    hostname,
+			Address: fmt.Sprintf("tcp://%s:%d", hostname, record.Port),
+		})
+	}
+
+	return hosts, nil
+}
+
+func checkDockerHost(ctx context.Context, host *DockerHost) error {
+	networks, err := host.Client.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return trackDockerError("network_list", err)
+	}
+
+	for _, network := range networks {
+		if network.Name == NetworkName {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("docker host %s has no %s network", host.Name, NetworkName)
+}
+
+// addDockerHosts connects to any of hosts which aren't already known about.
+// Hosts which can't be used are skipped rather than failing the others.
+func addDockerHosts(ctx context.Context, hosts []*DockerHost) {
+	for _, host := range hosts {
+		if getDockerHost(host.Name) != nil {
+			continue
+		}
+
+		cli, err := client.NewClient(host.Address, "1.38", nil, nil)
+		if err != nil {
+			logErrorf(ctx, "Failed to connect to docker host %s: %s", host.Name, err)
+			continue
+		}
+		host.Client = cli
+
+		err = checkDockerHost(ctx, host)
+		if err != nil {
+			logErrorf(ctx, "Cannot use docker host %s: %s", host.Name, err)
+			continue
+		}
+
+		logInfof(ctx, "Added docker host %s at %s", host.Name, host.Address)
+		dockerHostsLock.Lock()
+		dockerHosts = append(dockerHosts, host)
+		dockerHostsLock.Unlock()
+	}
+}
+
+// discoverDockerHosts picks up hosts which have been added to the SRV record
+// since we started.  Hosts which disappear from it are kept, since there may
+// still be clusters running on them.
+func discoverDockerHosts(ctx context.Context) error {
+	if dockerHostsSRV == "" {
+		return nil
+	}
+
+	hosts, err := lookupDockerHosts(dockerHostsSRV)
+	if err != nil {
+		return err
+	}
+
+	addDockerHosts(ctx, hosts)
+	return nil
+}
+
+func getDockerHosts() []*DockerHost {
+	dockerHostsLock.RLock()
+	defer dockerHostsLock.RUnlock()
+
+	return append([]*DockerHost(nil), dockerHosts...)
+}
+
+func getDockerHost(name string) *DockerHost {
+	for _, host := range getDockerHosts() {
+		if host.Name == name {
+			return host
+		}
+	}
+	return nil
+}
+
+// primaryDockerHost is used for anything which isn't tied to a host, and for
+// clusters created before there were multiple hosts.
+func primaryDockerHost() *DockerHost {
+	dockerHostsLock.RLock()
+	defer dockerHostsLock.RUnlock()
+
+	return dockerHosts[0]
+}
+
+func rememberContainerHost(containerID string, host *DockerHost) {
+	containerHostsLock.Lock()
+	containerHosts[shortContainerID(containerID)] = host
+	containerHostsLock.Unlock()
+}
+
+func forgetContainerHost(containerID string) {
+	containerHostsLock.Lock()
+	delete(containerHosts, shortContainerID(containerID))
+	containerHostsLock.Unlock()
+}
+
+func shortContainerID(containerID string) string {
+	if len(containerID) > 12 {
+		return containerID[0:12]
+	}
+	return containerID
+}
+
+// dockerHostOf finds the host which a container is on, asking each of them if
+// it hasn't been seen yet.
+func dockerHostOf(containerID string) *DockerHost {
+	containerHostsLock.Lock()
+	host, ok := containerHosts[shortContainerID(containerID)]
+	containerHostsLock.Unlock()
+	if ok {
+		return host
+	}
+
+	hosts := getDockerHosts()
+	if len(hosts) > 1 {
+		for _, host := range hosts {
+			_, err := host.Client.ContainerInspect(context.Background(), containerID)
+			if err == nil {
+				rememberContainerHost(containerID, host)
+				return host
+			}
+		}
+	}
+
+	return hosts[0]
+}
+
+// dockerFor returns the client of the host which a container is on.
+func dockerFor(containerID string) *client.Client {
+	return dockerHostOf(containerID).Client
+}
+
+// listContainers lists the containers on every host.  If allowPartial is set
+// then hosts which can't be reached are skipped, as long as at least one
+// host could be.
+func listContainers(ctx context.Context, opts types.ContainerListOptions, allowPartial bool) ([]types.Container, error) {
+	var allContainers []types.Container
+	var failedHosts []string
+	var lastErr error
+
+	hosts := getDockerHosts()
+	for _, host := range hosts {
+		containers, err := host.Client.ContainerList(ctx, opts)
+		if err != nil {
+			trackDockerError("container_list", err)
+			logWarnf(ctx, "Failed to list containers on docker host %s: %s", host.Name, err)
+			failedHosts = append(failedHosts, host.Name)
+			lastErr = err
+			continue
+		}
+
+		for _, container := range containers {
+			rememberContainerHost(container.ID, host)
+		}
+		allContainers = append(allContainers, containers...)
+	}
+
+	if len(failedHosts) == len(hosts) || (len(failedHosts) > 0 && !allowPartial) {
+		return nil, errors.Wrapf(lastErr, "failed to list containers on %s", strings.Join(failedHosts, ", "))
+	}
+
+	return allContainers, nil
+}
+
+// placeNodes picks the docker host with the fewest running nodes to create
+// numNodes new nodes on.  The returned function must be called once the
+// nodes have been created, or have failed to be.
+func placeNodes(ctx context.Context, numNodes int) (*DockerHost, func(), error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", "com.couchbase.dyncluster.creator")
+
+	pendingPlacementsLock.Lock()
+	defer pendingPlacementsLock.Unlock()
+
+	var bestHost *DockerHost
+	bestLoad := 0
+	for _, host := range getDockerHosts() {
+		containers, err := host.Client.ContainerList(ctx, types.ContainerListOptions{
+			Filters: filterArgs,
+		})
+		if err != nil {
+			logWarnf(ctx, "Not placing nodes on docker host %s: %s", host.Name, trackDockerError("container_list", err))
+			continue
+		}
+
+		load := len(containers) + pendingPlacements[host.Name]
+		if bestHost == nil || load < bestLoad {
+			bestHost = host
+			bestLoad = load
+		}
+	}
+
+	if bestHost == nil {
+		return nil, nil, errors.New("no docker hosts are available")
+	}
+
+	pendingPlacements[bestHost.Name] += numNodes
+
+	return bestHost, func() {
+		pendingPlacementsLock.Lock()
+		pendingPlacements[bestHost.Name] -= numNodes
+		pendingPlacementsLock.Unlock()
+	}, nil
+}
@@ -0,0 +1,342 @@
+package daemon
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/aws"
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+// The EC2 provider is only enabled when an AMI is configured.  The AMI must
+// be prepared with everything couchbase server needs to be installed, and
+// allow the same ssh login as our docker images.
+var ec2Endpoint, ec2Region, ec2AccessKey, ec2SecretKey string
+var ec2AMI, ec2SubnetID, ec2SecurityGroups, ec2KeyName string
+var ec2InstanceType = "m5.xlarge"
+
+const (
+	ec2ClusterIDTag = "cbdyncluster-cluster-id"
+	ec2NodeNameTag  = "cbdyncluster-node-name"
+	ec2CreatorTag   = "cbdyncluster-creator"
+)
+
+// ec2StartTimeout bounds how long instances have to boot and install
+// couchbase server before allocation is given up on.
+const ec2StartTimeout = 20 * time.Minute
+
+type ec2Provider struct {
+	client *aws.EC2Client
+
+	// metaLock serializes updates to the meta-data of a cluster from the
+	// goroutines allocating each of its nodes.
+	metaLock sync.Mutex
+}
+
+func connectEC2() error {
+	if ec2AMI == "" {
+		return nil
+	}
+
+	client, err := aws.NewEC2Client(ec2Endpoint, ec2Region, aws.Credentials{
+		AccessKey: ec2AccessKey,
+		SecretKey: ec2SecretKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	clusterProviders[ProviderEC2] = &ec2Provider{
+		client: client,
+	}
+	return nil
+}
+
+func getEC2Provider() *ec2Provider {
+	provider, _ := clusterProviders[ProviderEC2].(*ec2Provider)
+	return provider
+}
+
+// ec2Cluster builds a cluster from the meta-data of a cluster run on EC2.
+func ec2Cluster(clusterID string, meta ClusterMeta) *Cluster {
+	var nodes []*Node
+	for _, node := range meta.EC2.Nodes {
+		state := "running"
+		if node.IPv4Address == "" {
+			state = "pending"
+		}
+
+		nodes = append(nodes, &Node{
+			ContainerID:          node.InstanceID,
+			ContainerName:        "/" + ec2NodeHostname(clusterID, node.Name),
+			State:                state,
+			Name:                 node.Name,
+			InitialServerVersion: node.ServerVersion,
+			IPv4Address:          node.IPv4Address,
+		})
+	}
+
+	return &Cluster{
+		ID:         clusterID,
+		Creator:    meta.EC2.Creator,
+		Owner:      meta.Owner,
+		Timeout:    meta.Timeout,
+		Nodes:      nodes,
+		SharedWith: meta.SharedWith,
+		Team:       meta.Team,
+		Tags:       meta.Tags,
+		Alias:      meta.Alias,
+		Pool:       meta.Pool,
+		Provider:   ProviderEC2,
+	}
+}
+
+// ec2NodeHostname matches the container names of docker nodes, so that nodes
+// are registered in DNS under the same names whichever provider runs them.
+func ec2NodeHostname(clusterID, nodeName string) string {
+	return fmt.Sprintf("dynclsr-%s-%s", clusterID, nodeName)
+}
+
+// ec2UserData installs and starts the requested build when an instance first
+// boots.
+func ec2UserData(nodeVersion *NodeVersion) string {
+	checksumCheck := ""
+	if nodeVersion.Checksum != "" {
+		checksumCheck = fmt.Sprintf("echo '%s  /tmp/couchbase-server.rpm' | sha256sum -c -\n", nodeVersion.Checksum)
+	}
+
+	script := fmt.Sprintf(`#!/bin/bash
+set -e
+curl -fsSL -o /tmp/couchbase-server.rpm '%s'
+%syum install -y /tmp/couchbase-server.rpm
+systemctl enable couchbase-server
+systemctl start couchbase-server
+`, nodeVersion.toPkgURL(), checksumCheck)
+
+	return base64.StdEncoding.EncodeToString([]byte(script))
+}
+
+func (p *ec2Provider) updateNode(clusterID, nodeName string, updateFunc func(node *EC2Node)) error {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		if meta.EC2 == nil {
+			return meta, errors.New("cluster is not an ec2 cluster")
+		}
+
+		for i := range meta.EC2.Nodes {
+			if meta.EC2.Nodes[i].Name == nodeName {
+				updateFunc(&meta.EC2.Nodes[i])
+				return meta, nil
+			}
+		}
+
+		return meta, errors.Errorf("node %s is not part of the cluster", nodeName)
+	})
+}
+
+func (p *ec2Provider) allocateNodes(ctx context.Context, clusterID string, timeout time.Time, nodes []NodeOptions) error {
+	// Record the nodes up front so that the cluster shows up while instances
+	// are starting, and their instances can be found to clean them up.
+	ec2Meta := &EC2Meta{
+		Creator: ContextUser(ctx),
+	}
+	for _, node := range nodes {
+		ec2Meta.Nodes = append(ec2Meta.Nodes, EC2Node{
+			Name:          node.Name,
+			ServerVersion: node.ServerVersion,
+		})
+	}
+
+	err := metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.EC2 = ec2Meta
+		return meta, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	signal := make(chan error)
+
+	for _, node := range nodes {
+		go func(node NodeOptions) {
+			signal <- p.allocateNode(ctx, clusterID, node)
+		}(node)
+	}
+
+	var createError error
+	for range nodes {
+		err := <-signal
+		if err != nil && createError == nil {
+			createError = err
+		}
+	}
+
+	return createError
+}
+
+func (p *ec2Provider) allocateNode(ctx context.Context, clusterID string, opts NodeOptions) error {
+	ctx = ContextWithNode(ctx, opts.Name)
+	logInfof(ctx, "Launching ec2 instance")
+
+	hostname := ec2NodeHostname(clusterID, opts.Name)
+
+	var securityGroups []string
+	for _, group := range strings.Split(ec2SecurityGroups, ",") {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			securityGroups = append(securityGroups, group)
+		}
+	}
+
+	instance, err := p.client.RunInstance(ctx, aws.RunInstancesOptions{
+		ImageID:          ec2AMI,
+		InstanceType:     ec2InstanceType,
+		SubnetID:         ec2SubnetID,
+		SecurityGroupIDs: securityGroups,
+		KeyName:          ec2KeyName,
+		UserData:         ec2UserData(opts.VersionInfo),
+		Tags: map[string]string{
+			"Name":          hostname,
+			ec2ClusterIDTag: clusterID,
+			ec2NodeNameTag:  opts.Name,
+			ec2CreatorTag:   ContextUser(ctx),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.updateNode(clusterID, opts.Name, func(node *EC2Node) {
+		node.InstanceID = instance.ID
+	})
+	if err != nil {
+		return err
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, ec2StartTimeout)
+	defer cancel()
+
+	ipv4, err := p.waitForInstance(startCtx, instance.ID)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateNode(clusterID, opts.Name, func(node *EC2Node) {
+		node.IPv4Address = ipv4
+	})
+	if err != nil {
+		return err
+	}
+
+	registerNodeDNS(ctx, hostname, ipv4, "")
+
+	logInfof(ctx, "Waiting for couchbase server to be installed on %s", instance.ID)
+	return waitForPort(startCtx, net.JoinHostPort(ipv4, strconv.Itoa(helper.RestPort)))
+}
+
+// waitForInstance waits for an instance to be running, and returns its private
+// address.
+func (p *ec2Provider) waitForInstance(ctx context.Context, instanceID string) (string, error) {
+	for {
+		instances, err := p.client.DescribeInstances(ctx, map[string][]string{
+			"instance-id": {instanceID},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if len(instances) == 1 {
+			instance := instances[0]
+			if instance.State == "running" && instance.PrivateIPAddress != "" {
+				return instance.PrivateIPAddress, nil
+			}
+			if instance.State != "pending" {
+				return "", errors.Errorf("instance %s is %s", instanceID, instance.State)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrapf(ctx.Err(), "instance %s did not start", instanceID)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func waitForPort(ctx context.Context, address string) error {
+	for {
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s did not become available", address)
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func (p *ec2Provider) killNodes(ctx context.Context, cluster *Cluster) error {
+	var instanceIDs []string
+	for _, node := range cluster.Nodes {
+		if node.ContainerID != "" {
+			instanceIDs = append(instanceIDs, node.ContainerID)
+		}
+	}
+
+	logInfof(ctx, "Terminating ec2 instances %s", strings.Join(instanceIDs, ", "))
+	return p.client.TerminateInstances(ctx, instanceIDs)
+}
+
+// terminateOrphanedInstances terminates instances which were launched for
+// clusters that no longer have any meta-data, such as those whose allocation
+// was interrupted before the instance was recorded.  Clusters allocated
+// since metas was read won't be in it, so their meta-data is read again
+// before their instances are terminated.
+func (p *ec2Provider) terminateOrphanedInstances(ctx context.Context, metas map[string]ClusterMeta) ([]string, error) {
+	instances, err := p.client.DescribeInstances(ctx, map[string][]string{
+		"tag-key":             {ec2ClusterIDTag},
+		"instance-state-name": {"pending", "running", "stopping", "stopped"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, instance := range instances {
+		clusterID := instance.Tags[ec2ClusterIDTag]
+		if meta, ok := metas[clusterID]; ok && meta.EC2 != nil {
+			continue
+		}
+
+		meta, err := metaStore.GetClusterMeta(clusterID)
+		if err == nil && meta.EC2 != nil {
+			continue
+		} else if err != nil && err != ErrMetaNotFound {
+			logWarnf(ContextWithClusterID(ctx, clusterID), "Failed to check ec2 instance %s for meta-data: %s", instance.ID, err)
+			continue
+		}
+
+		logWarnf(ContextWithClusterID(ctx, clusterID), "Found ec2 instance %s without meta-data", instance.ID)
+		orphans = append(orphans, instance.ID)
+	}
+
+	err = p.client.TerminateInstances(ctx, orphans)
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
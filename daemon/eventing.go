@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/pkg/errors"
+)
+
+// eventingWaitTimeout bounds how long we wait for eventing functions to be
+// deployed, which involves them catching up with their source keyspace.
+const eventingWaitTimeout = 5 * time.Minute
+
+var eventingFunctionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+type AddEventingFunctionsOptions struct {
+	Conf AddEventingFunctionsJSON
+}
+
+func validateEventingFunctions(functions []EventingFunctionJSON) error {
+	functionNames := make(map[string]bool)
+	for _, function := range functions {
+		if !eventingFunctionNameRegexp.MatchString(function.Name) {
+			return errors.Errorf("%q is not a valid eventing function name", function.Name)
+		}
+		if functionNames[function.Name] {
+			return errors.Errorf("eventing function %s is specified more than once", function.Name)
+		}
+		functionNames[function.Name] = true
+
+		if _, err := eventingFunctionDefinition(function); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eventingFunctionDefinition returns the definition of a function with its
+// name set, since the eventing service expects the two to match.
+func eventingFunctionDefinition(function EventingFunctionJSON) ([]byte, error) {
+	var definition map[string]json.RawMessage
+	err := json.Unmarshal(function.Definition, &definition)
+	if err != nil || definition == nil {
+		return nil, errors.Errorf("definition of eventing function %s must be an object", function.Name)
+	}
+	if _, ok := definition["appcode"]; !ok {
+		return nil, errors.Errorf("definition of eventing function %s has no appcode", function.Name)
+	}
+
+	definition["appname"], _ = json.Marshal(function.Name)
+	return json.Marshal(definition)
+}
+
+// addEventingFunctions creates and deploys eventing functions on a cluster.
+func addEventingFunctions(ctx context.Context, clusterID string, opts AddEventingFunctionsOptions) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	if len(opts.Conf.Functions) == 0 {
+		return errors.New("must specify at least one eventing function")
+	}
+	err := validateEventingFunctions(opts.Conf.Functions)
+	if err != nil {
+		return err
+	}
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if c.Provider == ProviderCapella {
+		return errors.New("eventing functions cannot be added to capella clusters")
+	}
+	if len(c.Nodes) == 0 {
+		return errors.New("no nodes available")
+	}
+
+	node, err := findServiceNode(c.Nodes, "eventing")
+	if err != nil {
+		return err
+	}
+	eventingNode := restNodeOf(node)
+
+	for _, function := range opts.Conf.Functions {
+		definition, err := eventingFunctionDefinition(function)
+		if err != nil {
+			return err
+		}
+
+		logInfof(ctx, "Creating eventing function %s", function.Name)
+		err = eventingNode.CreateEventingFunction(function.Name, definition)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create eventing function %s", function.Name)
+		}
+
+		logInfof(ctx, "Deploying eventing function %s", function.Name)
+		err = eventingNode.DeployEventingFunction(function.Name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to deploy eventing function %s", function.Name)
+		}
+	}
+
+	if !opts.Conf.Wait {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, eventingWaitTimeout)
+	defer cancel()
+	return waitForEventingFunctions(waitCtx, eventingNode, opts.Conf.Functions)
+}
+
+// waitForEventingFunctions waits until every function is deployed, since
+// functions are deployed in the background.
+func waitForEventingFunctions(ctx context.Context, eventingNode *cluster.Node, functions []EventingFunctionJSON) error {
+	var lastPending string
+	for {
+		statuses, err := eventingNode.GetEventingFunctionStatuses()
+		if err == nil {
+			var pending []string
+			for _, function := range functions {
+				status, ok := statuses[function.Name]
+				if !ok {
+					status = "missing"
+				}
+				if status != "deployed" {
+					pending = append(pending, fmt.Sprintf("%s (%s)", function.Name, status))
+				}
+			}
+			if len(pending) == 0 {
+				return nil
+			}
+			if joined := strings.Join(pending, ", "); joined != lastPending {
+				logInfof(ctx, "Waiting for eventing functions to be deployed: %s", joined)
+				lastPending = joined
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "eventing functions were not deployed in time")
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package daemon
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind by before
+// events start being dropped for it, so that a slow client can't hold up
+// the daemon.
+const eventBufferSize = 64
+
+// eventSubscribers are the clients streaming the events of this daemon.
+// Each daemon only streams the events which it sees itself.
+var eventSubscribers = make(map[chan *ClusterEvent]bool)
+var eventSubscribersLock sync.Mutex
+
+// EventFilter picks the events which a subscriber is interested in, every
+// event that the user can see if it is empty.
+type EventFilter struct {
+	Owner     string
+	ClusterID string
+	Types     []string
+}
+
+func (filter *EventFilter) matches(event *ClusterEvent) bool {
+	if filter.Owner != "" && event.Owner != filter.Owner {
+		return false
+	}
+	if filter.ClusterID != "" && event.ClusterID != filter.ClusterID {
+		return false
+	}
+	if len(filter.Types) > 0 && !containsString(filter.Types, event.Type) {
+		return false
+	}
+	return true
+}
+
+// canSeeEvent is whether the user in ctx can see the cluster which an event
+// is about.  Events which aren't about anyone's cluster, such as image
+// builds, can be seen by everyone.
+func canSeeEvent(ctx context.Context, event *ClusterEvent) bool {
+	if ContextIgnoreOwnership(ctx) || event.Owner == "" {
+		return true
+	}
+
+	user := ContextUser(ctx)
+	return event.Owner == user || containsString(event.sharedWith, user) || isTeamMember(event.Team, user)
+}
+
+func validateEventFilter(filter EventFilter) error {
+	for _, eventType := range filter.Types {
+		if !containsString(clusterEventTypes, eventType) {
+			return errors.Errorf("unknown event type %s", eventType)
+		}
+	}
+	return nil
+}
+
+// subscribeEvents returns a channel which receives every event that the user
+// in ctx can see and which matches the filter, until the returned function is
+// called.
+func subscribeEvents(ctx context.Context, filter EventFilter) (<-chan *ClusterEvent, func()) {
+	all := make(chan *ClusterEvent, eventBufferSize)
+	eventSubscribersLock.Lock()
+	eventSubscribers[all] = true
+	eventSubscribersLock.Unlock()
+
+	matching := make(chan *ClusterEvent, eventBufferSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(matching)
+		for {
+			select {
+			case <-done:
+				return
+			case event := <-all:
+				if !canSeeEvent(ctx, event) || !filter.matches(event) {
+					continue
+				}
+				select {
+				case matching <- event:
+				default:
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return matching, func() {
+		once.Do(func() {
+			eventSubscribersLock.Lock()
+			delete(eventSubscribers, all)
+			eventSubscribersLock.Unlock()
+			close(done)
+		})
+	}
+}
+
+// broadcastEvent sends an event to the clients streaming events from this
+// daemon.  Clients which have fallen too far behind miss it.
+func broadcastEvent(event *ClusterEvent) {
+	eventSubscribersLock.Lock()
+	defer eventSubscribersLock.Unlock()
+
+	for subscriber := range eventSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// stoppingContainers are the nodes which this daemon is stopping, so that
+// their containers dying isn't mistaken for the node dying.
+var stoppingContainers = make(map[string]bool)
+var stoppingContainersLock sync.Mutex
+
+// markContainerStopping records that a node is being stopped.  Its die event
+// can arrive after the stop has returned, so the node is only forgotten about
+// once that has had plenty of time to happen.
+func markContainerStopping(containerID string) {
+	shortID := shortContainerID(containerID)
+
+	stoppingContainersLock.Lock()
+	stoppingContainers[shortID] = true
+	stoppingContainersLock.Unlock()
+
+	time.AfterFunc(1*time.Minute, func() {
+		stoppingContainersLock.Lock()
+		delete(stoppingContainers, shortID)
+		stoppingContainersLock.Unlock()
+	})
+}
+
+func isContainerStopping(containerID string) bool {
+	stoppingContainersLock.Lock()
+	defer stoppingContainersLock.Unlock()
+
+	return stoppingContainers[shortContainerID(containerID)]
+}
+
+// nodeDiedEvent works out whether a node container dying was unexpected,
+// returning the event for it if so.  Nodes die whenever clusters are killed
+// or hibernated, including by other daemons, which is told apart by the
+// meta-data of the cluster.
+func nodeDiedEvent(message events.Message, claims map[string]PoolClaim) *ClusterEvent {
+	if isContainerStopping(message.Actor.ID) {
+		return nil
+	}
+
+	clusterID := message.Actor.Attributes["com.couchbase.dyncluster.cluster_id"]
+	nodeName := message.Actor.Attributes["com.couchbase.dyncluster.node_name"]
+	if claim, ok := claims[shortContainerID(message.Actor.ID)]; ok {
+		clusterID = claim.ClusterID
+		nodeName = claim.NodeName
+	}
+	if clusterID == "" {
+		// Idle nodes of the warm pool don't belong to anyone.
+		return nil
+	}
+
+	var pendingKill PendingOperation
+	err := metaStore.getRecord(pendingOperationKey(OperationKill, clusterID), &pendingKill)
+	if err == nil {
+		return nil
+	}
+
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err != nil || meta.Hibernation != nil {
+		return nil
+	}
+
+	return &ClusterEvent{
+		Type:       ClusterEventNodeDied,
+		Time:       time.Unix(message.Time, 0),
+		ClusterID:  clusterID,
+		Owner:      meta.Owner,
+		Team:       meta.Team,
+		Timeout:    meta.Timeout,
+		Actor:      systemCtx.Value(ContexKeyUser).(string),
+		Node:       nodeName,
+		sharedWith: meta.SharedWith,
+	}
+}
+
+// watchNodeDeaths publishes an event whenever a node on a docker host dies
+// without the daemon having stopped it, until ctx is cancelled.
+func watchNodeDeaths(ctx context.Context, host *DockerHost) error {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("type", "container")
+	filterArgs.Add("event", "die")
+	filterArgs.Add("label", "com.couchbase.dyncluster.creator")
+
+	messages, errs := host.Client.Events(ctx, types.EventsOptions{Filters: filterArgs})
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case message := <-messages:
+			claims, err := getPoolClaims()
+			if err != nil {
+				logWarnf(ctx, "Failed to check whether node %s was claimed: %s", message.Actor.ID, err)
+				continue
+			}
+
+			event := nodeDiedEvent(message, claims)
+			if event == nil {
+				continue
+			}
+
+			logWarnf(ContextWithNode(ContextWithClusterID(ctx, event.ClusterID), event.Node),
+				"Node died with exit code %s", message.Actor.Attributes["exitCode"])
+			// Every daemon sees the node die, but only one should tell
+			// the webhooks about it.
+			if isLeader() {
+				publishClusterEvent(ctx, event)
+			} else {
+				broadcastEvent(event)
+			}
+		}
+	}
+}
+
+// runNodeDeathWatch watches every docker host for nodes dying, including
+// hosts which are discovered later on.
+func runNodeDeathWatch(shutdownSig chan struct{}) {
+	ctx, cancel := context.WithCancel(systemCtx)
+	defer cancel()
+
+	watching := make(map[string]bool)
+	for {
+		for _, host := range getDockerHosts() {
+			if watching[host.Name] {
+				continue
+			}
+			watching[host.Name] = true
+
+			go func(host *DockerHost) {
+				for {
+					err := watchNodeDeaths(ctx, host)
+					if ctx.Err() != nil {
+						return
+					}
+					logWarnf(ctx, "Lost the events of docker host %s: %s", host.Name, err)
+
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(10 * time.Second):
+					}
+				}
+			}(host)
+		}
+
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(1 * time.Minute):
+		}
+	}
+}
+
+// parseEventTypes splits a comma separated list of event types.
+func parseEventTypes(typesStr string) []string {
+	if typesStr == "" {
+		return nil
+	}
+	return strings.Split(typesStr, ",")
+}
@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// allowedExecCommands maps the commands which users may run on their nodes to
+// the binaries that implement them.
+var allowedExecCommands = map[string]string{
+	"cbstats":       "/opt/couchbase/bin/cbstats",
+	"cbq":           "/opt/couchbase/bin/cbq",
+	"couchbase-cli": "/opt/couchbase/bin/couchbase-cli",
+	"mcstat":        "/opt/couchbase/bin/mcstat",
+}
+
+var execTimeout = 5 * time.Minute
+
+type ExecOptions struct {
+	Command string
+	Args    []string
+}
+
+type ExecResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+func execOnNode(ctx context.Context, clusterID, nodeRef string, opts ExecOptions) (*ExecResult, error) {
+	ctx = ContextWithNode(ContextWithClusterID(ctx, clusterID), nodeRef)
+	logInfof(ctx, "Running %s", opts.Command)
+
+	binary, ok := allowedExecCommands[opts.Command]
+	if !ok {
+		return nil, errors.Errorf("command %s is not allowed", opts.Command)
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isClusterOwner(ctx, cluster) {
+		return nil, errors.New("cannot run commands on clusters you don't own")
+	}
+
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := findNode(cluster, nodeRef)
+	if err != nil {
+		return nil, err
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execStream(execCtx, node.ContainerID, append([]string{binary}, opts.Args...), &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExecResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: exitCode,
+	}, nil
+}
+
+// execStream runs cmd inside a container, copying its output to stdout and
+// stderr until it exits or ctx is cancelled, and returns its exit code.
+func execStream(ctx context.Context, containerID string, cmd []string, stdout, stderr io.Writer) (int, error) {
+	execConfig := types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	}
+
+	cli := dockerFor(containerID)
+	execResp, err := cli.ContainerExecCreate(ctx, containerID, execConfig)
+	if err != nil {
+		trackDockerError("exec_create", err)
+		return -1, errors.Wrap(err, "could not create exec")
+	}
+
+	attachResp, err := cli.ContainerExecAttach(ctx, execResp.ID, execConfig)
+	if err != nil {
+		return -1, errors.Wrap(err, "could not attach to exec")
+	}
+	defer attachResp.Close()
+
+	// The hijacked connection doesn't respect the context, so close it ourselves
+	// if the caller goes away before the command is finished.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			attachResp.Close()
+		case <-finished:
+		}
+	}()
+
+	_, err = stdcopy.StdCopy(stdout, stderr, attachResp.Reader)
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	if err != nil {
+		return -1, errors.Wrap(err, "could not read exec output")
+	}
+
+	inspectResp, err := cli.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return -1, errors.Wrap(err, "could not inspect exec")
+	}
+
+	return inspectResp.ExitCode, nil
+}
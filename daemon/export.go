@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// metaExportVersion is bumped whenever exports change in a way which older
+// daemons can't import.
+const metaExportVersion = 1
+
+// Pending operations and leadership are only meaningful to the daemons which
+// recorded them, so they aren't moved to another one.
+var unexportedRecordPrefixes = []string{"pendingop-", "instance-", leaderLeaseKey}
+
+// MetaRecord is a single record of the meta-data store, as its raw JSON.
+type MetaRecord struct {
+	Key   string
+	Value json.RawMessage
+}
+
+type MetaExport struct {
+	Version    int
+	ExportedAt time.Time
+	Records    []MetaRecord
+}
+
+type MetaImportResult struct {
+	Imported int
+	Skipped  int
+}
+
+// stripClusterMetaSecrets removes the password of Capella clusters from
+// their meta-data.  The daemon which imports it won't have the key it is
+// encrypted with anyway, so the password is only a liability in exports.
+func stripClusterMetaSecrets(recordBytes []byte) ([]byte, error) {
+	var metaJSON map[string]json.RawMessage
+	err := json.Unmarshal(recordBytes, &metaJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	capellaBytes, ok := metaJSON["capella"]
+	if !ok || string(capellaBytes) == "null" {
+		return recordBytes, nil
+	}
+
+	var capellaJSON map[string]json.RawMessage
+	err = json.Unmarshal(capellaBytes, &capellaJSON)
+	if err != nil {
+		return nil, err
+	}
+	delete(capellaJSON, "encrypted_password")
+
+	metaJSON["capella"], err = json.Marshal(capellaJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(metaJSON)
+}
+
+func isExportedRecord(key string) bool {
+	for _, prefix := range unexportedRecordPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// exportMeta returns every record of the meta-data store, such as cluster
+// meta-data, users and the audit log, so that it can be imported into the
+// store of another daemon.  The passwords of Capella clusters are left out.
+func exportMeta(ctx context.Context) (*MetaExport, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can export meta-data")
+	}
+
+	export := &MetaExport{
+		Version:    metaExportVersion,
+		ExportedAt: time.Now(),
+	}
+	err := metaStore.forEachRecord("", func(key string, recordBytes []byte) error {
+		if !isExportedRecord(key) {
+			return nil
+		}
+
+		if strings.HasPrefix(key, "cluster-") {
+			var err error
+			recordBytes, err = stripClusterMetaSecrets(recordBytes)
+			if err != nil {
+				return errors.Wrapf(err, "failed to export record %s", key)
+			}
+		}
+
+		export.Records = append(export.Records, MetaRecord{Key: key, Value: recordBytes})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Exported %d meta-data records", len(export.Records))
+
+	return export, nil
+}
+
+// importMeta writes the records of an export into the meta-data store.
+// Records which already exist are replaced, because a daemon which is being
+// migrated to will have adopted the clusters it found without knowing who
+// owns them, unless skipExisting is set.
+func importMeta(ctx context.Context, export *MetaExport, skipExisting bool) (*MetaImportResult, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can import meta-data")
+	}
+
+	if export.Version != metaExportVersion {
+		return nil, errors.Errorf("cannot import version %d exports, only version %d", export.Version, metaExportVersion)
+	}
+	for _, record := range export.Records {
+		if record.Key == "" || !isExportedRecord(record.Key) {
+			return nil, errors.Errorf("cannot import a record with key %q", record.Key)
+		}
+		if !json.Valid(record.Value) {
+			return nil, errors.Errorf("record %s is not valid JSON", record.Key)
+		}
+	}
+
+	result := &MetaImportResult{}
+	for _, record := range export.Records {
+		var err error
+		if skipExisting {
+			err = metaStore.createRawRecord(record.Key, record.Value)
+			if err == ErrMetaExists {
+				result.Skipped++
+				continue
+			}
+		} else {
+			err = metaStore.setRawRecord(record.Key, record.Value)
+		}
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to import record %s", record.Key)
+		}
+		result.Imported++
+	}
+
+	// The secret of refresh links is only read at startup, links from the
+	// other daemon should keep working.
+	err := loadRefreshLinkSecret()
+	if err != nil {
+		return result, err
+	}
+
+	logInfof(ctx, "Imported %d meta-data records, skipped %d", result.Imported, result.Skipped)
+
+	return result, nil
+}
@@ -0,0 +1,345 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// Firewall rules block ports of a node with iptables inside its container,
+// so that a single service of a node can be taken out, such as the data
+// service without the query service.  Rules are removed again once they
+// expire, so that a forgotten rule doesn't leave a cluster broken.  Changing
+// iptables needs the NET_ADMIN capability, which nodes only have when they
+// are allocated with it in cap_add, as the daemon's --allowed-capabilities
+// permit.
+
+const (
+	FirewallActionDrop   = "drop"
+	FirewallActionReject = "reject"
+)
+
+// defaultFirewallDuration is how long ports are blocked for when no duration
+// is given, and maxFirewallDuration is the longest they can be blocked for.
+var defaultFirewallDuration = 15 * time.Minute
+var maxFirewallDuration = 24 * time.Hour
+
+// firewallExpiryInterval is how often rules are checked for having expired.
+var firewallExpiryInterval = 10 * time.Second
+
+// FirewallRule is a port of a node which is blocked until ExpiresAt.
+type FirewallRule struct {
+	ClusterID   string    `json:"cluster_id"`
+	Node        string    `json:"node"`
+	ContainerID string    `json:"container_id"`
+	Port        int       `json:"port"`
+	Action      string    `json:"action"`
+	IPv6        bool      `json:"ipv6,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type BlockPortsOptions struct {
+	Ports    []int
+	Action   string
+	Duration time.Duration
+}
+
+func firewallRuleKey(clusterID, nodeName string, port int) string {
+	return fmt.Sprintf("firewall-%s-%s-%d", clusterID, nodeName, port)
+}
+
+// iptablesArgs is the rule which blocks a port.  Traffic over the loopback
+// interface is left alone, since the processes of a node talk to each other
+// over it.
+func (rule *FirewallRule) iptablesArgs(op string) []string {
+	target := "DROP"
+	if rule.Action == FirewallActionReject {
+		target = "REJECT"
+	}
+
+	return []string{op, "INPUT", "!", "-i", "lo", "-p", "tcp", "--dport", strconv.Itoa(rule.Port),
+		"-m", "comment", "--comment", "dyncluster-firewall", "-j", target}
+}
+
+// runIptables changes the rules of a node, with ip6tables too if the node has
+// an IPv6 address.
+func runIptables(ctx context.Context, rule *FirewallRule, op string) error {
+	binaries := []string{"iptables"}
+	if rule.IPv6 {
+		binaries = append(binaries, "ip6tables")
+	}
+
+	for _, binary := range binaries {
+		var stdout, stderr bytes.Buffer
+		exitCode, err := execStream(ctx, rule.ContainerID, append([]string{binary}, rule.iptablesArgs(op)...), &stdout, &stderr)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			output := strings.TrimSpace(stderr.String())
+			if strings.Contains(output, "Permission denied") {
+				return errors.Errorf("node %s was allocated without the NET_ADMIN capability, allocate nodes with cap_add NET_ADMIN to use firewall rules", rule.Node)
+			}
+			return errors.Errorf("%s failed with exit code %d: %s", binary, exitCode, output)
+		}
+	}
+
+	return nil
+}
+
+func firewallCluster(ctx context.Context, clusterID string) (*Cluster, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot change the firewall of a hibernated cluster")
+	}
+
+	return c, nil
+}
+
+// blockPorts blocks ports of a node until the duration has passed.  Ports
+// which are already blocked have their rule replaced, so that the new action
+// and expiry apply.
+func blockPorts(ctx context.Context, clusterID, nodeRef string, opts BlockPortsOptions) ([]FirewallRule, error) {
+	ctx = ContextWithNode(ContextWithClusterID(ctx, clusterID), nodeRef)
+
+	if len(opts.Ports) == 0 {
+		return nil, errors.New("no ports were given to block")
+	}
+	for _, port := range opts.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, errors.Errorf("%d is not a valid port", port)
+		}
+	}
+	if opts.Action == "" {
+		opts.Action = FirewallActionDrop
+	}
+	if opts.Action != FirewallActionDrop && opts.Action != FirewallActionReject {
+		return nil, errors.Errorf("action must be %s or %s", FirewallActionDrop, FirewallActionReject)
+	}
+	if opts.Duration == 0 {
+		opts.Duration = defaultFirewallDuration
+	}
+	if opts.Duration < 0 || opts.Duration > maxFirewallDuration {
+		return nil, errors.Errorf("ports can be blocked for at most %s", maxFirewallDuration)
+	}
+
+	c, err := firewallCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := findNode(c, nodeRef)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []FirewallRule
+	for _, port := range opts.Ports {
+		key := firewallRuleKey(clusterID, node.Name, port)
+
+		var existing FirewallRule
+		err = metaStore.getRecord(key, &existing)
+		if err == nil && existing.ContainerID == node.ContainerID {
+			err = runIptables(ctx, &existing, "-D")
+			if err != nil {
+				logWarnf(ctx, "Failed to remove the existing rule for port %d: %s", port, err)
+			}
+		}
+
+		rule := FirewallRule{
+			ClusterID:   clusterID,
+			Node:        node.Name,
+			ContainerID: node.ContainerID,
+			Port:        port,
+			Action:      opts.Action,
+			IPv6:        node.IPv6Address != "",
+			CreatedAt:   time.Now(),
+			ExpiresAt:   time.Now().Add(opts.Duration),
+		}
+
+		logInfof(ctx, "Blocking port %d until %s", port, rule.ExpiresAt.Format(time.RFC3339))
+		err = runIptables(ctx, &rule, "-I")
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to block port %d", port)
+		}
+
+		err = metaStore.setRecord(key, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// removeFirewallRule unblocks a port and forgets about the rule.  The rule
+// is forgotten even if the node has gone, along with its rules.
+func removeFirewallRule(ctx context.Context, rule *FirewallRule) error {
+	err := runIptables(ctx, rule, "-D")
+	if err != nil && !isNodeGone(ctx, rule.ContainerID) {
+		return errors.Wrapf(err, "failed to unblock port %d of node %s", rule.Port, rule.Node)
+	}
+
+	return metaStore.deleteRecord(firewallRuleKey(rule.ClusterID, rule.Node, rule.Port))
+}
+
+// isNodeGone is whether a node container no longer exists.
+func isNodeGone(ctx context.Context, containerID string) bool {
+	_, err := dockerFor(containerID).ContainerInspect(ctx, containerID)
+	return client.IsErrNotFound(err)
+}
+
+// unblockPorts removes the rules of a node before they expire, for a single
+// port if it is given.
+func unblockPorts(ctx context.Context, clusterID, nodeRef string, port int) error {
+	ctx = ContextWithNode(ContextWithClusterID(ctx, clusterID), nodeRef)
+
+	c, err := firewallCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	node, err := findNode(c, nodeRef)
+	if err != nil {
+		return err
+	}
+
+	rules, err := getAllFirewallRules(clusterID)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for _, rule := range rules {
+		if rule.Node != node.Name || (port != 0 && rule.Port != port) {
+			continue
+		}
+
+		logInfof(ctx, "Unblocking port %d", rule.Port)
+		err = removeFirewallRule(ctx, &rule)
+		if err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return errors.New("no ports are blocked")
+	}
+
+	return nil
+}
+
+// getAllFirewallRules returns the rules of a cluster, or of every cluster if
+// clusterID is empty.
+func getAllFirewallRules(clusterID string) ([]FirewallRule, error) {
+	prefix := "firewall-"
+	if clusterID != "" {
+		prefix += clusterID + "-"
+	}
+
+	var rules []FirewallRule
+	err := metaStore.forEachRecord(prefix, func(key string, recordBytes []byte) error {
+		var rule FirewallRule
+		err := json.Unmarshal(recordBytes, &rule)
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Node != rules[j].Node {
+			return rules[i].Node < rules[j].Node
+		}
+		return rules[i].Port < rules[j].Port
+	})
+
+	return rules, nil
+}
+
+func getFirewallRules(ctx context.Context, clusterID string) ([]FirewallRule, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	return getAllFirewallRules(c.ID)
+}
+
+// expireFirewallRules unblocks the ports whose rules have expired, and
+// forgets about the rules of clusters which have been killed.
+func expireFirewallRules(ctx context.Context) error {
+	rules, err := getAllFirewallRules("")
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		ruleCtx := ContextWithNode(ContextWithClusterID(ctx, rule.ClusterID), rule.Node)
+
+		_, err := metaStore.GetClusterMeta(rule.ClusterID)
+		if err == ErrMetaNotFound {
+			err = metaStore.deleteRecord(firewallRuleKey(rule.ClusterID, rule.Node, rule.Port))
+			if err != nil {
+				logWarnf(ruleCtx, "Failed to remove firewall rule of killed cluster: %s", err)
+			}
+			continue
+		}
+
+		if time.Now().Before(rule.ExpiresAt) {
+			continue
+		}
+
+		logInfof(ruleCtx, "Unblocking port %d, its rule has expired", rule.Port)
+		err = removeFirewallRule(ruleCtx, &rule)
+		if err != nil {
+			logWarnf(ruleCtx, "Failed to remove expired firewall rule: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func runFirewallExpiry(shutdownSig chan struct{}) {
+	for {
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(firewallExpiryInterval):
+		}
+
+		if !isLeader() {
+			continue
+		}
+
+		err := expireFirewallRules(systemCtx)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to expire firewall rules: %s", err)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package daemon
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/api"
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC API mirrors the REST API, see api/cbdynclusterd.proto.  Calls are
+// authenticated, rate limited, traced and audited the same way as REST
+// requests, and are served by the same functions as the REST handlers, so
+// that the two APIs can't drift apart.
+
+// watchPollInterval is how often streams which watch a cluster or a job check
+// whether it has changed.
+var watchPollInterval = 5 * time.Second
+
+type grpcServer struct {
+	api.UnimplementedDynClusterServer
+}
+
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcUnaryInterceptor),
+		grpc.StreamInterceptor(grpcStreamInterceptor),
+	)
+	api.RegisterDynClusterServer(server, &grpcServer{})
+	return server
+}
+
+func grpcMetadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// grpcMethodName strips the service from the full name of a method, such as
+// /cbdynclusterd.DynCluster/CreateCluster.
+func grpcMethodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// grpcContext does for gRPC calls what requestIDMiddleware, tracingMiddleware,
+// authMiddleware, rateLimitMiddleware and getHttpContext do for REST requests,
+// returning the context that the call is served with.  The returned span must
+// be ended once the call has finished.
+func grpcContext(ctx context.Context, fullMethod string) (context.Context, trace.Span, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	requestID := grpcMetadataValue(md, "cbdn-request-id")
+	if requestID == "" {
+		requestUUID, _ := uuid.NewRandom()
+		requestID = requestUUID.String()[0:8]
+	}
+	ctx = ContextWithRequestID(ctx, requestID)
+	grpc.SetHeader(ctx, metadata.Pairs("cbdn-request-id", requestID))
+
+	carrier := propagation.HeaderCarrier{}
+	if traceParent := grpcMetadataValue(md, "traceparent"); traceParent != "" {
+		carrier.Set("traceparent", traceParent)
+	}
+	ctx = traceContext.Extract(ctx, carrier)
+	ctx, span := startSpanOfKind(ctx, fullMethod, trace.SpanKindServer)
+
+	apiToken, role, err := authenticateBearer(grpcMetadataValue(md, "authorization"))
+	if err != nil {
+		return ctx, span, status.Error(codes.Unauthenticated, err.Error())
+	}
+	ctx = ContextWithRole(NewContext(ctx, apiToken.User, false), role)
+
+	if rateLimitPerMinute > 0 && !ContextIsAdmin(ctx) {
+		allowed, retryAfter := takeRateLimitToken(apiToken.User, time.Now())
+		if !allowed {
+			rateLimitedRequestsTotal.Inc()
+
+			retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+			return ctx, span, status.Errorf(codes.ResourceExhausted, "too many requests, retry in %d seconds", retrySeconds)
+		}
+	}
+
+	ignoreOwnership := false
+	if grpcMetadataValue(md, "cbdn-admin") == "true" {
+		if !ContextIsAdmin(ctx) {
+			return ctx, span, status.Error(codes.PermissionDenied, "only admins can ignore cluster ownership")
+		}
+		ignoreOwnership = true
+	}
+
+	return NewContext(ctx, apiToken.User, ignoreOwnership), span, nil
+}
+
+// grpcIsReadOnly is whether a method only reads, which like GET requests
+// aren't audited.
+func grpcIsReadOnly(method string) bool {
+	for _, prefix := range []string{"Get", "List", "Watch", "Stream"} {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcFinishCall audits a call which could have changed something, and ends
+// its span.
+func grpcFinishCall(ctx context.Context, span trace.Span, fullMethod string, req interface{}, err error) {
+	method := grpcMethodName(fullMethod)
+	if !grpcIsReadOnly(method) && ContextUser(ctx) != "" {
+		var clusterID, node string
+		if clusterReq, ok := req.(interface{ GetClusterId() string }); ok {
+			clusterID = resolveClusterID(clusterReq.GetClusterId())
+		}
+		if nodeReq, ok := req.(interface{ GetNode() string }); ok {
+			node = nodeReq.GetNode()
+		}
+		// Calls such as CreateCluster only know which cluster they were
+		// about once they have finished.
+		if details, ok := ctx.Value(auditContextKey{}).(*auditDetails); ok && clusterID == "" {
+			details.lock.Lock()
+			clusterID = details.clusterID
+			details.lock.Unlock()
+		}
+
+		recordAudit(ctx, "grpc "+method, clusterID, node, err)
+	}
+
+	endSpan(span, err)
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx = context.WithValue(ctx, auditContextKey{}, &auditDetails{})
+	ctx, span, err := grpcContext(ctx, info.FullMethod)
+	defer func() {
+		grpcFinishCall(ctx, span, info.FullMethod, req, err)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// grpcServerStream replaces the context of a stream with the one it is served
+// with.
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *grpcServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func grpcStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, span, err := grpcContext(stream.Context(), info.FullMethod)
+	defer func() {
+		grpcFinishCall(ctx, span, info.FullMethod, nil, err)
+	}()
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &grpcServerStream{ServerStream: stream, ctx: ctx})
+}
+
+func protoifyNode(node NodeJSON) *api.Node {
+	return &api.Node{
+		Id:                   node.ID,
+		ContainerName:        node.ContainerName,
+		State:                node.State,
+		Name:                 node.Name,
+		InitialServerVersion: node.InitialServerVersion,
+		Ipv4Address:          node.IPv4Address,
+		Ipv6Address:          node.IPv6Address,
+		Hostname:             node.Hostname,
+		Health:               node.Health,
+	}
+}
+
+func protoifyCluster(cluster ClusterJSON) *api.Cluster {
+	protoCluster := &api.Cluster{
+		Id:          cluster.ID,
+		Creator:     cluster.Creator,
+		Owner:       cluster.Owner,
+		Timeout:     cluster.Timeout,
+		Entry:       cluster.EntryPoint,
+		Hibernated:  cluster.Hibernated,
+		SharedWith:  cluster.SharedWith,
+		Team:        cluster.Team,
+		Tags:        cluster.Tags,
+		Alias:       cluster.Alias,
+		Pool:        cluster.Pool,
+		Host:        cluster.Host,
+		Provider:    cluster.Provider,
+		KeepAlive:   cluster.KeepAlive,
+		UseHostname: cluster.UseHostname,
+		Degraded:    cluster.Degraded,
+	}
+
+	if cluster.Credentials != nil {
+		protoCluster.Credentials = &api.ClusterCredentials{
+			Username: cluster.Credentials.Username,
+			Password: cluster.Credentials.Password,
+		}
+	}
+
+	for _, node := range cluster.Nodes {
+		protoCluster.Nodes = append(protoCluster.Nodes, protoifyNode(node))
+	}
+
+	return protoCluster
+}
+
+func protoifyClusterStatus(clusterStatus ClusterStatusJSON) *api.ClusterStatus {
+	protoStatus := &api.ClusterStatus{
+		Healthy:  clusterStatus.Healthy,
+		Balanced: clusterStatus.Balanced,
+		Rebalance: &api.ClusterStatus_Rebalance{
+			Status:   clusterStatus.Rebalance.Status,
+			Progress: clusterStatus.Rebalance.Progress,
+			Error:    clusterStatus.Rebalance.Error,
+		},
+		Services:        make(map[string]*api.ClusterStatus_Hostnames),
+		FailedOverNodes: clusterStatus.FailedOverNodes,
+	}
+
+	for _, node := range clusterStatus.Nodes {
+		protoStatus.Nodes = append(protoStatus.Nodes, &api.ClusterStatus_Node{
+			Name:       node.Name,
+			Hostname:   node.Hostname,
+			Status:     node.Status,
+			Membership: node.Membership,
+			Version:    node.Version,
+			Services:   node.Services,
+		})
+	}
+	for service, hostnames := range clusterStatus.Services {
+		protoStatus.Services[service] = &api.ClusterStatus_Hostnames{Hostnames: hostnames}
+	}
+	for _, bucket := range clusterStatus.Buckets {
+		protoStatus.Buckets = append(protoStatus.Buckets, &api.ClusterStatus_Bucket{
+			Name:         bucket.Name,
+			Ready:        bucket.Ready,
+			NodeStatuses: bucket.NodeStatuses,
+		})
+	}
+
+	return protoStatus
+}
+
+func protoifyJob(job *Job) *api.Job {
+	protoJob := &api.Job{
+		Id:        job.ID,
+		ClusterId: job.ClusterID,
+		Type:      job.Type,
+		State:     job.State,
+		Error:     job.Error,
+		StartedAt: job.StartedAt.Format(time.RFC3339),
+		Output:    job.Output,
+		Progress:  job.Progress,
+	}
+	if job.FinishedAt != nil {
+		protoJob.FinishedAt = job.FinishedAt.Format(time.RFC3339)
+	}
+	return protoJob
+}
+
+func unprotoifyNodeOverrides(overrides *api.NodeOverrides) *NodeOverridesJSON {
+	if overrides == nil {
+		return nil
+	}
+
+	overridesJSON := &NodeOverridesJSON{
+		Env:          overrides.Env,
+		StaticConfig: overrides.StaticConfig,
+		ExtraHosts:   overrides.ExtraHosts,
+		DNSSearch:    overrides.DnsSearch,
+	}
+	for _, setting := range overrides.Settings {
+		overridesJSON.Settings = append(overridesJSON.Settings, NodeSettingJSON{
+			Path:   setting.Path,
+			Values: setting.Values,
+		})
+	}
+	return overridesJSON
+}
+
+func unprotoifyClusterSetup(setup *api.ClusterSetup) *CreateClusterSetupJSON {
+	if setup == nil {
+		return nil
+	}
+
+	setupJSON := &CreateClusterSetupJSON{
+		Services:            setup.Services,
+		StorageMode:         setup.StorageMode,
+		RamQuota:            int(setup.RamQuota),
+		UseHostname:         setup.UseHostname,
+		UseIpv6:             setup.UseIpv6,
+		UseDeveloperPreview: setup.DeveloperPreview,
+	}
+	if setup.Bucket != nil {
+		setupJSON.Bucket = &helper.BucketOption{
+			Name:     setup.Bucket.Name,
+			Type:     setup.Bucket.Type,
+			Password: setup.Bucket.Password,
+		}
+	}
+	if setup.User != nil {
+		roles := setup.User.Roles
+		setupJSON.User = &helper.UserOption{
+			Name:     setup.User.Name,
+			Password: setup.User.Password,
+			Roles:    &roles,
+		}
+	}
+	for _, user := range setup.Users {
+		userJSON := SetupUserJSON{
+			Name:     user.Name,
+			Password: user.Password,
+		}
+		for _, role := range user.Roles {
+			userJSON.Roles = append(userJSON.Roles, SetupUserRoleJSON{
+				Role:   role.Role,
+				Bucket: role.Bucket,
+			})
+		}
+		setupJSON.Users = append(setupJSON.Users, userJSON)
+	}
+	return setupJSON
+}
+
+func (s *grpcServer) ListClusters(ctx context.Context, req *api.ListClustersRequest) (*api.ListClustersResponse, error) {
+	clusters, err := getAllClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := ClusterFilter{Tags: req.Tags}
+	clusters = filterClusters(clusters, filter)
+
+	resp := &api.ListClustersResponse{}
+	for _, cluster := range clusters {
+		if req.Team != "" && cluster.Team != req.Team {
+			continue
+		}
+		resp.Clusters = append(resp.Clusters, protoifyCluster(jsonifyCluster(cluster)))
+	}
+
+	return resp, nil
+}
+
+func (s *grpcServer) GetCluster(ctx context.Context, req *api.GetClusterRequest) (*api.Cluster, error) {
+	cluster, err := getCluster(ctx, resolveClusterID(req.ClusterId))
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyCluster(jsonifyCluster(cluster)), nil
+}
+
+func (s *grpcServer) CreateCluster(ctx context.Context, req *api.CreateClusterRequest) (*api.CreateClusterResponse, error) {
+	reqData := CreateClusterJSON{
+		Timeout:       req.Timeout,
+		Setup:         unprotoifyClusterSetup(req.Setup),
+		Team:          req.Team,
+		Tags:          req.Tags,
+		Alias:         req.Alias,
+		ServerVersion: req.ServerVersion,
+		Provider:      req.Provider,
+		WaitForReady:  req.WaitForReady,
+		ReadyTimeout:  req.ReadyTimeout,
+		KeepAlive:     req.KeepAlive,
+		ContiguousIPs: req.ContiguousIps,
+		ExtraHosts:    req.ExtraHosts,
+		DNSSearch:     req.DnsSearch,
+	}
+	for _, node := range req.Nodes {
+		reqData.Nodes = append(reqData.Nodes, CreateClusterNodeJSON{
+			Name:          node.Name,
+			Platform:      node.Platform,
+			ServerVersion: node.ServerVersion,
+			IPv4Address:   node.Ipv4Address,
+			Overrides:     unprotoifyNodeOverrides(node.Overrides),
+		})
+	}
+
+	clusterID, err := createCluster(ctx, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.CreateClusterResponse{Id: clusterID}, nil
+}
+
+func (s *grpcServer) SetupCluster(ctx context.Context, req *api.SetupClusterRequest) (*api.SetupClusterResponse, error) {
+	if req.Setup == nil {
+		return nil, status.Error(codes.InvalidArgument, "must specify how to set up the cluster")
+	}
+
+	cluster, err := setupCluster(ctx, resolveClusterID(req.ClusterId), *unprotoifyClusterSetup(req.Setup))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.SetupClusterResponse{Entry: cluster.EntryPoint}, nil
+}
+
+func (s *grpcServer) RefreshCluster(ctx context.Context, req *api.RefreshClusterRequest) (*api.Empty, error) {
+	newTimeout, err := time.ParseDuration(req.Timeout)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = refreshCluster(ctx, resolveClusterID(req.ClusterId), newTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Empty{}, nil
+}
+
+func (s *grpcServer) KillCluster(ctx context.Context, req *api.KillClusterRequest) (*api.Empty, error) {
+	err := killCluster(ctx, resolveClusterID(req.ClusterId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Empty{}, nil
+}
+
+func (s *grpcServer) GetClusterStatus(ctx context.Context, req *api.ClusterRef) (*api.ClusterStatus, error) {
+	clusterStatus, err := getClusterStatus(ctx, resolveClusterID(req.ClusterId))
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyClusterStatus(jsonifyClusterStatus(clusterStatus)), nil
+}
+
+func (s *grpcServer) HibernateCluster(ctx context.Context, req *api.ClusterRef) (*api.Empty, error) {
+	err := hibernateCluster(ctx, resolveClusterID(req.ClusterId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Empty{}, nil
+}
+
+func (s *grpcServer) WakeCluster(ctx context.Context, req *api.ClusterRef) (*api.Empty, error) {
+	err := wakeCluster(ctx, resolveClusterID(req.ClusterId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Empty{}, nil
+}
+
+// WatchCluster polls the cluster, since its nodes can change without the
+// daemon doing anything, such as when a container dies.
+func (s *grpcServer) WatchCluster(req *api.ClusterRef, stream api.DynCluster_WatchClusterServer) error {
+	ctx := stream.Context()
+	clusterID := resolveClusterID(req.ClusterId)
+
+	var last *ClusterJSON
+	for {
+		cluster, err := getCluster(ctx, clusterID)
+		if err != nil {
+			if last == nil {
+				return err
+			}
+
+			_, metaErr := metaStore.GetClusterMeta(clusterID)
+			if metaErr != ErrMetaNotFound {
+				return err
+			}
+			return stream.Send(&api.ClusterEvent{
+				Type:    api.ClusterEvent_KILLED,
+				Cluster: protoifyCluster(*last),
+			})
+		}
+
+		jsonCluster := jsonifyCluster(cluster)
+		if last == nil || !reflect.DeepEqual(*last, jsonCluster) {
+			err = stream.Send(&api.ClusterEvent{
+				Type:    api.ClusterEvent_UPDATED,
+				Cluster: protoifyCluster(jsonCluster),
+			})
+			if err != nil {
+				return err
+			}
+			last = &jsonCluster
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchPollInterval):
+		}
+	}
+}
+
+func (s *grpcServer) ExecOnNode(ctx context.Context, req *api.ExecRequest) (*api.ExecResult, error) {
+	result, err := execOnNode(ctx, resolveClusterID(req.ClusterId), req.Node, ExecOptions{
+		Command: req.Command,
+		Args:    req.Args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ExecResult{
+		Stdout:   result.Stdout,
+		Stderr:   result.Stderr,
+		ExitCode: int32(result.ExitCode),
+	}, nil
+}
+
+// logChunkWriter sends everything written to it as chunks of a log stream.
+type logChunkWriter struct {
+	stream api.DynCluster_StreamNodeLogsServer
+}
+
+func (w *logChunkWriter) Write(p []byte) (int, error) {
+	err := w.stream.Send(&api.LogChunk{Data: append([]byte(nil), p...)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *grpcServer) StreamNodeLogs(req *api.NodeLogsRequest, stream api.DynCluster_StreamNodeLogsServer) error {
+	return streamNodeLogs(stream.Context(), resolveClusterID(req.ClusterId), req.Node, NodeLogsOptions{
+		Follow: req.Follow,
+		Tail:   int(req.Tail),
+		File:   req.File,
+	}, &logChunkWriter{stream: stream})
+}
+
+func (s *grpcServer) ReplaceNode(ctx context.Context, req *api.ReplaceNodeRequest) (*api.Node, error) {
+	node, err := replaceNode(ctx, resolveClusterID(req.ClusterId), req.Node, ReplaceNodeOptions{
+		ServerVersion: req.ServerVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyNode(jsonifyNode(node)), nil
+}
+
+func (s *grpcServer) StartCollectInfo(ctx context.Context, req *api.ClusterRef) (*api.CollectInfo, error) {
+	collection, err := startCollectInfo(ctx, resolveClusterID(req.ClusterId))
+	if err != nil {
+		return nil, err
+	}
+
+	protoCollection := &api.CollectInfo{
+		Id:        collection.ID,
+		ClusterId: collection.ClusterID,
+		StartedAt: collection.StartedAt.Format(time.RFC3339),
+	}
+	for _, node := range collection.Nodes {
+		protoCollection.Nodes = append(protoCollection.Nodes, &api.CollectInfo_Node{
+			Name:   node.Name,
+			Status: node.Status,
+			Error:  node.Error,
+		})
+	}
+	return protoCollection, nil
+}
+
+func (s *grpcServer) StartLoad(ctx context.Context, req *api.LoadRequest) (*api.Job, error) {
+	job, err := startLoad(ctx, resolveClusterID(req.ClusterId), LoadOptions{
+		Conf: LoadJSON{
+			Bucket:     req.Bucket,
+			Scope:      req.Scope,
+			Collection: req.Collection,
+			NumItems:   int(req.NumItems),
+			DocSize:    int(req.DocSize),
+			Threads:    int(req.Threads),
+			JSON:       req.Json,
+			Duration:   req.Duration,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyJob(job), nil
+}
+
+func (s *grpcServer) StartBackup(ctx context.Context, req *api.BackupRequest) (*api.Job, error) {
+	job, err := startBackup(ctx, resolveClusterID(req.ClusterId), BackupOptions{
+		Conf: BackupJSON{
+			Repository: req.Repository,
+			Buckets:    req.Buckets,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyJob(job), nil
+}
+
+func (s *grpcServer) StartRestore(ctx context.Context, req *api.RestoreRequest) (*api.Job, error) {
+	job, err := startRestore(ctx, resolveClusterID(req.ClusterId), RestoreOptions{
+		Conf: RestoreJSON{
+			Repository:        req.Repository,
+			Backup:            req.Backup,
+			AutoCreateBuckets: req.AutoCreateBuckets,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyJob(job), nil
+}
+
+func (s *grpcServer) GetJob(ctx context.Context, req *api.GetJobRequest) (*api.Job, error) {
+	job, err := getJob(ctx, req.JobId)
+	if err != nil {
+		return nil, err
+	}
+
+	return protoifyJob(job), nil
+}
+
+func (s *grpcServer) WatchJob(req *api.GetJobRequest, stream api.DynCluster_WatchJobServer) error {
+	ctx := stream.Context()
+
+	var last *Job
+	for {
+		job, err := getJob(ctx, req.JobId)
+		if err != nil {
+			return err
+		}
+
+		if last == nil || !reflect.DeepEqual(*last, *job) {
+			err = stream.Send(protoifyJob(job))
+			if err != nil {
+				return err
+			}
+			last = job
+		}
+
+		if job.State != JobRunning {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchPollInterval):
+		}
+	}
+}
+
+// serveGRPC serves the gRPC API until the server is stopped.
+func serveGRPC(server *grpc.Server, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", address)
+	}
+
+	return server.Serve(listener)
+}
@@ -0,0 +1,182 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+const (
+	NodeHealthUnknown       = "unknown"
+	NodeHealthHealthy       = "healthy"
+	NodeHealthStopped       = "stopped"
+	NodeHealthUnreachable   = "unreachable"
+	NodeHealthMemcachedDown = "memcached_down"
+)
+
+// memcachedPort is where the data service of a node answers.  Memcached runs
+// on every node, whether or not it runs the data service.
+const memcachedPort = 11210
+
+// nodeHealthInterval is how often every running node is probed.
+var nodeHealthInterval = 30 * time.Second
+
+// nodeProbeTimeout is how long a node has to answer each probe.
+const nodeProbeTimeout = 5 * time.Second
+
+// nodeHealth is the result of the last probe of each node, by container ID.
+// Every daemon probes the nodes itself, so that listings don't wait on it.
+var nodeHealth = make(map[string]string)
+var nodeHealthLock sync.RWMutex
+
+// nodeHealthOf is the health of a node as of its last probe.
+func nodeHealthOf(containerID, state string) string {
+	if state != "running" {
+		return NodeHealthStopped
+	}
+
+	nodeHealthLock.RLock()
+	defer nodeHealthLock.RUnlock()
+
+	health, ok := nodeHealth[shortContainerID(containerID)]
+	if !ok {
+		return NodeHealthUnknown
+	}
+	return health
+}
+
+var probeClient = &http.Client{Timeout: nodeProbeTimeout}
+
+// probeManagement checks that ns_server answers on a node.  Any response at
+// all will do, since the node may not have been set up yet.
+func probeManagement(address string) error {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s%s", net.JoinHostPort(address, fmt.Sprint(helper.RestPort)), helper.PPools))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// probeMemcached checks that memcached answers a NOOP on a node.  Any
+// response will do, it doesn't matter whether it was allowed.
+func probeMemcached(address string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, fmt.Sprint(memcachedPort)), nodeProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(nodeProbeTimeout))
+	if err != nil {
+		return err
+	}
+
+	// A binary protocol request header for NOOP, with no extras, key or body
+	noop := make([]byte, 24)
+	noop[0] = 0x80
+	noop[1] = 0x0a
+	_, err = conn.Write(noop)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]byte, 24)
+	_, err = conn.Read(resp)
+	if err != nil {
+		return err
+	}
+	if resp[0] != 0x81 {
+		return errors.Errorf("unexpected response magic %#x", resp[0])
+	}
+	return nil
+}
+
+func probeNode(node *Node) string {
+	if node.IPv4Address == "" {
+		return NodeHealthUnreachable
+	}
+	if probeManagement(node.IPv4Address) != nil {
+		return NodeHealthUnreachable
+	}
+	if probeMemcached(node.IPv4Address) != nil {
+		return NodeHealthMemcachedDown
+	}
+	return NodeHealthHealthy
+}
+
+// probeNodeHealth probes every running node at once, and forgets about nodes
+// which are no longer running.
+func probeNodeHealth(ctx context.Context) error {
+	clusters, err := getAllClusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	var nodes []*Node
+	for _, cluster := range clusters {
+		if cluster.Hibernated {
+			continue
+		}
+		for _, node := range cluster.Nodes {
+			if node.State == "running" {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	health := make(map[string]string)
+	var healthLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			result := probeNode(node)
+
+			healthLock.Lock()
+			health[shortContainerID(node.ContainerID)] = result
+			healthLock.Unlock()
+		}(node)
+	}
+	wg.Wait()
+
+	var unhealthy []string
+	for _, node := range nodes {
+		result := health[shortContainerID(node.ContainerID)]
+		if result != NodeHealthHealthy && nodeHealthOf(node.ContainerID, node.State) == NodeHealthHealthy {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s is %s", node.ContainerName, result))
+		}
+	}
+	if len(unhealthy) > 0 {
+		logWarnf(ctx, "Nodes have become unhealthy: %s", strings.Join(unhealthy, ", "))
+	}
+
+	nodeHealthLock.Lock()
+	nodeHealth = health
+	nodeHealthLock.Unlock()
+
+	return nil
+}
+
+func runNodeHealthProbe(shutdownSig chan struct{}) {
+	for {
+		err := probeNodeHealth(systemCtx)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to probe the health of nodes: %s", err)
+		}
+
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(nodeHealthInterval):
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+)
+
+// Helper containers are arbitrary containers which are run on the same
+// network as the nodes of a cluster for as long as the cluster exists, such
+// as test harnesses, load generators or proxies for fault injection.  They
+// are fixtures of the cluster, so they are removed along with it.
+
+const helperNameLabel = "com.couchbase.dyncluster.helper_name"
+
+// maxHelperContainers stops a single cluster from filling its docker host
+// with helpers, since they don't count towards quotas.
+const maxHelperContainers = 10
+
+var helperNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+type HelperContainerOptions struct {
+	Name       string
+	Image      string
+	Entrypoint []string
+	Cmd        []string
+	Env        map[string]string
+}
+
+// HelperContainer is a helper container of a cluster.  Nodes can reach it by
+// its hostname as well as its address.
+type HelperContainer struct {
+	Name        string
+	ContainerID string
+	Image       string
+	State       string
+	IPv4Address string
+	Hostname    string
+}
+
+func helperContainerName(clusterID, name string) string {
+	return fmt.Sprintf("dynclsr-%s-helper-%s", clusterID, name)
+}
+
+func helperContainerOf(fixture types.Container) *HelperContainer {
+	helperContainer := &HelperContainer{
+		Name:        fixture.Labels[helperNameLabel],
+		ContainerID: fixture.ID[0:12],
+		Image:       fixture.Image,
+		State:       fixture.State,
+		Hostname:    strings.TrimPrefix(fixture.Names[0], "/"),
+	}
+	if eth0Net := fixture.NetworkSettings.Networks[NetworkName]; eth0Net != nil {
+		helperContainer.IPv4Address = eth0Net.IPAddress
+	}
+	return helperContainer
+}
+
+func findHelperContainers(ctx context.Context, clusterID, name string) ([]types.Container, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", fixtureClusterIDLabel+"="+clusterID)
+	filterArgs.Add("label", "com.couchbase.dyncluster.fixture_type=helper")
+	if name != "" {
+		filterArgs.Add("label", helperNameLabel+"="+name)
+	}
+
+	return listContainers(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterArgs,
+	}, true)
+}
+
+func validateHelperContainer(opts HelperContainerOptions) error {
+	if !helperNameRegexp.MatchString(opts.Name) {
+		return errors.Errorf("%q is not a valid helper name, it must be lowercase letters, digits and dashes", opts.Name)
+	}
+	if opts.Image == "" {
+		return errors.New("helper containers need an image")
+	}
+	for name := range opts.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return errors.Errorf("%q is not a valid environment variable name", name)
+		}
+	}
+	return nil
+}
+
+// addHelperContainer starts a helper container on the same docker host and
+// network as the nodes of a cluster.
+func addHelperContainer(ctx context.Context, clusterID string, opts HelperContainerOptions) (*HelperContainer, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Adding helper container %s from %s", opts.Name, opts.Image)
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot add helpers to a hibernated cluster")
+	}
+
+	err = validateHelperContainer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := findHelperContainers(ctx, clusterID, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxHelperContainers {
+		return nil, errors.Errorf("clusters can have at most %d helper containers", maxHelperContainers)
+	}
+	for _, fixture := range existing {
+		if fixture.Labels[helperNameLabel] == opts.Name {
+			return nil, errors.Errorf("cluster already has a helper called %s", opts.Name)
+		}
+	}
+
+	host := getDockerHost(c.Host)
+	if host == nil && len(c.Nodes) > 0 {
+		host = dockerHostOf(c.Nodes[0].ContainerID)
+	}
+	if host == nil {
+		return nil, errors.New("no docker hosts are available")
+	}
+
+	logInfof(ctx, "Pulling %s image", opts.Image)
+	err = imagePull(ctx, host, opts.Image)
+	if err != nil {
+		// The image may have been built or loaded onto the host by hand.
+		logWarnf(ctx, "Failed to pull %s: %s", opts.Image, err)
+	}
+
+	var env []string
+	for name, value := range opts.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	var dns []string
+	if dnsSvcHost != "" {
+		dns = append(dns, dnsSvcHost)
+	}
+
+	release, err := acquireDockerSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	containerName := helperContainerName(clusterID, opts.Name)
+	createResult, err := host.Client.ContainerCreate(context.Background(), &container.Config{
+		Image:      opts.Image,
+		Hostname:   containerName,
+		Entrypoint: opts.Entrypoint,
+		Cmd:        opts.Cmd,
+		Env:        env,
+		Labels: map[string]string{
+			fixtureClusterIDLabel:                   clusterID,
+			"com.couchbase.dyncluster.fixture_type": "helper",
+			helperNameLabel:                         opts.Name,
+		},
+	}, &container.HostConfig{
+		NetworkMode: container.NetworkMode(NetworkName),
+		DNS:         dns,
+	}, nil, containerName)
+	if err != nil {
+		release()
+		return nil, trackDockerError("container_create", err)
+	}
+	rememberContainerHost(createResult.ID, host)
+
+	err = host.Client.ContainerStart(context.Background(), createResult.ID, types.ContainerStartOptions{})
+	release()
+	if err != nil {
+		host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+		forgetContainerHost(createResult.ID)
+		return nil, trackDockerError("container_start", err)
+	}
+
+	containers, err := findHelperContainers(ctx, clusterID, opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, errors.Errorf("helper %s was removed as soon as it started", opts.Name)
+	}
+
+	return helperContainerOf(containers[0]), nil
+}
+
+// getHelperContainers lists the helper containers of a cluster, including
+// those which have exited.
+func getHelperContainers(ctx context.Context, clusterID string) ([]*HelperContainer, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := findHelperContainers(ctx, c.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var helpers []*HelperContainer
+	for _, fixture := range containers {
+		helpers = append(helpers, helperContainerOf(fixture))
+	}
+	sort.Slice(helpers, func(i, j int) bool {
+		return helpers[i].Name < helpers[j].Name
+	})
+
+	return helpers, nil
+}
+
+func removeHelperContainer(ctx context.Context, clusterID, name string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Removing helper container %s", name)
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return errors.New("cannot change clusters you don't own")
+	}
+
+	containers, err := findHelperContainers(ctx, clusterID, name)
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return errors.Errorf("cluster has no helper called %s", name)
+	}
+
+	return removeFixtureContainers(containers)
+}
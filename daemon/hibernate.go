@@ -0,0 +1,419 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// couchbaseDataDir holds both the configuration and the data of a node, so
+// archiving it is enough to bring the node back in a fresh container.
+const couchbaseDataDir = "/opt/couchbase/var"
+
+func hibernationArchiveKey(clusterID, nodeName string) string {
+	return fmt.Sprintf("hibernation/%s/%s.tar", clusterID, nodeName)
+}
+
+func archiveNode(ctx context.Context, containerID, archiveKey string) error {
+	content, _, err := dockerFor(containerID).CopyFromContainer(ctx, containerID, couchbaseDataDir)
+	if err != nil {
+		return errors.Wrapf(err, "could not read data from node %s", containerID)
+	}
+	defer content.Close()
+
+	// The archive is uploaded in parts as it is read, so it doesn't need to be
+	// spooled anywhere first.
+	err = objectStore.PutObject(ctx, archiveKey, content)
+	if err != nil {
+		return errors.Wrapf(err, "could not upload data from node %s", containerID)
+	}
+
+	return nil
+}
+
+func restoreNode(ctx context.Context, containerID, archiveKey string) error {
+	content, err := objectStore.GetObject(ctx, archiveKey)
+	if err != nil {
+		return errors.Wrapf(err, "could not download data for node %s", containerID)
+	}
+	defer content.Close()
+
+	// The archive was taken of the data directory itself, so it needs to be
+	// extracted into its parent.
+	err = dockerFor(containerID).CopyToContainer(ctx, containerID, "/opt/couchbase", content, types.CopyToContainerOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not restore data to node %s", containerID)
+	}
+
+	return nil
+}
+
+func deleteHibernationArchives(ctx context.Context, hibernation *HibernationMeta) {
+	for _, node := range hibernation.Nodes {
+		err := objectStore.DeleteObject(ctx, node.ArchiveKey)
+		if err != nil {
+			logWarnf(ctx, "Failed to delete hibernation archive %s: %s", node.ArchiveKey, err)
+		}
+	}
+}
+
+func hibernateCluster(ctx context.Context, clusterID string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Hibernating cluster")
+
+	if objectStore == nil {
+		return errors.New("object storage is not configured for this daemon")
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !isClusterOwner(ctx, cluster) {
+		return errors.New("cannot hibernate clusters you don't own")
+	}
+
+	finishOperation, err := beginOperation(ctx, OperationHibernate, clusterID)
+	if err != nil {
+		return err
+	}
+	defer finishOperation()
+
+	// The cluster is looked up again now that nothing else can be hibernating
+	// or waking it.
+	cluster, err = getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if cluster.Hibernated {
+		return errors.New("cluster is already hibernated")
+	}
+
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return err
+	}
+
+	err = requireStableNodeAddresses(cluster)
+	if err != nil {
+		return err
+	}
+
+	// Pause every node before taking any archives so that the archives are
+	// consistent with each other across the cluster.
+	for _, node := range cluster.Nodes {
+		err := dockerFor(node.ContainerID).ContainerPause(ctx, node.ContainerID)
+		if err != nil {
+			unpauseNodes(ctx, cluster.Nodes)
+			return errors.Wrapf(err, "could not pause node %s", node.ContainerID)
+		}
+	}
+
+	timeLeft := time.Until(cluster.Timeout)
+	if timeLeft < 0 {
+		timeLeft = 0
+	}
+	hibernation := &HibernationMeta{
+		Creator:      cluster.Creator,
+		HibernatedAt: time.Now(),
+		TimeLeft:     timeLeft,
+	}
+	// Hibernated clusters are kept for the retention period rather than
+	// until their timeout, their timeout starts again once they are woken.
+	retainUntil := hibernation.HibernatedAt.Add(getRuntimeConfig().HibernationRetention)
+
+	signal := make(chan error)
+
+	for _, node := range cluster.Nodes {
+		archiveKey := hibernationArchiveKey(clusterID, node.Name)
+		hibernation.Nodes = append(hibernation.Nodes, HibernatedNode{
+			Name:          node.Name,
+			ServerVersion: node.InitialServerVersion,
+			ArchiveKey:    archiveKey,
+		})
+
+		go func(containerID, archiveKey string) {
+			signal <- archiveNode(ctx, containerID, archiveKey)
+		}(node.ContainerID, archiveKey)
+	}
+
+	var archiveError error
+	for range cluster.Nodes {
+		err := <-signal
+		if err != nil && archiveError == nil {
+			archiveError = err
+		}
+	}
+
+	unpauseNodes(ctx, cluster.Nodes)
+
+	if archiveError != nil {
+		deleteHibernationArchives(ctx, hibernation)
+		return archiveError
+	}
+
+	_, err = metaStore.GetClusterMeta(clusterID)
+	if err != nil {
+		err = metaStore.CreateClusterMeta(clusterID, ClusterMeta{
+			Owner:       cluster.Owner,
+			Timeout:     retainUntil,
+			Hibernation: hibernation,
+		})
+	} else {
+		err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+			meta.Timeout = retainUntil
+			meta.Hibernation = hibernation
+			return meta, nil
+		})
+	}
+	if err != nil {
+		deleteHibernationArchives(ctx, hibernation)
+		return err
+	}
+
+	for _, node := range cluster.Nodes {
+		err := killNode(ctx, node.ContainerID)
+		if err != nil {
+			logWarnf(ctx, "Failed to kill hibernated node %s: %s", node.ContainerID, err)
+		}
+	}
+
+	return nil
+}
+
+// requireStableNodeAddresses checks that the nodes of a cluster will still be
+// able to find each other once it is woken.  Woken nodes get new containers,
+// which only come back with the addresses they had if they were given them
+// from the IP pool, so clusters whose nodes know each other by address can't
+// be hibernated otherwise.
+func requireStableNodeAddresses(cluster *Cluster) error {
+	if len(cluster.Nodes) < 2 || cluster.UseHostname {
+		return nil
+	}
+
+	nodeIPs, err := clusterNodeIPs(cluster.ID)
+	if err != nil {
+		return err
+	}
+	for _, node := range cluster.Nodes {
+		if nodeIPs[node.Name] == "" {
+			return errors.New("clusters with several nodes can only be hibernated if they were set up with use_hostname, or their nodes have addresses from the ip pool")
+		}
+	}
+
+	return nil
+}
+
+func unpauseNodes(ctx context.Context, nodes []*Node) {
+	for _, node := range nodes {
+		err := dockerFor(node.ContainerID).ContainerUnpause(context.Background(), node.ContainerID)
+		if err != nil {
+			logWarnf(ctx, "Failed to unpause node %s: %s", node.ContainerID, err)
+		}
+	}
+}
+
+func wakeCluster(ctx context.Context, clusterID string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Waking cluster")
+
+	if objectStore == nil {
+		return errors.New("object storage is not configured for this daemon")
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !isClusterOwner(ctx, cluster) {
+		return errors.New("cannot wake clusters you don't own")
+	}
+
+	finishOperation, err := beginOperation(ctx, OperationWake, clusterID)
+	if err != nil {
+		return err
+	}
+	defer finishOperation()
+
+	cluster, err = getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !cluster.Hibernated {
+		return errors.New("cluster is not hibernated")
+	}
+
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err != nil {
+		return err
+	}
+	hibernation := meta.Hibernation
+
+	timeLeft := hibernation.TimeLeft
+	if timeLeft <= 0 {
+		timeLeft = getRuntimeConfig().DefaultClusterTimeout
+	}
+	timeout := time.Now().Add(timeLeft)
+
+	// The cluster may as well come back on whichever host is least loaded now,
+	// rather than where it was before it was hibernated.
+	host, releasePlacement, err := placeNodes(ctx, len(hibernation.Nodes))
+	if err != nil {
+		return err
+	}
+	defer releasePlacement()
+
+	// Nodes come back with the addresses they had before, if they were
+	// given them from the IP pool.
+	nodeIPs, err := clusterNodeIPs(clusterID)
+	if err != nil {
+		return err
+	}
+
+	var nodesToAllocate []NodeOptions
+	builtImages := make(map[string]bool)
+	for _, node := range hibernation.Nodes {
+		nodeVersion, err := parseServerVersion(node.ServerVersion)
+		if err != nil {
+			return err
+		}
+
+		if !builtImages[nodeVersion.toImageName()] {
+			err = ensureImage(ctx, host, clusterID, nodeVersion)
+			if err != nil {
+				return err
+			}
+			builtImages[nodeVersion.toImageName()] = true
+		}
+
+		nodesToAllocate = append(nodesToAllocate, NodeOptions{
+			Name:           node.Name,
+			ServerVersion:  node.ServerVersion,
+			VersionInfo:    nodeVersion,
+			IPv4Address:    nodeIPs[node.Name],
+			Overrides:      meta.NodeOverrides[node.Name],
+			restoreArchive: node.ArchiveKey,
+			host:           host,
+		})
+	}
+
+	// The new containers should look like they were created by the original
+	// creator, so that the cluster remains visible to them.
+	creatorCtx := NewContext(ctx, hibernation.Creator, ContextIgnoreOwnership(ctx))
+
+	type allocateResult struct {
+		containerID string
+		err         error
+	}
+	signal := make(chan allocateResult)
+
+	for _, node := range nodesToAllocate {
+		go func(node NodeOptions) {
+			containerID, err := allocateNode(creatorCtx, clusterID, timeout, node)
+			signal <- allocateResult{containerID, err}
+		}(node)
+	}
+
+	var createError error
+	var createdNodes []string
+	for range nodesToAllocate {
+		res := <-signal
+		if res.err != nil && createError == nil {
+			createError = res.err
+		}
+		if res.containerID != "" {
+			createdNodes = append(createdNodes, res.containerID)
+		}
+	}
+	if createError != nil {
+		// Leave the hibernation archives in place so that waking can be retried.
+		for _, containerID := range createdNodes {
+			killNode(ctx, containerID)
+		}
+		return createError
+	}
+
+	err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Hibernation = nil
+		meta.Timeout = timeout
+		meta.Host = host.Name
+		return meta, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	deleteHibernationArchives(ctx, hibernation)
+
+	return nil
+}
+
+// recoverInterruptedHibernation deals with a hibernation which the daemon
+// stopped in the middle of.  Once the meta-data records the hibernation its
+// archives are complete, so all that is left is to remove the nodes which
+// weren't killed yet.  Otherwise the nodes are unpaused and carry on as they
+// were, and any archives which were already uploaded are removed.
+func recoverInterruptedHibernation(ctx context.Context, clusterID string) error {
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil || cluster.Hibernated {
+		// The cluster is gone, or every node had already been killed.
+		return nil
+	}
+
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err == nil && meta.Hibernation != nil {
+		for _, node := range cluster.Nodes {
+			err := killNode(ctx, node.ContainerID)
+			if err != nil {
+				logWarnf(ctx, "Failed to kill hibernated node %s: %s", node.ContainerID, err)
+			}
+		}
+		return nil
+	}
+
+	unpauseNodes(ctx, cluster.Nodes)
+
+	if objectStore != nil {
+		for _, node := range cluster.Nodes {
+			archiveKey := hibernationArchiveKey(clusterID, node.Name)
+			err := objectStore.DeleteObject(ctx, archiveKey)
+			if err != nil {
+				logWarnf(ctx, "Failed to delete hibernation archive %s: %s", archiveKey, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// recoverInterruptedWake removes the nodes which a wake that the daemon
+// stopped in the middle of had created, leaving the hibernation archives in
+// place so that waking the cluster can be retried.
+func recoverInterruptedWake(ctx context.Context, clusterID string) error {
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err != nil || meta.Hibernation == nil {
+		// The cluster is gone, or had already been woken.
+		return nil
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil || cluster.Hibernated {
+		return nil
+	}
+
+	for _, node := range cluster.Nodes {
+		err := killNode(ctx, node.ContainerID)
+		if err != nil {
+			logWarnf(ctx, "Failed to kill partially woken node %s: %s", node.ContainerID, err)
+		}
+	}
+
+	return nil
+}
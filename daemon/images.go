@@ -5,11 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/couchbaselabs/cbdynclusterd/helper"
 	"github.com/docker/docker/api/types"
 	"github.com/jhoonb/archivex"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
 )
 
 type imageEvent struct {
@@ -27,13 +32,145 @@ type imageBuildArgs struct {
 	BuildNo string
 }
 
-func imagePush(ctx context.Context, nodeVersion *NodeVersion) error {
-	eventReader, err := docker.ImagePush(ctx, nodeVersion.toImageName(), types.ImagePushOptions{
-		RegistryAuth: dockerRegistry,
+func checkBuildExists(url string) error {
+	resp, err := http.Head(url)
+	if err != nil {
+		return errors.Wrap(err, "Could not locate build")
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("Could not locate build")
+	}
+
+	return nil
+}
+
+// imageRevision is stamped onto the images which the daemon builds, images
+// pulled from the registry with any other revision are rebuilt and pushed
+// again.  It needs bumping whenever the Dockerfile changes in a way which
+// nodes depend on, such as 2 for libfaketime being preloaded.
+const imageRevision = "2"
+
+const imageRevisionLabel = "com.couchbase.dyncluster.image_revision"
+
+// imageIsCurrent returns whether an image was built from the current revision
+// of the Dockerfile.
+func imageIsCurrent(ctx context.Context, host *DockerHost, containerImage string) (bool, error) {
+	image, _, err := host.Client.ImageInspectWithRaw(ctx, containerImage)
+	if err != nil {
+		return false, trackDockerError("image_inspect", err)
+	}
+
+	return image.Config != nil && image.Config.Labels[imageRevisionLabel] == imageRevision, nil
+}
+
+// imageGroup deduplicates work on the same image, so that concurrent
+// allocations of a version all wait on a single pull or build.
+var imageGroup singleflight.Group
+
+// imageFetchTimeout is how long a pull or build of an image can take.
+var imageFetchTimeout = 1 * time.Hour
+
+// ensureImage makes sure that the image for the requested version is available
+// on a docker host, pulling it from the registry or building it as needed.
+func ensureImage(ctx context.Context, host *DockerHost, clusterID string, nodeVersion *NodeVersion) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	containerImage := nodeVersion.toImageName()
+
+	// The fetch is shared by every allocation waiting on the image, so it
+	// runs on its own context rather than on that of the allocation which
+	// started it, which may give up while the others are still waiting.
+	fetchResult := imageGroup.DoChan(host.Name+"/"+containerImage, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(ContextWithClusterID(systemCtx, clusterID), imageFetchTimeout)
+		defer cancel()
+
+		release, err := acquireDockerSlot(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		return nil, fetchImage(fetchCtx, host, nodeVersion)
 	})
+
+	select {
+	case res := <-fetchResult:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func fetchImage(ctx context.Context, host *DockerHost, nodeVersion *NodeVersion) error {
+	containerImage := nodeVersion.toImageName()
+
+	if getRuntimeConfig().DockerRegistry == "" {
+		err := checkBuildExists(nodeVersion.toPkgURL())
+		if err != nil {
+			return err
+		}
+
+		_, _, inspectErr := host.Client.ImageInspectWithRaw(ctx, containerImage)
+
+		// If the image is already built then this will won't rebuild
+		logInfof(ctx, "Building %s image", containerImage)
+		buildCtx, span := startSpan(ctx, "docker.ImageBuild", attribute.String("docker.image", containerImage))
+		err = imageBuild(buildCtx, host, nodeVersion, helper.DockerFilePath+"couchbase/centos7") // TODO: might want this to be a config too
+		endSpan(span, err)
+		if err == nil && inspectErr != nil {
+			publishClusterEvent(ctx, newImageBuiltEvent(ctx, containerImage))
+		}
+		return err
+	}
+
+	logInfof(ctx, "Pulling %s image", containerImage)
+	pullCtx, span := startSpan(ctx, "docker.ImagePull", attribute.String("docker.image", containerImage))
+	err := imagePull(pullCtx, host, containerImage)
+	endSpan(span, err)
+	if err == nil {
+		current, err := imageIsCurrent(ctx, host, containerImage)
+		if err != nil {
+			return err
+		}
+		if current {
+			return nil
+		}
+		logInfof(ctx, "Image %s was built from an old revision of the Dockerfile", containerImage)
+	}
+
+	// assume that pull failed because the image didn't exist on the registry,
+	// or was out of date, check the build exists and then build the image
+	err = checkBuildExists(nodeVersion.toPkgURL())
+	if err != nil {
+		return err
+	}
+
+	logInfof(ctx, "Building %s image", containerImage)
+	buildCtx, span := startSpan(ctx, "docker.ImageBuild", attribute.String("docker.image", containerImage))
+	err = imageBuild(buildCtx, host, nodeVersion, helper.DockerFilePath+"couchbase/centos7") // TODO: might want this to be a config too
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
+	publishClusterEvent(ctx, newImageBuiltEvent(ctx, containerImage))
+
+	logInfof(ctx, "Pushing %s image", containerImage)
+	pushCtx, span := startSpan(ctx, "docker.ImagePush", attribute.String("docker.image", containerImage))
+	err = imagePush(pushCtx, host, nodeVersion)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func imagePush(ctx context.Context, host *DockerHost, nodeVersion *NodeVersion) error {
+	eventReader, err := host.Client.ImagePush(ctx, nodeVersion.toImageName(), types.ImagePushOptions{
+		RegistryAuth: getRuntimeConfig().DockerRegistry,
+	})
+	if err != nil {
+		return trackDockerError("image_push", err)
+	}
 
 	defer eventReader.Close()
 	err = parseImageEvent(eventReader)
@@ -44,9 +181,15 @@ func imagePush(ctx context.Context, nodeVersion *NodeVersion) error {
 	return nil
 }
 
-func imageBuild(ctx context.Context, nodeVersion *NodeVersion, dockerfilePath string) error {
+func imageBuild(ctx context.Context, host *DockerHost, nodeVersion *NodeVersion, dockerfilePath string) error {
+	startTime := time.Now()
+	result := "failure"
+	defer func() {
+		imageBuildDurationSeconds.WithLabelValues(result).Observe(time.Since(startTime).Seconds())
+	}()
+
 	tar := new(archivex.TarFile)
-	tarPath := fmt.Sprintf("/tmp/%s-%s.tar", nodeVersion.Version, nodeVersion.Build)
+	tarPath := fmt.Sprintf("/tmp/%s-%s-%s.tar", host.Name, nodeVersion.Version, nodeVersion.Build)
 	err := tar.Create(tarPath)
 	if err != nil {
 		return errors.Wrap(err, "could not create tar file")
@@ -62,24 +205,29 @@ func imageBuild(ctx context.Context, nodeVersion *NodeVersion, dockerfilePath st
 
 	pkg := nodeVersion.toPkgName()
 	url := nodeVersion.toURL()
+	pkgURL := nodeVersion.toPkgURL()
 	buildArgs := make(map[string]*string)
 	buildArgs["VERSION"] = &nodeVersion.Version
 	buildArgs["BUILD_NO"] = &nodeVersion.Build
 	buildArgs["FLAVOR"] = &nodeVersion.Flavor
 	buildArgs["BUILD_PKG"] = &pkg
 	buildArgs["BASE_URL"] = &url
+	buildArgs["BUILD_URL"] = &pkgURL
+	buildArgs["BUILD_SHA256"] = &nodeVersion.Checksum
+	revision := imageRevision
+	buildArgs["IMAGE_REVISION"] = &revision
 
 	buildCtx, err := os.Open(tarPath)
 	defer buildCtx.Close()
 
-	resp, err := docker.ImageBuild(ctx, buildCtx, types.ImageBuildOptions{
+	resp, err := host.Client.ImageBuild(ctx, buildCtx, types.ImageBuildOptions{
 		PullParent:     true,
 		Tags:           []string{nodeVersion.toImageName()},
 		BuildArgs:      buildArgs,
 		SuppressOutput: false,
 	})
 	if err != nil {
-		return err
+		return trackDockerError("image_build", err)
 	}
 	defer resp.Body.Close()
 	err = parseImageEvent(resp.Body)
@@ -87,16 +235,17 @@ func imageBuild(ctx context.Context, nodeVersion *NodeVersion, dockerfilePath st
 		return errors.Wrap(err, "could not build image")
 	}
 
+	result = "success"
 	return nil
 }
 
-func imagePull(ctx context.Context, imageRef string) error {
-	eventReader, err := docker.ImagePull(ctx, imageRef, types.ImagePullOptions{
+func imagePull(ctx context.Context, host *DockerHost, imageRef string) error {
+	eventReader, err := host.Client.ImagePull(ctx, imageRef, types.ImagePullOptions{
 		All:          false,
-		RegistryAuth: dockerRegistry,
+		RegistryAuth: getRuntimeConfig().DockerRegistry,
 	})
 	if err != nil {
-		return err
+		return trackDockerError("image_pull", err)
 	}
 
 	defer eventReader.Close()
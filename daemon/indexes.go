@@ -0,0 +1,227 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/pkg/errors"
+)
+
+// indexesWaitTimeout bounds how long we wait for new indexes to be built,
+// which can take a while on buckets which already hold data.
+const indexesWaitTimeout = 5 * time.Minute
+
+const primaryIndexName = "#primary"
+
+var indexNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+type AddIndexesOptions struct {
+	Conf AddIndexesJSON
+}
+
+func indexName(index CreateIndexJSON) string {
+	if index.Name == "" && index.Primary {
+		return primaryIndexName
+	}
+	return index.Name
+}
+
+// indexKeyspace returns the keyspace that an index is on, as it is written
+// in N1QL.
+func indexKeyspace(index CreateIndexJSON) string {
+	if index.Collection == "" {
+		return "`" + index.Bucket + "`"
+	}
+	return fmt.Sprintf("`%s`.`%s`.`%s`", index.Bucket, index.Scope, index.Collection)
+}
+
+func validateIndexes(indexes []CreateIndexJSON) error {
+	indexNames := make(map[string]bool)
+	for _, index := range indexes {
+		if index.Bucket == "" {
+			return errors.New("indexes must have a bucket")
+		}
+		if index.Name == "" && !index.Primary {
+			return errors.New("secondary indexes must have a name")
+		}
+		if index.Name != "" && !indexNameRegexp.MatchString(index.Name) {
+			return errors.Errorf("%q is not a valid index name", index.Name)
+		}
+		for _, identifier := range []string{index.Bucket, index.Scope, index.Collection} {
+			if strings.Contains(identifier, "`") {
+				return errors.Errorf("%q is not a valid keyspace for index %s", identifier, indexName(index))
+			}
+		}
+		if (index.Scope == "") != (index.Collection == "") {
+			return errors.Errorf("index %s must specify both a scope and a collection, or neither", indexName(index))
+		}
+		if index.Primary && (len(index.Fields) > 0 || index.Where != "") {
+			return errors.Errorf("primary index %s cannot have fields or a where clause", indexName(index))
+		}
+		if !index.Primary && len(index.Fields) == 0 {
+			return errors.Errorf("index %s must have at least one field", index.Name)
+		}
+		if index.NumReplicas < 0 {
+			return errors.Errorf("index %s cannot have a negative number of replicas", indexName(index))
+		}
+
+		key := indexKeyspace(index) + "." + indexName(index)
+		if indexNames[key] {
+			return errors.Errorf("index %s is specified more than once on %s", indexName(index), indexKeyspace(index))
+		}
+		indexNames[key] = true
+	}
+
+	return nil
+}
+
+func createIndexStatement(index CreateIndexJSON) string {
+	var statement string
+	if index.Primary {
+		statement = "CREATE PRIMARY INDEX"
+		if index.Name != "" {
+			statement += " `" + index.Name + "`"
+		}
+		statement += " ON " + indexKeyspace(index)
+	} else {
+		statement = fmt.Sprintf("CREATE INDEX `%s` ON %s(%s)", index.Name, indexKeyspace(index), strings.Join(index.Fields, ", "))
+		if index.Where != "" {
+			statement += " WHERE " + index.Where
+		}
+	}
+
+	if index.NumReplicas > 0 {
+		statement += fmt.Sprintf(` WITH {"num_replica": %d}`, index.NumReplicas)
+	}
+
+	return statement
+}
+
+// addIndexes creates the GSI indexes which don't already exist on a cluster.
+func addIndexes(ctx context.Context, clusterID string, opts AddIndexesOptions) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	if len(opts.Conf.Indexes) == 0 {
+		return errors.New("must specify at least one index")
+	}
+	err := validateIndexes(opts.Conf.Indexes)
+	if err != nil {
+		return err
+	}
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if c.Provider == ProviderCapella {
+		return errors.New("indexes cannot be added to capella clusters")
+	}
+	if len(c.Nodes) == 0 {
+		return errors.New("no nodes available")
+	}
+
+	node, err := findServiceNode(c.Nodes, "n1ql")
+	if err != nil {
+		return err
+	}
+	queryNode := restNodeOf(node)
+
+	for _, index := range opts.Conf.Indexes {
+		logInfof(ctx, "Creating index %s on %s", indexName(index), indexKeyspace(index))
+		_, err := queryNode.ExecuteN1qlQuery(createIndexStatement(index))
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return errors.Wrapf(err, "failed to create index %s", indexName(index))
+		}
+	}
+
+	if !opts.Conf.Wait {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, indexesWaitTimeout)
+	defer cancel()
+	return waitForIndexes(waitCtx, queryNode, opts.Conf.Indexes)
+}
+
+type indexStatus struct {
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	BucketID   string `json:"bucket_id"`
+	ScopeID    string `json:"scope_id"`
+	KeyspaceID string `json:"keyspace_id"`
+}
+
+func (status indexStatus) matches(index CreateIndexJSON) bool {
+	if status.Name != indexName(index) {
+		return false
+	}
+	if index.Collection == "" {
+		return status.BucketID == "" && status.KeyspaceID == index.Bucket
+	}
+	return status.BucketID == index.Bucket && status.ScopeID == index.Scope && status.KeyspaceID == index.Collection
+}
+
+// waitForIndexes waits until every index is online, since indexes are built
+// in the background after they are created.
+func waitForIndexes(ctx context.Context, queryNode *cluster.Node, indexes []CreateIndexJSON) error {
+	var lastPending string
+	for {
+		statuses, err := getIndexStatuses(queryNode)
+		if err == nil {
+			pending := pendingIndexes(statuses, indexes)
+			if len(pending) == 0 {
+				return nil
+			}
+			if joined := strings.Join(pending, ", "); joined != lastPending {
+				logInfof(ctx, "Waiting for indexes to be online: %s", joined)
+				lastPending = joined
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "indexes were not online in time")
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func getIndexStatuses(queryNode *cluster.Node) ([]indexStatus, error) {
+	results, err := queryNode.ExecuteN1qlQuery(
+		"SELECT i.name, i.state, i.bucket_id, i.scope_id, i.keyspace_id FROM system:indexes AS i WHERE i.`using` = \"gsi\"")
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []indexStatus
+	for _, result := range results {
+		var status indexStatus
+		if err := json.Unmarshal(result, &status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func pendingIndexes(statuses []indexStatus, indexes []CreateIndexJSON) []string {
+	var pending []string
+	for _, index := range indexes {
+		state := "missing"
+		for _, status := range statuses {
+			if status.matches(index) {
+				state = status.State
+				break
+			}
+		}
+		if state != "online" {
+			pending = append(pending, fmt.Sprintf("%s (%s)", indexName(index), state))
+		}
+	}
+	return pending
+}
@@ -0,0 +1,500 @@
+package daemon
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ipRanges are the addresses which the daemon gives nodes on the docker
+// network itself, rather than leaving it to docker's IPAM.  Nodes then keep
+// their addresses for as long as their cluster exists, even across
+// hibernation, so DNS records and alternate addresses don't go stale.  Docker
+// must be kept from handing these out to other containers, such as by giving
+// the network an --ip-range outside of them.
+var ipRanges []ipRange
+
+// ipPoolLock serializes reservations made by this daemon, reservations are
+// created atomically so that other daemons sharing the meta-data store can't
+// take the same addresses.
+var ipPoolLock sync.Mutex
+
+type ipRange struct {
+	first uint32
+	last  uint32
+}
+
+func (r ipRange) contains(ip uint32) bool {
+	return ip >= r.first && ip <= r.last
+}
+
+func (r ipRange) String() string {
+	return uint32ToIP(r.first).String() + "-" + uint32ToIP(r.last).String()
+}
+
+// IPReservation records that an address of the IP pool belongs to a node of
+// a cluster.
+type IPReservation struct {
+	Address   string `json:"address"`
+	ClusterID string `json:"cluster_id"`
+	NodeName  string `json:"node_name"`
+	// Static is set for addresses which the user asked for.
+	Static     bool      `json:"static"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+// IPConflict is an address of the IP pool which is in use by a container
+// other than the one it is reserved for.
+type IPConflict struct {
+	Address   string
+	Container string
+	Reason    string
+}
+
+type IPPoolStatus struct {
+	Ranges       []string
+	Reservations []IPReservation
+	Conflicts    []IPConflict
+}
+
+func ipReservationKey(address string) string {
+	return "ip-" + address
+}
+
+func ipToUint32(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip4), true
+}
+
+func uint32ToIP(ip uint32) net.IP {
+	ipBytes := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ipBytes, ip)
+	return ipBytes
+}
+
+// parseIPRanges parses IPv4 ranges in the form
+// 10.112.200.10-10.112.200.99,10.112.201.0/25.
+func parseIPRanges(rangesStr string) ([]ipRange, error) {
+	var ranges []ipRange
+	if rangesStr == "" {
+		return ranges, nil
+	}
+
+	for _, rangeStr := range strings.Split(rangesStr, ",") {
+		rangeStr = strings.TrimSpace(rangeStr)
+
+		var r ipRange
+		if strings.Contains(rangeStr, "/") {
+			_, ipNet, err := net.ParseCIDR(rangeStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip range %s: %s", rangeStr, err)
+			}
+			first, ok := ipToUint32(ipNet.IP)
+			ones, bits := ipNet.Mask.Size()
+			if !ok || bits != 32 {
+				return nil, fmt.Errorf("ip range %s is not IPv4", rangeStr)
+			}
+			r = ipRange{first: first, last: first | (1<<uint(32-ones) - 1)}
+		} else {
+			rangeParts := strings.SplitN(rangeStr, "-", 2)
+			if len(rangeParts) != 2 {
+				return nil, fmt.Errorf("ip ranges must be first-last or a CIDR, not %s", rangeStr)
+			}
+			first, okFirst := ipToUint32(net.ParseIP(rangeParts[0]))
+			last, okLast := ipToUint32(net.ParseIP(rangeParts[1]))
+			if !okFirst || !okLast || last < first {
+				return nil, fmt.Errorf("invalid ip range %s", rangeStr)
+			}
+			r = ipRange{first: first, last: last}
+		}
+
+		for _, other := range ranges {
+			if r.first <= other.last && other.first <= r.last {
+				return nil, fmt.Errorf("ip range %s overlaps %s", rangeStr, other)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+
+	return ranges, nil
+}
+
+func inIPRanges(ip uint32) bool {
+	for _, r := range ipRanges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func getIPReservations() ([]IPReservation, error) {
+	var reservations []IPReservation
+	err := metaStore.forEachRecord("ip-", func(key string, recordBytes []byte) error {
+		var reservation IPReservation
+		err := json.Unmarshal(recordBytes, &reservation)
+		if err != nil {
+			return err
+		}
+
+		reservations = append(reservations, reservation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+// networkAddressesInUse returns the containers using each address of the
+// docker network, across every docker host.
+func networkAddressesInUse(ctx context.Context) (map[string]string, error) {
+	inUse := make(map[string]string)
+	for _, host := range getDockerHosts() {
+		network, err := host.Client.NetworkInspect(ctx, NetworkName)
+		if err != nil {
+			return nil, errors.Wrapf(trackDockerError("network_inspect", err), "failed to inspect the network of docker host %s", host.Name)
+		}
+
+		for _, endpoint := range network.Containers {
+			address := strings.SplitN(endpoint.IPv4Address, "/", 2)[0]
+			if address != "" {
+				inUse[address] = endpoint.Name
+			}
+		}
+	}
+	return inUse, nil
+}
+
+func reserveIP(reservation IPReservation) error {
+	reservationBytes, err := json.Marshal(&reservation)
+	if err != nil {
+		return err
+	}
+
+	err = metaStore.createRawRecord(ipReservationKey(reservation.Address), reservationBytes)
+	if err == ErrMetaExists {
+		return errors.Errorf("address %s is already reserved", reservation.Address)
+	}
+	return err
+}
+
+// reserveNodeIPs reserves an address of the IP pool for each node of a new
+// cluster, filling in their IPv4Address.  Addresses which were asked for are
+// reserved as they are, the rest are the lowest free ones, or the lowest
+// block of free ones in a single range if contiguous is set.
+func reserveNodeIPs(ctx context.Context, clusterID string, nodes []NodeOptions, contiguous bool) (err error) {
+	if len(ipRanges) == 0 {
+		for _, node := range nodes {
+			if node.IPv4Address != "" {
+				return errors.New("static addresses need the daemon to be run with ip-ranges")
+			}
+		}
+		return nil
+	}
+
+	ipPoolLock.Lock()
+	defer ipPoolLock.Unlock()
+
+	inUse, err := networkAddressesInUse(ctx)
+	if err != nil {
+		return err
+	}
+
+	reservations, err := getIPReservations()
+	if err != nil {
+		return err
+	}
+	taken := make(map[uint32]bool)
+	for _, reservation := range reservations {
+		ip, _ := ipToUint32(net.ParseIP(reservation.Address))
+		taken[ip] = true
+	}
+	for address := range inUse {
+		ip, _ := ipToUint32(net.ParseIP(address))
+		taken[ip] = true
+	}
+
+	var reserved []string
+	defer func() {
+		if err != nil {
+			for _, address := range reserved {
+				metaStore.deleteRecord(ipReservationKey(address))
+			}
+		}
+	}()
+
+	now := time.Now()
+	var dynamicNodes []int
+	for i, node := range nodes {
+		if node.IPv4Address == "" {
+			dynamicNodes = append(dynamicNodes, i)
+			continue
+		}
+
+		ip, ok := ipToUint32(net.ParseIP(node.IPv4Address))
+		if !ok {
+			return errors.Errorf("%s is not a valid IPv4 address", node.IPv4Address)
+		}
+		if !inIPRanges(ip) {
+			return errors.Errorf("%s is not in the ip ranges of the daemon", node.IPv4Address)
+		}
+		if container, ok := inUse[node.IPv4Address]; ok {
+			return errors.Errorf("address %s is already in use by %s", node.IPv4Address, container)
+		}
+
+		err = reserveIP(IPReservation{
+			Address:    node.IPv4Address,
+			ClusterID:  clusterID,
+			NodeName:   node.Name,
+			Static:     true,
+			ReservedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		reserved = append(reserved, node.IPv4Address)
+		taken[ip] = true
+	}
+
+	addresses, err := freeIPs(taken, len(dynamicNodes), contiguous)
+	if err != nil {
+		return err
+	}
+
+	for i, nodeIdx := range dynamicNodes {
+		err = reserveIP(IPReservation{
+			Address:    addresses[i],
+			ClusterID:  clusterID,
+			NodeName:   nodes[nodeIdx].Name,
+			ReservedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		reserved = append(reserved, addresses[i])
+		nodes[nodeIdx].IPv4Address = addresses[i]
+	}
+
+	logInfof(ctx, "Reserved addresses %s", strings.Join(reserved, ", "))
+
+	return nil
+}
+
+// freeIPs finds count addresses of the IP pool which aren't taken.
+func freeIPs(taken map[uint32]bool, count int, contiguous bool) ([]string, error) {
+	var addresses []string
+	if count == 0 {
+		return addresses, nil
+	}
+
+	for _, r := range ipRanges {
+		for ip := uint64(r.first); ip <= uint64(r.last); ip++ {
+			if taken[uint32(ip)] {
+				if contiguous {
+					addresses = nil
+				}
+				continue
+			}
+
+			addresses = append(addresses, uint32ToIP(uint32(ip)).String())
+			if len(addresses) == count {
+				return addresses, nil
+			}
+		}
+
+		// Blocks can't span ranges, the gap between them may well belong to
+		// somebody else.
+		if contiguous {
+			addresses = nil
+		}
+	}
+
+	if contiguous {
+		return nil, errors.Errorf("there is no block of %d free addresses in the ip ranges", count)
+	}
+	return nil, errors.Errorf("there are not %d free addresses in the ip ranges", count)
+}
+
+// clusterNodeIPs returns the addresses reserved for each node of a cluster.
+func clusterNodeIPs(clusterID string) (map[string]string, error) {
+	reservations, err := getIPReservations()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]string)
+	for _, reservation := range reservations {
+		if reservation.ClusterID == clusterID {
+			addresses[reservation.NodeName] = reservation.Address
+		}
+	}
+	return addresses, nil
+}
+
+// releaseClusterIPs returns the addresses of a cluster which is being killed
+// to the IP pool.
+func releaseClusterIPs(ctx context.Context, clusterID string) {
+	reservations, err := getIPReservations()
+	if err != nil {
+		logWarnf(ctx, "Failed to release the addresses of the cluster: %s", err)
+		return
+	}
+
+	for _, reservation := range reservations {
+		if reservation.ClusterID != clusterID {
+			continue
+		}
+
+		err = metaStore.deleteRecord(ipReservationKey(reservation.Address))
+		if err != nil {
+			logWarnf(ctx, "Failed to release address %s: %s", reservation.Address, err)
+		}
+	}
+}
+
+// releaseStaleIPReservations returns addresses to the IP pool whose clusters
+// no longer have meta-data, such as allocations which were interrupted.
+// Reservations are only made once the meta-data of a cluster exists.
+func releaseStaleIPReservations(ctx context.Context) error {
+	reservations, err := getIPReservations()
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		_, err := metaStore.GetClusterMeta(reservation.ClusterID)
+		if err != ErrMetaNotFound {
+			continue
+		}
+
+		logInfof(ContextWithClusterID(ctx, reservation.ClusterID), "Releasing address %s of cluster which no longer exists", reservation.Address)
+		err = metaStore.deleteRecord(ipReservationKey(reservation.Address))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ipConflicts finds addresses of the IP pool which are used by containers
+// they aren't reserved for, such as ones given out by docker's IPAM.
+func ipConflicts(inUse map[string]string, reservations []IPReservation) []IPConflict {
+	reservedFor := make(map[string]IPReservation)
+	for _, reservation := range reservations {
+		reservedFor[reservation.Address] = reservation
+	}
+
+	var conflicts []IPConflict
+	for address, container := range inUse {
+		ip, ok := ipToUint32(net.ParseIP(address))
+		if !ok || !inIPRanges(ip) {
+			continue
+		}
+
+		reservation, reserved := reservedFor[address]
+		if !reserved {
+			conflicts = append(conflicts, IPConflict{
+				Address:   address,
+				Container: container,
+				Reason:    "the address is not reserved",
+			})
+		} else if !strings.HasPrefix(container, fmt.Sprintf("dynclsr-%s-", reservation.ClusterID)) {
+			conflicts = append(conflicts, IPConflict{
+				Address:   address,
+				Container: container,
+				Reason:    fmt.Sprintf("the address is reserved for node %s of cluster %s", reservation.NodeName, reservation.ClusterID),
+			})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Address < conflicts[j].Address
+	})
+
+	return conflicts
+}
+
+func getIPPoolStatus(ctx context.Context) (*IPPoolStatus, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can see the ip pool")
+	}
+
+	reservations, err := getIPReservations()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse, err := networkAddressesInUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &IPPoolStatus{
+		Reservations: reservations,
+		Conflicts:    ipConflicts(inUse, reservations),
+	}
+	for _, r := range ipRanges {
+		status.Ranges = append(status.Ranges, r.String())
+	}
+
+	return status, nil
+}
+
+// releaseIP removes a reservation by hand, such as one that was left behind
+// by a cluster whose meta-data is still around.
+func releaseIP(ctx context.Context, address string) error {
+	if !ContextIsAdmin(ctx) {
+		return errors.New("only admins can release addresses")
+	}
+
+	var reservation IPReservation
+	err := metaStore.getRecord(ipReservationKey(address), &reservation)
+	if err == ErrMetaNotFound {
+		return errors.Errorf("address %s is not reserved", address)
+	} else if err != nil {
+		return err
+	}
+
+	logInfof(ContextWithClusterID(ctx, reservation.ClusterID), "Releasing address %s of node %s", address, reservation.NodeName)
+
+	return metaStore.deleteRecord(ipReservationKey(address))
+}
+
+// releaseNodeIP returns the address of a node which has been removed from its
+// cluster to the IP pool.
+func releaseNodeIP(ctx context.Context, clusterID, nodeName string) {
+	reservations, err := getIPReservations()
+	if err != nil {
+		logWarnf(ctx, "Failed to release the address of node %s: %s", nodeName, err)
+		return
+	}
+
+	for _, reservation := range reservations {
+		if reservation.ClusterID != clusterID || reservation.NodeName != nodeName {
+			continue
+		}
+
+		err = metaStore.deleteRecord(ipReservationKey(reservation.Address))
+		if err != nil {
+			logWarnf(ctx, "Failed to release address %s: %s", reservation.Address, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package daemon
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseIPRanges(t *testing.T, rangesStr string) []ipRange {
+	ranges, err := parseIPRanges(rangesStr)
+	if err != nil {
+		t.Fatalf("failed to parse ip ranges %s: %s", rangesStr, err)
+	}
+	return ranges
+}
+
+func takenIPs(t *testing.T, addresses ...string) map[uint32]bool {
+	taken := make(map[uint32]bool)
+	for _, address := range addresses {
+		ip, ok := ipToUint32(net.ParseIP(address))
+		if !ok {
+			t.Fatalf("%s is not an IPv4 address", address)
+		}
+		taken[ip] = true
+	}
+	return taken
+}
+
+func TestParseIPRanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranges    string
+		want      []string
+		wantError bool
+	}{
+		{name: "empty", ranges: "", want: nil},
+		{name: "first-last", ranges: "10.0.0.10-10.0.0.20", want: []string{"10.0.0.10-10.0.0.20"}},
+		{name: "cidr", ranges: "10.0.1.0/30", want: []string{"10.0.1.0-10.0.1.3"}},
+		{name: "sorted", ranges: "10.0.1.0/30, 10.0.0.1-10.0.0.1", want: []string{"10.0.0.1-10.0.0.1", "10.0.1.0-10.0.1.3"}},
+		{name: "overlapping", ranges: "10.0.0.0/24,10.0.0.200-10.0.1.10", wantError: true},
+		{name: "backwards", ranges: "10.0.0.20-10.0.0.10", wantError: true},
+		{name: "not a range", ranges: "10.0.0.1", wantError: true},
+		{name: "ipv6", ranges: "fd00::/120", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges, err := parseIPRanges(test.ranges)
+			if test.wantError {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ranges)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var got []string
+			for _, r := range ranges {
+				got = append(got, r.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestFreeIPs(t *testing.T) {
+	tests := []struct {
+		name       string
+		ranges     string
+		taken      []string
+		count      int
+		contiguous bool
+		want       []string
+		wantError  bool
+	}{
+		{
+			name:   "lowest addresses first",
+			ranges: "10.0.0.1-10.0.0.5",
+			count:  2,
+			want:   []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:   "skips taken addresses",
+			ranges: "10.0.0.1-10.0.0.5",
+			taken:  []string{"10.0.0.1", "10.0.0.3"},
+			count:  2,
+			want:   []string{"10.0.0.2", "10.0.0.4"},
+		},
+		{
+			name:   "spans ranges",
+			ranges: "10.0.0.1-10.0.0.2,10.0.1.1-10.0.1.2",
+			taken:  []string{"10.0.0.1"},
+			count:  2,
+			want:   []string{"10.0.0.2", "10.0.1.1"},
+		},
+		{
+			name:       "contiguous skips gaps",
+			ranges:     "10.0.0.1-10.0.0.6",
+			taken:      []string{"10.0.0.2", "10.0.0.4"},
+			count:      2,
+			contiguous: true,
+			want:       []string{"10.0.0.5", "10.0.0.6"},
+		},
+		{
+			name:       "contiguous blocks don't span ranges",
+			ranges:     "10.0.0.1-10.0.0.2,10.0.0.4-10.0.0.6",
+			taken:      []string{"10.0.0.1"},
+			count:      2,
+			contiguous: true,
+			want:       []string{"10.0.0.4", "10.0.0.5"},
+		},
+		{
+			name:   "none",
+			ranges: "10.0.0.1-10.0.0.2",
+			taken:  []string{"10.0.0.1", "10.0.0.2"},
+			count:  0,
+			want:   []string{},
+		},
+		{
+			name:      "exhausted",
+			ranges:    "10.0.0.1-10.0.0.3",
+			taken:     []string{"10.0.0.1", "10.0.0.3"},
+			count:     2,
+			wantError: true,
+		},
+		{
+			name:       "no contiguous block",
+			ranges:     "10.0.0.1-10.0.0.5",
+			taken:      []string{"10.0.0.2", "10.0.0.4"},
+			count:      2,
+			contiguous: true,
+			wantError:  true,
+		},
+		{
+			name:      "no ranges",
+			ranges:    "",
+			count:     1,
+			wantError: true,
+		},
+	}
+
+	oldRanges := ipRanges
+	defer func() {
+		ipRanges = oldRanges
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ipRanges = mustParseIPRanges(t, test.ranges)
+
+			addresses, err := freeIPs(takenIPs(t, test.taken...), test.count, test.contiguous)
+			if test.wantError {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addresses)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if addresses == nil {
+				addresses = []string{}
+			}
+			if !reflect.DeepEqual(addresses, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, addresses)
+			}
+		})
+	}
+}
+
+// TestFreeIPsAfterRelease checks that addresses can be handed out again once
+// their reservations are released, as happens when a cluster is killed.
+func TestFreeIPsAfterRelease(t *testing.T) {
+	oldRanges := ipRanges
+	defer func() {
+		ipRanges = oldRanges
+	}()
+	ipRanges = mustParseIPRanges(t, "10.0.0.1-10.0.0.3")
+
+	taken := takenIPs(t)
+	for i := 0; i < 3; i++ {
+		addresses, err := freeIPs(taken, 1, false)
+		if err != nil {
+			t.Fatalf("failed to reserve address %d: %s", i, err)
+		}
+		for k := range takenIPs(t, addresses...) {
+			taken[k] = true
+		}
+	}
+
+	_, err := freeIPs(taken, 1, false)
+	if err == nil {
+		t.Fatalf("expected the pool to be exhausted")
+	}
+
+	released, _ := ipToUint32(net.ParseIP("10.0.0.2"))
+	delete(taken, released)
+
+	addresses, err := freeIPs(taken, 1, false)
+	if err != nil {
+		t.Fatalf("failed to reserve released address: %s", err)
+	}
+	if !reflect.DeepEqual(addresses, []string{"10.0.0.2"}) {
+		t.Fatalf("expected the released address, got %v", addresses)
+	}
+}
+
+func TestIPConflicts(t *testing.T) {
+	oldRanges := ipRanges
+	defer func() {
+		ipRanges = oldRanges
+	}()
+	ipRanges = mustParseIPRanges(t, "10.0.0.1-10.0.0.10")
+
+	reservations := []IPReservation{
+		{Address: "10.0.0.1", ClusterID: "aaaaaaaa", NodeName: "node1"},
+		{Address: "10.0.0.2", ClusterID: "aaaaaaaa", NodeName: "node2"},
+	}
+
+	tests := []struct {
+		name          string
+		inUse         map[string]string
+		wantAddresses []string
+	}{
+		{
+			name:  "reserved for the container using it",
+			inUse: map[string]string{"10.0.0.1": "dynclsr-aaaaaaaa-node1"},
+		},
+		{
+			name:          "not reserved",
+			inUse:         map[string]string{"10.0.0.3": "something-else"},
+			wantAddresses: []string{"10.0.0.3"},
+		},
+		{
+			name:          "reserved for another cluster",
+			inUse:         map[string]string{"10.0.0.2": "dynclsr-bbbbbbbb-node1"},
+			wantAddresses: []string{"10.0.0.2"},
+		},
+		{
+			name:  "outside of the pool",
+			inUse: map[string]string{"10.0.1.1": "something-else"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var addresses []string
+			for _, conflict := range ipConflicts(test.inUse, reservations) {
+				addresses = append(addresses, conflict.Address)
+			}
+			if !reflect.DeepEqual(addresses, test.wantAddresses) {
+				t.Fatalf("expected conflicts on %v, got %v", test.wantAddresses, addresses)
+			}
+		})
+	}
+}
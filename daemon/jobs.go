@@ -0,0 +1,212 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// jobRetention is how long the records of finished jobs are kept, so that
+// their results can still be fetched after they finish.
+var jobRetention = 24 * time.Hour
+
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+const (
+	JobTypeLoad          = "load"
+	JobTypeBackup        = "backup"
+	JobTypeRestore       = "restore"
+	JobTypeRebalance     = "rebalance"
+	JobTypeStopRebalance = "stop-rebalance"
+	JobTypeFailover      = "failover"
+	JobTypeRecovery      = "recovery"
+)
+
+// Job is a long running piece of work against a cluster, which runs in the
+// background of the request which started it.
+type Job struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	ClusterID string `json:"cluster_id"`
+	Owner     string `json:"owner"`
+	Requester string `json:"requester"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"`
+	Output    string `json:"output,omitempty"`
+	// Progress is how far through the job is as a percentage, for jobs
+	// which can tell.
+	Progress   float64    `json:"progress,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Instance is the daemon running the job.
+	Instance string `json:"instance,omitempty"`
+}
+
+// jobFunc does the work of a job, returning any output worth keeping.
+type jobFunc func(ctx context.Context, job Job) (string, error)
+
+func jobKey(jobID string) string {
+	return fmt.Sprintf("job-%s", jobID)
+}
+
+// startJob records a job against a cluster and runs it in the background.
+func startJob(ctx context.Context, jobType string, cluster *Cluster, fn jobFunc) (*Job, error) {
+	jobID, _ := uuid.NewRandom()
+	job := &Job{
+		ID:        jobID.String()[0:8],
+		Type:      jobType,
+		ClusterID: cluster.ID,
+		Owner:     cluster.Owner,
+		Requester: ContextUser(ctx),
+		State:     JobRunning,
+		StartedAt: time.Now(),
+		Instance:  daemonInstanceID,
+	}
+
+	err := metaStore.setRecord(jobKey(job.ID), job)
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs take minutes, so they must outlive the request that started them.
+	jobCtx := NewContext(context.Background(), ContextUser(ctx), ContextIgnoreOwnership(ctx))
+	jobCtx = ContextWithRequestID(jobCtx, ContextRequestID(ctx))
+	jobCtx = ContextWithClusterID(jobCtx, cluster.ID)
+	go func() {
+		logInfof(jobCtx, "Starting %s job %s", jobType, job.ID)
+		output, err := fn(jobCtx, *job)
+		if err != nil {
+			logErrorf(jobCtx, "Job %s failed: %s", job.ID, err)
+		} else {
+			logInfof(jobCtx, "Job %s completed", job.ID)
+		}
+		finishJob(job.ID, output, err)
+	}()
+
+	return job, nil
+}
+
+// setJobProgress records how far through a running job is.
+func setJobProgress(jobID string, progress float64) {
+	var job Job
+	err := metaStore.getRecord(jobKey(jobID), &job)
+	if err != nil {
+		logErrorf(context.Background(), "Failed to load job %s: %s", jobID, err)
+		return
+	}
+
+	job.Progress = progress
+	err = metaStore.setRecord(jobKey(jobID), job)
+	if err != nil {
+		logErrorf(context.Background(), "Failed to update job %s: %s", jobID, err)
+	}
+}
+
+func finishJob(jobID, output string, jobErr error) {
+	var job Job
+	err := metaStore.getRecord(jobKey(jobID), &job)
+	if err != nil {
+		logErrorf(context.Background(), "Failed to load job %s: %s", jobID, err)
+		return
+	}
+
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	job.Output = output
+	job.State = JobCompleted
+	if job.Progress > 0 {
+		job.Progress = 100
+	}
+	if jobErr != nil {
+		job.State = JobFailed
+		job.Error = jobErr.Error()
+	}
+
+	err = metaStore.setRecord(jobKey(jobID), job)
+	if err != nil {
+		logErrorf(context.Background(), "Failed to update job %s: %s", jobID, err)
+	}
+}
+
+func getJob(ctx context.Context, jobID string) (*Job, error) {
+	var job Job
+	err := metaStore.getRecord(jobKey(jobID), &job)
+	if err != nil {
+		return nil, errors.New("job not found")
+	}
+
+	if !ContextIgnoreOwnership(ctx) && job.Requester != ContextUser(ctx) && job.Owner != ContextUser(ctx) {
+		return nil, errors.New("job not found")
+	}
+
+	return &job, nil
+}
+
+// failInterruptedJobs fails the jobs which were running on daemons which
+// have since stopped, since nothing is running them anymore.
+func failInterruptedJobs() error {
+	live, err := liveInstances()
+	if err != nil {
+		return err
+	}
+
+	var interrupted []string
+	err = metaStore.forEachRecord("job-", func(key string, recordBytes []byte) error {
+		var job Job
+		err := json.Unmarshal(recordBytes, &job)
+		if err != nil {
+			return err
+		}
+
+		if job.State == JobRunning && !live[job.Instance] {
+			interrupted = append(interrupted, job.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, jobID := range interrupted {
+		logWarnf(systemCtx, "Failing job %s which was interrupted", jobID)
+		finishJob(jobID, "", errors.New("interrupted by the daemon stopping"))
+	}
+
+	return nil
+}
+
+func cleanupJobs() error {
+	var expired []string
+	err := metaStore.forEachRecord("job-", func(key string, recordBytes []byte) error {
+		var job Job
+		err := json.Unmarshal(recordBytes, &job)
+		if err != nil {
+			return err
+		}
+
+		if job.FinishedAt != nil && job.FinishedAt.Add(jobRetention).Before(time.Now()) {
+			expired = append(expired, job.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, jobID := range expired {
+		err = metaStore.deleteRecord(jobKey(jobID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
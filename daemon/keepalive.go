@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// keepAliveInterval is how often the activity of keep-alive clusters is
+// sampled.
+const keepAliveInterval = 5 * time.Minute
+
+// keepAliveExtension is how long an active keep-alive cluster is kept around
+// for after it was last seen in use.
+const keepAliveExtension = time.Hour
+
+// keepAliveMinTraffic is how many bytes the nodes of a cluster must send and
+// receive between samples for it to count as in use.  Idle clusters still
+// talk among themselves, so this needs to be well above that.
+var keepAliveMinTraffic uint64 = 16 * 1024 * 1024
+
+// keepAliveTraffic is the network traffic of each keep-alive cluster at the
+// last sample.
+var keepAliveTraffic = make(map[string]uint64)
+
+func setClusterKeepAlive(ctx context.Context, clusterID string, keepAlive bool) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Setting cluster keep-alive to %t", keepAlive)
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if !canManageCluster(ctx, cluster) {
+		return errors.New("cannot change clusters you don't own")
+	}
+	if keepAlive {
+		// Activity is only known for clusters which we run the containers of.
+		err = requireDockerCluster(cluster)
+		if err != nil {
+			return err
+		}
+	}
+
+	return metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.KeepAlive = keepAlive
+		return meta, nil
+	})
+}
+
+// clusterTraffic is how many bytes the nodes of a cluster have sent and
+// received since they started.
+func clusterTraffic(ctx context.Context, cluster *Cluster) (uint64, error) {
+	var traffic uint64
+	for _, node := range cluster.Nodes {
+		usage, err := getContainerUsage(ctx, node.ContainerID)
+		if err != nil {
+			return 0, err
+		}
+		traffic += usage.NetworkRx + usage.NetworkTx
+	}
+	return traffic, nil
+}
+
+// keepAliveClusters extends the timeout of keep-alive clusters which have
+// been in use since the last sample, so that they aren't reaped while
+// somebody is still working with them.
+func keepAliveClusters(ctx context.Context) error {
+	clusters, err := getAllClusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, cluster := range clusters {
+		if !cluster.KeepAlive || cluster.Hibernated || requireDockerCluster(cluster) != nil {
+			continue
+		}
+		seen[cluster.ID] = true
+		clusterCtx := ContextWithClusterID(ctx, cluster.ID)
+
+		traffic, err := clusterTraffic(ctx, cluster)
+		if err != nil {
+			logWarnf(clusterCtx, "Failed to sample cluster activity: %s", err)
+			continue
+		}
+
+		// The first sample of a cluster only tells us where to count from.
+		lastTraffic, sampled := keepAliveTraffic[cluster.ID]
+		keepAliveTraffic[cluster.ID] = traffic
+		if !sampled || traffic < lastTraffic || traffic-lastTraffic < keepAliveMinTraffic {
+			continue
+		}
+
+		extension := keepAliveExtension
+		if maxTimeout := getRuntimeConfig().MaxClusterTimeout; extension > maxTimeout {
+			extension = maxTimeout
+		}
+		newTimeout := time.Now().Add(extension)
+		if !cluster.Timeout.Before(newTimeout) {
+			continue
+		}
+
+		logInfof(clusterCtx, "Cluster is in use, extending its timeout to %s", newTimeout.Format(time.RFC3339))
+		err = metaStore.UpdateClusterMeta(cluster.ID, func(meta ClusterMeta) (ClusterMeta, error) {
+			if meta.Timeout.Before(newTimeout) {
+				meta.Timeout = newTimeout
+			}
+			return meta, nil
+		})
+		if err != nil {
+			logWarnf(clusterCtx, "Failed to extend cluster timeout: %s", err)
+		}
+	}
+
+	for clusterID := range keepAliveTraffic {
+		if !seen[clusterID] {
+			delete(keepAliveTraffic, clusterID)
+		}
+	}
+
+	return nil
+}
+
+func runKeepAlive(shutdownSig chan struct{}) {
+	for {
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(keepAliveInterval):
+		}
+
+		if !isLeader() {
+			continue
+		}
+
+		err := keepAliveClusters(systemCtx)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to keep active clusters alive: %s", err)
+		}
+	}
+}
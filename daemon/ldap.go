@@ -0,0 +1,495 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// An LDAP fixture is an OpenLDAP server which is run next to the nodes of a
+// cluster for as long as the cluster exists, seeded with users and groups
+// and with the cluster authenticating against it, so that tests of external
+// authentication don't need a directory of their own.
+
+const ldapImage = "osixia/openldap:1.5.0"
+const ldapPort = 389
+const ldapDomain = "dyncluster.local"
+const ldapBaseDN = "dc=dyncluster,dc=local"
+const ldapAdminDN = "cn=admin," + ldapBaseDN
+const ldapUsersDN = "ou=users," + ldapBaseDN
+const ldapGroupsDN = "ou=groups," + ldapBaseDN
+
+// ldapBootstrapPath is where the image reads LDIF files to seed the directory
+// with the first time that it starts.
+const ldapBootstrapPath = "/container/service/slapd/assets/config/bootstrap/ldif/custom"
+
+// ldapStartTimeout is how long the server has to start listening once its
+// container has been started.
+const ldapStartTimeout = 2 * time.Minute
+
+const fixtureClusterIDLabel = "com.couchbase.dyncluster.fixture_cluster_id"
+
+var ldapNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// LDAPFixture is how to reach the LDAP server of a cluster.
+type LDAPFixture struct {
+	ContainerID  string
+	Address      string
+	BindPassword string
+}
+
+func ldapUserDN(name string) string {
+	return "uid=" + name + "," + ldapUsersDN
+}
+
+func ldapGroupDN(name string) string {
+	return "cn=" + name + "," + ldapGroupsDN
+}
+
+func validateLDAPFixture(opts AddLDAPFixtureJSON) error {
+	if len(opts.Users) == 0 {
+		return errors.New("an ldap fixture needs at least one user")
+	}
+
+	userNames := make(map[string]bool)
+	for _, user := range opts.Users {
+		if !ldapNameRegexp.MatchString(user.Name) {
+			return errors.Errorf("%q is not a valid ldap user name", user.Name)
+		}
+		if userNames[user.Name] {
+			return errors.Errorf("user %s is specified more than once", user.Name)
+		}
+		userNames[user.Name] = true
+		if user.Password == "" {
+			return errors.Errorf("user %s must have a password", user.Name)
+		}
+		// Users without roles of their own get them from their groups.
+		if len(user.Roles) > 0 {
+			_, err := setupRoles(user.Roles, "user "+user.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	groupNames := make(map[string]bool)
+	for _, group := range opts.Groups {
+		if !ldapNameRegexp.MatchString(group.Name) {
+			return errors.Errorf("%q is not a valid ldap group name", group.Name)
+		}
+		if groupNames[group.Name] {
+			return errors.Errorf("group %s is specified more than once", group.Name)
+		}
+		groupNames[group.Name] = true
+		// groupOfNames entries can't be empty.
+		if len(group.Members) == 0 {
+			return errors.Errorf("group %s must have at least one member", group.Name)
+		}
+		for _, member := range group.Members {
+			if !userNames[member] {
+				return errors.Errorf("member %s of group %s is not one of the users", member, group.Name)
+			}
+		}
+		_, err := setupRoles(group.Roles, "group "+group.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ldapFixtureLDIF is the directory which the server is seeded with.
+// Passwords are base64 encoded, so that they can contain anything.
+func ldapFixtureLDIF(opts AddLDAPFixtureJSON) string {
+	var ldif strings.Builder
+	fmt.Fprintf(&ldif, "dn: %s\nobjectClass: organizationalUnit\nou: users\n\n", ldapUsersDN)
+	fmt.Fprintf(&ldif, "dn: %s\nobjectClass: organizationalUnit\nou: groups\n\n", ldapGroupsDN)
+
+	for _, user := range opts.Users {
+		fmt.Fprintf(&ldif, "dn: %s\nobjectClass: inetOrgPerson\nuid: %s\ncn: %s\nsn: %s\nuserPassword:: %s\n\n",
+			ldapUserDN(user.Name), user.Name, user.Name, user.Name,
+			base64.StdEncoding.EncodeToString([]byte(user.Password)))
+	}
+
+	for _, group := range opts.Groups {
+		fmt.Fprintf(&ldif, "dn: %s\nobjectClass: groupOfNames\ncn: %s\n", ldapGroupDN(group.Name), group.Name)
+		for _, member := range group.Members {
+			fmt.Fprintf(&ldif, "member: %s\n", ldapUserDN(member))
+		}
+		ldif.WriteString("\n")
+	}
+
+	return ldif.String()
+}
+
+// startLDAPFixture runs an LDAP server seeded with the users and groups on
+// the same docker host and network as the nodes of a cluster, and waits for
+// it to start listening.
+func startLDAPFixture(ctx context.Context, host *DockerHost, clusterID string, opts AddLDAPFixtureJSON) (*LDAPFixture, error) {
+	logInfof(ctx, "Pulling %s image", ldapImage)
+	err := imagePull(ctx, host, ldapImage)
+	if err != nil {
+		// The image may have been loaded onto the host by hand.
+		logWarnf(ctx, "Failed to pull %s: %s", ldapImage, err)
+	}
+
+	release, err := acquireDockerSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordUUID, _ := uuid.NewRandom()
+	fixture := &LDAPFixture{
+		BindPassword: passwordUUID.String(),
+	}
+
+	var dns []string
+	if dnsSvcHost != "" {
+		dns = append(dns, dnsSvcHost)
+	}
+	createResult, err := host.Client.ContainerCreate(context.Background(), &container.Config{
+		Image: ldapImage,
+		// Seeding moves the LDIF files, which can't be done to those copied in.
+		Cmd: []string{"--copy-service"},
+		Env: []string{
+			"LDAP_ORGANISATION=cbdynclusterd",
+			"LDAP_DOMAIN=" + ldapDomain,
+			"LDAP_ADMIN_PASSWORD=" + fixture.BindPassword,
+		},
+		Labels: map[string]string{
+			fixtureClusterIDLabel:                   clusterID,
+			"com.couchbase.dyncluster.fixture_type": "ldap",
+		},
+	}, &container.HostConfig{
+		AutoRemove:  true,
+		NetworkMode: container.NetworkMode(NetworkName),
+		DNS:         dns,
+	}, nil, fmt.Sprintf("dynclsr-%s-ldap", clusterID))
+	if err != nil {
+		release()
+		return nil, trackDockerError("container_create", err)
+	}
+	fixture.ContainerID = createResult.ID[0:12]
+	rememberContainerHost(createResult.ID, host)
+
+	removeContainer := func() {
+		host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+	}
+
+	ldif := []byte(ldapFixtureLDIF(opts))
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	err = writer.WriteHeader(&tar.Header{Name: "50-dyncluster.ldif", Mode: 0644, Size: int64(len(ldif))})
+	if err == nil {
+		_, err = writer.Write(ldif)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		release()
+		removeContainer()
+		return nil, err
+	}
+
+	err = host.Client.CopyToContainer(ctx, createResult.ID, ldapBootstrapPath, &archive, types.CopyToContainerOptions{})
+	if err != nil {
+		release()
+		removeContainer()
+		return nil, errors.Wrap(trackDockerError("copy_to_container", err), "could not seed the ldap server")
+	}
+
+	err = host.Client.ContainerStart(context.Background(), createResult.ID, types.ContainerStartOptions{})
+	release()
+	if err != nil {
+		removeContainer()
+		return nil, trackDockerError("container_start", err)
+	}
+
+	containerJSON, err := host.Client.ContainerInspect(context.Background(), createResult.ID)
+	if err != nil {
+		removeContainer()
+		return nil, trackDockerError("container_inspect", err)
+	}
+	fixture.Address = containerJSON.NetworkSettings.Networks[NetworkName].IPAddress
+
+	startCtx, cancel := context.WithTimeout(ctx, ldapStartTimeout)
+	defer cancel()
+	err = waitForPort(startCtx, net.JoinHostPort(fixture.Address, strconv.Itoa(ldapPort)))
+	if err != nil {
+		removeContainer()
+		return nil, err
+	}
+
+	return fixture, nil
+}
+
+// configureLDAPFixture points the cluster at its LDAP server, and gives the
+// users and groups of the server their roles.
+func configureLDAPFixture(node *Node, fixture *LDAPFixture, opts AddLDAPFixtureJSON) error {
+	userDNMapping, err := json.Marshal(map[string]string{"template": ldapUserDN("%u")})
+	if err != nil {
+		return err
+	}
+
+	restNode := restNodeOf(node)
+	err = restNode.UpdateSettings(helper.PSettingsLDAP, map[string]string{
+		"hosts":                 fixture.Address,
+		"port":                  strconv.Itoa(ldapPort),
+		"encryption":            "None",
+		"bindDN":                ldapAdminDN,
+		"bindPass":              fixture.BindPassword,
+		"authenticationEnabled": "true",
+		"authorizationEnabled":  strconv.FormatBool(len(opts.Groups) > 0),
+		"userDNMapping":         string(userDNMapping),
+		"groupsQuery":           ldapGroupsDN + "??one?(member=%D)",
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to configure ldap")
+	}
+
+	for _, user := range opts.Users {
+		if len(user.Roles) == 0 {
+			continue
+		}
+
+		roles, err := setupRoles(user.Roles, "user "+user.Name)
+		if err != nil {
+			return err
+		}
+		err = restNode.CreateExternalUser(user.Name, roles)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create external user %s", user.Name)
+		}
+	}
+
+	for _, group := range opts.Groups {
+		roles, err := setupRoles(group.Roles, "group "+group.Name)
+		if err != nil {
+			return err
+		}
+		err = restNode.CreateGroup(group.Name, roles, ldapGroupDN(group.Name))
+		if err != nil {
+			return errors.Wrapf(err, "failed to create group %s", group.Name)
+		}
+	}
+
+	return nil
+}
+
+func ldapFixtureCluster(ctx context.Context, clusterID string) (*Cluster, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot change the ldap server of a hibernated cluster")
+	}
+
+	return c, nil
+}
+
+// addLDAPFixture starts an LDAP server for a cluster which has been set up,
+// and configures the cluster to authenticate against it.  The server is
+// removed again if the cluster can't be configured.
+func addLDAPFixture(ctx context.Context, clusterID string, opts AddLDAPFixtureJSON) (*LDAPFixture, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Adding ldap fixture with %d users and %d groups", len(opts.Users), len(opts.Groups))
+
+	c, err := ldapFixtureCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nodes) == 0 {
+		return nil, errors.New("no nodes available")
+	}
+
+	err = validateLDAPFixture(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := findLDAPFixtures(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, errors.New("cluster already has an ldap server")
+	}
+
+	host := dockerHostOf(c.Nodes[0].ContainerID)
+	fixture, err := startLDAPFixture(ctx, host, clusterID, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = configureLDAPFixture(c.Nodes[0], fixture, opts)
+	if err != nil {
+		host.Client.ContainerRemove(context.Background(), fixture.ContainerID, types.ContainerRemoveOptions{Force: true})
+		return nil, err
+	}
+
+	return fixture, nil
+}
+
+func findLDAPFixtures(ctx context.Context, clusterID string) ([]types.Container, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", fixtureClusterIDLabel+"="+clusterID)
+	filterArgs.Add("label", "com.couchbase.dyncluster.fixture_type=ldap")
+
+	return listContainers(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterArgs,
+	}, true)
+}
+
+// getLDAPFixture returns the LDAP server of a cluster.  The bind password is
+// only kept in the environment of the container.
+func getLDAPFixture(ctx context.Context, clusterID string) (*LDAPFixture, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := findLDAPFixtures(ctx, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, errors.New("cluster has no ldap server")
+	}
+
+	containerJSON, err := dockerFor(containers[0].ID).ContainerInspect(context.Background(), containers[0].ID)
+	if err != nil {
+		return nil, trackDockerError("container_inspect", err)
+	}
+
+	fixture := &LDAPFixture{
+		ContainerID: containers[0].ID[0:12],
+	}
+	if eth0Net := containerJSON.NetworkSettings.Networks[NetworkName]; eth0Net != nil {
+		fixture.Address = eth0Net.IPAddress
+	}
+	for _, env := range containerJSON.Config.Env {
+		if strings.HasPrefix(env, "LDAP_ADMIN_PASSWORD=") {
+			fixture.BindPassword = strings.TrimPrefix(env, "LDAP_ADMIN_PASSWORD=")
+		}
+	}
+
+	return fixture, nil
+}
+
+// removeLDAPFixture stops a cluster authenticating against its LDAP server,
+// and removes the server.
+func removeLDAPFixture(ctx context.Context, clusterID string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Removing ldap fixture")
+
+	c, err := ldapFixtureCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	containers, err := findLDAPFixtures(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return errors.New("cluster has no ldap server")
+	}
+
+	if len(c.Nodes) > 0 {
+		err = restNodeOf(c.Nodes[0]).UpdateSettings(helper.PSettingsLDAP, map[string]string{
+			"authenticationEnabled": "false",
+			"authorizationEnabled":  "false",
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to disable ldap")
+		}
+	}
+
+	return removeFixtureContainers(containers)
+}
+
+func removeFixtureContainers(containers []types.Container) error {
+	for _, fixture := range containers {
+		err := dockerFor(fixture.ID).ContainerRemove(context.Background(), fixture.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return trackDockerError("container_remove", err)
+		}
+		forgetContainerHost(fixture.ID)
+	}
+	return nil
+}
+
+// removeClusterFixtures removes everything which was run next to a cluster
+// which is being killed.
+func removeClusterFixtures(ctx context.Context, clusterID string) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", fixtureClusterIDLabel+"="+clusterID)
+
+	containers, err := listContainers(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterArgs,
+	}, true)
+	if err == nil {
+		err = removeFixtureContainers(containers)
+	}
+	if err != nil {
+		logWarnf(ctx, "Failed to remove the fixtures of the cluster: %s", err)
+	}
+}
+
+// removeStaleFixtures removes fixtures whose clusters no longer have
+// meta-data, such as those of clusters which were killed while a docker host
+// was unreachable.
+func removeStaleFixtures(ctx context.Context) error {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", fixtureClusterIDLabel)
+
+	containers, err := listContainers(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterArgs,
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	var stale []types.Container
+	for _, fixture := range containers {
+		clusterID := fixture.Labels[fixtureClusterIDLabel]
+		_, err := metaStore.GetClusterMeta(clusterID)
+		if err != ErrMetaNotFound {
+			continue
+		}
+
+		logInfof(ContextWithClusterID(ctx, clusterID), "Removing fixture %s of cluster which no longer exists", fixture.Names[0])
+		stale = append(stale, fixture)
+	}
+
+	return removeFixtureContainers(stale)
+}
@@ -0,0 +1,292 @@
+package daemon
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Several daemons can share the same docker hosts and a postgres meta-data
+// store, such as while one is being upgraded.  They all serve requests, but
+// only the leader runs background work like reaping expired clusters, so
+// that they don't fight over it.
+
+// leaderLeaseDuration is how long a leader stays leader without renewing its
+// lease, and how long other daemons take to notice that a daemon is gone.
+const leaderLeaseDuration = 30 * time.Second
+
+const leaderRenewInterval = 10 * time.Second
+
+// instanceRetention is how long the records of daemons which have stopped
+// are kept for.
+const instanceRetention = time.Hour
+
+const leaderLeaseKey = "leader"
+
+// daemonInstanceID tells the daemons sharing a meta-data store apart.
+var daemonInstanceID string
+
+var leading int32
+
+type LeaderLease struct {
+	Instance   string    `json:"instance"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// DaemonInstance is a daemon which is, or was, using the meta-data store.
+type DaemonInstance struct {
+	ID        string    `json:"id"`
+	Hostname  string    `json:"hostname"`
+	StartedAt time.Time `json:"started_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func (instance *DaemonInstance) alive() bool {
+	return time.Since(instance.LastSeen) < leaderLeaseDuration
+}
+
+func instanceKey(instanceID string) string {
+	return "instance-" + instanceID
+}
+
+func initDaemonInstance() {
+	hostname, _ := os.Hostname()
+	suffix, _ := uuid.NewRandom()
+	daemonInstanceID = hostname + "-" + suffix.String()[0:8]
+}
+
+func isLeader() bool {
+	return atomic.LoadInt32(&leading) == 1
+}
+
+func getDaemonInstances() ([]DaemonInstance, error) {
+	var instances []DaemonInstance
+	err := metaStore.forEachRecord("instance-", func(key string, recordBytes []byte) error {
+		var instance DaemonInstance
+		err := json.Unmarshal(recordBytes, &instance)
+		if err != nil {
+			return err
+		}
+
+		instances = append(instances, instance)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// liveInstances returns the IDs of the daemons which are still running.
+// Anything left behind by the others was interrupted.
+func liveInstances() (map[string]bool, error) {
+	instances, err := getDaemonInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.alive() {
+			live[instance.ID] = true
+		}
+	}
+	return live, nil
+}
+
+func getLeaderLease() (*LeaderLease, error) {
+	var lease LeaderLease
+	err := metaStore.getRecord(leaderLeaseKey, &lease)
+	if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// tryLeadership takes or renews the leader lease, returning whether we are
+// the leader.  The lease can only be taken over once it has expired.
+func tryLeadership() (bool, error) {
+	now := time.Now()
+	lease := LeaderLease{
+		Instance:   daemonInstanceID,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(leaderLeaseDuration),
+	}
+	leaseBytes, err := json.Marshal(&lease)
+	if err != nil {
+		return false, err
+	}
+
+	err = metaStore.createRawRecord(leaderLeaseKey, leaseBytes)
+	if err == nil {
+		return true, nil
+	} else if err != ErrMetaExists {
+		return false, err
+	}
+
+	var acquired bool
+	err = metaStore.updateRawRecord(leaderLeaseKey, func(currentBytes []byte) ([]byte, error) {
+		var current LeaderLease
+		err := json.Unmarshal(currentBytes, &current)
+		if err != nil {
+			return nil, err
+		}
+
+		acquired = false
+		if current.Instance == daemonInstanceID {
+			lease.AcquiredAt = current.AcquiredAt
+		} else if now.Before(current.ExpiresAt) {
+			return currentBytes, nil
+		}
+
+		acquired = true
+		return json.Marshal(&lease)
+	})
+	if err == ErrMetaNotFound {
+		// The leader stepped down just now, we will try again next time.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return acquired, nil
+}
+
+// updateLeadership records that we are still running and tries to become or
+// stay leader, returning true if we have just become leader.
+func updateLeadership(instance *DaemonInstance) bool {
+	instance.LastSeen = time.Now()
+	err := metaStore.setRecord(instanceKey(instance.ID), instance)
+	if err != nil {
+		logWarnf(systemCtx, "Failed to record that this daemon is running: %s", err)
+	}
+
+	acquired, err := tryLeadership()
+	if err != nil {
+		// We can't know whether another daemon has taken over, so stop
+		// doing anything which only the leader should.
+		logWarnf(systemCtx, "Failed to renew leadership: %s", err)
+		acquired = false
+	}
+
+	wasLeader := atomic.SwapInt32(&leading, boolToInt32(acquired)) == 1
+	if acquired && !wasLeader {
+		logInfof(systemCtx, "This daemon (%s) is now the leader", daemonInstanceID)
+		return true
+	} else if !acquired && wasLeader {
+		logWarnf(systemCtx, "This daemon (%s) is no longer the leader", daemonInstanceID)
+	}
+	return false
+}
+
+func boolToInt32(value bool) int32 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// becomeLeader picks up after daemons which stopped in the middle of
+// something, and makes sure every cluster on the docker hosts is known
+// about.
+func becomeLeader() {
+	err := recoverPendingOperations()
+	if err != nil {
+		logErrorf(systemCtx, "Failed to recover interrupted operations: %s", err)
+	}
+
+	err = failInterruptedJobs()
+	if err != nil {
+		logErrorf(systemCtx, "Failed to fail interrupted jobs: %s", err)
+	}
+
+	_, err = reconcileClusters(systemCtx)
+	if err != nil {
+		logErrorf(systemCtx, "Failed to reconcile clusters: %s", err)
+	}
+
+	err = cleanupInstances()
+	if err != nil {
+		logErrorf(systemCtx, "Failed to clean up stopped daemons: %s", err)
+	}
+
+	signalClusterPools()
+}
+
+func cleanupInstances() error {
+	instances, err := getDaemonInstances()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if time.Since(instance.LastSeen) > instanceRetention {
+			err = metaStore.deleteRecord(instanceKey(instance.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// stepDown gives up the leader lease, so that another daemon can take over
+// straight away rather than waiting for it to expire.
+func stepDown() {
+	lease, err := getLeaderLease()
+	if err == nil && lease.Instance == daemonInstanceID {
+		err = metaStore.deleteRecord(leaderLeaseKey)
+		if err != nil {
+			logWarnf(systemCtx, "Failed to give up leadership: %s", err)
+		}
+	}
+	atomic.StoreInt32(&leading, 0)
+
+	err = metaStore.deleteRecord(instanceKey(daemonInstanceID))
+	if err != nil {
+		logWarnf(systemCtx, "Failed to remove the record of this daemon: %s", err)
+	}
+}
+
+// startLeaderElection tries to become leader straight away, so that a lone
+// daemon does its startup work before it serves any requests, and then keeps
+// trying in the background.
+func startLeaderElection(shutdownSig chan struct{}) chan struct{} {
+	instance := &DaemonInstance{
+		ID:        daemonInstanceID,
+		StartedAt: time.Now(),
+	}
+	instance.Hostname, _ = os.Hostname()
+
+	if updateLeadership(instance) {
+		becomeLeader()
+	} else {
+		logInfof(systemCtx, "Another daemon is the leader, this daemon (%s) will only serve requests", daemonInstanceID)
+	}
+
+	closedSig := make(chan struct{})
+	go func() {
+		defer close(closedSig)
+		for {
+			select {
+			case <-shutdownSig:
+				stepDown()
+				return
+			case <-time.After(leaderRenewInterval):
+			}
+
+			// Renewing the lease mustn't wait for this, or it could expire.
+			if updateLeadership(instance) {
+				go becomeLeader()
+			}
+		}
+	}()
+
+	return closedSig
+}
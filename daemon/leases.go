@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Leases tie a cluster to the CI job which allocated it, so that it is reaped
+// as soon as the job has finished rather than at its timeout, which is when
+// clusters of aborted builds would otherwise be reclaimed.  Jobs report that
+// they have finished with their token, and in case they never get the chance
+// to, the daemon asks the callback of the lease whether the job still exists.
+
+// leaseCheckInterval is how often the callbacks of leases are polled.
+var leaseCheckInterval = 1 * time.Minute
+
+const leaseCallbackTimeout = 10 * time.Second
+
+// minJobTokenLength stops tokens which are easily guessed from being used,
+// since anybody with the token of a job can reap its clusters.
+const minJobTokenLength = 16
+
+var leaseCallbackClient = &http.Client{Timeout: leaseCallbackTimeout}
+
+type LeaseOptions struct {
+	JobToken    string
+	CallbackURL string
+}
+
+// LeaseMeta is the lease of a cluster.  Only the hash of the token of the job
+// is kept, so that the token can't be read back out of the meta-data.
+type LeaseMeta struct {
+	JobTokenHash string
+	CallbackURL  string
+}
+
+func hashJobToken(jobToken string) string {
+	hash := sha256.Sum256([]byte(jobToken))
+	return hex.EncodeToString(hash[:])
+}
+
+func newLeaseMeta(opts LeaseOptions) (*LeaseMeta, error) {
+	if len(opts.JobToken) < minJobTokenLength {
+		return nil, errors.Errorf("job tokens must be at least %d characters", minJobTokenLength)
+	}
+
+	if opts.CallbackURL != "" {
+		parsedURL, err := url.Parse(opts.CallbackURL)
+		if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+			return nil, errors.Errorf("%q is not a valid callback url", opts.CallbackURL)
+		}
+	}
+
+	return &LeaseMeta{
+		JobTokenHash: hashJobToken(opts.JobToken),
+		CallbackURL:  opts.CallbackURL,
+	}, nil
+}
+
+// reapLeasedCluster kills a cluster whose job has finished.  The lease is
+// what allows it to be killed, so ownership is ignored.
+func reapLeasedCluster(ctx context.Context, clusterID, reason string) error {
+	ctx = ContextWithClusterID(NewContext(ctx, ContextUser(ctx), true), clusterID)
+	logInfof(ctx, "Reaping leased cluster, %s", reason)
+
+	err := killCluster(ctx, clusterID)
+	recordAudit(ctx, "reap leased cluster", clusterID, "", err)
+	return err
+}
+
+// completeLease reaps every cluster which is leased to a job, once the job
+// reports that it has finished, and returns their IDs.
+func completeLease(ctx context.Context, jobToken string) ([]string, error) {
+	metas, err := metaStore.GetAllClusterMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenHash := hashJobToken(jobToken)
+	var clusterIDs []string
+	for clusterID, meta := range metas {
+		if meta.Lease != nil && meta.Lease.JobTokenHash == tokenHash {
+			clusterIDs = append(clusterIDs, clusterID)
+		}
+	}
+	if len(clusterIDs) == 0 {
+		return nil, errors.New("no clusters are leased to this job")
+	}
+	sort.Strings(clusterIDs)
+
+	var reaped []string
+	for _, clusterID := range clusterIDs {
+		err = reapLeasedCluster(ctx, clusterID, "its job has finished")
+		if err != nil {
+			return reaped, err
+		}
+		reaped = append(reaped, clusterID)
+	}
+
+	return reaped, nil
+}
+
+// leaseJobFinished asks the callback of a lease whether its job has finished.
+// The job is gone if the callback answers 404 or 410, and has finished if it
+// answers with building set to false, which is how the JSON API of a Jenkins
+// build (i.e. https://jenkins.example.com/job/sdk/123/api/json) describes it.
+// Anything else means the job is still running, or that we can't tell.
+func leaseJobFinished(callbackURL string) (bool, error) {
+	resp, err := leaseCallbackClient.Get(callbackURL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.Errorf("callback returned status %d", resp.StatusCode)
+	}
+
+	var status struct {
+		Building *bool `json:"building"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		// Callbacks don't have to answer with JSON while the job is running.
+		return false, nil
+	}
+
+	return status.Building != nil && !*status.Building, nil
+}
+
+// checkLeases reaps the clusters whose callbacks say that their job has
+// finished.
+func checkLeases(ctx context.Context) error {
+	metas, err := metaStore.GetAllClusterMeta()
+	if err != nil {
+		return err
+	}
+
+	for clusterID, meta := range metas {
+		if meta.Lease == nil || meta.Lease.CallbackURL == "" {
+			continue
+		}
+		clusterCtx := ContextWithClusterID(ctx, clusterID)
+
+		finished, err := leaseJobFinished(meta.Lease.CallbackURL)
+		if err != nil {
+			logWarnf(clusterCtx, "Failed to check on the job of leased cluster: %s", err)
+			continue
+		}
+		if !finished {
+			continue
+		}
+
+		err = reapLeasedCluster(ctx, clusterID, "the callback says its job has finished")
+		if err != nil {
+			logWarnf(clusterCtx, "Failed to reap leased cluster: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func runLeaseChecks(shutdownSig chan struct{}) {
+	for {
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(leaseCheckInterval):
+		}
+
+		if !isLeader() {
+			continue
+		}
+
+		err := checkLeases(systemCtx)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to check cluster leases: %s", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ClusterStateRunning    = "running"
+	ClusterStateDegraded   = "degraded"
+	ClusterStateStopped    = "stopped"
+	ClusterStateHibernated = "hibernated"
+)
+
+// State summarises the states of the nodes of a cluster.  Clusters with nodes
+// which are running but failed their last health probe are degraded too.
+func (cluster *Cluster) State() string {
+	if cluster.Hibernated {
+		return ClusterStateHibernated
+	}
+
+	running := 0
+	unhealthy := 0
+	for _, node := range cluster.Nodes {
+		if node.State == "running" {
+			running++
+			if node.Health != "" && node.Health != NodeHealthHealthy && node.Health != NodeHealthUnknown {
+				unhealthy++
+			}
+		}
+	}
+
+	switch {
+	case running == 0:
+		return ClusterStateStopped
+	case running < len(cluster.Nodes) || unhealthy > 0:
+		return ClusterStateDegraded
+	}
+	return ClusterStateRunning
+}
+
+// Degraded is whether some of the nodes of a cluster are stopped or broken.
+func (cluster *Cluster) Degraded() bool {
+	return cluster.State() == ClusterStateDegraded
+}
+
+// ClusterFilter selects clusters from a listing, zero values match all
+// clusters.
+type ClusterFilter struct {
+	Owner         string
+	ServerVersion string
+	MinNodes      int
+	MaxNodes      int
+	Tags          map[string]string
+	State         string
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+}
+
+func (filter *ClusterFilter) matches(cluster *Cluster) bool {
+	if filter.Owner != "" && cluster.Owner != filter.Owner {
+		return false
+	}
+
+	if filter.ServerVersion != "" {
+		// Versions match on prefix so that 6.5 matches every 6.5.x build
+		found := false
+		for _, node := range cluster.Nodes {
+			if strings.HasPrefix(node.InitialServerVersion, filter.ServerVersion) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if filter.MinNodes > 0 && len(cluster.Nodes) < filter.MinNodes {
+		return false
+	}
+	if filter.MaxNodes > 0 && len(cluster.Nodes) > filter.MaxNodes {
+		return false
+	}
+
+	if !cluster.hasTags(filter.Tags) {
+		return false
+	}
+
+	if filter.State != "" && cluster.State() != filter.State {
+		return false
+	}
+
+	if !filter.ExpiresAfter.IsZero() && !cluster.Timeout.After(filter.ExpiresAfter) {
+		return false
+	}
+	if !filter.ExpiresBefore.IsZero() && !cluster.Timeout.Before(filter.ExpiresBefore) {
+		return false
+	}
+
+	return true
+}
+
+func filterClusters(clusters []*Cluster, filter ClusterFilter) []*Cluster {
+	var filtered []*Cluster
+	for _, cluster := range clusters {
+		if filter.matches(cluster) {
+			filtered = append(filtered, cluster)
+		}
+	}
+	return filtered
+}
+
+var clusterSortFields = map[string]func(a, b *Cluster) bool{
+	"id": func(a, b *Cluster) bool {
+		return a.ID < b.ID
+	},
+	"owner": func(a, b *Cluster) bool {
+		return a.Owner < b.Owner
+	},
+	"timeout": func(a, b *Cluster) bool {
+		return a.Timeout.Before(b.Timeout)
+	},
+	"nodes": func(a, b *Cluster) bool {
+		return len(a.Nodes) < len(b.Nodes)
+	},
+}
+
+// sortClusters sorts clusters by a field name, prefixed with - to sort in
+// descending order.  Ties are broken by ID so that pages are stable.
+func sortClusters(clusters []*Cluster, sortBy string) error {
+	descending := strings.HasPrefix(sortBy, "-")
+	field := strings.TrimPrefix(sortBy, "-")
+	if field == "" {
+		field = "id"
+	}
+
+	less, ok := clusterSortFields[field]
+	if !ok {
+		return fmt.Errorf("cannot sort clusters by %s", field)
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		a, b := clusters[i], clusters[j]
+		if descending {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return clusters[i].ID < clusters[j].ID
+	})
+
+	return nil
+}
+
+func paginateClusters(clusters []*Cluster, offset, limit int) []*Cluster {
+	if offset >= len(clusters) {
+		return nil
+	}
+	clusters = clusters[offset:]
+
+	if limit > 0 && limit < len(clusters) {
+		clusters = clusters[:limit]
+	}
+	return clusters
+}
@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+// loaderImage is the image which data is loaded into clusters from, it must
+// have cbc-pillowfight on its path.
+var loaderImage = "sequoiatools/pillowfight"
+
+// loadMaxDuration bounds how long a single load can run for, including
+// loads which only populate a bucket.
+const loadMaxDuration = 2 * time.Hour
+
+type LoadOptions struct {
+	Conf LoadJSON
+}
+
+func (opts LoadOptions) duration() (time.Duration, error) {
+	if opts.Conf.Duration == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(opts.Conf.Duration)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 || duration > loadMaxDuration {
+		return 0, errors.Errorf("duration must be between 0 and %s", loadMaxDuration)
+	}
+	return duration, nil
+}
+
+// pillowfightArgs returns the arguments to cbc-pillowfight to load a bucket
+// through a node.
+func pillowfightArgs(node *Node, conf LoadJSON) []string {
+	args := []string{
+		"-U", fmt.Sprintf("couchbase://%s/%s", node.IPv4Address, conf.Bucket),
+		"-u", helper.RestUser,
+		"-P", helper.RestPass,
+		"-I", strconv.Itoa(conf.NumItems),
+	}
+	if conf.Collection != "" {
+		args = append(args, "--collection", conf.Scope+"."+conf.Collection)
+	}
+	if conf.DocSize > 0 {
+		args = append(args, "-m", strconv.Itoa(conf.DocSize), "-M", strconv.Itoa(conf.DocSize))
+	}
+	if conf.Threads > 0 {
+		args = append(args, "-t", strconv.Itoa(conf.Threads))
+	}
+	if conf.JSON {
+		args = append(args, "-J")
+	}
+	if conf.Duration == "" {
+		args = append(args, "--populate-only")
+	}
+	return args
+}
+
+// startLoad starts a job which loads data into a bucket of a cluster with
+// cbc-pillowfight, running in a container next to the cluster's nodes.
+// Without a duration the documents are written once, otherwise the loader
+// keeps reading and writing them until the duration has passed.
+func startLoad(ctx context.Context, clusterID string, opts LoadOptions) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	if opts.Conf.Bucket == "" {
+		return nil, errors.New("must specify a bucket")
+	}
+	if opts.Conf.NumItems <= 0 {
+		return nil, errors.New("num_items must be greater than 0")
+	}
+	if opts.Conf.DocSize < 0 || opts.Conf.Threads < 0 {
+		return nil, errors.New("doc_size and threads cannot be negative")
+	}
+	if (opts.Conf.Scope == "") != (opts.Conf.Collection == "") {
+		return nil, errors.New("must specify both a scope and a collection, or neither")
+	}
+	duration, err := opts.duration()
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Hibernated {
+		return nil, errors.New("cannot load data into a hibernated cluster")
+	}
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if len(cluster.Nodes) == 0 {
+		return nil, errors.New("no nodes available")
+	}
+
+	node := cluster.Nodes[0]
+	args := pillowfightArgs(node, opts.Conf)
+	return startJob(ctx, JobTypeLoad, cluster, func(ctx context.Context, job Job) (string, error) {
+		return runLoader(ctx, dockerHostOf(node.ContainerID), "dynclsr-load-"+job.ID, args, duration)
+	})
+}
+
+// runLoader runs the loader to completion, or until the duration has passed
+// if one is given, and returns the end of its output.
+func runLoader(ctx context.Context, host *DockerHost, containerName string, args []string, duration time.Duration) (string, error) {
+	logInfof(ctx, "Pulling %s image", loaderImage)
+	err := imagePull(ctx, host, loaderImage)
+	if err != nil {
+		// The image may have been loaded onto the host by hand.
+		logWarnf(ctx, "Failed to pull %s: %s", loaderImage, err)
+	}
+
+	// Loads with a duration are expected to still be running when it passes.
+	timeout := loadMaxDuration
+	if duration > 0 {
+		timeout = duration
+	}
+
+	result, err := runSidecar(ctx, host, SidecarOptions{
+		Name:       containerName,
+		Image:      loaderImage,
+		Entrypoint: []string{"cbc-pillowfight"},
+		Args:       args,
+		Timeout:    timeout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if result.TimedOut && duration == 0 {
+		return result.Output, errors.Errorf("loader did not finish within %s", loadMaxDuration)
+	}
+	if result.ExitCode != 0 {
+		return result.Output, errors.Errorf("loader exited with %d", result.ExitCode)
+	}
+	return result.Output, nil
+}
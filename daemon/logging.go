@@ -0,0 +1,187 @@
+package daemon
+
+import (
+	"container/ring"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRecentLogs is the number of log entries kept in memory for the logs
+// endpoint.
+var maxRecentLogs = 10000
+
+// logFormatter writes entries as logfmt lines, both to stderr and in the
+// daemon.log of reproduction bundles.
+var logFormatter = &logrus.TextFormatter{
+	DisableColors:   true,
+	FullTimestamp:   true,
+	TimestampFormat: time.RFC3339Nano,
+}
+
+var recentLogs = newLogHistory(maxRecentLogs)
+
+var logger = newLogger()
+
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	logger.SetFormatter(logFormatter)
+	logger.AddHook(recentLogs)
+	return logger
+}
+
+type LogEntry struct {
+	Time      time.Time
+	Level     logrus.Level
+	Message   string
+	RequestID string
+	User      string
+	ClusterID string
+	Node      string
+}
+
+func newLogEntry(entry *logrus.Entry) LogEntry {
+	field := func(key string) string {
+		value, _ := entry.Data[key].(string)
+		return value
+	}
+
+	return LogEntry{
+		Time:      entry.Time,
+		Level:     entry.Level,
+		Message:   entry.Message,
+		RequestID: field("request_id"),
+		User:      field("user"),
+		ClusterID: field("cluster_id"),
+		Node:      field("node"),
+	}
+}
+
+// String formats the entry as a logfmt line, as it was written to stderr.
+func (entry *LogEntry) String() string {
+	line, err := logFormatter.Format(&logrus.Entry{
+		Data:    logFields(entry.RequestID, entry.User, entry.ClusterID, entry.Node),
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Message: entry.Message,
+	})
+	if err != nil {
+		return entry.Message
+	}
+	return strings.TrimSuffix(string(line), "\n")
+}
+
+// logHistory is a hook which keeps the most recent entries of the logger.
+type logHistory struct {
+	lock    sync.Mutex
+	entries *ring.Ring
+}
+
+func newLogHistory(size int) *logHistory {
+	return &logHistory{entries: ring.New(size)}
+}
+
+func (history *logHistory) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (history *logHistory) Fire(entry *logrus.Entry) error {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	history.entries.Value = newLogEntry(entry)
+	history.entries = history.entries.Next()
+	return nil
+}
+
+// filter returns the most recent entries matching fn in chronological order.
+func (history *logHistory) filter(limit int, fn func(*LogEntry) bool) []LogEntry {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	var matched []LogEntry
+	current := history.entries
+	for i := 0; i < history.entries.Len(); i++ {
+		current = current.Prev()
+		entry, ok := current.Value.(LogEntry)
+		if !ok {
+			break
+		}
+		if !fn(&entry) {
+			continue
+		}
+
+		matched = append(matched, entry)
+		if limit > 0 && len(matched) >= limit {
+			break
+		}
+	}
+
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	return matched
+}
+
+// logFields are the fields which entries are logged with, leaving out those
+// which are empty.
+func logFields(requestID, user, clusterID, node string) logrus.Fields {
+	fields := make(logrus.Fields)
+	addField := func(key, value string) {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	addField("request_id", requestID)
+	addField("user", user)
+	addField("cluster_id", clusterID)
+	addField("node", node)
+	return fields
+}
+
+// contextLogger returns the logger with the request, user, cluster and node
+// of ctx as fields.
+func contextLogger(ctx context.Context) *logrus.Entry {
+	return logger.WithFields(logFields(ContextRequestID(ctx), ContextUser(ctx), ContextClusterID(ctx), ContextNode(ctx)))
+}
+
+func logInfof(ctx context.Context, format string, args ...interface{}) {
+	contextLogger(ctx).Infof(format, args...)
+}
+
+func logWarnf(ctx context.Context, format string, args ...interface{}) {
+	contextLogger(ctx).Warnf(format, args...)
+}
+
+func logErrorf(ctx context.Context, format string, args ...interface{}) {
+	contextLogger(ctx).Errorf(format, args...)
+}
+
+// getRecentLogs returns recent daemon log entries, optionally limited to a
+// single cluster.  Users who can't ignore ownership only see entries for
+// clusters they can currently see, or which were logged on their behalf.
+func getRecentLogs(ctx context.Context, clusterID string, limit int) ([]LogEntry, error) {
+	if ContextIgnoreOwnership(ctx) {
+		return recentLogs.filter(limit, func(entry *LogEntry) bool {
+			return clusterID == "" || entry.ClusterID == clusterID
+		}), nil
+	}
+
+	if clusterID == "" {
+		return nil, fmt.Errorf("must specify a cluster")
+	}
+
+	_, err := getCluster(ctx, clusterID)
+	clusterVisible := err == nil
+	user := ContextUser(ctx)
+
+	return recentLogs.filter(limit, func(entry *LogEntry) bool {
+		return entry.ClusterID == clusterID && (clusterVisible || entry.User == user)
+	}), nil
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+const couchbaseLogsDir = "/opt/couchbase/var/lib/couchbase/logs"
+
+type NodeLogsOptions struct {
+	// Follow keeps the stream open and sends new log lines as they are written.
+	Follow bool
+	// Tail limits the output to the last Tail lines, 0 means everything.
+	Tail int
+	// File selects a server log file (e.g. debug.log) to stream instead of the
+	// container output.
+	File string
+}
+
+func streamNodeLogs(ctx context.Context, clusterID, nodeRef string, opts NodeLogsOptions, out io.Writer) error {
+	ctx = ContextWithNode(ContextWithClusterID(ctx, clusterID), nodeRef)
+	logInfof(ctx, "Streaming logs")
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return err
+	}
+
+	node, err := findNode(cluster, nodeRef)
+	if err != nil {
+		return err
+	}
+
+	if opts.File != "" {
+		return streamServerLogFile(ctx, node.ContainerID, opts, out)
+	}
+
+	tail := "all"
+	if opts.Tail > 0 {
+		tail = strconv.Itoa(opts.Tail)
+	}
+
+	logsReader, err := dockerFor(node.ContainerID).ContainerLogs(ctx, node.ContainerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Tail:       tail,
+	})
+	if err != nil {
+		return err
+	}
+	defer logsReader.Close()
+
+	_, err = stdcopy.StdCopy(out, out, logsReader)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+func streamServerLogFile(ctx context.Context, containerID string, opts NodeLogsOptions, out io.Writer) error {
+	if opts.File != path.Base(opts.File) || opts.File == ".." {
+		return errors.New("log file must be a file name within the server logs directory")
+	}
+
+	cmd := []string{"tail"}
+	if opts.Tail > 0 {
+		cmd = append(cmd, "-n", strconv.Itoa(opts.Tail))
+	} else {
+		cmd = append(cmd, "-n", "+1")
+	}
+	if opts.Follow {
+		cmd = append(cmd, "-F")
+	}
+	cmd = append(cmd, path.Join(couchbaseLogsDir, opts.File))
+
+	exitCode, err := execStream(ctx, containerID, cmd, out, out)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	if exitCode != 0 {
+		return errors.Errorf("could not read log file %s", opts.File)
+	}
+
+	return nil
+}
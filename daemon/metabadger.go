@@ -0,0 +1,159 @@
+package daemon
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger"
+)
+
+// badgerMetaBackend keeps meta-data in a badger database in a local
+// directory, which only a single daemon can have open.
+type badgerMetaBackend struct {
+	db *badger.DB
+}
+
+func openBadgerMetaBackend(dir string) (*badgerMetaBackend, error) {
+	opts := badger.DefaultOptions(dir)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &badgerMetaBackend{db: db}, nil
+}
+
+// badgerConflictRetries is how many times a transaction is tried when it
+// conflicts with another which changed the same key.
+const badgerConflictRetries = 10
+
+// update runs fn in a read-write transaction, trying it again if another
+// transaction changed the same keys in the meantime.
+func (backend *badgerMetaBackend) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < badgerConflictRetries; i++ {
+		err = backend.db.Update(fn)
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	return err
+}
+
+func badgerMetaError(err error) error {
+	if err == badger.ErrKeyNotFound {
+		return ErrMetaNotFound
+	}
+	return err
+}
+
+func (backend *badgerMetaBackend) Get(key string) ([]byte, error) {
+	var value []byte
+	err := backend.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, badgerMetaError(err)
+	}
+
+	return value, nil
+}
+
+func (backend *badgerMetaBackend) Set(key string, value []byte) error {
+	return backend.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), value)
+	})
+}
+
+func (backend *badgerMetaBackend) Create(key string, value []byte) error {
+	return backend.update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if err == nil {
+			return ErrMetaExists
+		}
+
+		return txn.Set([]byte(key), value)
+	})
+}
+
+func (backend *badgerMetaBackend) Update(key string, updateFunc func(value []byte) ([]byte, error)) error {
+	err := backend.update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		value, err = updateFunc(value)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(key), value)
+	})
+	return badgerMetaError(err)
+}
+
+func (backend *badgerMetaBackend) Delete(key string) error {
+	return backend.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (backend *badgerMetaBackend) DeleteIf(key string, value []byte) error {
+	return backend.update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		existing, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(existing, value) {
+			return nil
+		}
+
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (backend *badgerMetaBackend) Scan(prefix string, fn func(key string, value []byte) error) error {
+	prefixBytes := []byte(prefix)
+	return backend.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefixBytes); it.ValidForPrefix(prefixBytes); it.Next() {
+			item := it.Item()
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			err = fn(string(item.Key()), value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (backend *badgerMetaBackend) Close() error {
+	return backend.db.Close()
+}
@@ -1,27 +1,270 @@
 package daemon
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
-
-	"github.com/dgraph-io/badger"
-	"github.com/golang/glog"
 )
 
 type ClusterMetaJSON struct {
-	Owner   string `json:"owner,omitempty"`
-	Timeout string `json:"timeout,omitempty"`
+	Owner       string               `json:"owner,omitempty"`
+	Timeout     string               `json:"timeout,omitempty"`
+	SharedWith  []string             `json:"shared_with,omitempty"`
+	Team        string               `json:"team,omitempty"`
+	Tags        map[string]string    `json:"tags,omitempty"`
+	Alias       string               `json:"alias,omitempty"`
+	Pool        string               `json:"pool,omitempty"`
+	Host        string               `json:"host,omitempty"`
+	Provider    string               `json:"provider,omitempty"`
+	KeepAlive   bool                 `json:"keep_alive,omitempty"`
+	Hibernation *HibernationMetaJSON `json:"hibernation,omitempty"`
+	EC2         *EC2MetaJSON         `json:"ec2,omitempty"`
+	Capella     *CapellaMetaJSON     `json:"capella,omitempty"`
+	Lease       *LeaseMetaJSON       `json:"lease,omitempty"`
+	UseHostname bool                 `json:"use_hostname,omitempty"`
+
+	NodeOverrides map[string]NodeOverridesJSON `json:"node_overrides,omitempty"`
+}
+
+type LeaseMetaJSON struct {
+	JobTokenHash string `json:"job_token_hash"`
+	CallbackURL  string `json:"callback_url,omitempty"`
+}
+
+type NodeSettingJSON struct {
+	Path   string            `json:"path"`
+	Values map[string]string `json:"values"`
+}
+
+type NodeOverridesJSON struct {
+	Env          map[string]string `json:"env,omitempty"`
+	StaticConfig map[string]string `json:"static_config,omitempty"`
+	Settings     []NodeSettingJSON `json:"settings,omitempty"`
+	ExtraHosts   map[string]string `json:"extra_hosts,omitempty"`
+	DNSSearch    []string          `json:"dns_search,omitempty"`
+	// Ulimits are such as memlock, -1 is unlimited.
+	Ulimits    map[string]NodeUlimitJSON `json:"ulimits,omitempty"`
+	Sysctls    map[string]string         `json:"sysctls,omitempty"`
+	CapAdd     []string                  `json:"cap_add,omitempty"`
+	Privileged bool                      `json:"privileged,omitempty"`
+}
+
+type NodeUlimitJSON struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+func jsonifyNodeOverrides(overrides NodeOverrides) NodeOverridesJSON {
+	overridesJSON := NodeOverridesJSON{
+		Env:          overrides.Env,
+		StaticConfig: overrides.StaticConfig,
+		ExtraHosts:   overrides.ExtraHosts,
+		DNSSearch:    overrides.DNSSearch,
+		Sysctls:      overrides.Sysctls,
+		CapAdd:       overrides.CapAdd,
+		Privileged:   overrides.Privileged,
+	}
+	for name, ulimit := range overrides.Ulimits {
+		if overridesJSON.Ulimits == nil {
+			overridesJSON.Ulimits = make(map[string]NodeUlimitJSON)
+		}
+		overridesJSON.Ulimits[name] = NodeUlimitJSON{Soft: ulimit.Soft, Hard: ulimit.Hard}
+	}
+	for _, setting := range overrides.Settings {
+		overridesJSON.Settings = append(overridesJSON.Settings, NodeSettingJSON{
+			Path:   setting.Path,
+			Values: setting.Values,
+		})
+	}
+	return overridesJSON
+}
+
+func unjsonifyNodeOverrides(overridesJSON NodeOverridesJSON) NodeOverrides {
+	overrides := NodeOverrides{
+		Env:          overridesJSON.Env,
+		StaticConfig: overridesJSON.StaticConfig,
+		ExtraHosts:   overridesJSON.ExtraHosts,
+		DNSSearch:    overridesJSON.DNSSearch,
+		Sysctls:      overridesJSON.Sysctls,
+		CapAdd:       overridesJSON.CapAdd,
+		Privileged:   overridesJSON.Privileged,
+	}
+	for name, ulimit := range overridesJSON.Ulimits {
+		if overrides.Ulimits == nil {
+			overrides.Ulimits = make(map[string]NodeUlimit)
+		}
+		overrides.Ulimits[name] = NodeUlimit{Soft: ulimit.Soft, Hard: ulimit.Hard}
+	}
+	for _, setting := range overridesJSON.Settings {
+		overrides.Settings = append(overrides.Settings, NodeSetting{
+			Path:   setting.Path,
+			Values: setting.Values,
+		})
+	}
+	return overrides
+}
+
+type HibernatedNodeJSON struct {
+	Name          string `json:"name"`
+	ServerVersion string `json:"server_version"`
+	ArchiveKey    string `json:"archive_key"`
+}
+
+type HibernationMetaJSON struct {
+	Creator      string               `json:"creator"`
+	HibernatedAt string               `json:"hibernated_at"`
+	TimeLeft     int64                `json:"time_left,omitempty"`
+	Nodes        []HibernatedNodeJSON `json:"nodes"`
+}
+
+type EC2NodeJSON struct {
+	Name          string `json:"name"`
+	ServerVersion string `json:"server_version"`
+	InstanceID    string `json:"instance_id"`
+	IPv4Address   string `json:"ipv4_address,omitempty"`
+}
+
+type EC2MetaJSON struct {
+	Creator string        `json:"creator"`
+	Nodes   []EC2NodeJSON `json:"nodes"`
+}
+
+type CapellaNodeJSON struct {
+	Name          string `json:"name"`
+	ServerVersion string `json:"server_version"`
+}
+
+type CapellaMetaJSON struct {
+	Creator           string            `json:"creator"`
+	ProjectID         string            `json:"project_id"`
+	ClusterID         string            `json:"cluster_id,omitempty"`
+	State             string            `json:"state"`
+	ConnectionString  string            `json:"connection_string,omitempty"`
+	Username          string            `json:"username,omitempty"`
+	EncryptedPassword string            `json:"encrypted_password,omitempty"`
+	Nodes             []CapellaNodeJSON `json:"nodes"`
 }
 
 type ClusterMeta struct {
 	Owner   string
 	Timeout time.Time
+	// SharedWith lists the users, other than the owner, who can refresh and
+	// kill the cluster.
+	SharedWith []string
+	// Team is set for clusters which are owned by a team, all of its members
+	// have the same rights as the owner.
+	Team  string
+	Tags  map[string]string
+	Alias string
+	// Pool is set for clusters which belong to a check-out pool, they are
+	// owned by the pool while they are checked in.
+	Pool string
+	// Host is the name of the docker host which the nodes of the cluster are
+	// run on.
+	Host string
+	// Provider runs the nodes of the cluster, it is empty for docker clusters.
+	Provider    string
+	Hibernation *HibernationMeta
+	EC2         *EC2Meta
+	Capella     *CapellaMeta
+	// KeepAlive makes the daemon extend the timeout of the cluster for as
+	// long as it is in use.
+	KeepAlive bool
+	// Lease is set for clusters which are reaped once their CI job has
+	// finished.
+	Lease *LeaseMeta
+	// UseHostname is set once the cluster has been set up with its nodes
+	// known by their hostnames.
+	UseHostname bool
+	// NodeOverrides are the overrides which each node was allocated with, so
+	// that they can be applied again when the cluster is woken.
+	NodeOverrides map[string]NodeOverrides
+}
+
+type HibernatedNode struct {
+	Name          string
+	ServerVersion string
+	ArchiveKey    string
+}
+
+// HibernationMeta records everything needed to rebuild a cluster whose
+// containers were destroyed after its data was stored in object storage.
+type HibernationMeta struct {
+	Creator      string
+	HibernatedAt time.Time
+	// TimeLeft is how long the cluster had left before it was hibernated,
+	// which it is given again when it is woken.
+	TimeLeft time.Duration
+	Nodes    []HibernatedNode
+}
+
+// EC2Meta records the instances of clusters run on EC2, which unlike
+// containers can't be found from their labels.
+type EC2Meta struct {
+	Creator string
+	Nodes   []EC2Node
+}
+
+type EC2Node struct {
+	Name          string
+	ServerVersion string
+	InstanceID    string
+	IPv4Address   string
+}
+
+// CapellaMeta records the Capella cluster which runs a cluster, and the
+// credentials created to access it.  The password is encrypted with the
+// capella-password-key of the daemon.
+type CapellaMeta struct {
+	Creator           string
+	ProjectID         string
+	ClusterID         string
+	State             string
+	ConnectionString  string
+	Username          string
+	EncryptedPassword string
+	Nodes             []CapellaNode
+}
+
+type CapellaNode struct {
+	Name          string
+	ServerVersion string
+}
+
+const (
+	MetaStoreBadger   = "badger"
+	MetaStoreSQLite   = "sqlite"
+	MetaStorePostgres = "postgres"
+)
+
+var (
+	// ErrMetaNotFound is returned by backends for keys which don't exist.
+	ErrMetaNotFound = errors.New("meta-data not found")
+	// ErrMetaExists is returned by backends when creating a key which
+	// already exists.
+	ErrMetaExists = errors.New("meta-data already exists")
+)
+
+// MetaBackend stores the raw records of the meta-data store, every record is
+// JSON.  Scans must return records in the order of their keys.
+type MetaBackend interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Create(key string, value []byte) error
+	// Update replaces the value of an existing key with what updateFunc
+	// returns, without anything else changing it in the meantime.
+	Update(key string, updateFunc func(value []byte) ([]byte, error)) error
+	Delete(key string) error
+	// DeleteIf deletes a key only if its value is still value.
+	DeleteIf(key string, value []byte) error
+	Scan(prefix string, fn func(key string, value []byte) error) error
+	Close() error
 }
 
 type MetaDataStore struct {
-	db *badger.DB
+	backend MetaBackend
 }
 
 var DEFAULT_CLUSTER_META ClusterMeta = ClusterMeta{
@@ -31,8 +274,82 @@ var DEFAULT_CLUSTER_META ClusterMeta = ClusterMeta{
 
 func (store *MetaDataStore) serializeMeta(meta ClusterMeta) ([]byte, error) {
 	metaJSON := ClusterMetaJSON{
-		Owner:   meta.Owner,
-		Timeout: meta.Timeout.Format(time.RFC3339),
+		Owner:      meta.Owner,
+		Timeout:    meta.Timeout.Format(time.RFC3339),
+		SharedWith: meta.SharedWith,
+		Team:       meta.Team,
+		Tags:       meta.Tags,
+		Alias:      meta.Alias,
+		Pool:       meta.Pool,
+		Host:       meta.Host,
+		Provider:   meta.Provider,
+		KeepAlive:  meta.KeepAlive,
+
+		UseHostname: meta.UseHostname,
+	}
+
+	if len(meta.NodeOverrides) > 0 {
+		metaJSON.NodeOverrides = make(map[string]NodeOverridesJSON)
+		for nodeName, overrides := range meta.NodeOverrides {
+			metaJSON.NodeOverrides[nodeName] = jsonifyNodeOverrides(overrides)
+		}
+	}
+
+	if meta.Lease != nil {
+		metaJSON.Lease = &LeaseMetaJSON{
+			JobTokenHash: meta.Lease.JobTokenHash,
+			CallbackURL:  meta.Lease.CallbackURL,
+		}
+	}
+
+	if meta.Hibernation != nil {
+		hibernationJSON := &HibernationMetaJSON{
+			Creator:      meta.Hibernation.Creator,
+			HibernatedAt: meta.Hibernation.HibernatedAt.Format(time.RFC3339),
+			TimeLeft:     int64(meta.Hibernation.TimeLeft / time.Second),
+		}
+		for _, node := range meta.Hibernation.Nodes {
+			hibernationJSON.Nodes = append(hibernationJSON.Nodes, HibernatedNodeJSON{
+				Name:          node.Name,
+				ServerVersion: node.ServerVersion,
+				ArchiveKey:    node.ArchiveKey,
+			})
+		}
+		metaJSON.Hibernation = hibernationJSON
+	}
+
+	if meta.EC2 != nil {
+		ec2JSON := &EC2MetaJSON{
+			Creator: meta.EC2.Creator,
+		}
+		for _, node := range meta.EC2.Nodes {
+			ec2JSON.Nodes = append(ec2JSON.Nodes, EC2NodeJSON{
+				Name:          node.Name,
+				ServerVersion: node.ServerVersion,
+				InstanceID:    node.InstanceID,
+				IPv4Address:   node.IPv4Address,
+			})
+		}
+		metaJSON.EC2 = ec2JSON
+	}
+
+	if meta.Capella != nil {
+		capellaJSON := &CapellaMetaJSON{
+			Creator:           meta.Capella.Creator,
+			ProjectID:         meta.Capella.ProjectID,
+			ClusterID:         meta.Capella.ClusterID,
+			State:             meta.Capella.State,
+			ConnectionString:  meta.Capella.ConnectionString,
+			Username:          meta.Capella.Username,
+			EncryptedPassword: meta.Capella.EncryptedPassword,
+		}
+		for _, node := range meta.Capella.Nodes {
+			capellaJSON.Nodes = append(capellaJSON.Nodes, CapellaNodeJSON{
+				Name:          node.Name,
+				ServerVersion: node.ServerVersion,
+			})
+		}
+		metaJSON.Capella = capellaJSON
 	}
 
 	metaBytes, err := json.Marshal(metaJSON)
@@ -55,122 +372,288 @@ func (store *MetaDataStore) deserializeMeta(bytes []byte) (ClusterMeta, error) {
 		parsedTimeout = DEFAULT_CLUSTER_TIMEOUT
 	}
 
-	return ClusterMeta{
-		Owner:   metaJSON.Owner,
-		Timeout: parsedTimeout,
-	}, nil
+	meta := ClusterMeta{
+		Owner:      metaJSON.Owner,
+		Timeout:    parsedTimeout,
+		SharedWith: metaJSON.SharedWith,
+		Team:       metaJSON.Team,
+		Tags:       metaJSON.Tags,
+		Alias:      metaJSON.Alias,
+		Pool:       metaJSON.Pool,
+		Host:       metaJSON.Host,
+		Provider:   metaJSON.Provider,
+		KeepAlive:  metaJSON.KeepAlive,
+
+		UseHostname: metaJSON.UseHostname,
+	}
+
+	if len(metaJSON.NodeOverrides) > 0 {
+		meta.NodeOverrides = make(map[string]NodeOverrides)
+		for nodeName, overridesJSON := range metaJSON.NodeOverrides {
+			meta.NodeOverrides[nodeName] = unjsonifyNodeOverrides(overridesJSON)
+		}
+	}
+
+	if metaJSON.Lease != nil {
+		meta.Lease = &LeaseMeta{
+			JobTokenHash: metaJSON.Lease.JobTokenHash,
+			CallbackURL:  metaJSON.Lease.CallbackURL,
+		}
+	}
+
+	if metaJSON.Hibernation != nil {
+		hibernatedAt, err := time.Parse(time.RFC3339Nano, metaJSON.Hibernation.HibernatedAt)
+		if err != nil {
+			return ClusterMeta{}, err
+		}
+
+		hibernation := &HibernationMeta{
+			Creator:      metaJSON.Hibernation.Creator,
+			HibernatedAt: hibernatedAt,
+			TimeLeft:     time.Duration(metaJSON.Hibernation.TimeLeft) * time.Second,
+		}
+		for _, node := range metaJSON.Hibernation.Nodes {
+			hibernation.Nodes = append(hibernation.Nodes, HibernatedNode{
+				Name:          node.Name,
+				ServerVersion: node.ServerVersion,
+				ArchiveKey:    node.ArchiveKey,
+			})
+		}
+		meta.Hibernation = hibernation
+	}
+
+	if metaJSON.EC2 != nil {
+		ec2Meta := &EC2Meta{
+			Creator: metaJSON.EC2.Creator,
+		}
+		for _, node := range metaJSON.EC2.Nodes {
+			ec2Meta.Nodes = append(ec2Meta.Nodes, EC2Node{
+				Name:          node.Name,
+				ServerVersion: node.ServerVersion,
+				InstanceID:    node.InstanceID,
+				IPv4Address:   node.IPv4Address,
+			})
+		}
+		meta.EC2 = ec2Meta
+	}
+
+	if metaJSON.Capella != nil {
+		capellaMeta := &CapellaMeta{
+			Creator:           metaJSON.Capella.Creator,
+			ProjectID:         metaJSON.Capella.ProjectID,
+			ClusterID:         metaJSON.Capella.ClusterID,
+			State:             metaJSON.Capella.State,
+			ConnectionString:  metaJSON.Capella.ConnectionString,
+			Username:          metaJSON.Capella.Username,
+			EncryptedPassword: metaJSON.Capella.EncryptedPassword,
+		}
+		for _, node := range metaJSON.Capella.Nodes {
+			capellaMeta.Nodes = append(capellaMeta.Nodes, CapellaNode{
+				Name:          node.Name,
+				ServerVersion: node.ServerVersion,
+			})
+		}
+		meta.Capella = capellaMeta
+	}
+
+	return meta, nil
 }
 
-func (store *MetaDataStore) Open(dir string) error {
-	opts := badger.DefaultOptions(dir)
-	db, err := badger.Open(opts)
+// openMetaBackend opens the backend which meta-data is stored in.  Badger
+// keeps it in a local directory, while SQLite and Postgres can be shared by
+// several daemons and queried with SQL.
+func openMetaBackend(kind, source string) (MetaBackend, error) {
+	switch kind {
+	case "", MetaStoreBadger:
+		if source == "" {
+			source = "./data"
+		}
+		return openBadgerMetaBackend(source)
+	case MetaStoreSQLite:
+		if !sqliteSupported {
+			return nil, errors.New("the sqlite meta-data store needs a daemon built with cgo, use badger or postgres instead")
+		}
+		if source == "" {
+			source = "./data.sqlite"
+		}
+		return openSQLMetaBackend(sqliteDialect, source)
+	case MetaStorePostgres:
+		if source == "" {
+			return nil, errors.New("the postgres meta-data store needs a connection string")
+		}
+		return openSQLMetaBackend(postgresDialect, source)
+	}
+
+	return nil, fmt.Errorf("unknown meta-data store %s, must be badger, sqlite or postgres", kind)
+}
+
+func (store *MetaDataStore) Open(kind, source string) error {
+	backend, err := openMetaBackend(kind, source)
 	if err != nil {
 		return err
 	}
 
-	store.db = db
+	store.backend = backend
 	return nil
 }
 
 func (store *MetaDataStore) Close() error {
-	return store.db.Close()
+	return store.backend.Close()
 }
 
-func (store *MetaDataStore) CreateClusterMeta(clusterID string, meta ClusterMeta) error {
-	clusterKey := []byte(fmt.Sprintf("cluster-%s", clusterID))
+func clusterMetaKey(clusterID string) string {
+	return fmt.Sprintf("cluster-%s", clusterID)
+}
 
+func (store *MetaDataStore) CreateClusterMeta(clusterID string, meta ClusterMeta) error {
 	metaBytes, err := store.serializeMeta(meta)
 	if err != nil {
 		return err
 	}
 
-	err = store.db.Update(func(txn *badger.Txn) error {
-		_, err := txn.Get(clusterKey)
-		if err == nil {
-			return errors.New("cluster meta-data already existed")
-		}
-
-		err = txn.Set(clusterKey, metaBytes)
-		return err
-	})
-	if err != nil {
-		return err
+	err = store.backend.Create(clusterMetaKey(clusterID), metaBytes)
+	if err == ErrMetaExists {
+		return errors.New("cluster meta-data already existed")
 	}
-
-	return nil
+	return err
 }
 
 type UpdateClusterMetaFunc func(ClusterMeta) (ClusterMeta, error)
 
 func (store *MetaDataStore) UpdateClusterMeta(clusterID string, updateFunc UpdateClusterMetaFunc) error {
-	clusterKey := []byte(fmt.Sprintf("cluster-%s", clusterID))
-	return store.db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get(clusterKey)
-		if err != nil {
-			return err
-		}
-
-		metaBytes, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-
+	return store.backend.Update(clusterMetaKey(clusterID), func(metaBytes []byte) ([]byte, error) {
 		meta, err := store.deserializeMeta(metaBytes)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		meta, err = updateFunc(meta)
 		if err != nil {
-			return err
-		}
-
-		metaBytes, err = store.serializeMeta(meta)
-		if err != nil {
-			return err
-		}
-
-		err = txn.Set(clusterKey, metaBytes)
-		if err != nil {
-			return err
+			return nil, err
 		}
 
-		return nil
+		return store.serializeMeta(meta)
 	})
 }
 
 func (store *MetaDataStore) GetClusterMeta(clusterID string) (ClusterMeta, error) {
-	clusterKey := []byte(fmt.Sprintf("cluster-%s", clusterID))
-
 	var meta ClusterMeta
 	// dgraph-io/badger sometimes panicing
 	defer func() {
 		if r := recover(); r != nil {
-			glog.Warningf("Something went wrong while retrieving cluster meta")
+			logWarnf(ContextWithClusterID(context.Background(), clusterID), "Something went wrong while retrieving cluster meta")
 			return
 		}
 	}()
-	err := store.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(clusterKey)
+
+	metaBytes, err := store.backend.Get(clusterMetaKey(clusterID))
+	if err != nil {
+		return DEFAULT_CLUSTER_META, err
+	}
+
+	meta, err = store.deserializeMeta(metaBytes)
+	if err != nil {
+		return DEFAULT_CLUSTER_META, err
+	}
+
+	return meta, nil
+}
+
+func (store *MetaDataStore) DeleteClusterMeta(clusterID string) error {
+	return store.backend.Delete(clusterMetaKey(clusterID))
+}
+
+func (store *MetaDataStore) GetAllClusterMeta() (map[string]ClusterMeta, error) {
+	prefix := "cluster-"
+
+	metas := make(map[string]ClusterMeta)
+	err := store.backend.Scan(prefix, func(key string, metaBytes []byte) error {
+		meta, err := store.deserializeMeta(metaBytes)
 		if err != nil {
 			return err
 		}
 
-		metaBytes, err := item.ValueCopy(nil)
-		if err != nil {
+		metas[key[len(prefix):]] = meta
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+// setRecord stores an arbitrary JSON serializable record under key.
+func (store *MetaDataStore) setRecord(key string, record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return store.backend.Set(key, recordBytes)
+}
+
+// getRecord loads the record stored under key into record.
+func (store *MetaDataStore) getRecord(key string, record interface{}) error {
+	recordBytes, err := store.backend.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(recordBytes, record)
+}
+
+func (store *MetaDataStore) deleteRecord(key string) error {
+	return store.backend.Delete(key)
+}
+
+// setRawRecord stores the raw JSON of a record under key.
+func (store *MetaDataStore) setRawRecord(key string, recordBytes []byte) error {
+	return store.backend.Set(key, recordBytes)
+}
+
+// createRawRecord stores the raw JSON of a record under key, unless there
+// already is a record with that key.
+func (store *MetaDataStore) createRawRecord(key string, recordBytes []byte) error {
+	return store.backend.Create(key, recordBytes)
+}
+
+// updateRawRecord replaces the raw JSON of the record under key with what
+// updateFunc returns, without anything else changing it in the meantime.
+func (store *MetaDataStore) updateRawRecord(key string, updateFunc func(recordBytes []byte) ([]byte, error)) error {
+	return store.backend.Update(key, updateFunc)
+}
+
+// createOrUpdateRawRecord is updateRawRecord for records which may not exist
+// yet, updateFunc is passed nil when the record is to be created.  Daemons
+// which race to create the record end up updating it in turn.
+func (store *MetaDataStore) createOrUpdateRawRecord(key string, updateFunc func(recordBytes []byte) ([]byte, error)) error {
+	for {
+		err := store.backend.Update(key, updateFunc)
+		if err != ErrMetaNotFound {
 			return err
 		}
 
-		meta, err = store.deserializeMeta(metaBytes)
+		recordBytes, err := updateFunc(nil)
 		if err != nil {
 			return err
 		}
 
-		return nil
-	})
-	if err != nil {
-		return DEFAULT_CLUSTER_META, err
+		err = store.backend.Create(key, recordBytes)
+		if err != ErrMetaExists {
+			return err
+		}
 	}
+}
 
-	return meta, nil
+// deleteRawRecordIf deletes the record under key, unless it has been changed
+// from recordBytes in the meantime.
+func (store *MetaDataStore) deleteRawRecordIf(key string, recordBytes []byte) error {
+	return store.backend.DeleteIf(key, recordBytes)
+}
+
+// forEachRecord calls fn with the key and raw JSON of every record whose key
+// starts with prefix.
+func (store *MetaDataStore) forEachRecord(prefix string, fn func(key string, recordBytes []byte) error) error {
+	return store.backend.Scan(prefix, fn)
 }
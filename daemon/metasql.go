@@ -0,0 +1,218 @@
+package daemon
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	// The driver of the postgres meta-data store, the sqlite driver is only
+	// included in builds with cgo.
+	_ "github.com/lib/pq"
+)
+
+// sqlMetaUpdateRetries is how many times an update is tried when the record
+// keeps being changed by somebody else in the meantime.
+const sqlMetaUpdateRetries = 10
+
+type sqlDialect struct {
+	driver string
+	schema string
+	// numberedParams is set for databases which take $1 rather than ? as
+	// query parameters.
+	numberedParams bool
+}
+
+// Records are kept as JSON so that they can be queried, such as with
+// SELECT meta_value->>'owner' FROM cbdyncluster_meta in Postgres.
+var sqliteDialect = sqlDialect{
+	driver: "sqlite3",
+	schema: `CREATE TABLE IF NOT EXISTS cbdyncluster_meta (
+		meta_key TEXT PRIMARY KEY,
+		meta_value TEXT NOT NULL
+	)`,
+}
+
+var postgresDialect = sqlDialect{
+	driver: "postgres",
+	schema: `CREATE TABLE IF NOT EXISTS cbdyncluster_meta (
+		meta_key TEXT COLLATE "C" PRIMARY KEY,
+		meta_value JSONB NOT NULL
+	)`,
+	numberedParams: true,
+}
+
+// sqlMetaBackend keeps meta-data in a single table of a SQL database, which
+// several daemons can share.  Updates compare and swap the value which they
+// read, rather than holding locks while the update runs.
+type sqlMetaBackend struct {
+	dialect sqlDialect
+	db      *sql.DB
+}
+
+func openSQLMetaBackend(dialect sqlDialect, source string) (*sqlMetaBackend, error) {
+	// SQLite allows a single writer at a time, so writers wait for each
+	// other rather than failing straight away.
+	if dialect.driver == sqliteDialect.driver && !strings.Contains(source, "?") {
+		source += "?_busy_timeout=5000&_journal_mode=WAL"
+	}
+
+	db, err := sql.Open(dialect.driver, source)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(dialect.schema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlMetaBackend{dialect: dialect, db: db}, nil
+}
+
+// query rewrites the ? parameters of a query for the database.
+func (backend *sqlMetaBackend) query(query string) string {
+	if !backend.dialect.numberedParams {
+		return query
+	}
+
+	var rewritten strings.Builder
+	param := 0
+	for _, c := range query {
+		if c == '?' {
+			param++
+			fmt.Fprintf(&rewritten, "$%d", param)
+		} else {
+			rewritten.WriteRune(c)
+		}
+	}
+	return rewritten.String()
+}
+
+func (backend *sqlMetaBackend) Get(key string) ([]byte, error) {
+	var value []byte
+	err := backend.db.QueryRow(backend.query("SELECT meta_value FROM cbdyncluster_meta WHERE meta_key = ?"), key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrMetaNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (backend *sqlMetaBackend) Set(key string, value []byte) error {
+	_, err := backend.db.Exec(backend.query(
+		"INSERT INTO cbdyncluster_meta (meta_key, meta_value) VALUES (?, ?) "+
+			"ON CONFLICT (meta_key) DO UPDATE SET meta_value = excluded.meta_value"),
+		key, string(value))
+	return err
+}
+
+func (backend *sqlMetaBackend) Create(key string, value []byte) error {
+	result, err := backend.db.Exec(backend.query(
+		"INSERT INTO cbdyncluster_meta (meta_key, meta_value) VALUES (?, ?) "+
+			"ON CONFLICT (meta_key) DO NOTHING"),
+		key, string(value))
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrMetaExists
+	}
+
+	return nil
+}
+
+func (backend *sqlMetaBackend) Update(key string, updateFunc func(value []byte) ([]byte, error)) error {
+	for i := 0; i < sqlMetaUpdateRetries; i++ {
+		value, err := backend.Get(key)
+		if err != nil {
+			return err
+		}
+
+		newValue, err := updateFunc(value)
+		if err != nil {
+			return err
+		}
+
+		result, err := backend.db.Exec(backend.query(
+			"UPDATE cbdyncluster_meta SET meta_value = ? WHERE meta_key = ? AND meta_value = ?"),
+			string(newValue), key, string(value))
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s kept changing while it was being updated", key)
+}
+
+func (backend *sqlMetaBackend) Delete(key string) error {
+	_, err := backend.db.Exec(backend.query("DELETE FROM cbdyncluster_meta WHERE meta_key = ?"), key)
+	return err
+}
+
+func (backend *sqlMetaBackend) DeleteIf(key string, value []byte) error {
+	_, err := backend.db.Exec(backend.query(
+		"DELETE FROM cbdyncluster_meta WHERE meta_key = ? AND meta_value = ?"),
+		key, string(value))
+	return err
+}
+
+func (backend *sqlMetaBackend) Scan(prefix string, fn func(key string, value []byte) error) error {
+	rows, err := backend.db.Query(backend.query(
+		"SELECT meta_key, meta_value FROM cbdyncluster_meta "+
+			"WHERE substr(meta_key, 1, length(CAST(? AS TEXT))) = CAST(? AS TEXT) ORDER BY meta_key"),
+		prefix, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Read everything before calling fn, which may well use the store
+	// itself.
+	type record struct {
+		key   string
+		value []byte
+	}
+	var records []record
+	for rows.Next() {
+		var rec record
+		err = rows.Scan(&rec.key, &rec.value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, rec)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		err = fn(rec.key, rec.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (backend *sqlMetaBackend) Close() error {
+	return backend.db.Close()
+}
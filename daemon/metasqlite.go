@@ -0,0 +1,12 @@
+//go:build cgo
+// +build cgo
+
+package daemon
+
+import (
+	// go-sqlite3 wraps the C library of SQLite, so the sqlite meta-data store
+	// is only part of daemons built with cgo.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSupported = true
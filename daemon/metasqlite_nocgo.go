@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package daemon
+
+// sqliteSupported is unset in daemons built without cgo, such as the macOS and
+// Windows releases which are cross-compiled, since they have no SQLite driver.
+const sqliteSupported = false
@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+// durationBuckets are the buckets of durations, in seconds, from allocations
+// which reuse everything to image builds which download a whole package.
+var durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200}
+
+var (
+	clustersAllocatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cbdyncluster_clusters_allocated_total",
+		Help: "Number of cluster allocations by result.",
+	}, []string{"result"})
+	clustersKilledTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cbdyncluster_clusters_killed_total",
+		Help: "Number of clusters killed.",
+	})
+	allocationDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cbdyncluster_allocation_duration_seconds",
+		Help:    "Time taken to allocate clusters by result.",
+		Buckets: durationBuckets,
+	}, []string{"result"})
+	imageBuildDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cbdyncluster_image_build_duration_seconds",
+		Help:    "Time taken to build server images by result.",
+		Buckets: durationBuckets,
+	}, []string{"result"})
+	dockerErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cbdyncluster_docker_errors_total",
+		Help: "Number of failed Docker API calls by operation.",
+	}, []string{"operation"})
+	reaperRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cbdyncluster_reaper_runs_total",
+		Help: "Number of times the reaper has looked for expired clusters by result.",
+	}, []string{"result"})
+	reaperKilledTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cbdyncluster_reaper_killed_clusters_total",
+		Help: "Number of expired clusters killed by the reaper.",
+	})
+	rateLimitedRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cbdyncluster_rate_limited_requests_total",
+		Help: "Number of requests rejected by the per-user rate limit.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		clustersAllocatedTotal,
+		clustersKilledTotal,
+		allocationDurationSeconds,
+		imageBuildDurationSeconds,
+		dockerErrorsTotal,
+		reaperRunsTotal,
+		reaperKilledTotal,
+		rateLimitedRequestsTotal,
+		newGaugeFunc("cbdyncluster_active_clusters", "Number of active clusters by owner.",
+			"owner", collectActiveClusters),
+		newGaugeFunc("cbdyncluster_active_nodes", "Number of active nodes by owner.",
+			"owner", collectActiveNodes),
+		newGaugeFunc("cbdyncluster_warm_pool_nodes", "Number of idle warm pool nodes by server version.",
+			"server_version", collectWarmPoolNodes),
+	)
+}
+
+// gaugeFunc is a gauge with a single label whose values are computed when it
+// is collected, such as the number of active clusters of each owner.
+type gaugeFunc struct {
+	desc    *prometheus.Desc
+	collect func() (map[string]float64, error)
+}
+
+func newGaugeFunc(name, help, labelName string, collect func() (map[string]float64, error)) *gaugeFunc {
+	return &gaugeFunc{
+		desc:    prometheus.NewDesc(name, help, []string{labelName}, nil),
+		collect: collect,
+	}
+}
+
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	values, err := g.collect()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(g.desc, err)
+		return
+	}
+
+	for labelValue, value := range values {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, labelValue)
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.  A
+// collector which fails, such as when docker can't be reached, leaves out its
+// own metrics rather than failing the whole scrape.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// trackDockerError counts failed Docker API calls, passing the error through.
+func trackDockerError(operation string, err error) error {
+	if err != nil {
+		dockerErrorsTotal.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+func collectActiveClusters() (map[string]float64, error) {
+	return collectPerOwner(func(cluster *Cluster) float64 {
+		return 1
+	})
+}
+
+func collectActiveNodes() (map[string]float64, error) {
+	return collectPerOwner(func(cluster *Cluster) float64 {
+		return float64(len(cluster.Nodes))
+	})
+}
+
+func collectPerOwner(valueFn func(*Cluster) float64) (map[string]float64, error) {
+	clusters, err := getAllClusters(systemCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	perOwner := make(map[string]float64)
+	for _, cluster := range clusters {
+		if cluster.Hibernated {
+			continue
+		}
+		perOwner[cluster.Owner] += valueFn(cluster)
+	}
+
+	return perOwner, nil
+}
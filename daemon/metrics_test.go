@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGaugeFuncExposition(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    map[string]float64
+		err       error
+		want      string
+		wantError bool
+	}{
+		{
+			name: "no values",
+			want: "",
+		},
+		{
+			name:   "a value per label",
+			values: map[string]float64{"alice@couchbase.com": 2, "bob@couchbase.com": 1},
+			want: `
+# HELP cbdyncluster_test_clusters Number of test clusters by owner.
+# TYPE cbdyncluster_test_clusters gauge
+cbdyncluster_test_clusters{owner="alice@couchbase.com"} 2
+cbdyncluster_test_clusters{owner="bob@couchbase.com"} 1
+`,
+		},
+		{
+			name:      "collection fails",
+			err:       errors.New("docker is down"),
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gauge := newGaugeFunc("cbdyncluster_test_clusters", "Number of test clusters by owner.", "owner",
+				func() (map[string]float64, error) {
+					return test.values, test.err
+				})
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(gauge)
+
+			err := testutil.GatherAndCompare(registry, strings.NewReader(test.want), "cbdyncluster_test_clusters")
+			if test.wantError {
+				if err == nil {
+					t.Fatalf("expected gathering to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCounterExposition(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		err       error
+		want      float64
+	}{
+		{name: "failed call is counted", operation: "test_failed", err: errors.New("failed"), want: 1},
+		{name: "successful call isn't counted", operation: "test_succeeded", want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := trackDockerError(test.operation, test.err)
+			if err != test.err {
+				t.Fatalf("expected the error to be passed through, got %v", err)
+			}
+
+			got := testutil.ToFloat64(dockerErrorsTotal.WithLabelValues(test.operation))
+			if got != test.want {
+				t.Fatalf("expected %v failed calls, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	// Point at a docker daemon which isn't listening, so that docker calls
+	// fail straight away.
+	oldDocker, oldDockerHosts, oldSystemCtx := docker, dockerHosts, systemCtx
+	defer func() {
+		docker, dockerHosts, systemCtx = oldDocker, oldDockerHosts, oldSystemCtx
+	}()
+	systemCtx = NewContext(context.Background(), "system", true)
+	cli, err := client.NewClient("tcp://127.0.0.1:1", "1.38", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &DockerHost{Name: "unreachable", Address: "tcp://127.0.0.1:1", Client: cli}
+	docker, dockerHosts = cli, []*DockerHost{host}
+
+	_, err = allocateCluster(context.Background(), ClusterOptions{Timeout: -time.Hour})
+	if err == nil {
+		t.Fatalf("expected allocating a cluster with a negative timeout to fail")
+	}
+
+	err = imagePull(context.Background(), host, "couchbase/server:unreachable")
+	if err == nil {
+		t.Fatalf("expected pulling an image without docker to fail")
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`cbdyncluster_clusters_allocated_total{result="failure"} 1`,
+		`cbdyncluster_allocation_duration_seconds_bucket{result="failure",le="1"} 1`,
+		`cbdyncluster_allocation_duration_seconds_count{result="failure"} 1`,
+		`cbdyncluster_docker_errors_total{operation="image_pull"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the metrics to contain %s, got:\n%s", want, body)
+		}
+	}
+}
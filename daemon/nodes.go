@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -13,7 +12,8 @@ import (
 	"github.com/couchbaselabs/cbdynclusterd/helper"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/golang/glog"
+	"github.com/docker/docker/api/types/network"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var NetworkName = "macvlan0"
@@ -23,12 +23,32 @@ type NodeOptions struct {
 	Platform      string
 	ServerVersion string
 	VersionInfo   *NodeVersion
+	// IPv4Address is the address to give the node on the docker network, it
+	// must have been reserved from the IP pool, see reserveNodeIPs.  Docker
+	// picks one if it is empty.
+	IPv4Address string
+	Overrides   NodeOverrides
+
+	// restoreArchive is the object storage key of a data archive to restore
+	// into the node before it is started, used when waking hibernated clusters.
+	restoreArchive string
+	// host is the docker host to create the node on, the cluster is placed
+	// before any of its nodes are allocated.
+	host *DockerHost
 }
 
 type NodeVersion struct {
 	Version string
 	Flavor  string
 	Build   string
+	// PackageURL and Checksum are where the package of a toy build is, and
+	// its SHA-256, they are empty for official builds.
+	PackageURL string
+	Checksum   string
+}
+
+func (nv *NodeVersion) isToyBuild() bool {
+	return nv.PackageURL != ""
 }
 
 func (nv *NodeVersion) toTagName() string {
@@ -39,7 +59,10 @@ func (nv *NodeVersion) toTagName() string {
 }
 
 func (nv *NodeVersion) toImageName() string {
-	return fmt.Sprintf("%s/dynclsr-couchbase_%s", dockerRegistry, nv.toTagName())
+	if nv.isToyBuild() {
+		return fmt.Sprintf("%s/dynclsr-couchbase-toy_%s", getRuntimeConfig().DockerRegistry, nv.toTagName())
+	}
+	return fmt.Sprintf("%s/dynclsr-couchbase_%s", getRuntimeConfig().DockerRegistry, nv.toTagName())
 }
 
 func (nv *NodeVersion) toPkgName() string {
@@ -57,6 +80,14 @@ func (nv *NodeVersion) toURL() string {
 	return fmt.Sprintf("%s%s/%s", cluster.BuildUrl, nv.Flavor, nv.Build)
 }
 
+// toPkgURL is where the package of the build is downloaded from.
+func (nv *NodeVersion) toPkgURL() string {
+	if nv.isToyBuild() {
+		return nv.PackageURL
+	}
+	return fmt.Sprintf("%s/%s", nv.toURL(), nv.toPkgName())
+}
+
 var versionToFlavor = map[int]map[int]string{
 	4: {0: "sherlock", 5: "watson"},
 	5: {0: "spock", 5: "vulcan"},
@@ -103,68 +134,196 @@ func parseServerVersion(version string) (*NodeVersion, error) {
 	if len(versionParts) > 1 {
 		nodeVersion.Build = versionParts[1]
 	}
+	if len(versionParts) == 3 && versionParts[1] == toyBuildMarker {
+		build, err := getToyBuild(versionParts[2])
+		if err != nil {
+			return nil, err
+		}
+		nodeVersion.Build = versionParts[1] + "-" + versionParts[2]
+		nodeVersion.PackageURL = build.PackageURL
+		nodeVersion.Checksum = build.Checksum
+	}
 
 	return &nodeVersion, nil
 }
 
-func allocateNode(ctx context.Context, clusterID string, timeout time.Time, opts NodeOptions) (string, error) {
-	log.Printf("Allocating node for cluster %s (requested by: %s)", clusterID, ContextUser(ctx))
+func allocateNode(ctx context.Context, clusterID string, timeout time.Time, opts NodeOptions) (containerID string, err error) {
+	ctx = ContextWithNode(ContextWithClusterID(ctx, clusterID), opts.Name)
+	logInfof(ctx, "Allocating node")
+
+	ctx, span := startSpan(ctx, "allocateNode", attribute.String("cbdyncluster.server_version", opts.ServerVersion))
+	defer func() {
+		endSpan(span, err)
+	}()
 
 	containerName := fmt.Sprintf("dynclsr-%s-%s", clusterID, opts.Name)
 	containerImage := opts.VersionInfo.toImageName()
 
-	var dns []string
-	if dnsSvcHost != "" {
-		dns = append(dns, dnsSvcHost)
+	host := opts.host
+	if host == nil {
+		host = primaryDockerHost()
 	}
-	createResult, err := docker.ContainerCreate(context.Background(), &container.Config{
-		Image: containerImage,
-		Labels: map[string]string{
-			"com.couchbase.dyncluster.creator":                ContextUser(ctx),
-			"com.couchbase.dyncluster.cluster_id":             clusterID,
-			"com.couchbase.dyncluster.node_name":              opts.Name,
-			"com.couchbase.dyncluster.initial_server_version": opts.ServerVersion,
-		},
-		// same effect as ntp
-		Volumes: map[string]struct{}{"/etc/localtime:/etc/localtime": {}},
-	}, &container.HostConfig{
-		AutoRemove:  true,
-		NetworkMode: container.NetworkMode(NetworkName),
-		DNS:         dns,
-	}, nil, containerName)
+
+	release, err := nodeAllocationSlots.acquire(ctx)
 	if err != nil {
 		return "", err
 	}
+	defer release()
+
+	// Pooled nodes already have an address, which won't be the one reserved,
+	// and have already been started without any overrides.  This is why the
+	// warm pool can't be used with ip-ranges.
+	if opts.restoreArchive == "" && opts.IPv4Address == "" && opts.Overrides.empty() {
+		containerID, ok := claimPooledNode(ctx, clusterID, opts)
+		if ok {
+			return containerID, nil
+		}
+	}
 
-	err = docker.ContainerStart(context.Background(), createResult.ID, types.ContainerStartOptions{})
+	containerID, err = startNodeContainer(ctx, host, containerName, containerImage, map[string]string{
+		"com.couchbase.dyncluster.creator":                ContextUser(ctx),
+		"com.couchbase.dyncluster.cluster_id":             clusterID,
+		"com.couchbase.dyncluster.node_name":              opts.Name,
+		"com.couchbase.dyncluster.initial_server_version": opts.ServerVersion,
+	}, opts)
 	if err != nil {
 		return "", err
 	}
-	containerJSON, err := docker.ContainerInspect(context.Background(), createResult.ID)
+
+	containerJSON, err := host.Client.ContainerInspect(context.Background(), containerID)
 	if err != nil {
-		return "", err
+		return "", trackDockerError("container_inspect", err)
 	}
 	ipv4 := containerJSON.NetworkSettings.Networks[NetworkName].IPAddress
 	ipv6 := containerJSON.NetworkSettings.Networks[NetworkName].GlobalIPv6Address
-	containerHostName := containerName + ".couchbase.com"
+
+	registerNodeDNS(ctx, containerName, ipv4, ipv6)
+
+	return containerID, nil
+}
+
+// startNodeContainer creates and starts the container of a node, restoring a
+// data archive into it and overriding its config first if the options say
+// to.  Only a limited number of these run at once, to protect the docker
+// host.
+func startNodeContainer(ctx context.Context, host *DockerHost, containerName, containerImage string, labels map[string]string, opts NodeOptions) (string, error) {
+	release, err := acquireDockerSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	_, createSpan := startSpan(ctx, "docker.ContainerCreate", attribute.String("docker.image", containerImage))
+	containerConfig, hostConfig := nodeContainerConfig(containerImage, labels)
+	containerConfig.Env = containerEnv(opts.Overrides.Env)
+	hostConfig.ExtraHosts = containerExtraHosts(opts.Overrides.ExtraHosts)
+	hostConfig.DNSSearch = opts.Overrides.DNSSearch
+	hostConfig.Ulimits = containerUlimits(opts.Overrides.Ulimits)
+	hostConfig.Sysctls = opts.Overrides.Sysctls
+	hostConfig.CapAdd = append(hostConfig.CapAdd, opts.Overrides.CapAdd...)
+	hostConfig.Privileged = opts.Overrides.Privileged
+	var networkingConfig *network.NetworkingConfig
+	if opts.IPv4Address != "" {
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				NetworkName: {IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: opts.IPv4Address}},
+			},
+		}
+	}
+	createResult, err := host.Client.ContainerCreate(context.Background(), containerConfig, hostConfig, networkingConfig, containerName)
+	endSpan(createSpan, err)
+	if err != nil {
+		return "", trackDockerError("container_create", err)
+	}
+	rememberContainerHost(createResult.ID, host)
+
+	if opts.restoreArchive != "" {
+		err = restoreNode(ctx, createResult.ID, opts.restoreArchive)
+		if err != nil {
+			host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+			return "", err
+		}
+	}
+
+	if len(opts.Overrides.StaticConfig) > 0 {
+		err = overrideStaticConfig(ctx, host, createResult.ID, opts.Overrides.StaticConfig)
+		if err != nil {
+			host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+			return "", err
+		}
+	}
+
+	_, containerStartSpan := startSpan(ctx, "docker.ContainerStart")
+	err = host.Client.ContainerStart(context.Background(), createResult.ID, types.ContainerStartOptions{})
+	endSpan(containerStartSpan, err)
+	if err != nil {
+		host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+		return "", trackDockerError("container_start", err)
+	}
+
+	return createResult.ID, nil
+}
+
+func nodeContainerConfig(containerImage string, labels map[string]string) (*container.Config, *container.HostConfig) {
+	var dns []string
+	if dnsSvcHost != "" {
+		dns = append(dns, dnsSvcHost)
+	}
+
+	return &container.Config{
+		Image:  containerImage,
+		Labels: labels,
+		// same effect as ntp
+		Volumes: map[string]struct{}{"/etc/localtime:/etc/localtime": {}},
+	}, &container.HostConfig{
+		AutoRemove:  true,
+		NetworkMode: container.NetworkMode(NetworkName),
+		DNS:         dns,
+	}
+}
+
+// nodeHostname is the DNS name which a node is registered under, given the
+// name of its container.
+func nodeHostname(containerName string) string {
+	return strings.TrimPrefix(containerName, "/") + helper.DomainPostfix
+}
+
+func registerNodeDNS(ctx context.Context, containerName, ipv4, ipv6 string) {
+	containerHostName := nodeHostname(containerName)
 
 	if dnsSvcHost != "" {
 		if ipv4 != "" {
-			glog.Infof("register %s => %s on %s\n", ipv4, containerHostName, dnsSvcHost)
+			logInfof(ctx, "register %s => %s on %s", ipv4, containerHostName, dnsSvcHost)
+			_, dnsSpan := startSpan(ctx, "dns.Register", attribute.String("dns.hostname", containerHostName))
 			body, err := registerDomainName(containerHostName, ipv4)
+			endSpan(dnsSpan, err)
 			if err != nil {
-				glog.Warningf("Failed registering IPv4:%s, %s", err, body)
+				logWarnf(ctx, "Failed registering IPv4:%s, %s", err, body)
 			}
 		}
 
 		if ipv6 != "" {
-			glog.Infof("register %s => %s on %s\n", ipv6, containerHostName, dnsSvcHost)
+			logInfof(ctx, "register %s => %s on %s", ipv6, containerHostName, dnsSvcHost)
+			_, dnsSpan := startSpan(ctx, "dns.Register", attribute.String("dns.hostname", containerHostName))
 			body, err := registerDomainName(containerHostName, ipv6)
-			glog.Warningf("Failed registering IPv6:%s, %s", err, body)
+			endSpan(dnsSpan, err)
+			if err != nil {
+				logWarnf(ctx, "Failed registering IPv6:%s, %s", err, body)
+			}
 		}
 	}
+}
 
-	return createResult.ID, nil
+// findNode locates a node of a cluster by its node name, container name or
+// container ID.
+func findNode(cluster *Cluster, nodeRef string) (*Node, error) {
+	for _, node := range cluster.Nodes {
+		if node.Name == nodeRef || node.ContainerID == nodeRef || strings.TrimPrefix(node.ContainerName, "/") == nodeRef {
+			return node, nil
+		}
+	}
+
+	return nil, errors.New("node not found")
 }
 
 // assign hostname to the IP in DNS server
@@ -184,11 +343,15 @@ func registerDomainName(hostname, ip string) (string, error) {
 }
 
 func killNode(ctx context.Context, containerID string) error {
-	log.Printf("Killing node %s (requested by: %s)", containerID, ContextUser(ctx))
+	ctx = ContextWithNode(ctx, containerID)
+	logInfof(ctx, "Killing node")
 
-	err := docker.ContainerStop(context.Background(), containerID, nil)
+	markContainerStopping(containerID)
+	_, span := startSpan(ctx, "docker.ContainerStop")
+	err := dockerFor(containerID).ContainerStop(context.Background(), containerID, nil)
+	endSpan(span, err)
 	if err != nil {
-		return err
+		return trackDockerError("container_stop", err)
 	}
 
 	// No need to kill the node, since we use `kill on stop` when creating the container
@@ -199,5 +362,8 @@ func killNode(ctx context.Context, containerID string) error {
 		}
 	*/
 
+	releasePoolClaim(ctx, containerID)
+	forgetContainerHost(containerID)
+
 	return nil
 }
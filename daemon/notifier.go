@@ -0,0 +1,308 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// publicURL is the address users reach the daemon on, used to build links in
+// notifications.  Links are left out when it isn't configured.
+var publicURL = ""
+var smtpHost = ""
+var smtpFrom = ""
+
+// refreshLinkExtension is how much longer a cluster lives each time its
+// refresh link is followed.
+var refreshLinkExtension = 1 * time.Hour
+
+// NotificationSettings controls how a user is warned about their clusters
+// expiring, by default they are emailed if the daemon can send email.
+type NotificationSettings struct {
+	SlackWebhook string `json:"slack_webhook,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+}
+
+// refreshLinkSecret signs refresh links, it is kept in the meta-data store so
+// that links survive restarts of the daemon.
+var refreshLinkSecret []byte
+
+const refreshLinkSecretKey = "notifier-secret"
+
+func loadRefreshLinkSecret() error {
+	var secret string
+	err := metaStore.getRecord(refreshLinkSecretKey, &secret)
+	if err == nil {
+		refreshLinkSecret, err = hex.DecodeString(secret)
+		return err
+	} else if err != ErrMetaNotFound {
+		return err
+	}
+
+	refreshLinkSecret = make([]byte, 32)
+	_, err = rand.Read(refreshLinkSecret)
+	if err != nil {
+		return err
+	}
+
+	return metaStore.setRecord(refreshLinkSecretKey, hex.EncodeToString(refreshLinkSecret))
+}
+
+func signRefreshLink(clusterID string, expires int64) string {
+	mac := hmac.New(sha256.New, refreshLinkSecret)
+	fmt.Fprintf(mac, "%s|%d", clusterID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// refreshLink builds a link which refreshes a cluster without needing an API
+// token, so that it can be followed straight from a notification.
+func refreshLink(clusterID string, expires time.Time) string {
+	if publicURL == "" {
+		return ""
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", signRefreshLink(clusterID, expires.Unix()))
+	return fmt.Sprintf("%s/cluster/%s/refresh-link?%s", strings.TrimSuffix(publicURL, "/"), clusterID, query.Encode())
+}
+
+// usedRefreshLinkKey records that a refresh link has been used, since each
+// link only refreshes its cluster once.  The records are kept until the
+// links expire, after which they can't be used anyway.
+func usedRefreshLinkKey(sig string) string {
+	return "refreshlink-used-" + sig
+}
+
+// checkRefreshLink checks that a refresh link is signed by this daemon, and
+// that it is neither expired nor used yet.
+func checkRefreshLink(clusterID, expiresParam, sig string) (int64, error) {
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid refresh link")
+	}
+
+	expectedSig := signRefreshLink(clusterID, expires)
+	if !hmac.Equal([]byte(sig), []byte(expectedSig)) {
+		return 0, errors.New("invalid refresh link")
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return 0, errors.New("refresh link has expired")
+	}
+
+	var usedExpires int64
+	err = metaStore.getRecord(usedRefreshLinkKey(sig), &usedExpires)
+	if err == nil {
+		return 0, errors.New("refresh link has already been used")
+	} else if err != ErrMetaNotFound {
+		return 0, err
+	}
+
+	return expires, nil
+}
+
+// refreshClusterFromLink checks a refresh link, uses it up, and extends the
+// cluster, without changing who owns it.
+func refreshClusterFromLink(ctx context.Context, clusterID, expiresParam, sig string) (time.Time, error) {
+	expires, err := checkRefreshLink(clusterID, expiresParam, sig)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Claiming the link is what makes it single use, two requests racing to
+	// use the same link can't both create the record.
+	err = metaStore.createRawRecord(usedRefreshLinkKey(sig), []byte(strconv.FormatInt(expires, 10)))
+	if err == ErrMetaExists {
+		return time.Time{}, errors.New("refresh link has already been used")
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	var newTimeout time.Time
+	err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		extendedTimeout := time.Now().Add(refreshLinkExtension)
+		if meta.Timeout.Before(extendedTimeout) {
+			meta.Timeout = extendedTimeout
+		}
+		newTimeout = meta.Timeout
+		return meta, nil
+	})
+	if err != nil {
+		return time.Time{}, errors.New("cluster not found")
+	}
+
+	logInfof(ContextWithClusterID(ctx, clusterID), "Refreshed cluster from link until %s", newTimeout.Format(time.RFC3339))
+
+	return newTimeout, nil
+}
+
+// cleanupUsedRefreshLinks forgets the links which were used once they have
+// expired.
+func cleanupUsedRefreshLinks() error {
+	var expired []string
+	err := metaStore.forEachRecord("refreshlink-used-", func(key string, recordBytes []byte) error {
+		var expires int64
+		err := json.Unmarshal(recordBytes, &expires)
+		if err != nil {
+			return err
+		}
+
+		if time.Now().After(time.Unix(expires, 0)) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		err = metaStore.deleteRecord(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateEmailAddress only accepts a bare address, such as
+// someone@example.com, since the address is written into the headers of
+// notification emails.
+func validateEmailAddress(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Name != "" || parsed.Address != address {
+		return errors.Errorf("%q is not a valid email address", address)
+	}
+	return nil
+}
+
+func getNotificationSettings(user string) (NotificationSettings, error) {
+	record, err := getUserRecord(user)
+	if err != nil {
+		return NotificationSettings{}, err
+	}
+
+	if record.Notifications != nil {
+		return *record.Notifications, nil
+	}
+	return NotificationSettings{}, nil
+}
+
+func setNotificationSettings(ctx context.Context, settings NotificationSettings) error {
+	if settings.SlackWebhook != "" {
+		hookURL, err := url.Parse(settings.SlackWebhook)
+		if err != nil || hookURL.Scheme != "https" || hookURL.Host == "" {
+			return errors.New("slack webhook must be an https url")
+		}
+	}
+	if settings.Email != "" {
+		err := validateEmailAddress(settings.Email)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := updateUserRecord(ctx, ContextUser(ctx), func(record *UserRecord) {
+		record.Notifications = &settings
+	})
+	return err
+}
+
+func expiryMessage(cluster *Cluster) string {
+	message := fmt.Sprintf("Your cluster %s expires in %d minutes, at %s.",
+		cluster.ID, int(time.Until(cluster.Timeout).Minutes()), cluster.Timeout.Format(time.RFC1123))
+
+	link := refreshLink(cluster.ID, cluster.Timeout.Add(time.Hour))
+	if link != "" {
+		message += fmt.Sprintf(" Keep it for another %s: %s", refreshLinkExtension, link)
+	}
+
+	return message
+}
+
+func sendSlackMessage(webhookURL, message string) error {
+	body, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("slack returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func sendEmail(to, subject, message string) error {
+	// Owners without an email set are mailed at their user name, which was
+	// never checked to be an address.
+	err := validateEmailAddress(to)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", smtpFrom, to, subject, message)
+	return smtp.SendMail(smtpHost, nil, smtpFrom, []string{to}, []byte(body))
+}
+
+// notifyExpiringCluster warns the owner of a cluster that it is about to be
+// killed, through whichever channels they have set up.
+func notifyExpiringCluster(ctx context.Context, cluster *Cluster) {
+	ctx = ContextWithClusterID(ctx, cluster.ID)
+
+	if cluster.Owner == "" || cluster.Owner == DEFAULT_CLUSTER_META.Owner {
+		return
+	}
+
+	settings, err := getNotificationSettings(cluster.Owner)
+	if err != nil {
+		logWarnf(ctx, "Failed to load notification settings of %s: %s", cluster.Owner, err)
+		return
+	}
+	if settings.Disabled {
+		return
+	}
+
+	message := expiryMessage(cluster)
+
+	if settings.SlackWebhook != "" {
+		err := sendSlackMessage(settings.SlackWebhook, message)
+		if err != nil {
+			logWarnf(ctx, "Failed to notify %s on slack: %s", cluster.Owner, err)
+		}
+	}
+
+	if smtpHost != "" {
+		to := settings.Email
+		if to == "" {
+			to = cluster.Owner
+		}
+
+		err := sendEmail(to, fmt.Sprintf("Cluster %s is about to expire", cluster.ID), message)
+		if err != nil {
+			logWarnf(ctx, "Failed to email %s: %s", to, err)
+		}
+	}
+}
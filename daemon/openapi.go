@@ -0,0 +1,440 @@
+package daemon
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPIOperation documents a single route.  Request and response bodies
+// are given as the same types that the handlers read and write, so that the
+// document is generated from them and can't drift from what the daemon does.
+type openAPIOperation struct {
+	Summary string
+	Tag     string
+	Query   []openAPIParam
+	// Request is a value of the type of the JSON request body, if any.
+	Request interface{}
+	// Response is a value of the type of the JSON response body, if any.
+	Response interface{}
+	// ResponseType is the content type of responses which aren't JSON.
+	ResponseType string
+}
+
+type openAPIParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+var clusterFilterParams = []openAPIParam{
+	{"owner", "Only clusters owned by this user", "string"},
+	{"server_version", "Only clusters with a node running this server version", "string"},
+	{"state", "Only clusters in this state: running, degraded, stopped or hibernated", "string"},
+	{"min_nodes", "Only clusters with at least this many nodes", "integer"},
+	{"max_nodes", "Only clusters with at most this many nodes", "integer"},
+	{"tag", "Only clusters with this tag, as name=value or name for any value", "string"},
+	{"expires_after", "Only clusters expiring after this RFC3339 time", "string"},
+	{"expires_before", "Only clusters expiring before this RFC3339 time", "string"},
+	{"expires_within", "Only clusters expiring within this duration", "string"},
+	{"sort", "Field to sort clusters by", "string"},
+	{"offset", "Number of clusters to skip", "integer"},
+	{"limit", "Maximum number of clusters to return", "integer"},
+}
+
+// openAPIOperations is keyed by the method and path template of each route.
+// Routes which are missing from here are still documented, but only with
+// their path and method.
+var openAPIOperations = map[string]openAPIOperation{
+	"GET /":             {Summary: "Check that the daemon is running", Tag: "daemon", ResponseType: "text/plain"},
+	"GET /docker-host":  {Summary: "Get the docker host which runs clusters", Tag: "daemon", Query: []openAPIParam{{"cluster", "Get the docker host which runs this cluster", "string"}}, Response: DockerHostJSON{}},
+	"GET /version":      {Summary: "Get the version of the daemon", Tag: "daemon", Response: VersionJSON{}},
+	"GET /metrics":      {Summary: "Get metrics in the Prometheus text format", Tag: "daemon", ResponseType: "text/plain"},
+	"GET /logs":         {Summary: "Get recent daemon logs", Tag: "daemon", Query: []openAPIParam{{"cluster_id", "Only logs about this cluster", "string"}, {"limit", "Maximum number of entries to return", "integer"}}, Response: []LogEntryJSON{}},
+	"GET /admin/config": {Summary: "Get the settings the daemon is using", Tag: "admin", Response: ConfigJSON{}},
+	"GET /admin/stats":  {Summary: "Get the docker resource usage of every user", Tag: "admin", Response: []OwnerStatsJSON{}},
+
+	"GET /admin/overview":     {Summary: "Get an overview of the capacity of the daemon", Tag: "admin", Response: OverviewJSON{}},
+	"GET /admin/ip-pool":      {Summary: "List the addresses reserved from the IP pool and any conflicts with docker", Tag: "admin", Response: IPPoolJSON{}},
+	"GET /admin/instances":    {Summary: "List the daemons sharing the meta-data store, and which of them is the leader", Tag: "admin", Response: []DaemonInstanceJSON{}},
+	"GET /admin/meta/export":  {Summary: "Export the whole meta-data store, to move it to another daemon", Tag: "admin", Response: MetaExportJSON{}},
+	"POST /admin/meta/import": {Summary: "Import meta-data exported from another daemon", Tag: "admin", Query: []openAPIParam{{"skip_existing", "Keep records which already exist rather than replacing them", "boolean"}}, Request: MetaExportJSON{}, Response: MetaImportResultJSON{}},
+
+	"GET /clusters":                {Summary: "List clusters", Tag: "clusters", Query: clusterFilterParams, Response: GetClustersJSON{}},
+	"POST /clusters":               {Summary: "Allocate a cluster", Tag: "clusters", Query: []openAPIParam{{"template", "Allocate the cluster from this template", "string"}}, Request: CreateClusterJSON{}, Response: NewClusterJSON{}},
+	"DELETE /clusters":             {Summary: "Kill every cluster", Tag: "clusters"},
+	"POST /clusters/refresh-all":   {Summary: "Refresh every cluster you own", Tag: "clusters", Request: RefreshAllJSON{}, Response: RefreshAllResultJSON{}},
+	"POST /clusters/spec":          {Summary: "Make clusters match a JSON or YAML spec", Tag: "clusters", Request: ClusterSpecJSON{}, Response: ClusterSpecReportJSON{}},
+	"GET /cluster/{cluster_id}":    {Summary: "Get a cluster", Tag: "clusters", Response: ClusterJSON{}},
+	"PUT /cluster/{cluster_id}":    {Summary: "Refresh a cluster or change its tags and alias", Tag: "clusters", Request: UpdateClusterJSON{}},
+	"DELETE /cluster/{cluster_id}": {Summary: "Kill a cluster", Tag: "clusters"},
+	"POST /leases/complete":        {Summary: "Reap the clusters leased to a CI job once it has finished", Tag: "clusters", Request: CompleteLeaseJSON{}, Response: CompleteLeaseResultJSON{}},
+
+	"POST /cluster/{cluster_id}/setup":           {Summary: "Set up couchbase server on a cluster", Tag: "clusters", Request: CreateClusterSetupJSON{}, Response: ClusterJSON{}},
+	"GET /cluster/{cluster_id}/status":           {Summary: "Get the health of a cluster from ns_server", Tag: "clusters", Response: ClusterStatusJSON{}},
+	"GET /cluster/{cluster_id}/stats":            {Summary: "Get the docker resource usage of each node of a cluster", Tag: "clusters", Response: ClusterStatsJSON{}},
+	"POST /cluster/{cluster_id}/transfer":        {Summary: "Transfer a cluster to another user", Tag: "sharing", Request: TransferClusterJSON{}},
+	"PUT /cluster/{cluster_id}/shared-with":      {Summary: "Share a cluster with other users", Tag: "sharing", Request: ShareClusterJSON{}},
+	"PUT /cluster/{cluster_id}/team":             {Summary: "Give a cluster to a team", Tag: "sharing", Request: ClusterTeamJSON{}},
+	"POST /cluster/{cluster_id}/add-bucket":      {Summary: "Add a bucket to a cluster", Tag: "clusters", Request: AddBucketJSON{}},
+	"POST /cluster/{cluster_id}/add-collections": {Summary: "Add scopes and collections to a bucket", Tag: "clusters", Request: AddCollectionsJSON{}},
+	"POST /cluster/{cluster_id}/add-indexes":     {Summary: "Create GSI indexes, optionally waiting for them to be online", Tag: "clusters", Request: AddIndexesJSON{}},
+	"POST /cluster/{cluster_id}/add-analytics":   {Summary: "Create analytics links and datasets", Tag: "clusters", Request: AddAnalyticsJSON{}},
+	"POST /cluster/{cluster_id}/setup-cert-auth": {Summary: "Set up client certificate authentication", Tag: "clusters", Request: SetupClientCertAuthJSON{}, Response: CertAuthResultJSON{}},
+	"POST /cluster/{cluster_id}/hibernate":       {Summary: "Hibernate a cluster, which is kept for the hibernation retention period of the daemon", Tag: "lifecycle"},
+	"POST /cluster/{cluster_id}/wake":            {Summary: "Wake a hibernated cluster, with the time it had left when it was hibernated", Tag: "lifecycle"},
+	"GET /cluster/{cluster_id}/refresh-link":     {Summary: "Confirm refreshing a cluster from a signed link", Tag: "lifecycle", Query: []openAPIParam{{"expires", "Expiry of the link", "string"}, {"sig", "Signature of the link", "string"}}, ResponseType: "text/html"},
+	"POST /cluster/{cluster_id}/refresh-link":    {Summary: "Refresh a cluster from a signed link, once", Tag: "lifecycle", ResponseType: "text/html"},
+
+	"POST /cluster/{cluster_id}/add-eventing-functions": {Summary: "Create and deploy eventing functions", Tag: "clusters", Request: AddEventingFunctionsJSON{}},
+	"PUT /cluster/{cluster_id}/alternate-addresses":     {Summary: "Set the external addresses and ports of nodes, for clients outside of the docker network", Tag: "nodes", Request: SetAlternateAddressesJSON{}},
+	"DELETE /cluster/{cluster_id}/alternate-addresses":  {Summary: "Remove the external addresses of every node", Tag: "nodes"},
+
+	"POST /cluster/{cluster_id}/ldap":   {Summary: "Run an LDAP server seeded with users and groups, and authenticate the cluster against it", Tag: "clusters", Request: AddLDAPFixtureJSON{}, Response: LDAPFixtureJSON{}},
+	"GET /cluster/{cluster_id}/ldap":    {Summary: "Get the LDAP server of a cluster", Tag: "clusters", Response: LDAPFixtureJSON{}},
+	"DELETE /cluster/{cluster_id}/ldap": {Summary: "Stop authenticating against the LDAP server of a cluster and remove it", Tag: "clusters"},
+
+	"POST /cluster/{cluster_id}/helpers":           {Summary: "Run a helper container on the network of a cluster until the cluster is killed", Tag: "clusters", Request: AddHelperContainerJSON{}, Response: HelperContainerJSON{}},
+	"GET /cluster/{cluster_id}/helpers":            {Summary: "List the helper containers of a cluster", Tag: "clusters", Response: []HelperContainerJSON{}},
+	"DELETE /cluster/{cluster_id}/helper/{helper}": {Summary: "Remove a helper container", Tag: "clusters"},
+
+	"POST /cluster/{cluster_id}/toxiproxy":                   {Summary: "Run toxiproxy with a proxy in front of ports of every node", Tag: "clusters", Request: AddToxiproxyJSON{}, Response: ToxiproxyJSON{}},
+	"GET /cluster/{cluster_id}/toxiproxy":                    {Summary: "Get the toxiproxy of a cluster, with its proxies and toxics", Tag: "clusters", Response: ToxiproxyJSON{}},
+	"DELETE /cluster/{cluster_id}/toxiproxy":                 {Summary: "Remove the toxiproxy of a cluster", Tag: "clusters"},
+	"POST /cluster/{cluster_id}/node/{node}/toxics":          {Summary: "Add a latency, bandwidth, reset_peer or timeout toxic to the proxies of a node", Tag: "nodes", Request: AddToxicJSON{}, Response: ToxicJSON{}},
+	"DELETE /cluster/{cluster_id}/node/{node}/toxic/{toxic}": {Summary: "Remove a toxic from the proxies of a node", Tag: "nodes", Query: []openAPIParam{{"port", "Only remove the toxic from the proxy of this port", "integer"}}},
+
+	"GET /cluster/{cluster_id}/firewall":                {Summary: "List the ports which are blocked on the nodes of a cluster", Tag: "nodes", Response: []FirewallRuleJSON{}},
+	"POST /cluster/{cluster_id}/node/{node}/firewall":   {Summary: "Block ports of a node with iptables until they expire, the node must be allocated with cap_add NET_ADMIN", Tag: "nodes", Request: BlockPortsJSON{}, Response: []FirewallRuleJSON{}},
+	"DELETE /cluster/{cluster_id}/node/{node}/firewall": {Summary: "Unblock the ports of a node", Tag: "nodes", Query: []openAPIParam{{"port", "Only unblock this port", "integer"}}},
+
+	"GET /cluster/{cluster_id}/node/{node}/clock":    {Summary: "Get how far the clock of a node is shifted", Tag: "nodes", Response: ClockSkewJSON{}},
+	"PUT /cluster/{cluster_id}/node/{node}/clock":    {Summary: "Shift the clock of a node with libfaketime, which doesn't affect the services written in Go such as the indexer and query", Tag: "nodes", Request: ClockSkewJSON{}},
+	"DELETE /cluster/{cluster_id}/node/{node}/clock": {Summary: "Put the clock of a node back", Tag: "nodes"},
+
+	"GET /cluster/{cluster_id}/node/{node}/logs":  {Summary: "Get the logs of a node", Tag: "nodes", Query: []openAPIParam{{"follow", "Keep streaming logs as they are written", "boolean"}, {"file", "Read this couchbase server log file rather than the container logs", "string"}, {"tail", "Number of lines from the end of the logs to start at", "integer"}}, ResponseType: "text/plain"},
+	"POST /cluster/{cluster_id}/node/{node}/exec": {Summary: "Run a command on a node", Tag: "nodes", Request: ExecJSON{}, Response: ExecResultJSON{}},
+
+	"POST /cluster/{cluster_id}/node/{node}/replace": {Summary: "Swap rebalance a new node in for a node and remove the old one", Tag: "nodes", Request: ReplaceNodeJSON{}, Response: NodeJSON{}},
+
+	"POST /cluster/{cluster_id}/node/{node}/failover": {Summary: "Start a graceful or hard failover of a node", Tag: "jobs", Request: FailoverJSON{}, Response: Job{}},
+	"POST /cluster/{cluster_id}/node/{node}/recovery": {Summary: "Start adding a failed over node back with full or delta recovery", Tag: "jobs", Request: RecoveryJSON{}, Response: Job{}},
+	"POST /cluster/{cluster_id}/rebalance":            {Summary: "Start rebalancing a cluster", Tag: "jobs", Request: RebalanceJSON{}, Response: Job{}},
+	"POST /cluster/{cluster_id}/rebalance/stop":       {Summary: "Stop the rebalance running on a cluster", Tag: "jobs", Response: Job{}},
+
+	"POST /cluster/{cluster_id}/collectinfo":  {Summary: "Start collecting logs from every node", Tag: "collectinfo", Response: CollectInfo{}},
+	"GET /collectinfo/{collection_id}":        {Summary: "Get the progress of a log collection", Tag: "collectinfo", Response: CollectInfo{}},
+	"GET /collectinfo/{collection_id}/{node}": {Summary: "Download the logs collected from a node", Tag: "collectinfo", ResponseType: "application/zip"},
+	"GET /cluster/{cluster_id}/bundle":        {Summary: "Download everything needed to reproduce a cluster, such as its containers, config and logs", Tag: "collectinfo", ResponseType: "application/zip"},
+
+	"POST /cluster/{cluster_id}/load": {Summary: "Start loading data into a bucket with cbc-pillowfight", Tag: "jobs", Request: LoadJSON{}, Response: Job{}},
+	"GET /job/{job_id}":               {Summary: "Get the progress of a job", Tag: "jobs", Response: Job{}},
+
+	"POST /cluster/{cluster_id}/backup":  {Summary: "Start backing a cluster up with cbbackupmgr", Tag: "backups", Request: BackupJSON{}, Response: Job{}},
+	"POST /cluster/{cluster_id}/restore": {Summary: "Start restoring a backup into a cluster with cbbackupmgr", Tag: "backups", Request: RestoreJSON{}, Response: Job{}},
+	"GET /backups":                       {Summary: "List backup repositories", Tag: "backups", Response: []BackupRepository{}},
+	"DELETE /backup/{repository}":        {Summary: "Remove a backup repository and its backups", Tag: "backups"},
+
+	"GET /tokens":          {Summary: "List API tokens", Tag: "auth", Response: []APITokenJSON{}},
+	"POST /tokens":         {Summary: "Issue an API token", Tag: "auth", Request: IssueTokenJSON{}, Response: APITokenJSON{}},
+	"DELETE /token/{user}": {Summary: "Revoke the API tokens of a user", Tag: "auth"},
+
+	"GET /admin/users":                 {Summary: "List users", Tag: "admin", Response: []UserJSON{}},
+	"PUT /admin/users/{user}":          {Summary: "Set the role of a user", Tag: "admin", Request: SetUserRoleJSON{}, Response: UserJSON{}},
+	"DELETE /admin/users/{user}":       {Summary: "Delete a user", Tag: "admin"},
+	"PUT /admin/users/{user}/quota":    {Summary: "Set the quota of a user", Tag: "admin", Request: QuotaLimitsJSON{}, Response: UserJSON{}},
+	"DELETE /admin/users/{user}/quota": {Summary: "Reset a user to the default quota", Tag: "admin", Response: UserJSON{}},
+	"GET /quota":                       {Summary: "Get a quota and its usage", Tag: "auth", Query: []openAPIParam{{"user", "Get the quota of this user rather than your own", "string"}}, Response: QuotaJSON{}},
+	"GET /audit":                       {Summary: "Search the audit log", Tag: "audit", Query: []openAPIParam{{"user", "Only entries by this user", "string"}, {"cluster_id", "Only entries about this cluster", "string"}, {"since", "Only entries after this RFC3339 time", "string"}, {"until", "Only entries before this RFC3339 time", "string"}, {"limit", "Maximum number of entries to return", "integer"}}, Response: []AuditEntryJSON{}},
+	"GET /usage":                       {Summary: "Report cluster-hours and node-hours by user or team", Tag: "audit", Query: []openAPIParam{{"user", "Only usage of this user", "string"}, {"team", "Only usage of this team", "string"}, {"group_by", "Total by user or by team", "string"}, {"since", "Only usage after this RFC3339 time", "string"}, {"until", "Only usage before this RFC3339 time", "string"}}, Response: []UsageTotalJSON{}},
+
+	"GET /notifications":                 {Summary: "Get your notification settings", Tag: "notifications", Response: NotificationsJSON{}},
+	"PUT /notifications":                 {Summary: "Change your notification settings", Tag: "notifications", Request: NotificationsJSON{}},
+	"GET /webhooks":                      {Summary: "List your webhooks", Tag: "notifications", Response: []WebhookJSON{}},
+	"POST /webhooks":                     {Summary: "Create a webhook", Tag: "notifications", Request: CreateWebhookJSON{}, Response: WebhookJSON{}},
+	"DELETE /webhook/{webhook_id}":       {Summary: "Delete a webhook", Tag: "notifications"},
+	"GET /events":                        {Summary: "Stream lifecycle events as server-sent events", Tag: "notifications", Query: []openAPIParam{{"owner", "Only events about clusters owned by this user", "string"}, {"cluster_id", "Only events about this cluster", "string"}, {"events", "Comma separated event types to stream", "string"}}, ResponseType: "text/event-stream"},
+	"GET /admin/teams":                   {Summary: "List teams", Tag: "admin", Response: []TeamJSON{}},
+	"PUT /admin/teams/{team}":            {Summary: "Create or change a team", Tag: "admin", Request: SetTeamJSON{}, Response: TeamJSON{}},
+	"DELETE /admin/teams/{team}":         {Summary: "Delete a team", Tag: "admin"},
+	"DELETE /admin/ip-pool/{address}":    {Summary: "Release an address reserved from the IP pool", Tag: "admin"},
+	"GET /pools":                         {Summary: "List check-out pools", Tag: "pools", Response: []ClusterPoolJSON{}},
+	"POST /pool/{pool}/checkout":         {Summary: "Check out a cluster from a pool", Tag: "pools", Request: CheckOutClusterJSON{}, Response: ClusterJSON{}},
+	"POST /cluster/{cluster_id}/checkin": {Summary: "Check a cluster back in to its pool", Tag: "pools"},
+	"PUT /admin/pools/{pool}":            {Summary: "Create or change a check-out pool", Tag: "admin", Request: SetClusterPoolJSON{}, Response: ClusterPoolJSON{}},
+	"DELETE /admin/pools/{pool}":         {Summary: "Delete a check-out pool", Tag: "admin"},
+	"GET /templates":                     {Summary: "List cluster templates", Tag: "templates", Response: []TemplateJSON{}},
+	"GET /template/{template}":           {Summary: "Get a cluster template", Tag: "templates", Response: TemplateJSON{}},
+	"PUT /admin/templates/{template}":    {Summary: "Create or change a cluster template", Tag: "admin", Request: SetTemplateJSON{}, Response: TemplateJSON{}},
+	"DELETE /admin/templates/{template}": {Summary: "Delete a cluster template", Tag: "admin"},
+
+	"GET /schedules":              {Summary: "List your cluster schedules, or everybody's for admins", Tag: "schedules", Response: []ScheduleJSON{}},
+	"PUT /schedule/{schedule}":    {Summary: "Create or change a schedule which creates and kills a cluster on certain days", Tag: "schedules", Request: SetScheduleJSON{}, Response: ScheduleJSON{}},
+	"DELETE /schedule/{schedule}": {Summary: "Delete a cluster schedule, leaving its cluster to expire", Tag: "schedules"},
+
+	"GET /openapi.json": {Summary: "Get this document", Tag: "daemon"},
+	"GET /docs":         {Summary: "Browse this document with Swagger UI", Tag: "daemon", ResponseType: "text/html"},
+	"GET /docs/{asset}": {Summary: "Get a script or stylesheet of Swagger UI", Tag: "daemon", ResponseType: "application/octet-stream"},
+}
+
+var pathParamRegexp = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// openAPISchemas builds schemas from Go types, using their JSON encoding.
+// Named struct types become components which are referenced by name.
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s *openAPISchemas) schemaOf(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := s.components[t.Name()]; !ok {
+			// Register the name before building the schema, so that types
+			// which refer to themselves don't recurse forever.
+			s.components[t.Name()] = nil
+			s.components[t.Name()] = s.structSchema(t)
+		}
+		return ref
+	}
+
+	return map[string]interface{}{}
+}
+
+func (s *openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		omitEmpty := false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagParts := strings.Split(tag, ",")
+			if tagParts[0] == "-" {
+				continue
+			}
+			if tagParts[0] != "" {
+				name = tagParts[0]
+			}
+			for _, option := range tagParts[1:] {
+				if option == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+
+		properties[name] = s.schemaOf(field.Type)
+		if !omitEmpty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s *openAPISchemas) jsonContent(value interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": s.schemaOf(reflect.TypeOf(value)),
+		},
+	}
+}
+
+// buildOpenAPIDocument generates an OpenAPI v3 document describing every
+// route of router.
+func buildOpenAPIDocument(router *mux.Router) (map[string]interface{}, error) {
+	schemas := &openAPISchemas{
+		components: make(map[string]interface{}),
+	}
+	paths := make(map[string]interface{})
+
+	errorResponse := map[string]interface{}{
+		"description": "The request failed",
+		"content":     schemas.jsonContent(ErrorJSON{}),
+	}
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		pathTemplate, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes without methods match any method, document them as GET
+			methods = []string{"GET"}
+		}
+
+		var pathParams []interface{}
+		for _, match := range pathParamRegexp.FindAllStringSubmatch(pathTemplate, -1) {
+			pathParams = append(pathParams, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		openAPIPath := pathParamRegexp.ReplaceAllString(pathTemplate, "{$1}")
+
+		pathItem, ok := paths[openAPIPath].(map[string]interface{})
+		if !ok {
+			pathItem = make(map[string]interface{})
+			paths[openAPIPath] = pathItem
+		}
+
+		for _, method := range methods {
+			op := openAPIOperations[method+" "+pathTemplate]
+
+			parameters := append([]interface{}{}, pathParams...)
+			for _, param := range op.Query {
+				parameters = append(parameters, map[string]interface{}{
+					"name":        param.Name,
+					"in":          "query",
+					"description": param.Description,
+					"schema":      map[string]interface{}{"type": param.Type},
+				})
+			}
+
+			success := map[string]interface{}{
+				"description": "Success",
+			}
+			if op.Response != nil {
+				success["content"] = schemas.jsonContent(op.Response)
+			} else if op.ResponseType != "" {
+				success["content"] = map[string]interface{}{
+					op.ResponseType: map[string]interface{}{
+						"schema": map[string]interface{}{"type": "string"},
+					},
+				}
+			}
+
+			operation := map[string]interface{}{
+				"operationId": strings.ToLower(method) + operationName(openAPIPath),
+				"responses": map[string]interface{}{
+					"200":     success,
+					"default": errorResponse,
+				},
+			}
+			if op.Summary != "" {
+				operation["summary"] = op.Summary
+			}
+			if op.Tag != "" {
+				operation["tags"] = []string{op.Tag}
+			}
+			if len(parameters) > 0 {
+				operation["parameters"] = parameters
+			}
+			if op.Request != nil {
+				operation["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content":  schemas.jsonContent(op.Request),
+				}
+			}
+			if unauthenticatedRoutes[route.GetName()] {
+				operation["security"] = []interface{}{}
+			}
+
+			pathItem[strings.ToLower(method)] = operation
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "cbdynclusterd",
+			"description": "Allocates and manages couchbase server clusters for testing.",
+			"version":     Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"token": []string{}},
+		},
+	}, nil
+}
+
+// operationName turns a path into a name for its operations, such as
+// ClusterClusterIdNodeNodeLogs for /cluster/{cluster_id}/node/{node}/logs.
+func operationName(path string) string {
+	var name strings.Builder
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '-' || r == '_' || r == '.'
+	}) {
+		name.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	if name.Len() == 0 {
+		return "Root"
+	}
+	return name.String()
+}
+
+// HttpGetOpenAPI returns a handler serving the document for router.
+func HttpGetOpenAPI(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := buildOpenAPIDocument(router)
+		if err != nil {
+			writeJSONErrorStatus(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJsonResponse(w, doc)
+	}
+}
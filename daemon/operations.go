@@ -0,0 +1,212 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	OperationAllocate  = "allocate"
+	OperationKill      = "kill"
+	OperationHibernate = "hibernate"
+	OperationWake      = "wake"
+)
+
+// shutdownTimeout bounds how long the daemon waits for in-flight operations
+// when it is shutting down, and then how long it waits for requests.
+var shutdownTimeout = 2 * time.Minute
+
+// PendingOperation is a cluster operation which was in progress.  They are
+// kept in the meta-data store while they run so that operations which were
+// interrupted by the daemon stopping can be dealt with when it starts again.
+type PendingOperation struct {
+	Type      string    `json:"type"`
+	ClusterID string    `json:"cluster_id"`
+	User      string    `json:"user"`
+	StartedAt time.Time `json:"started_at"`
+	// Instance is the daemon running the operation.
+	Instance string `json:"instance,omitempty"`
+}
+
+func pendingOperationKey(operationType, clusterID string) string {
+	return "pendingop-" + operationType + "-" + clusterID
+}
+
+// Kills can start while the daemon is draining, so in-flight operations are
+// counted under a lock rather than with a sync.WaitGroup, whose Add must not
+// race its Wait.
+var operationsLock sync.Mutex
+var operationsFinished = sync.NewCond(&operationsLock)
+var operationsInFlight int
+var operationsDraining bool
+
+var errShuttingDown = errors.New("daemon is shutting down, try again shortly")
+
+var errOperationInProgress = errors.New("another daemon is already doing that to this cluster")
+
+// beginOperation records that an operation has started on a cluster, the
+// returned function must be called once it has finished.  The same operation
+// can't run on a cluster more than once at a time, even across daemons which
+// share the meta-data store.  Only kills are allowed once the daemon has
+// started shutting down, since failed allocations clean up after themselves
+// with them.
+func beginOperation(ctx context.Context, operationType, clusterID string) (func(), error) {
+	operationsLock.Lock()
+	if operationsDraining && operationType != OperationKill {
+		operationsLock.Unlock()
+		return nil, errShuttingDown
+	}
+	operationsInFlight++
+	operationsLock.Unlock()
+
+	key := pendingOperationKey(operationType, clusterID)
+	operationBytes, err := json.Marshal(&PendingOperation{
+		Type:      operationType,
+		ClusterID: clusterID,
+		User:      ContextUser(ctx),
+		StartedAt: time.Now(),
+		Instance:  daemonInstanceID,
+	})
+	if err == nil {
+		err = metaStore.createRawRecord(key, operationBytes)
+		if err == ErrMetaExists {
+			err = errOperationInProgress
+		}
+	}
+	if err != nil {
+		endOperation()
+		return nil, err
+	}
+
+	return func() {
+		err := metaStore.deleteRecord(key)
+		if err != nil {
+			logWarnf(ctx, "Failed to clear pending %s operation: %s", operationType, err)
+		}
+		endOperation()
+	}, nil
+}
+
+func endOperation() {
+	operationsLock.Lock()
+	operationsInFlight--
+	if operationsInFlight == 0 {
+		operationsFinished.Broadcast()
+	}
+	operationsLock.Unlock()
+}
+
+// drainOperations stops new operations from starting and waits for those in
+// flight to finish, returning false if they didn't finish before the timeout.
+func drainOperations(timeout time.Duration) bool {
+	operationsLock.Lock()
+	operationsDraining = true
+	operationsLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		operationsLock.Lock()
+		for operationsInFlight > 0 {
+			operationsFinished.Wait()
+		}
+		operationsLock.Unlock()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func getPendingOperations() ([]PendingOperation, error) {
+	var operations []PendingOperation
+	err := metaStore.forEachRecord("pendingop-", func(key string, recordBytes []byte) error {
+		var operation PendingOperation
+		err := json.Unmarshal(recordBytes, &operation)
+		if err != nil {
+			return err
+		}
+
+		operations = append(operations, operation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return operations, nil
+}
+
+// recoverPendingOperations deals with the operations which were interrupted
+// by the daemon running them stopping.  Half built clusters can't be
+// finished since the request asking for them is gone, so they are rolled
+// back, interrupted kills are carried out again, and hibernations and wakes
+// are undone or finished depending on how far they got.
+func recoverPendingOperations() error {
+	operations, err := getPendingOperations()
+	if err != nil {
+		return err
+	}
+
+	live, err := liveInstances()
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range operations {
+		if live[operation.Instance] {
+			continue
+		}
+
+		ctx := ContextWithClusterID(systemCtx, operation.ClusterID)
+		logInfof(ctx, "Recovering interrupted %s operation started by %s at %s",
+			operation.Type, operation.User, operation.StartedAt.Format(time.RFC3339))
+
+		// Killing the cluster records its own operation, which would clash
+		// with an interrupted kill.  If it fails that one is recovered next.
+		err = metaStore.deleteRecord(pendingOperationKey(operation.Type, operation.ClusterID))
+		if err != nil {
+			return err
+		}
+
+		switch operation.Type {
+		case OperationHibernate:
+			err = recoverInterruptedHibernation(ctx, operation.ClusterID)
+		case OperationWake:
+			err = recoverInterruptedWake(ctx, operation.ClusterID)
+		default:
+			err = killInterruptedCluster(ctx, operation.ClusterID)
+		}
+		recordAudit(ctx, "recover interrupted "+operation.Type, operation.ClusterID, "", err)
+		if err != nil {
+			logErrorf(ctx, "Failed to recover interrupted %s operation: %s", operation.Type, err)
+		}
+	}
+
+	return nil
+}
+
+func killInterruptedCluster(ctx context.Context, clusterID string) error {
+	_, err := getCluster(ctx, clusterID)
+	if err == nil {
+		return killCluster(ctx, clusterID)
+	}
+
+	// The containers never got created, or were all removed before the
+	// daemon stopped, so all that is left is the meta-data.
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err != nil {
+		return nil
+	}
+	if meta.Alias != "" {
+		releaseAlias(meta.Alias, clusterID)
+	}
+	return metaStore.DeleteClusterMeta(clusterID)
+}
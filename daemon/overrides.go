@@ -0,0 +1,309 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const staticConfigPath = "/opt/couchbase/etc/couchbase/static_config"
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var staticConfigKeyRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+var domainNameRegexp = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// nodeSettingPrefixes are the ns_server endpoints which node settings can be
+// posted to, so that they can't be used to do anything else to the cluster.
+var nodeSettingPrefixes = []string{"/settings/", "/internalSettings", "/pools/default"}
+
+// NodeOverrides customise the couchbase server of a node beyond what its
+// image does, so that niche configurations can be tested without editing
+// files inside of the container.
+type NodeOverrides struct {
+	// Env is added to the environment of the container.
+	Env map[string]string
+	// StaticConfig sets terms of the static_config of ns_server before it
+	// first starts, such as loglevel_default to debug.  Values are Erlang
+	// terms.
+	StaticConfig map[string]string
+	// Settings are posted to ns_server once the cluster is set up, a node
+	// takes on the settings of the cluster when it joins it so they would
+	// be lost any earlier.
+	Settings []NodeSetting
+	// ExtraHosts maps hostnames to addresses in /etc/hosts of the container,
+	// such as to point the node at a mock KMIP or LDAP server.
+	ExtraHosts map[string]string
+	// DNSSearch are the DNS search domains of the container.
+	DNSSearch []string
+	// Ulimits, Sysctls, CapAdd and Privileged loosen the security settings
+	// of the container, such as raising memlock for the analytics service.
+	// Only those on the allowlist of the daemon can be given.
+	Ulimits    map[string]NodeUlimit
+	Sysctls    map[string]string
+	CapAdd     []string
+	Privileged bool
+}
+
+type NodeUlimit struct {
+	Soft int64
+	Hard int64
+}
+
+// NodeSetting is a form posted to an ns_server settings endpoint, such as
+// globalValue=8 to /settings/maxParallelIndexers.
+type NodeSetting struct {
+	Path   string
+	Values map[string]string
+}
+
+func (overrides *NodeOverrides) empty() bool {
+	return len(overrides.Env) == 0 && len(overrides.StaticConfig) == 0 && len(overrides.Settings) == 0 &&
+		len(overrides.ExtraHosts) == 0 && len(overrides.DNSSearch) == 0 && len(overrides.Ulimits) == 0 &&
+		len(overrides.Sysctls) == 0 && len(overrides.CapAdd) == 0 && !overrides.Privileged
+}
+
+func validateNodeOverrides(overrides NodeOverrides) error {
+	for name := range overrides.Env {
+		if !envNameRegexp.MatchString(name) {
+			return errors.Errorf("%q is not a valid environment variable name", name)
+		}
+	}
+
+	for key, value := range overrides.StaticConfig {
+		if !staticConfigKeyRegexp.MatchString(key) {
+			return errors.Errorf("%q is not a valid static_config key", key)
+		}
+		if strings.TrimSpace(value) == "" || strings.ContainsAny(value, "\r\n") {
+			return errors.Errorf("static_config %s must be a single line Erlang term", key)
+		}
+	}
+
+	for _, setting := range overrides.Settings {
+		allowed := false
+		for _, prefix := range nodeSettingPrefixes {
+			if strings.HasPrefix(setting.Path, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed || strings.Contains(setting.Path, "..") {
+			return errors.Errorf("settings can only be posted to %s, not %s", strings.Join(nodeSettingPrefixes, ", "), setting.Path)
+		}
+		if len(setting.Values) == 0 {
+			return errors.Errorf("setting %s has no values", setting.Path)
+		}
+	}
+
+	for hostname, address := range overrides.ExtraHosts {
+		if !domainNameRegexp.MatchString(hostname) {
+			return errors.Errorf("%q is not a valid hostname", hostname)
+		}
+		if net.ParseIP(address) == nil {
+			return errors.Errorf("%q is not a valid address for %s", address, hostname)
+		}
+	}
+
+	for _, domain := range overrides.DNSSearch {
+		if !domainNameRegexp.MatchString(domain) {
+			return errors.Errorf("%q is not a valid DNS search domain", domain)
+		}
+	}
+
+	return validateContainerSecurity(overrides, getRuntimeConfig().ContainerAllowlist)
+}
+
+// validateContainerSecurity checks the security settings of a container
+// against the allowlist, which admins set in the config of the daemon.
+// Docker only sets sysctls which are namespaced, so sysctls such as
+// vm.max_map_count are refused when the container is created even if they
+// are allowed.
+func validateContainerSecurity(overrides NodeOverrides, allowlist ContainerAllowlist) error {
+	for name, ulimit := range overrides.Ulimits {
+		if !containsString(allowlist.Ulimits, name) {
+			return errors.Errorf("the %s ulimit is not allowed, allowed ulimits are: %s", name, strings.Join(allowlist.Ulimits, ", "))
+		}
+		if ulimit.Soft < -1 || ulimit.Hard < -1 || (ulimit.Hard != -1 && (ulimit.Soft == -1 || ulimit.Soft > ulimit.Hard)) {
+			return errors.Errorf("the soft %s ulimit must be no more than the hard limit, -1 is unlimited", name)
+		}
+	}
+
+	for name := range overrides.Sysctls {
+		if !containsString(allowlist.Sysctls, name) {
+			return errors.Errorf("the %s sysctl is not allowed, allowed sysctls are: %s", name, strings.Join(allowlist.Sysctls, ", "))
+		}
+	}
+
+	for _, capability := range overrides.CapAdd {
+		if !containsString(allowlist.Capabilities, strings.TrimPrefix(strings.ToUpper(capability), "CAP_")) {
+			return errors.Errorf("the %s capability is not allowed, allowed capabilities are: %s", capability, strings.Join(allowlist.Capabilities, ", "))
+		}
+	}
+
+	if overrides.Privileged && !allowlist.Privileged {
+		return errors.New("privileged containers are not allowed")
+	}
+
+	return nil
+}
+
+// containerUlimits turns ulimits into the form docker takes.
+func containerUlimits(ulimits map[string]NodeUlimit) []*units.Ulimit {
+	var containerUlimits []*units.Ulimit
+	for name, ulimit := range ulimits {
+		containerUlimits = append(containerUlimits, &units.Ulimit{
+			Name: name,
+			Soft: ulimit.Soft,
+			Hard: ulimit.Hard,
+		})
+	}
+	sort.Slice(containerUlimits, func(i, j int) bool {
+		return containerUlimits[i].Name < containerUlimits[j].Name
+	})
+	return containerUlimits
+}
+
+// mergeNodeOverrides adds extra hosts and DNS search domains which were given
+// for the whole cluster to the overrides of a node, which take precedence.
+func mergeNodeOverrides(overrides NodeOverrides, extraHosts map[string]string, dnsSearch []string) NodeOverrides {
+	if len(extraHosts) > 0 {
+		mergedHosts := make(map[string]string)
+		for hostname, address := range extraHosts {
+			mergedHosts[hostname] = address
+		}
+		for hostname, address := range overrides.ExtraHosts {
+			mergedHosts[hostname] = address
+		}
+		overrides.ExtraHosts = mergedHosts
+	}
+
+	if len(overrides.DNSSearch) == 0 {
+		overrides.DNSSearch = dnsSearch
+	}
+
+	return overrides
+}
+
+// containerEnv turns environment variables into the form docker takes.
+func containerEnv(env map[string]string) []string {
+	var containerEnv []string
+	for name, value := range env {
+		containerEnv = append(containerEnv, name+"="+value)
+	}
+	sort.Strings(containerEnv)
+	return containerEnv
+}
+
+// containerExtraHosts turns extra hosts into the host:address form docker
+// takes.
+func containerExtraHosts(extraHosts map[string]string) []string {
+	var containerHosts []string
+	for hostname, address := range extraHosts {
+		containerHosts = append(containerHosts, hostname+":"+address)
+	}
+	sort.Strings(containerHosts)
+	return containerHosts
+}
+
+// overrideStaticConfig rewrites the static_config of a node whose container
+// has been created but not started.  Terms which are overridden are removed
+// rather than just appended to, because ns_server uses the first of them.
+func overrideStaticConfig(ctx context.Context, host *DockerHost, containerID string, staticConfig map[string]string) error {
+	content, _, err := host.Client.CopyFromContainer(ctx, containerID, staticConfigPath)
+	if err != nil {
+		return errors.Wrap(trackDockerError("copy_from_container", err), "could not read static_config")
+	}
+	defer content.Close()
+
+	reader := tar.NewReader(content)
+	header, err := reader.Next()
+	if err != nil {
+		return errors.Wrap(err, "could not read static_config")
+	}
+	configBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "could not read static_config")
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(configBytes), "\n"), "\n") {
+		overridden := false
+		for key := range staticConfig {
+			if strings.HasPrefix(strings.TrimSpace(line), "{"+key+",") {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			lines = append(lines, line)
+		}
+	}
+
+	var keys []string
+	for key := range staticConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("{%s, %s}.", key, staticConfig[key]))
+	}
+	configBytes = []byte(strings.Join(lines, "\n") + "\n")
+
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	header.Name = path.Base(staticConfigPath)
+	header.Size = int64(len(configBytes))
+	err = writer.WriteHeader(header)
+	if err == nil {
+		_, err = writer.Write(configBytes)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = host.Client.CopyToContainer(ctx, containerID, path.Dir(staticConfigPath), &archive, types.CopyToContainerOptions{})
+	if err != nil {
+		return errors.Wrap(trackDockerError("copy_to_container", err), "could not write static_config")
+	}
+
+	return nil
+}
+
+// applyNodeSettings posts the settings which the nodes of a cluster were
+// allocated with to ns_server.
+func applyNodeSettings(ctx context.Context, cluster *Cluster) error {
+	meta, err := metaStore.GetClusterMeta(cluster.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range cluster.Nodes {
+		overrides, ok := meta.NodeOverrides[node.Name]
+		if !ok {
+			continue
+		}
+
+		for _, setting := range overrides.Settings {
+			logInfof(ContextWithNode(ctx, node.Name), "Applying setting %s", setting.Path)
+			err = restNodeOf(node).UpdateSettings(setting.Path, setting.Values)
+			if err != nil {
+				return errors.Wrapf(err, "failed to apply setting %s to node %s", setting.Path, node.Name)
+			}
+		}
+	}
+
+	return nil
+}
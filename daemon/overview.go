@@ -0,0 +1,257 @@
+package daemon
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+)
+
+// overviewExpiryWindow is how soon clusters have to be expiring to be listed
+// as expiring in the overview.
+const overviewExpiryWindow = 1 * time.Hour
+
+type OwnerOverview struct {
+	Owner    string
+	Clusters int
+	Nodes    int
+}
+
+type VersionOverview struct {
+	ServerVersion string
+	Nodes         int
+}
+
+type ExpiringCluster struct {
+	ClusterID string
+	Owner     string
+	Timeout   time.Time
+}
+
+// HostOverview is how much room is left on a docker host.  Docker doesn't
+// know how much disk space its host has, so only what it is using is given.
+type HostOverview struct {
+	Name           string
+	Error          string
+	Nodes          int
+	CPUs           int
+	MemoryTotal    uint64
+	MemoryUsed     uint64
+	DiskUsed       int64
+	Images         int
+	ImageCacheSize int64
+}
+
+type WarmPoolOverview struct {
+	ServerVersion string
+	Size          int
+	Idle          int
+}
+
+// Overview is a summary of everything that the daemon is running, for admins
+// to keep an eye on the capacity of the docker hosts.
+type Overview struct {
+	Clusters        int
+	Nodes           int
+	ClustersByOwner []OwnerOverview
+	NodesByVersion  []VersionOverview
+	ExpiringSoon    []ExpiringCluster
+	Hosts           []HostOverview
+	ImageCacheSize  int64
+	WarmPool        []WarmPoolOverview
+}
+
+// overviewOfHost asks a docker host how much of it is in use.  Only nodes
+// are counted towards the memory which is used, since that is what the
+// daemon has control over.
+func overviewOfHost(ctx context.Context, host *DockerHost) HostOverview {
+	hostOverview := HostOverview{Name: host.Name}
+
+	info, err := host.Client.Info(ctx)
+	if err != nil {
+		hostOverview.Error = trackDockerError("info", err).Error()
+		return hostOverview
+	}
+	hostOverview.CPUs = info.NCPU
+	hostOverview.MemoryTotal = uint64(info.MemTotal)
+
+	diskUsage, err := host.Client.DiskUsage(ctx)
+	if err != nil {
+		hostOverview.Error = trackDockerError("disk_usage", err).Error()
+		return hostOverview
+	}
+	hostOverview.Images = len(diskUsage.Images)
+	hostOverview.ImageCacheSize = diskUsage.LayersSize
+	hostOverview.DiskUsed = diskUsage.LayersSize
+	for _, container := range diskUsage.Containers {
+		hostOverview.DiskUsed += container.SizeRw
+	}
+	for _, volume := range diskUsage.Volumes {
+		if volume.UsageData != nil && volume.UsageData.Size > 0 {
+			hostOverview.DiskUsed += volume.UsageData.Size
+		}
+	}
+
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", "com.couchbase.dyncluster.creator")
+	containers, err := host.Client.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filterArgs,
+	})
+	if err != nil {
+		hostOverview.Error = trackDockerError("container_list", err).Error()
+		return hostOverview
+	}
+	hostOverview.Nodes = len(containers)
+
+	// Every sample takes a moment for docker to take, so take them at once.
+	var wg sync.WaitGroup
+	var usedLock sync.Mutex
+	for _, container := range containers {
+		rememberContainerHost(container.ID, host)
+
+		wg.Add(1)
+		go func(containerID string) {
+			defer wg.Done()
+			usage, err := getContainerUsage(ctx, containerID)
+			if err != nil {
+				// Nodes can be killed while we are looking at them.
+				return
+			}
+
+			usedLock.Lock()
+			hostOverview.MemoryUsed += usage.MemoryUsage
+			usedLock.Unlock()
+		}(container.ID)
+	}
+	wg.Wait()
+
+	return hostOverview
+}
+
+func warmPoolOverview(ctx context.Context) ([]WarmPoolOverview, error) {
+	idleNodes := make(map[string]int)
+	for _, host := range getDockerHosts() {
+		hostIdleNodes, err := getIdlePoolNodes(ctx, host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get the warm pool of %s", host.Name)
+		}
+
+		for serverVersion, containers := range hostIdleNodes {
+			idleNodes[serverVersion] += len(containers)
+		}
+	}
+
+	var pool []WarmPoolOverview
+	for serverVersion, size := range warmPoolSizes {
+		pool = append(pool, WarmPoolOverview{
+			ServerVersion: serverVersion,
+			Size:          size,
+			Idle:          idleNodes[serverVersion],
+		})
+	}
+	sort.Slice(pool, func(i, j int) bool {
+		return pool[i].ServerVersion < pool[j].ServerVersion
+	})
+
+	return pool, nil
+}
+
+// getOverview gathers everything that admins need to see how full the daemon
+// is at a glance.
+func getOverview(ctx context.Context) (*Overview, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can see the overview of the daemon")
+	}
+
+	clusters, err := getAllClusters(NewContext(ctx, ContextUser(ctx), true))
+	if err != nil {
+		return nil, err
+	}
+
+	overview := &Overview{
+		ClustersByOwner: []OwnerOverview{},
+		NodesByVersion:  []VersionOverview{},
+		ExpiringSoon:    []ExpiringCluster{},
+		Hosts:           []HostOverview{},
+		WarmPool:        []WarmPoolOverview{},
+	}
+
+	owners := make(map[string]*OwnerOverview)
+	versions := make(map[string]int)
+	expiryCutoff := time.Now().Add(overviewExpiryWindow)
+	for _, cluster := range clusters {
+		overview.Clusters++
+		overview.Nodes += len(cluster.Nodes)
+
+		owner, ok := owners[cluster.Owner]
+		if !ok {
+			owner = &OwnerOverview{Owner: cluster.Owner}
+			owners[cluster.Owner] = owner
+		}
+		owner.Clusters++
+		owner.Nodes += len(cluster.Nodes)
+
+		for _, node := range cluster.Nodes {
+			versions[node.InitialServerVersion]++
+		}
+
+		if !cluster.KeepAlive && cluster.Timeout.Before(expiryCutoff) {
+			overview.ExpiringSoon = append(overview.ExpiringSoon, ExpiringCluster{
+				ClusterID: cluster.ID,
+				Owner:     cluster.Owner,
+				Timeout:   cluster.Timeout,
+			})
+		}
+	}
+
+	for _, owner := range owners {
+		overview.ClustersByOwner = append(overview.ClustersByOwner, *owner)
+	}
+	sort.Slice(overview.ClustersByOwner, func(i, j int) bool {
+		return overview.ClustersByOwner[i].Clusters > overview.ClustersByOwner[j].Clusters
+	})
+
+	for serverVersion, nodes := range versions {
+		overview.NodesByVersion = append(overview.NodesByVersion, VersionOverview{
+			ServerVersion: serverVersion,
+			Nodes:         nodes,
+		})
+	}
+	sort.Slice(overview.NodesByVersion, func(i, j int) bool {
+		return overview.NodesByVersion[i].ServerVersion < overview.NodesByVersion[j].ServerVersion
+	})
+
+	sort.Slice(overview.ExpiringSoon, func(i, j int) bool {
+		return overview.ExpiringSoon[i].Timeout.Before(overview.ExpiringSoon[j].Timeout)
+	})
+
+	hosts := getDockerHosts()
+	overview.Hosts = make([]HostOverview, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host *DockerHost) {
+			defer wg.Done()
+			overview.Hosts[i] = overviewOfHost(ctx, host)
+		}(i, host)
+	}
+	wg.Wait()
+
+	for _, host := range overview.Hosts {
+		overview.ImageCacheSize += host.ImageCacheSize
+	}
+
+	pool, err := warmPoolOverview(ctx)
+	if err != nil {
+		// The rest of the overview is still worth seeing.
+		logWarnf(ctx, "Failed to get the warm pool: %s", err)
+	} else if pool != nil {
+		overview.WarmPool = pool
+	}
+
+	return overview, nil
+}
@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ProviderDocker  = "docker"
+	ProviderEC2     = "ec2"
+	ProviderCapella = "capella"
+)
+
+// clusterProvider is somewhere that the nodes of clusters can be run.  The
+// meta-data, ownership and expiry of clusters is handled the same way no
+// matter which provider runs them.
+type clusterProvider interface {
+	// allocateNodes creates the nodes of a cluster whose meta-data has already
+	// been created.
+	allocateNodes(ctx context.Context, clusterID string, timeout time.Time, nodes []NodeOptions) error
+	// killNodes destroys every node of a cluster.
+	killNodes(ctx context.Context, cluster *Cluster) error
+}
+
+var clusterProviders = map[string]clusterProvider{
+	ProviderDocker: &dockerProvider{},
+}
+
+func getClusterProvider(name string) (clusterProvider, error) {
+	if name == "" {
+		name = ProviderDocker
+	}
+
+	provider, ok := clusterProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a configured cluster provider", name)
+	}
+
+	return provider, nil
+}
+
+// requireDockerCluster is used by operations which work on the containers of
+// a cluster directly.
+func requireDockerCluster(cluster *Cluster) error {
+	if cluster.Provider != ProviderDocker {
+		return errors.Errorf("this cannot be done to %s clusters", cluster.Provider)
+	}
+	return nil
+}
+
+type dockerProvider struct{}
+
+func (p *dockerProvider) allocateNodes(ctx context.Context, clusterID string, timeout time.Time, nodes []NodeOptions) error {
+	host, releasePlacement, err := placeNodes(ctx, len(nodes))
+	if err != nil {
+		return err
+	}
+	defer releasePlacement()
+	logInfof(ctx, "Placing cluster on docker host %s", host.Name)
+
+	err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+		meta.Host = host.Name
+		return meta, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// We assume that all nodes are using the same server version.
+	err = ensureImage(ctx, host, clusterID, nodes[0].VersionInfo)
+	if err != nil {
+		return err
+	}
+
+	signal := make(chan error)
+
+	for _, node := range nodes {
+		node.host = host
+		go func(node NodeOptions) {
+			_, err := allocateNode(ctx, clusterID, timeout, node)
+			signal <- err
+		}(node)
+	}
+
+	var createError error
+	for range nodes {
+		err := <-signal
+		if err != nil && createError == nil {
+			createError = err
+		}
+	}
+
+	return createError
+}
+
+func (p *dockerProvider) killNodes(ctx context.Context, cluster *Cluster) error {
+	signal := make(chan error)
+
+	for _, node := range cluster.Nodes {
+		go func(nodeID string) {
+			signal <- killNode(ctx, nodeID)
+		}(node.ContainerID)
+	}
+
+	var killError error
+	for range cluster.Nodes {
+		err := <-signal
+		if err != nil && killError == nil {
+			killError = err
+		}
+	}
+
+	return killError
+}
@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Quota limits the resources a single user can allocate, a limit of 0 means
+// that there is no limit.
+type Quota struct {
+	MaxClusters        int `json:"max_clusters"`
+	MaxNodes           int `json:"max_nodes"`
+	MaxNodesPerCluster int `json:"max_nodes_per_cluster"`
+}
+
+type QuotaUsage struct {
+	Clusters int
+	Nodes    int
+}
+
+// QuotaReservation holds the usage of an allocation which is in progress,
+// whose containers may not exist yet so they can't be seen by getAllClusters.
+// Reservations are kept in the meta-data store, so that allocations on other
+// daemons count towards the quota too.
+type QuotaReservation struct {
+	Nodes      int       `json:"nodes"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+// quotaReservationExpiry is how long reservations last, in case the daemon
+// which made one stops before it can release it.
+var quotaReservationExpiry = 1 * time.Hour
+
+func quotaReservationsKey(user string) string {
+	return "quotareservations-" + user
+}
+
+func getQuotaReservations(user string) (map[string]QuotaReservation, error) {
+	reservations := make(map[string]QuotaReservation)
+	err := metaStore.getRecord(quotaReservationsKey(user), &reservations)
+	if err != nil && err != ErrMetaNotFound {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+// addReservedUsage adds the reservations which haven't expired to usage,
+// dropping those which have.
+func addReservedUsage(usage *QuotaUsage, reservations map[string]QuotaReservation) {
+	for reservationID, reservation := range reservations {
+		if time.Since(reservation.ReservedAt) > quotaReservationExpiry {
+			delete(reservations, reservationID)
+			continue
+		}
+
+		usage.Clusters++
+		usage.Nodes += reservation.Nodes
+	}
+}
+
+// updateQuotaReservations changes the reservations of user with updateFunc,
+// which may be called again if they change in the meantime.
+func updateQuotaReservations(user string, updateFunc func(reservations map[string]QuotaReservation) error) error {
+	return metaStore.createOrUpdateRawRecord(quotaReservationsKey(user), func(recordBytes []byte) ([]byte, error) {
+		reservations := make(map[string]QuotaReservation)
+		if recordBytes != nil {
+			err := json.Unmarshal(recordBytes, &reservations)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := updateFunc(reservations)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(reservations)
+	})
+}
+
+func getUserQuota(user string) (Quota, error) {
+	record, err := getUserRecord(user)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	if record.Quota != nil {
+		return *record.Quota, nil
+	}
+	return getRuntimeConfig().DefaultQuota, nil
+}
+
+// getQuotaUsage counts the clusters and nodes that user currently owns or is
+// allocating.
+func getQuotaUsage(ctx context.Context, user string) (QuotaUsage, error) {
+	usage, err := getOwnedUsage(ctx, user)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+
+	reservations, err := getQuotaReservations(user)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	addReservedUsage(&usage, reservations)
+
+	return usage, nil
+}
+
+// getOwnedUsage counts the clusters and nodes that user currently owns,
+// hibernated clusters count towards the cluster limit but their nodes don't.
+func getOwnedUsage(ctx context.Context, user string) (QuotaUsage, error) {
+	clusters, err := getAllClusters(NewContext(ctx, user, false))
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+
+	var usage QuotaUsage
+	for _, cluster := range clusters {
+		// Clusters which are only shared with the user don't count against them
+		if cluster.Owner != user {
+			continue
+		}
+
+		usage.Clusters++
+		if !cluster.Hibernated {
+			usage.Nodes += len(cluster.Nodes)
+		}
+	}
+
+	return usage, nil
+}
+
+// checkNodesPerCluster checks that the user in ctx can allocate a cluster of
+// numNodes nodes on a docker host.
+func checkNodesPerCluster(ctx context.Context, numNodes int) error {
+	if ContextIsAdmin(ctx) {
+		return nil
+	}
+
+	quota, err := getUserQuota(ContextUser(ctx))
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxNodesPerCluster > 0 && numNodes > quota.MaxNodesPerCluster {
+		return fmt.Errorf("cannot allocate clusters with more than %d nodes", quota.MaxNodesPerCluster)
+	}
+
+	return nil
+}
+
+// reserveQuota checks that the user in ctx can allocate a cluster of numNodes
+// nodes, and reserves that usage until the returned release function is
+// called.  Admins are not subject to quotas.
+func reserveQuota(ctx context.Context, numNodes int) (func(), error) {
+	if ContextIsAdmin(ctx) {
+		return func() {}, nil
+	}
+
+	user := ContextUser(ctx)
+
+	quota, err := getUserQuota(user)
+	if err != nil {
+		return nil, err
+	}
+
+	ownedUsage, err := getOwnedUsage(ctx, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not determine quota usage")
+	}
+
+	// The check and the reservation are a single update of the reservations,
+	// so that concurrent allocations by the same user can't both squeeze in
+	// under their limits.
+	reservationID := uuid.New().String()
+	err = updateQuotaReservations(user, func(reservations map[string]QuotaReservation) error {
+		usage := ownedUsage
+		addReservedUsage(&usage, reservations)
+
+		if quota.MaxClusters > 0 && usage.Clusters+1 > quota.MaxClusters {
+			return fmt.Errorf("cluster quota exceeded, you already have %d of %d clusters", usage.Clusters, quota.MaxClusters)
+		}
+		if quota.MaxNodes > 0 && usage.Nodes+numNodes > quota.MaxNodes {
+			return fmt.Errorf("node quota exceeded, you have %d of %d nodes and requested %d more", usage.Nodes, quota.MaxNodes, numNodes)
+		}
+
+		reservations[reservationID] = QuotaReservation{
+			Nodes:      numNodes,
+			ReservedAt: time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() {
+			err := updateQuotaReservations(user, func(reservations map[string]QuotaReservation) error {
+				delete(reservations, reservationID)
+				return nil
+			})
+			if err != nil {
+				logWarnf(ctx, "Failed to release quota reservation: %s", err)
+			}
+		})
+	}, nil
+}
+
+func setUserQuota(ctx context.Context, user string, quota *Quota) (*UserRecord, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can set quotas")
+	}
+
+	if quota != nil && (quota.MaxClusters < 0 || quota.MaxNodes < 0 || quota.MaxNodesPerCluster < 0) {
+		return nil, errors.New("quota limits cannot be negative")
+	}
+
+	record, err := updateUserRecord(ctx, user, func(record *UserRecord) {
+		record.Quota = quota
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if quota == nil {
+		logInfof(ctx, "Reset quota of %s to the default", user)
+	} else {
+		logInfof(ctx, "Set quota of %s to %d clusters, %d nodes, %d nodes per cluster",
+			user, quota.MaxClusters, quota.MaxNodes, quota.MaxNodesPerCluster)
+	}
+
+	return record, nil
+}
@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPerMinute is how many requests each user can make a minute, with
+// up to rateLimitBurst of them at once.  0 disables rate limiting.
+var rateLimitPerMinute = 120
+var rateLimitBurst = 30
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var rateLimitBuckets = make(map[string]*tokenBucket)
+var rateLimitLock sync.Mutex
+var rateLimitPruned time.Time
+
+// takeRateLimitToken uses up one of a user's requests, returning how long
+// they need to wait if they have none left.
+func takeRateLimitToken(user string, now time.Time) (bool, time.Duration) {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+
+	refillRate := float64(rateLimitPerMinute) / float64(time.Minute)
+	burst := float64(rateLimitBurst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	// Users whose buckets have refilled are no different to users who have
+	// never made a request, so stop tracking them now and then.
+	if now.Sub(rateLimitPruned) > 10*time.Minute {
+		for bucketUser, bucket := range rateLimitBuckets {
+			if bucket.tokens+float64(now.Sub(bucket.updated))*refillRate >= burst {
+				delete(rateLimitBuckets, bucketUser)
+			}
+		}
+		rateLimitPruned = now
+	}
+
+	bucket, ok := rateLimitBuckets[user]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		rateLimitBuckets[user] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+float64(now.Sub(bucket.updated))*refillRate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / refillRate)
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// rateLimitMiddleware stops any one user from flooding the daemon with
+// requests, admins aren't limited.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := ContextUser(r.Context())
+		if rateLimitPerMinute <= 0 || user == "" || ContextIsAdmin(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, retryAfter := takeRateLimitToken(user, time.Now())
+		if !allowed {
+			rateLimitedRequestsTotal.Inc()
+
+			retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+			writeJSONErrorStatus(w, http.StatusTooManyRequests,
+				fmt.Errorf("too many requests, retry in %d seconds", retrySeconds))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
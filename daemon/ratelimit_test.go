@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func resetRateLimits(t *testing.T, perMinute, burst int) {
+	oldPerMinute, oldBurst := rateLimitPerMinute, rateLimitBurst
+	rateLimitPerMinute, rateLimitBurst = perMinute, burst
+	rateLimitBuckets = make(map[string]*tokenBucket)
+	rateLimitPruned = time.Time{}
+
+	t.Cleanup(func() {
+		rateLimitPerMinute, rateLimitBurst = oldPerMinute, oldBurst
+		rateLimitBuckets = make(map[string]*tokenBucket)
+	})
+}
+
+func TestTakeRateLimitToken(t *testing.T) {
+	type request struct {
+		user          string
+		after         time.Duration
+		wantAllowed   bool
+		wantRetryWait time.Duration
+	}
+
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		requests  []request
+	}{
+		{
+			name:      "burst is allowed at once",
+			perMinute: 60,
+			burst:     3,
+			requests: []request{
+				{user: "a", wantAllowed: true},
+				{user: "a", wantAllowed: true},
+				{user: "a", wantAllowed: true},
+				{user: "a", wantAllowed: false, wantRetryWait: time.Second},
+			},
+		},
+		{
+			name:      "tokens refill over time",
+			perMinute: 60,
+			burst:     1,
+			requests: []request{
+				{user: "a", wantAllowed: true},
+				{user: "a", after: 500 * time.Millisecond, wantAllowed: false, wantRetryWait: 500 * time.Millisecond},
+				{user: "a", after: time.Second, wantAllowed: true},
+			},
+		},
+		{
+			name:      "refill is capped at the burst",
+			perMinute: 60,
+			burst:     2,
+			requests: []request{
+				{user: "a", wantAllowed: true},
+				{user: "a", wantAllowed: true},
+				{user: "a", after: time.Hour, wantAllowed: true},
+				{user: "a", after: time.Hour, wantAllowed: true},
+				{user: "a", after: time.Hour, wantAllowed: false, wantRetryWait: time.Second},
+			},
+		},
+		{
+			name:      "users have separate buckets",
+			perMinute: 60,
+			burst:     1,
+			requests: []request{
+				{user: "a", wantAllowed: true},
+				{user: "a", wantAllowed: false, wantRetryWait: time.Second},
+				{user: "b", wantAllowed: true},
+			},
+		},
+		{
+			name:      "a burst of 0 still allows one request",
+			perMinute: 60,
+			burst:     0,
+			requests: []request{
+				{user: "a", wantAllowed: true},
+				{user: "a", wantAllowed: false, wantRetryWait: time.Second},
+			},
+		},
+	}
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRateLimits(t, test.perMinute, test.burst)
+
+			for i, req := range test.requests {
+				allowed, retryWait := takeRateLimitToken(req.user, start.Add(req.after))
+				if allowed != req.wantAllowed {
+					t.Fatalf("request %d: expected allowed to be %t, got %t", i, req.wantAllowed, allowed)
+				}
+				// The refill rate isn't exact in floating point.
+				if diff := retryWait - req.wantRetryWait; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Fatalf("request %d: expected to wait %s, got %s", i, req.wantRetryWait, retryWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		perMinute      int
+		admin          bool
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "limited", perMinute: 60, wantStatus: http.StatusTooManyRequests, wantRetryAfter: "1"},
+		{name: "slow refill", perMinute: 1, wantStatus: http.StatusTooManyRequests, wantRetryAfter: "60"},
+		{name: "admins aren't limited", perMinute: 60, admin: true, wantStatus: http.StatusOK},
+		{name: "disabled", perMinute: 0, wantStatus: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRateLimits(t, test.perMinute, 1)
+
+			handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			ctx := NewContext(context.Background(), "user@couchbase.com", false)
+			if test.admin {
+				ctx = ContextWithRole(ctx, RoleAdmin)
+			}
+
+			var rec *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				rec = httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/clusters", nil).WithContext(ctx))
+			}
+
+			if rec.Code != test.wantStatus {
+				t.Fatalf("expected status %d, got %d", test.wantStatus, rec.Code)
+			}
+			if retryAfter := rec.Header().Get("Retry-After"); retryAfter != test.wantRetryAfter {
+				t.Fatalf("expected Retry-After of %q, got %q", test.wantRetryAfter, retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// waitForClusterReady waits until a cluster is ready to be used.  Before a
+// cluster is set up that is once ns_server answers on every node, after it is
+// set up every node must also be healthy and running its services, no
+// rebalance may be running and every bucket must be ready.
+func waitForClusterReady(ctx context.Context, clusterID string, setup *CreateClusterSetupJSON, timeout time.Duration) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if c.Provider == ProviderCapella {
+		// Capella clusters are only handed out once Capella reports them as
+		// healthy.
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastReason string
+	for {
+		reason := clusterNotReadyReason(ctx, c, setup)
+		if reason == "" {
+			logInfof(ctx, "Cluster is ready")
+			return nil
+		}
+		if reason != lastReason {
+			logInfof(ctx, "Waiting for cluster to be ready: %s", reason)
+			lastReason = reason
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return errors.Errorf("cluster was not ready within %s: %s", timeout, reason)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// clusterNotReadyReason returns why a cluster isn't ready, or nothing if it
+// is.
+func clusterNotReadyReason(ctx context.Context, c *Cluster, setup *CreateClusterSetupJSON) string {
+	for _, node := range c.Nodes {
+		err := restNodeOf(node).Ping()
+		if err != nil {
+			return fmt.Sprintf("ns_server is not answering on node %s", node.Name)
+		}
+	}
+
+	if setup == nil {
+		return ""
+	}
+
+	status, err := getClusterStatus(ctx, c.ID)
+	if err != nil {
+		return err.Error()
+	}
+
+	for _, node := range status.Nodes {
+		if node.Status != "healthy" || node.Membership != "active" {
+			return fmt.Sprintf("node %s is %s and %s", node.Hostname, node.Status, node.Membership)
+		}
+	}
+	if status.RebalanceStatus != "none" {
+		return fmt.Sprintf("rebalance is %s", status.RebalanceStatus)
+	}
+
+	expectedServices := make(map[string]int)
+	for _, nodeServices := range setup.Services {
+		for _, service := range strings.Split(nodeServices, ",") {
+			expectedServices[strings.TrimSpace(service)]++
+		}
+	}
+	for service, count := range expectedServices {
+		running := len(status.Services[service])
+		if service == "" || running >= count {
+			continue
+		}
+		return fmt.Sprintf("%s service is running on %d of %d nodes", service, running, count)
+	}
+
+	for _, bucket := range status.Buckets {
+		if !bucket.Ready {
+			return fmt.Sprintf("bucket %s is not ready", bucket.Name)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,315 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/pkg/errors"
+)
+
+// rebalanceTimeout is how long rebalances started by the daemon are waited
+// for, which is plenty for the amount of data test clusters hold.
+const rebalanceTimeout = 30 * time.Minute
+
+const (
+	RecoveryFull  = "full"
+	RecoveryDelta = "delta"
+)
+
+type RebalanceOptions struct {
+	// EjectNodes are removed from the cluster by the rebalance, as are nodes
+	// which have been failed over without a recovery type being set.
+	EjectNodes []string
+}
+
+type FailoverOptions struct {
+	Node     string
+	Graceful bool
+}
+
+type RecoveryOptions struct {
+	Node string
+	// RecoveryType is either full or delta.
+	RecoveryType string
+}
+
+// waitForRebalanceEnd waits for the rebalance which is running on a cluster
+// to end, reporting its progress as it goes if onProgress is set.
+func waitForRebalanceEnd(ctx context.Context, restNode *cluster.Node, onProgress func(float64)) (*cluster.RebalanceProgress, error) {
+	for {
+		// Nodes which are being moved can briefly fail to answer.
+		progress, err := restNode.GetRebalanceProgress()
+		if err == nil {
+			if progress.Status == "none" {
+				return progress, nil
+			}
+			if onProgress != nil {
+				onProgress(progress.Progress)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "rebalance did not finish")
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitForRebalance waits for the rebalance which is running on a cluster to
+// finish, returning why it failed if it did.
+func waitForRebalance(ctx context.Context, restNode *cluster.Node, onProgress func(float64)) error {
+	progress, err := waitForRebalanceEnd(ctx, restNode, onProgress)
+	if err != nil {
+		return err
+	}
+	if progress.Error != "" {
+		return errors.Errorf("rebalance failed: %s", progress.Error)
+	}
+	return nil
+}
+
+// jobProgress records the progress of a job each time it moves on by a
+// whole percent, rather than every time it is polled.
+func jobProgress(jobID string) func(float64) {
+	recorded := -1
+	return func(progress float64) {
+		if int(progress) != recorded {
+			recorded = int(progress)
+			setJobProgress(jobID, progress)
+		}
+	}
+}
+
+// poolNodeOf finds a node of a cluster in what ns_server reports about the
+// cluster.
+func poolNodeOf(c *Cluster, pool *cluster.PoolStatus, node *Node) *cluster.PoolNodeStatus {
+	for i, poolNode := range pool.Nodes {
+		if nodeOfHostname(c.Nodes, poolNode.Hostname) == node {
+			return &pool.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// poolOf asks ns_server about a cluster through the first of its nodes which
+// answers, other than those excluded, such as ones being removed.
+func poolOf(c *Cluster, exclude map[*Node]bool) (*cluster.Node, *cluster.PoolStatus, error) {
+	err := errors.New("no nodes available")
+	for _, node := range c.Nodes {
+		if exclude[node] {
+			continue
+		}
+
+		restNode := restNodeOf(node)
+		var pool *cluster.PoolStatus
+		pool, err = restNode.GetPoolStatus()
+		if err == nil {
+			return restNode, pool, nil
+		}
+	}
+	return nil, nil, errors.Wrap(err, "failed to get the nodes of the cluster from ns_server")
+}
+
+func rebalanceTarget(ctx context.Context, clusterID string) (*Cluster, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	if c.Provider == ProviderCapella {
+		return nil, errors.New("capella clusters are managed by capella")
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot rebalance a hibernated cluster")
+	}
+
+	return c, nil
+}
+
+// rebalance rebalances a cluster, ejecting the given nodes and any which
+// have been failed over and aren't being recovered.
+func rebalance(ctx context.Context, c *Cluster, ejectNodes []*Node, onProgress func(float64)) error {
+	exclude := make(map[*Node]bool)
+	for _, node := range ejectNodes {
+		exclude[node] = true
+	}
+
+	restNode, pool, err := poolOf(c, exclude)
+	if err != nil {
+		return err
+	}
+
+	var knownNodes, ejectedNodes []string
+	for _, poolNode := range pool.Nodes {
+		knownNodes = append(knownNodes, poolNode.OtpNode)
+		if poolNode.ClusterMembership == "inactiveFailed" && (poolNode.RecoveryType == "" || poolNode.RecoveryType == "none") {
+			ejectedNodes = append(ejectedNodes, poolNode.OtpNode)
+		}
+	}
+	for _, node := range ejectNodes {
+		poolNode := poolNodeOf(c, pool, node)
+		if poolNode == nil {
+			return errors.Errorf("node %s is not part of the couchbase cluster", node.Name)
+		}
+		if !containsString(ejectedNodes, poolNode.OtpNode) {
+			ejectedNodes = append(ejectedNodes, poolNode.OtpNode)
+		}
+	}
+
+	logInfof(ctx, "Rebalancing %d nodes, ejecting %d", len(knownNodes), len(ejectedNodes))
+	err = restNode.StartRebalance(knownNodes, ejectedNodes)
+	if err != nil {
+		return errors.Wrap(err, "failed to start rebalance")
+	}
+
+	rebalanceCtx, cancel := context.WithTimeout(ctx, rebalanceTimeout)
+	defer cancel()
+	return waitForRebalance(rebalanceCtx, restNode, onProgress)
+}
+
+// startRebalance starts a job which rebalances a cluster.
+func startRebalance(ctx context.Context, clusterID string, opts RebalanceOptions) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	c, err := rebalanceTarget(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ejectNodes []*Node
+	for _, nodeRef := range opts.EjectNodes {
+		node, err := findNode(c, nodeRef)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find node %s", nodeRef)
+		}
+		ejectNodes = append(ejectNodes, node)
+	}
+	if len(ejectNodes) >= len(c.Nodes) {
+		return nil, errors.New("cannot eject every node of a cluster")
+	}
+
+	return startJob(ctx, JobTypeRebalance, c, func(ctx context.Context, job Job) (string, error) {
+		return "", rebalance(ctx, c, ejectNodes, jobProgress(job.ID))
+	})
+}
+
+// stopRebalance starts a job which stops the rebalance running on a cluster,
+// and finishes once it has stopped.
+func stopRebalance(ctx context.Context, clusterID string) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	c, err := rebalanceTarget(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	return startJob(ctx, JobTypeStopRebalance, c, func(ctx context.Context, job Job) (string, error) {
+		restNode, _, err := poolOf(c, nil)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = restNode.StopRebalance()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to stop rebalance")
+		}
+
+		stopCtx, cancel := context.WithTimeout(ctx, rebalanceTimeout)
+		defer cancel()
+		progress, err := waitForRebalanceEnd(stopCtx, restNode, nil)
+		if err != nil {
+			return "", err
+		}
+		// Stopped rebalances say so in their error.
+		return progress.Error, nil
+	})
+}
+
+// startFailover starts a job which fails a node over, which for graceful
+// failovers finishes once its vbuckets have been moved off of it.
+func startFailover(ctx context.Context, clusterID string, opts FailoverOptions) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	c, err := rebalanceTarget(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := findNode(c, opts.Node)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nodes) < 2 {
+		return nil, errors.New("cannot fail over the only node of a cluster")
+	}
+
+	return startJob(ctx, JobTypeFailover, c, func(ctx context.Context, job Job) (string, error) {
+		restNode, pool, err := poolOf(c, map[*Node]bool{node: true})
+		if err != nil {
+			return "", err
+		}
+		poolNode := poolNodeOf(c, pool, node)
+		if poolNode == nil {
+			return "", errors.Errorf("node %s is not part of the couchbase cluster", node.Name)
+		}
+
+		logInfof(ctx, "Failing over node %s, graceful: %t", node.Name, opts.Graceful)
+		err = restNode.FailOver(poolNode.OtpNode, opts.Graceful)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to fail over node %s", node.Name)
+		}
+
+		if !opts.Graceful {
+			return "", nil
+		}
+
+		failoverCtx, cancel := context.WithTimeout(ctx, rebalanceTimeout)
+		defer cancel()
+		return "", waitForRebalance(failoverCtx, restNode, jobProgress(job.ID))
+	})
+}
+
+// startRecovery starts a job which adds a failed over node back into its
+// cluster with full or delta recovery, and rebalances the cluster.
+func startRecovery(ctx context.Context, clusterID string, opts RecoveryOptions) (*Job, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	if opts.RecoveryType != RecoveryFull && opts.RecoveryType != RecoveryDelta {
+		return nil, errors.Errorf("recovery type must be %s or %s", RecoveryFull, RecoveryDelta)
+	}
+
+	c, err := rebalanceTarget(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := findNode(c, opts.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	return startJob(ctx, JobTypeRecovery, c, func(ctx context.Context, job Job) (string, error) {
+		restNode, pool, err := poolOf(c, map[*Node]bool{node: true})
+		if err != nil {
+			return "", err
+		}
+		poolNode := poolNodeOf(c, pool, node)
+		if poolNode == nil {
+			return "", errors.Errorf("node %s is not part of the couchbase cluster", node.Name)
+		}
+		if poolNode.ClusterMembership != "inactiveFailed" {
+			return "", errors.Errorf("node %s has not been failed over", node.Name)
+		}
+
+		logInfof(ctx, "Recovering node %s with %s recovery", node.Name, opts.RecoveryType)
+		err = restNode.SetRecoveryType(poolNode.OtpNode, opts.RecoveryType)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to set the recovery type of node %s", node.Name)
+		}
+
+		return "", rebalance(ctx, c, nil, jobProgress(job.ID))
+	})
+}
@@ -0,0 +1,204 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	OrphanPolicyAdopt = "adopt"
+	OrphanPolicyKill  = "kill"
+)
+
+// orphanPolicy is what happens to clusters which have containers but no
+// meta-data when the daemon starts.
+var orphanPolicy = OrphanPolicyAdopt
+
+// orphanAdoptTimeout is how long adopted orphans are kept alive for, their
+// creators can refresh them if they are still wanted.
+var orphanAdoptTimeout = 1 * time.Hour
+
+// ReconcileReport describes what was found when the docker host and the
+// meta-data store were compared.
+type ReconcileReport struct {
+	Adopted      []string
+	Orphaned     []string
+	StaleMeta    []string
+	StaleAliases []string
+	StaleClaims  []string
+	// OrphanedInstances are ec2 instances, and OrphanedCapellaClusters are
+	// Capella clusters, which were destroyed because their clusters no longer
+	// existed.
+	OrphanedInstances       []string
+	OrphanedCapellaClusters []string
+}
+
+func validateOrphanPolicy(policy string) error {
+	if policy != OrphanPolicyAdopt && policy != OrphanPolicyKill {
+		return fmt.Errorf("orphaned cluster policy must be %s or %s, not %s", OrphanPolicyAdopt, OrphanPolicyKill, policy)
+	}
+	return nil
+}
+
+// reconcileClusters compares the containers on the docker host with the
+// meta-data store, so that a crash can never leave clusters running which
+// the daemon doesn't know about, or records for clusters which are gone.
+func reconcileClusters(ctx context.Context) (*ReconcileReport, error) {
+	logInfof(ctx, "Reconciling docker state with meta-data")
+
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", "com.couchbase.dyncluster.creator")
+
+	// Every host needs to be listed, otherwise the clusters on a host which
+	// is down would look like they had gone away.
+	containers, err := listContainers(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterArgs,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	poolClaims, err := getPoolClaims()
+	if err != nil {
+		return nil, err
+	}
+
+	metas, err := metaStore.GetAllClusterMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{}
+
+	containerIDs := make(map[string]bool)
+	clusterCreators := make(map[string]string)
+	for _, container := range containers {
+		containerIDs[container.ID[0:12]] = true
+
+		labels := effectiveLabels(container, poolClaims)
+		clusterID := labels["com.couchbase.dyncluster.cluster_id"]
+		if clusterID != "" && clusterCreators[clusterID] == "" {
+			clusterCreators[clusterID] = labels["com.couchbase.dyncluster.creator"]
+		}
+	}
+
+	for clusterID, creator := range clusterCreators {
+		clusterCtx := ContextWithClusterID(ctx, clusterID)
+
+		meta, ok := metas[clusterID]
+		if ok {
+			if meta.Alias != "" && resolveClusterID(meta.Alias) != clusterID {
+				err := claimAlias(meta.Alias, clusterID)
+				if err != nil {
+					logWarnf(clusterCtx, "Failed to restore alias %s: %s", meta.Alias, err)
+				}
+			}
+			report.Adopted = append(report.Adopted, clusterID)
+			continue
+		}
+
+		logWarnf(clusterCtx, "Found cluster without meta-data created by %s", creator)
+		report.Orphaned = append(report.Orphaned, clusterID)
+
+		if orphanPolicy == OrphanPolicyKill {
+			err := killCluster(clusterCtx, clusterID)
+			recordAudit(clusterCtx, "kill orphaned cluster", clusterID, "", err)
+			if err != nil {
+				logErrorf(clusterCtx, "Failed to kill orphaned cluster: %s", err)
+			}
+			continue
+		}
+
+		// Hand the cluster back to whoever created it, with a short timeout so
+		// that it gets reaped unless they still want it.
+		err := metaStore.CreateClusterMeta(clusterID, ClusterMeta{
+			Owner:   creator,
+			Timeout: time.Now().Add(orphanAdoptTimeout),
+		})
+		recordAudit(clusterCtx, "adopt orphaned cluster", clusterID, "", err)
+		if err != nil {
+			logErrorf(clusterCtx, "Failed to adopt orphaned cluster: %s", err)
+		}
+	}
+
+	// Hibernated clusters and those run by other providers are the only ones
+	// which should have meta-data but no containers.
+	for clusterID, meta := range metas {
+		if meta.Hibernation != nil || meta.EC2 != nil || meta.Capella != nil || clusterCreators[clusterID] != "" {
+			continue
+		}
+
+		clusterCtx := ContextWithClusterID(ctx, clusterID)
+		logWarnf(clusterCtx, "Removing meta-data of cluster with no containers")
+
+		err := metaStore.DeleteClusterMeta(clusterID)
+		if err != nil {
+			logErrorf(clusterCtx, "Failed to remove stale meta-data: %s", err)
+			continue
+		}
+		if meta.Alias != "" {
+			releaseAlias(meta.Alias, clusterID)
+		}
+		report.StaleMeta = append(report.StaleMeta, clusterID)
+	}
+
+	aliases := make(map[string]string)
+	err = metaStore.forEachRecord("alias-", func(key string, recordBytes []byte) error {
+		var clusterID string
+		err := json.Unmarshal(recordBytes, &clusterID)
+		if err != nil {
+			return err
+		}
+
+		aliases[strings.TrimPrefix(key, "alias-")] = clusterID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for alias, clusterID := range aliases {
+		meta, err := metaStore.GetClusterMeta(clusterID)
+		if err == nil && meta.Alias == alias {
+			continue
+		}
+
+		releaseAlias(alias, clusterID)
+		report.StaleAliases = append(report.StaleAliases, alias)
+	}
+
+	for containerID := range poolClaims {
+		if containerIDs[containerID] {
+			continue
+		}
+
+		releasePoolClaim(ctx, containerID)
+		report.StaleClaims = append(report.StaleClaims, containerID)
+	}
+
+	if provider := getEC2Provider(); provider != nil {
+		report.OrphanedInstances, err = provider.terminateOrphanedInstances(ctx, metas)
+		if err != nil {
+			logErrorf(ctx, "Failed to clean up orphaned ec2 instances: %s", err)
+		}
+	}
+
+	if provider := getCapellaProvider(); provider != nil {
+		report.OrphanedCapellaClusters, err = provider.deleteOrphanedClusters(ctx, metas)
+		if err != nil {
+			logErrorf(ctx, "Failed to clean up orphaned capella clusters: %s", err)
+		}
+	}
+
+	logInfof(ctx, "Reconciled %d clusters, %d orphaned clusters, %d stale meta-data records, %d stale aliases, %d stale pool claims, %d orphaned ec2 instances and %d orphaned capella clusters",
+		len(report.Adopted), len(report.Orphaned), len(report.StaleMeta), len(report.StaleAliases), len(report.StaleClaims), len(report.OrphanedInstances), len(report.OrphanedCapellaClusters))
+
+	return report, nil
+}
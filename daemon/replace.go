@@ -0,0 +1,233 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/pkg/errors"
+)
+
+type ReplaceNodeOptions struct {
+	// ServerVersion is the version of the new node, it is the initial
+	// version of the node being replaced if empty.
+	ServerVersion string
+}
+
+// nextNodeName picks a name for a node being added to a cluster which none
+// of its nodes, past or present, are likely to have.
+func nextNodeName(c *Cluster) string {
+	names := make(map[string]bool)
+	for _, node := range c.Nodes {
+		names[node.Name] = true
+	}
+
+	for i := len(c.Nodes) + 1; ; i++ {
+		name := fmt.Sprintf("node_%d", i)
+		if !names[name] {
+			return name
+		}
+	}
+}
+
+// replaceNode allocates a new node with the same services as a node of a
+// cluster, swap rebalances it in for the old node and removes the old node.
+// The hostname of the old node is pointed at the new one, so that anything
+// which was configured with it keeps working.
+func replaceNode(ctx context.Context, clusterID, nodeRef string, opts ReplaceNodeOptions) (*Node, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Replacing node %s", nodeRef)
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot replace the nodes of a hibernated cluster")
+	}
+
+	oldNode, err := findNode(c, nodeRef)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nodes are often replaced because they are broken, so another node is
+	// asked about the cluster if there is one.
+	coordinator := oldNode
+	for _, node := range c.Nodes {
+		if node != oldNode {
+			coordinator = node
+			break
+		}
+	}
+	restCoordinator := restNodeOf(coordinator)
+
+	pool, err := restCoordinator.GetPoolStatus()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the nodes of the cluster from ns_server")
+	}
+	oldPoolNode := poolNodeOf(c, pool, oldNode)
+	if oldPoolNode == nil {
+		return nil, errors.Errorf("node %s is not part of the couchbase cluster", oldNode.Name)
+	}
+
+	serverVersion := opts.ServerVersion
+	if serverVersion == "" {
+		serverVersion = oldNode.InitialServerVersion
+	}
+	nodeVersion, err := parseServerVersion(serverVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both nodes exist until the swap has finished.
+	releaseQuota, err := reserveQuota(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuota()
+
+	meta, err := metaStore.GetClusterMeta(clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	host := getDockerHost(c.Host)
+	if host == nil {
+		host = dockerHostOf(oldNode.ContainerID)
+	}
+	err = ensureImage(ctx, host, clusterID, nodeVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	newNodes := []NodeOptions{{
+		Name:          nextNodeName(c),
+		ServerVersion: serverVersion,
+		VersionInfo:   nodeVersion,
+		Overrides:     meta.NodeOverrides[oldNode.Name],
+		host:          host,
+	}}
+	newName := newNodes[0].Name
+
+	if !newNodes[0].Overrides.empty() {
+		err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+			if meta.NodeOverrides == nil {
+				meta.NodeOverrides = make(map[string]NodeOverrides)
+			}
+			meta.NodeOverrides[newName] = newNodes[0].Overrides
+			return meta, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = reserveNodeIPs(ctx, clusterID, newNodes, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new container should look like it was created by the original
+	// creator, so that the cluster remains visible to them.
+	creatorCtx := NewContext(ctx, c.Creator, ContextIgnoreOwnership(ctx))
+	containerID, err := allocateNode(creatorCtx, clusterID, meta.Timeout, newNodes[0])
+	if err != nil {
+		releaseNodeIP(ctx, clusterID, newName)
+		return nil, err
+	}
+
+	removeNewNode := func() {
+		killNode(ctx, containerID)
+		releaseNodeIP(ctx, clusterID, newName)
+	}
+
+	c, err = getCluster(ctx, clusterID)
+	if err != nil {
+		removeNewNode()
+		return nil, err
+	}
+	newNode, err := findNode(c, newName)
+	if err != nil {
+		removeNewNode()
+		return nil, err
+	}
+
+	restNewNode := restNodeOf(newNode)
+	_, err = restNewNode.GetInfo()
+	if err != nil {
+		removeNewNode()
+		return nil, errors.Wrap(err, "new node did not start")
+	}
+
+	addHostname := newNode.IPv4Address
+	if c.UseHostname {
+		addHostname = newNode.Hostname
+	}
+	services := strings.Join(oldPoolNode.Services, ",")
+	logInfof(ctx, "Adding node %s with services %s", newName, services)
+	err = restCoordinator.AddNode(&cluster.Node{HostName: addHostname, Services: services}, services)
+	if err != nil {
+		removeNewNode()
+		return nil, errors.Wrap(err, "failed to add the new node to the cluster")
+	}
+
+	pool, err = restCoordinator.GetPoolStatus()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the nodes of the cluster from ns_server")
+	}
+	var knownNodes []string
+	for _, poolNode := range pool.Nodes {
+		knownNodes = append(knownNodes, poolNode.OtpNode)
+	}
+
+	logInfof(ctx, "Swap rebalancing node %s in for node %s", newName, oldNode.Name)
+	err = restCoordinator.StartRebalance(knownNodes, []string{oldPoolNode.OtpNode})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start rebalance, node %s has been added to the cluster", newName)
+	}
+
+	// The old node may be the orchestrator, the new one will be around
+	// throughout.
+	rebalanceCtx, cancel := context.WithTimeout(ctx, rebalanceTimeout)
+	defer cancel()
+	err = waitForRebalance(rebalanceCtx, restNewNode, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "node %s has been added to the cluster, but node %s is still in it", newName, oldNode.Name)
+	}
+
+	err = killNode(ctx, oldNode.ContainerID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "node %s has been rebalanced out but could not be removed", oldNode.Name)
+	}
+	releaseNodeIP(ctx, clusterID, oldNode.Name)
+
+	if _, ok := meta.NodeOverrides[oldNode.Name]; ok {
+		err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+			delete(meta.NodeOverrides, oldNode.Name)
+			return meta, nil
+		})
+		if err != nil {
+			logWarnf(ctx, "Failed to remove the overrides of node %s: %s", oldNode.Name, err)
+		}
+	}
+
+	if dnsSvcHost != "" && newNode.IPv4Address != "" {
+		logInfof(ctx, "register %s => %s on %s", newNode.IPv4Address, oldNode.Hostname, dnsSvcHost)
+		body, err := registerDomainName(oldNode.Hostname, newNode.IPv4Address)
+		if err != nil {
+			logWarnf(ctx, "Failed registering IPv4:%s, %s", err, body)
+		}
+	}
+
+	return newNode, nil
+}
@@ -5,14 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"html/template"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/couchbaselabs/cbdynclusterd/swaggerui"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
 )
 
 var Version string
@@ -41,6 +46,8 @@ type NodeJSON struct {
 	InitialServerVersion string `json:"initial_server_version"`
 	IPv4Address          string `json:"ipv4_address"`
 	IPv6Address          string `json:"ipv6_address"`
+	Hostname             string `json:"hostname,omitempty"`
+	Health               string `json:"health,omitempty"`
 }
 
 func jsonifyNode(node *Node) NodeJSON {
@@ -52,6 +59,8 @@ func jsonifyNode(node *Node) NodeJSON {
 		InitialServerVersion: node.InitialServerVersion,
 		IPv4Address:          node.IPv4Address,
 		IPv6Address:          node.IPv6Address,
+		Hostname:             node.Hostname,
+		Health:               node.Health,
 	}
 }
 
@@ -64,6 +73,8 @@ func UnjsonifyNode(jsonNode *NodeJSON) *Node {
 		InitialServerVersion: jsonNode.InitialServerVersion,
 		IPv4Address:          jsonNode.IPv4Address,
 		IPv6Address:          jsonNode.IPv6Address,
+		Hostname:             jsonNode.Hostname,
+		Health:               jsonNode.Health,
 	}
 }
 
@@ -77,12 +88,30 @@ type VersionJSON struct {
 }
 
 type ClusterJSON struct {
-	ID         string     `json:"id"`
-	Creator    string     `json:"creator"`
-	Owner      string     `json:"owner"`
-	Timeout    string     `json:"timeout"`
-	Nodes      []NodeJSON `json:"nodes"`
-	EntryPoint string     `json:"entry"`
+	ID         string            `json:"id"`
+	Creator    string            `json:"creator"`
+	Owner      string            `json:"owner"`
+	Timeout    string            `json:"timeout"`
+	Nodes      []NodeJSON        `json:"nodes"`
+	EntryPoint string            `json:"entry"`
+	Hibernated bool              `json:"hibernated,omitempty"`
+	SharedWith []string          `json:"shared_with,omitempty"`
+	Team       string            `json:"team,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Alias      string            `json:"alias,omitempty"`
+	Pool       string            `json:"pool,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Provider   string            `json:"provider,omitempty"`
+	KeepAlive  bool              `json:"keep_alive,omitempty"`
+	Degraded   bool              `json:"degraded,omitempty"`
+
+	UseHostname bool                    `json:"use_hostname,omitempty"`
+	Credentials *ClusterCredentialsJSON `json:"credentials,omitempty"`
+}
+
+type ClusterCredentialsJSON struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 func jsonifyCluster(cluster *Cluster) ClusterJSON {
@@ -92,6 +121,25 @@ func jsonifyCluster(cluster *Cluster) ClusterJSON {
 		Owner:      cluster.Owner,
 		Timeout:    cluster.Timeout.Format(time.RFC3339),
 		EntryPoint: cluster.EntryPoint,
+		Hibernated: cluster.Hibernated,
+		SharedWith: cluster.SharedWith,
+		Team:       cluster.Team,
+		Tags:       cluster.Tags,
+		Alias:      cluster.Alias,
+		Pool:       cluster.Pool,
+		Host:       cluster.Host,
+		Provider:   cluster.Provider,
+		KeepAlive:  cluster.KeepAlive,
+		Degraded:   cluster.Degraded(),
+
+		UseHostname: cluster.UseHostname,
+	}
+
+	if cluster.Credentials != nil {
+		jsonCluster.Credentials = &ClusterCredentialsJSON{
+			Username: cluster.Credentials.Username,
+			Password: cluster.Credentials.Password,
+		}
 	}
 
 	for _, node := range cluster.Nodes {
@@ -122,6 +170,20 @@ func UnjsonifyCluster(jsonCluster *ClusterJSON) (*Cluster, error) {
 	cluster.Creator = jsonCluster.Creator
 	cluster.Owner = jsonCluster.Owner
 	cluster.EntryPoint = jsonCluster.EntryPoint
+	cluster.Hibernated = jsonCluster.Hibernated
+	cluster.SharedWith = jsonCluster.SharedWith
+	cluster.Team = jsonCluster.Team
+	cluster.Tags = jsonCluster.Tags
+	cluster.Alias = jsonCluster.Alias
+	cluster.Pool = jsonCluster.Pool
+	cluster.Host = jsonCluster.Host
+	cluster.Provider = jsonCluster.Provider
+	if jsonCluster.Credentials != nil {
+		cluster.Credentials = &ClusterCredentials{
+			Username: jsonCluster.Credentials.Username,
+			Password: jsonCluster.Credentials.Password,
+		}
+	}
 
 	clusterTimeout, err := time.Parse(time.RFC3339, jsonCluster.Timeout)
 	if err != nil {
@@ -137,19 +199,35 @@ func UnjsonifyCluster(jsonCluster *ClusterJSON) (*Cluster, error) {
 	return cluster, nil
 }
 
+// requestIDMiddleware tags every request with an ID which is included in all
+// of the log entries written while handling it, and returned to the client so
+// that it can be quoted when reporting problems.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("cbdn-request-id")
+		if requestID == "" {
+			requestUUID, _ := uuid.NewRandom()
+			requestID = requestUUID.String()[0:8]
+		}
+
+		w.Header().Set("cbdn-request-id", requestID)
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestID(r.Context(), requestID)))
+	})
+}
+
 func getHttpContext(r *http.Request) (context.Context, error) {
-	userHeader := r.Header.Get("cbdn-user")
-	if userHeader == "" {
-		return nil, errors.New("must specify a user")
+	// The user is the identity that authMiddleware authenticated the request as
+	user := ContextUser(r.Context())
+	if user == "" {
+		return nil, errors.New("must specify an API token")
 	}
-	if !strings.HasSuffix(userHeader, "@couchbase.com") {
-		return nil, errors.New("your user must be your @couchbase.com email")
-	}
-	user := userHeader
 
 	ignoreOwnership := false
 	adminHeader := r.Header.Get("cbdn-admin")
 	if adminHeader == "true" {
+		if !ContextIsAdmin(r.Context()) {
+			return nil, errors.New("only admins can ignore cluster ownership")
+		}
 		ignoreOwnership = true
 	}
 
@@ -157,24 +235,28 @@ func getHttpContext(r *http.Request) (context.Context, error) {
 }
 
 func writeJSONError(w http.ResponseWriter, err error) {
+	writeJSONErrorStatus(w, 400, err)
+}
+
+func writeJSONErrorStatus(w http.ResponseWriter, status int, err error) {
 	jsonErr := jsonifyError(err)
 
 	jsonBytes, err := json.Marshal(jsonErr)
 	if err != nil {
-		log.Printf("Failed to marshal error JSON: %s", err)
+		logErrorf(context.Background(), "Failed to marshal error JSON: %s", err)
 		w.WriteHeader(500)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(400)
+	w.WriteHeader(status)
 	w.Write(jsonBytes)
 }
 
 func writeJsonResponse(w http.ResponseWriter, data interface{}) {
 	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("Failed to marshal response JSON: %s", err)
+		logErrorf(context.Background(), "Failed to marshal response JSON: %s", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -189,12 +271,163 @@ func readJsonRequest(r *http.Request, data interface{}) error {
 	return jsonDec.Decode(data)
 }
 
+// readJsonOrYamlRequest reads a request body as YAML if its content type says
+// so, otherwise as JSON.  YAML is converted to JSON first so that the same
+// field names work for both.
+func readJsonOrYamlRequest(r *http.Request, data interface{}) error {
+	switch r.Header.Get("Content-Type") {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+	default:
+		return readJsonRequest(r, data)
+	}
+
+	yamlBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	jsonBytes, err := yamlToJSON(yamlBytes)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(jsonBytes, data)
+}
+
+func yamlToJSON(yamlBytes []byte) ([]byte, error) {
+	var value interface{}
+	err := yaml.Unmarshal(yamlBytes, &value)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err = convertYamlValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
+
+// convertYamlValue turns the map[interface{}]interface{} maps produced by the
+// yaml decoder into maps that can be marshalled as JSON.
+func convertYamlValue(value interface{}) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		jsonMap := make(map[string]interface{})
+		for key, mapValue := range typedValue {
+			keyString, ok := key.(string)
+			if !ok {
+				keyString = fmt.Sprintf("%v", key)
+			}
+
+			convertedValue, err := convertYamlValue(mapValue)
+			if err != nil {
+				return nil, err
+			}
+			jsonMap[keyString] = convertedValue
+		}
+		return jsonMap, nil
+	case []interface{}:
+		for i, sliceValue := range typedValue {
+			convertedValue, err := convertYamlValue(sliceValue)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[i] = convertedValue
+		}
+		return typedValue, nil
+	}
+	return value, nil
+}
+
 func HttpRoot(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("This is the cbdyncluster daemon!\n"))
 }
 
 type GetClustersJSON []ClusterJSON
 
+func parseIntParam(query url.Values, name string, defaultValue int) (int, error) {
+	param := query.Get(name)
+	if param == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(param)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return value, nil
+}
+
+func parseTimeParam(query url.Values, name string) (time.Time, error) {
+	param := query.Get(name)
+	if param == "" {
+		return time.Time{}, nil
+	}
+
+	value, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 time", name)
+	}
+	return value, nil
+}
+
+func parseClusterFilter(query url.Values) (ClusterFilter, error) {
+	filter := ClusterFilter{
+		Owner:         query.Get("owner"),
+		ServerVersion: query.Get("server_version"),
+		State:         query.Get("state"),
+		Tags:          make(map[string]string),
+	}
+
+	var err error
+	filter.MinNodes, err = parseIntParam(query, "min_nodes", 0)
+	if err != nil {
+		return ClusterFilter{}, err
+	}
+	filter.MaxNodes, err = parseIntParam(query, "max_nodes", 0)
+	if err != nil {
+		return ClusterFilter{}, err
+	}
+
+	// Tags are filtered on as ?tag=name=value, or ?tag=name for any value
+	for _, tag := range query["tag"] {
+		tagParts := strings.SplitN(tag, "=", 2)
+		if len(tagParts) == 2 {
+			filter.Tags[tagParts[0]] = tagParts[1]
+		} else {
+			filter.Tags[tagParts[0]] = ""
+		}
+	}
+
+	filter.ExpiresAfter, err = parseTimeParam(query, "expires_after")
+	if err != nil {
+		return ClusterFilter{}, err
+	}
+	filter.ExpiresBefore, err = parseTimeParam(query, "expires_before")
+	if err != nil {
+		return ClusterFilter{}, err
+	}
+
+	// expires_within is a shorthand for an expiry window starting now
+	if within := query.Get("expires_within"); within != "" {
+		duration, err := time.ParseDuration(within)
+		if err != nil {
+			return ClusterFilter{}, err
+		}
+		filter.ExpiresBefore = time.Now().Add(duration)
+	}
+
+	switch filter.State {
+	case "", ClusterStateRunning, ClusterStateDegraded, ClusterStateStopped, ClusterStateHibernated:
+	default:
+		return ClusterFilter{}, fmt.Errorf("unknown cluster state %s", filter.State)
+	}
+
+	return filter, nil
+}
+
 func HttpGetClusters(w http.ResponseWriter, r *http.Request) {
 	reqCtx, err := getHttpContext(r)
 	if err != nil {
@@ -202,12 +435,44 @@ func HttpGetClusters(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	query := r.URL.Query()
+
+	filter, err := parseClusterFilter(query)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	offset, err := parseIntParam(query, "offset", 0)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	limit, err := parseIntParam(query, "limit", 0)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
 	clusters, err := getAllClusters(reqCtx)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
+	clusters = filterClusters(clusters, filter)
+
+	err = sortClusters(clusters, query.Get("sort"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	// The total lets clients page through the results without changing the
+	// shape of the response.
+	w.Header().Set("cbdn-total-count", strconv.Itoa(len(clusters)))
+	clusters = paginateClusters(clusters, offset, limit)
+
 	jsonClusters := make(GetClustersJSON, 0)
 
 	for _, cluster := range clusters {
@@ -222,6 +487,15 @@ type CreateClusterNodeJSON struct {
 	Name          string `json:"name"`
 	Platform      string `json:"platform"`
 	ServerVersion string `json:"server_version"`
+	// PackageURL allocates the node from a toy build, whose rpm package is
+	// downloaded from here and checked against PackageSHA256.  ServerVersion
+	// is the version it was built from.
+	PackageURL    string `json:"package_url,omitempty"`
+	PackageSHA256 string `json:"package_sha256,omitempty"`
+	// IPv4Address asks for a static address from the IP pool of the daemon.
+	IPv4Address string `json:"ipv4_address,omitempty"`
+	// Overrides customise the environment and ns_server config of the node.
+	Overrides *NodeOverridesJSON `json:"overrides,omitempty"`
 }
 
 type CreateClusterSetupJSON struct {
@@ -233,51 +507,156 @@ type CreateClusterSetupJSON struct {
 	Bucket              *helper.BucketOption `json:"bucket"`
 	User                *helper.UserOption   `json:"user"`
 	UseDeveloperPreview bool                 `json:"developer_preview"`
+	Users               []SetupUserJSON      `json:"users,omitempty"`
+}
+
+// SetupUserJSON is an RBAC user to create on a cluster once it is set up.
+type SetupUserJSON struct {
+	Name     string              `json:"name"`
+	Password string              `json:"password"`
+	Roles    []SetupUserRoleJSON `json:"roles"`
+}
+
+// SetupUserRoleJSON is a role such as data_reader, which is scoped to a
+// bucket if one is given.  A bucket of * scopes it to every bucket.
+type SetupUserRoleJSON struct {
+	Role   string `json:"role"`
+	Bucket string `json:"bucket,omitempty"`
 }
 
 type CreateClusterJSON struct {
-	Timeout string                  `json:"timeout"`
-	Nodes   []CreateClusterNodeJSON `json:"nodes"`
-	Setup   CreateClusterNodeJSON   `json:"setup"`
+	Timeout       string                  `json:"timeout"`
+	Nodes         []CreateClusterNodeJSON `json:"nodes"`
+	Setup         *CreateClusterSetupJSON `json:"setup"`
+	Team          string                  `json:"team"`
+	Tags          map[string]string       `json:"tags"`
+	Alias         string                  `json:"alias"`
+	ServerVersion string                  `json:"server_version"`
+	Provider      string                  `json:"provider"`
+	// WaitForReady makes allocation only return once the cluster is ready,
+	// see waitForClusterReady.
+	WaitForReady bool `json:"wait_for_ready"`
+	// ReadyTimeout is how long to wait for the cluster to be ready, such as
+	// 5m.  The daemon's default is used if it is empty.
+	ReadyTimeout string `json:"ready_timeout"`
+	// KeepAlive extends the timeout of the cluster for as long as it is in
+	// use, see keepAliveClusters.
+	KeepAlive bool `json:"keep_alive"`
+	// ContiguousIPs gives the nodes consecutive addresses from the IP pool
+	// of the daemon.
+	ContiguousIPs bool `json:"contiguous_ips"`
+	// ExtraHosts and DNSSearch are added to the overrides of every node,
+	// see NodeOverrides.
+	ExtraHosts map[string]string `json:"extra_hosts,omitempty"`
+	DNSSearch  []string          `json:"dns_search,omitempty"`
+	// Lease ties the cluster to a CI job, so that it is reaped as soon as the
+	// job has finished.
+	Lease *LeaseJSON `json:"lease,omitempty"`
 }
 
-type NewClusterJSON struct {
-	ID string `json:"id"`
+type LeaseJSON struct {
+	// JobToken is an opaque token of the job, which it reports that it has
+	// finished with.
+	JobToken string `json:"job_token"`
+	// CallbackURL is polled to find out whether the job still exists, such
+	// as the JSON API of a Jenkins build.
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
-func HttpCreateCluster(w http.ResponseWriter, r *http.Request) {
+type CompleteLeaseJSON struct {
+	JobToken string `json:"job_token"`
+}
+
+type CompleteLeaseResultJSON struct {
+	Reaped []string `json:"reaped"`
+}
+
+func HttpCompleteLease(w http.ResponseWriter, r *http.Request) {
 	reqCtx, err := getHttpContext(r)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	var reqData CreateClusterJSON
+	var reqData CompleteLeaseJSON
 	err = readJsonRequest(r, &reqData)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
+	reaped, err := completeLease(reqCtx, reqData.JobToken)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, CompleteLeaseResultJSON{
+		Reaped: reaped,
+	})
+}
+
+type NewClusterJSON struct {
+	ID string `json:"id"`
+}
+
+// createCluster allocates a cluster as described by a request, and sets it
+// up if the request asks for it.  It is shared by the REST and gRPC APIs.
+func createCluster(ctx context.Context, reqData CreateClusterJSON) (string, error) {
+	// A single server version can be given to override the version of every
+	// node, which is mostly useful when allocating from a template.
+	if reqData.ServerVersion != "" {
+		for i := range reqData.Nodes {
+			reqData.Nodes[i].ServerVersion = reqData.ServerVersion
+		}
+	}
+
 	clusterOpts := ClusterOptions{
-		Timeout: 1 * time.Hour,
+		Timeout:   getRuntimeConfig().DefaultClusterTimeout,
+		Team:      reqData.Team,
+		Tags:      reqData.Tags,
+		Alias:     reqData.Alias,
+		Provider:  reqData.Provider,
+		KeepAlive: reqData.KeepAlive,
+
+		ContiguousIPs: reqData.ContiguousIPs,
+	}
+	if reqData.Lease != nil {
+		clusterOpts.Lease = &LeaseOptions{
+			JobToken:    reqData.Lease.JobToken,
+			CallbackURL: reqData.Lease.CallbackURL,
+		}
 	}
 
 	if reqData.Timeout != "" {
 		clusterTimeout, err := time.ParseDuration(reqData.Timeout)
 		if err != nil {
-			writeJSONError(w, err)
-			return
+			return "", err
 		}
 
 		clusterOpts.Timeout = clusterTimeout
 	}
 
+	var err error
+	readyTimeout := getRuntimeConfig().DefaultReadyTimeout
+	if reqData.ReadyTimeout != "" {
+		readyTimeout, err = time.ParseDuration(reqData.ReadyTimeout)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	for _, node := range reqData.Nodes {
+		if node.PackageURL != "" {
+			node.ServerVersion, err = registerToyBuild(ctx, node.ServerVersion, node.PackageURL, node.PackageSHA256)
+			if err != nil {
+				return "", err
+			}
+		}
+
 		nodeVersion, err := parseServerVersion(node.ServerVersion)
 		if err != nil {
-			writeJSONError(w, err)
-			return
+			return "", err
 		}
 
 		nodeOpts := NodeOptions{
@@ -285,11 +664,70 @@ func HttpCreateCluster(w http.ResponseWriter, r *http.Request) {
 			Platform:      node.Platform,
 			ServerVersion: node.ServerVersion,
 			VersionInfo:   nodeVersion,
+			IPv4Address:   node.IPv4Address,
 		}
+		if node.Overrides != nil {
+			nodeOpts.Overrides = unjsonifyNodeOverrides(*node.Overrides)
+		}
+		nodeOpts.Overrides = mergeNodeOverrides(nodeOpts.Overrides, reqData.ExtraHosts, reqData.DNSSearch)
 		clusterOpts.Nodes = append(clusterOpts.Nodes, nodeOpts)
 	}
 
-	clusterID, err := allocateCluster(reqCtx, clusterOpts)
+	clusterID, err := allocateCluster(ctx, clusterOpts)
+	if err != nil {
+		return "", err
+	}
+
+	if reqData.Setup != nil {
+		_, err = setupCluster(ctx, clusterID, *reqData.Setup)
+		if err != nil {
+			// Nobody has the ID of the cluster yet, so clean it up rather
+			// than leaving it around until it times out.
+			killErr := killCluster(ctx, clusterID)
+			if killErr != nil {
+				logWarnf(ContextWithClusterID(ctx, clusterID), "Failed to kill cluster after setup failed: %s", killErr)
+			}
+			return "", err
+		}
+	}
+
+	if reqData.WaitForReady {
+		err = waitForClusterReady(ctx, clusterID, reqData.Setup, readyTimeout)
+		if err != nil {
+			killErr := killCluster(ctx, clusterID)
+			if killErr != nil {
+				logWarnf(ContextWithClusterID(ctx, clusterID), "Failed to kill cluster after it was not ready: %s", killErr)
+			}
+			return "", err
+		}
+	}
+
+	return clusterID, nil
+}
+
+func HttpCreateCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData CreateClusterJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if templateName := r.URL.Query().Get("template"); templateName != "" {
+		err = applyClusterTemplate(&reqData, templateName)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	clusterID, err := createCluster(reqCtx, reqData)
 	if err != nil {
 		writeJSONError(w, err)
 		return
@@ -310,7 +748,7 @@ func HttpGetCluster(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clusterID := mux.Vars(r)["cluster_id"]
+	clusterID := clusterIDFromRequest(r)
 
 	cluster, err := getCluster(reqCtx, clusterID)
 	if err != nil {
@@ -323,158 +761,3235 @@ func HttpGetCluster(w http.ResponseWriter, r *http.Request) {
 	writeJsonResponse(w, jsonCluster)
 }
 
-type UpdateClusterJSON struct {
-	Timeout string `json:"timeout"`
+type ClusterStatusNodeJSON struct {
+	Name       string   `json:"name,omitempty"`
+	Hostname   string   `json:"hostname"`
+	Status     string   `json:"status"`
+	Membership string   `json:"membership"`
+	Version    string   `json:"version"`
+	Services   []string `json:"services"`
 }
 
-func HttpGetDockerHost(w http.ResponseWriter, r *http.Request) {
-	hostURI, err := url.Parse(dockerHost)
-	if err != nil {
-		writeJSONError(w, err)
-		return
-	}
+type ClusterStatusBucketJSON struct {
+	Name         string            `json:"name"`
+	Ready        bool              `json:"ready"`
+	NodeStatuses map[string]string `json:"node_statuses"`
+}
 
-	if hostURI.Scheme != "tcp" {
-		writeJSONError(w, errors.New("docker is not configured via tcp and cannot return the docker host"))
-		return
-	}
+type ClusterStatusRebalanceJSON struct {
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+}
 
-	jsonResp := &DockerHostJSON{
-		Hostname: hostURI.Hostname(),
-		Port:     hostURI.Port(),
-	}
-	writeJsonResponse(w, jsonResp)
-	return
+type ClusterStatusJSON struct {
+	Healthy         bool                       `json:"healthy"`
+	Balanced        bool                       `json:"balanced"`
+	Rebalance       ClusterStatusRebalanceJSON `json:"rebalance"`
+	Nodes           []ClusterStatusNodeJSON    `json:"nodes"`
+	Services        map[string][]string        `json:"services"`
+	Buckets         []ClusterStatusBucketJSON  `json:"buckets"`
+	FailedOverNodes []string                   `json:"failed_over_nodes"`
 }
 
-func HttpGetVersion(w http.ResponseWriter, r *http.Request) {
-	jsonResp := &VersionJSON{
-		Version: Version,
+func jsonifyClusterStatus(status *ClusterStatus) ClusterStatusJSON {
+	jsonStatus := ClusterStatusJSON{
+		Healthy:  status.Healthy,
+		Balanced: status.Balanced,
+		Rebalance: ClusterStatusRebalanceJSON{
+			Status:   status.RebalanceStatus,
+			Progress: status.RebalanceProgress,
+			Error:    status.RebalanceError,
+		},
+		Nodes:           make([]ClusterStatusNodeJSON, 0),
+		Services:        status.Services,
+		Buckets:         make([]ClusterStatusBucketJSON, 0),
+		FailedOverNodes: make([]string, 0),
 	}
-	writeJsonResponse(w, jsonResp)
-	return
+	for _, node := range status.Nodes {
+		jsonStatus.Nodes = append(jsonStatus.Nodes, ClusterStatusNodeJSON{
+			Name:       node.Name,
+			Hostname:   node.Hostname,
+			Status:     node.Status,
+			Membership: node.Membership,
+			Version:    node.Version,
+			Services:   node.Services,
+		})
+	}
+	for _, bucket := range status.Buckets {
+		jsonStatus.Buckets = append(jsonStatus.Buckets, ClusterStatusBucketJSON{
+			Name:         bucket.Name,
+			Ready:        bucket.Ready,
+			NodeStatuses: bucket.NodeStatuses,
+		})
+	}
+	jsonStatus.FailedOverNodes = append(jsonStatus.FailedOverNodes, status.FailedOverNodes...)
+
+	return jsonStatus
 }
 
-func HttpSetupCluster(w http.ResponseWriter, r *http.Request) {
+func HttpGetClusterStatus(w http.ResponseWriter, r *http.Request) {
 	reqCtx, err := getHttpContext(r)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	clusterID := mux.Vars(r)["cluster_id"]
+	clusterID := clusterIDFromRequest(r)
 
-	var reqData CreateClusterSetupJSON
-	err = readJsonRequest(r, &reqData)
+	status, err := getClusterStatus(reqCtx, clusterID)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	cluster, err := getCluster(reqCtx, clusterID)
-	if err != nil {
-		writeJSONError(w, err)
-		return
-	}
-	if len(cluster.Nodes) != len(reqData.Services) {
-		writeJSONError(w, errors.New("services does not map to number of nodes"))
-		return
-	}
+	writeJsonResponse(w, jsonifyClusterStatus(status))
+}
 
-	epnode, err := SetupCluster(&ClusterSetupOptions{
-		Nodes: cluster.Nodes,
-		Conf:  reqData,
-	})
-	if err != nil {
-		writeJSONError(w, err)
-		return
-	}
+type ResourceUsageJSON struct {
+	CPUPercent   float64 `json:"cpu_percent"`
+	MemoryUsage  uint64  `json:"memory_usage"`
+	MemoryLimit  uint64  `json:"memory_limit"`
+	NetworkRx    uint64  `json:"network_rx"`
+	NetworkTx    uint64  `json:"network_tx"`
+	BlockRead    uint64  `json:"block_read"`
+	BlockWritten uint64  `json:"block_written"`
+}
 
-	cluster.EntryPoint = epnode
+type NodeStatsJSON struct {
+	Name  string            `json:"name"`
+	Usage ResourceUsageJSON `json:"usage"`
+}
 
-	jsonCluster := jsonifyCluster(cluster)
-	writeJsonResponse(w, jsonCluster)
-	return
+type ClusterStatsJSON struct {
+	ID    string            `json:"id"`
+	Owner string            `json:"owner"`
+	Nodes []NodeStatsJSON   `json:"nodes"`
+	Total ResourceUsageJSON `json:"total"`
 }
 
-func HttpUpdateCluster(w http.ResponseWriter, r *http.Request) {
+type OwnerStatsJSON struct {
+	Owner    string            `json:"owner"`
+	Clusters int               `json:"clusters"`
+	Nodes    int               `json:"nodes"`
+	Total    ResourceUsageJSON `json:"total"`
+}
+
+func jsonifyResourceUsage(usage ResourceUsage) ResourceUsageJSON {
+	return ResourceUsageJSON{
+		CPUPercent:   usage.CPUPercent,
+		MemoryUsage:  usage.MemoryUsage,
+		MemoryLimit:  usage.MemoryLimit,
+		NetworkRx:    usage.NetworkRx,
+		NetworkTx:    usage.NetworkTx,
+		BlockRead:    usage.BlockRead,
+		BlockWritten: usage.BlockWritten,
+	}
+}
+
+func HttpGetClusterStats(w http.ResponseWriter, r *http.Request) {
 	reqCtx, err := getHttpContext(r)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	clusterID := mux.Vars(r)["cluster_id"]
+	clusterID := clusterIDFromRequest(r)
 
-	var reqData UpdateClusterJSON
-	err = readJsonRequest(r, &reqData)
+	stats, err := getClusterStats(reqCtx, clusterID)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	if reqData.Timeout != "" {
-		newTimeout, err := time.ParseDuration(reqData.Timeout)
-		if err != nil {
-			writeJSONError(w, err)
-			return
-		}
-
-		refreshCluster(reqCtx, clusterID, newTimeout)
-
-		w.WriteHeader(200)
-		return
+	jsonStats := ClusterStatsJSON{
+		ID:    stats.ClusterID,
+		Owner: stats.Owner,
+		Nodes: make([]NodeStatsJSON, 0),
+		Total: jsonifyResourceUsage(stats.Total),
+	}
+	for _, node := range stats.Nodes {
+		jsonStats.Nodes = append(jsonStats.Nodes, NodeStatsJSON{
+			Name:  node.Name,
+			Usage: jsonifyResourceUsage(node.Usage),
+		})
 	}
 
-	writeJSONError(w, errors.New("not sure what you wanted to do"))
+	writeJsonResponse(w, jsonStats)
 }
 
-func HttpDeleteCluster(w http.ResponseWriter, r *http.Request) {
+func HttpGetStatsByOwner(w http.ResponseWriter, r *http.Request) {
 	reqCtx, err := getHttpContext(r)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	clusterID := mux.Vars(r)["cluster_id"]
-
-	err = killCluster(reqCtx, clusterID)
+	allStats, err := getStatsByOwner(reqCtx)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	w.WriteHeader(200)
+	jsonStats := make([]OwnerStatsJSON, 0)
+	for _, stats := range allStats {
+		jsonStats = append(jsonStats, OwnerStatsJSON{
+			Owner:    stats.Owner,
+			Clusters: stats.Clusters,
+			Nodes:    stats.Nodes,
+			Total:    jsonifyResourceUsage(stats.Total),
+		})
+	}
+
+	writeJsonResponse(w, jsonStats)
 }
 
-type AddBucketJSON struct {
-	Name         string `json:"name"`
-	StorageMode  string `json:"storage_mode"`
-	RamQuota     int    `json:"ram_quota"`
-	UseHostname  bool   `json:"use_hostname"`
-	ReplicaCount int    `json:"replica_count"`
-	BucketType   string `json:"bucket_type"`
+type OwnerOverviewJSON struct {
+	Owner    string `json:"owner"`
+	Clusters int    `json:"clusters"`
+	Nodes    int    `json:"nodes"`
 }
 
-func HttpAddBucket(w http.ResponseWriter, r *http.Request) {
-	reqCtx, err := getHttpContext(r)
+type VersionOverviewJSON struct {
+	ServerVersion string `json:"server_version"`
+	Nodes         int    `json:"nodes"`
+}
+
+type ExpiringClusterJSON struct {
+	ClusterID string `json:"cluster_id"`
+	Owner     string `json:"owner"`
+	Timeout   string `json:"timeout"`
+}
+
+type HostOverviewJSON struct {
+	Name           string `json:"name"`
+	Error          string `json:"error,omitempty"`
+	Nodes          int    `json:"nodes"`
+	CPUs           int    `json:"cpus"`
+	MemoryTotal    uint64 `json:"memory_total"`
+	MemoryUsed     uint64 `json:"memory_used"`
+	MemoryFree     uint64 `json:"memory_free"`
+	DiskUsed       int64  `json:"disk_used"`
+	Images         int    `json:"images"`
+	ImageCacheSize int64  `json:"image_cache_size"`
+}
+
+type WarmPoolOverviewJSON struct {
+	ServerVersion string `json:"server_version"`
+	Size          int    `json:"size"`
+	Idle          int    `json:"idle"`
+}
+
+type OverviewJSON struct {
+	Clusters        int                    `json:"clusters"`
+	Nodes           int                    `json:"nodes"`
+	ClustersByOwner []OwnerOverviewJSON    `json:"clusters_by_owner"`
+	NodesByVersion  []VersionOverviewJSON  `json:"nodes_by_version"`
+	ExpiringSoon    []ExpiringClusterJSON  `json:"expiring_soon"`
+	Hosts           []HostOverviewJSON     `json:"hosts"`
+	ImageCacheSize  int64                  `json:"image_cache_size"`
+	WarmPool        []WarmPoolOverviewJSON `json:"warm_pool"`
+}
+
+func HttpGetOverview(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	overview, err := getOverview(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonOverview := OverviewJSON{
+		Clusters:        overview.Clusters,
+		Nodes:           overview.Nodes,
+		ClustersByOwner: make([]OwnerOverviewJSON, 0),
+		NodesByVersion:  make([]VersionOverviewJSON, 0),
+		ExpiringSoon:    make([]ExpiringClusterJSON, 0),
+		Hosts:           make([]HostOverviewJSON, 0),
+		ImageCacheSize:  overview.ImageCacheSize,
+		WarmPool:        make([]WarmPoolOverviewJSON, 0),
+	}
+	for _, owner := range overview.ClustersByOwner {
+		jsonOverview.ClustersByOwner = append(jsonOverview.ClustersByOwner, OwnerOverviewJSON{
+			Owner:    owner.Owner,
+			Clusters: owner.Clusters,
+			Nodes:    owner.Nodes,
+		})
+	}
+	for _, version := range overview.NodesByVersion {
+		jsonOverview.NodesByVersion = append(jsonOverview.NodesByVersion, VersionOverviewJSON{
+			ServerVersion: version.ServerVersion,
+			Nodes:         version.Nodes,
+		})
+	}
+	for _, cluster := range overview.ExpiringSoon {
+		jsonOverview.ExpiringSoon = append(jsonOverview.ExpiringSoon, ExpiringClusterJSON{
+			ClusterID: cluster.ClusterID,
+			Owner:     cluster.Owner,
+			Timeout:   cluster.Timeout.Format(time.RFC3339),
+		})
+	}
+	for _, host := range overview.Hosts {
+		jsonHost := HostOverviewJSON{
+			Name:           host.Name,
+			Error:          host.Error,
+			Nodes:          host.Nodes,
+			CPUs:           host.CPUs,
+			MemoryTotal:    host.MemoryTotal,
+			MemoryUsed:     host.MemoryUsed,
+			DiskUsed:       host.DiskUsed,
+			Images:         host.Images,
+			ImageCacheSize: host.ImageCacheSize,
+		}
+		if host.MemoryTotal > host.MemoryUsed {
+			jsonHost.MemoryFree = host.MemoryTotal - host.MemoryUsed
+		}
+		jsonOverview.Hosts = append(jsonOverview.Hosts, jsonHost)
+	}
+	for _, pool := range overview.WarmPool {
+		jsonOverview.WarmPool = append(jsonOverview.WarmPool, WarmPoolOverviewJSON{
+			ServerVersion: pool.ServerVersion,
+			Size:          pool.Size,
+			Idle:          pool.Idle,
+		})
+	}
+
+	writeJsonResponse(w, jsonOverview)
+}
+
+type UpdateClusterJSON struct {
+	Timeout   string            `json:"timeout"`
+	Tags      map[string]string `json:"tags"`
+	Alias     *string           `json:"alias"`
+	KeepAlive *bool             `json:"keep_alive"`
+}
+
+func HttpGetDockerHost(w http.ResponseWriter, r *http.Request) {
+	hostAddress := dockerHost
+
+	// Clusters can be on any of the docker hosts, so callers which want to
+	// reach the nodes of a cluster directly need to ask for its host.
+	if clusterRef := r.URL.Query().Get("cluster"); clusterRef != "" {
+		reqCtx, err := getHttpContext(r)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+
+		cluster, err := getCluster(reqCtx, resolveClusterID(clusterRef))
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+
+		err = requireDockerCluster(cluster)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+
+		host := getDockerHost(cluster.Host)
+		if host == nil {
+			writeJSONError(w, errors.New("docker host of the cluster is not connected"))
+			return
+		}
+		hostAddress = host.Address
+	}
+
+	hostURI, err := url.Parse(hostAddress)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if hostURI.Scheme != "tcp" {
+		writeJSONError(w, errors.New("docker is not configured via tcp and cannot return the docker host"))
+		return
+	}
+
+	jsonResp := &DockerHostJSON{
+		Hostname: hostURI.Hostname(),
+		Port:     hostURI.Port(),
+	}
+	writeJsonResponse(w, jsonResp)
+	return
+}
+
+func HttpGetVersion(w http.ResponseWriter, r *http.Request) {
+	jsonResp := &VersionJSON{
+		Version: Version,
+	}
+	writeJsonResponse(w, jsonResp)
+	return
+}
+
+func HttpSetupCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData CreateClusterSetupJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	cluster, err := setupCluster(reqCtx, clusterID, reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonCluster := jsonifyCluster(cluster)
+	writeJsonResponse(w, jsonCluster)
+	return
+}
+
+func HttpUpdateCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData UpdateClusterJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if reqData.Timeout == "" && reqData.Tags == nil && reqData.Alias == nil && reqData.KeepAlive == nil {
+		writeJSONError(w, errors.New("not sure what you wanted to do"))
+		return
+	}
+
+	if reqData.Timeout != "" {
+		newTimeout, err := time.ParseDuration(reqData.Timeout)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+
+		err = refreshCluster(reqCtx, clusterID, newTimeout)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	if reqData.Tags != nil {
+		err = setClusterTags(reqCtx, clusterID, reqData.Tags)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	if reqData.Alias != nil {
+		err = setClusterAlias(reqCtx, clusterID, *reqData.Alias)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	if reqData.KeepAlive != nil {
+		err = setClusterKeepAlive(reqCtx, clusterID, *reqData.KeepAlive)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+type TransferClusterJSON struct {
+	Owner string `json:"owner"`
+}
+
+func HttpTransferCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData TransferClusterJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = transferCluster(reqCtx, clusterID, reqData.Owner)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type ShareClusterJSON struct {
+	Users []string `json:"users"`
+}
+
+func HttpShareCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData ShareClusterJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = shareCluster(reqCtx, clusterID, reqData.Users)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type ClusterTeamJSON struct {
+	Team string `json:"team"`
+}
+
+func HttpSetClusterTeam(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData ClusterTeamJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = setClusterTeam(reqCtx, clusterID, reqData.Team)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpDeleteCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = killCluster(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpDeleteAllClusters(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !ContextIsAdmin(reqCtx) {
+		writeJSONError(w, errors.New("only admins can kill all clusters"))
+		return
+	}
+
+	err = killAllClusters(NewContext(reqCtx, ContextUser(reqCtx), true))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type RefreshAllJSON struct {
+	Timeout string `json:"timeout"`
+}
+
+type RefreshAllResultJSON struct {
+	Refreshed []string          `json:"refreshed"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+func HttpRefreshAllClusters(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData RefreshAllJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if reqData.Timeout == "" {
+		writeJSONError(w, errors.New("must specify a timeout"))
+		return
+	}
+
+	newTimeout, err := time.ParseDuration(reqData.Timeout)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	result, err := refreshAllClusters(reqCtx, newTimeout)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonResult := RefreshAllResultJSON{
+		Refreshed: make([]string, 0),
+	}
+	jsonResult.Refreshed = append(jsonResult.Refreshed, result.Refreshed...)
+	for clusterID, err := range result.Failed {
+		if jsonResult.Failed == nil {
+			jsonResult.Failed = make(map[string]string)
+		}
+		jsonResult.Failed[clusterID] = err.Error()
+	}
+
+	writeJsonResponse(w, jsonResult)
+}
+
+// streamWriter flushes every write straight to the client so that long lived
+// streams are delivered as they are produced.
+type streamWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.written {
+		sw.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		sw.w.WriteHeader(200)
+		sw.written = true
+	}
+
+	n, err := sw.w.Write(p)
+	if flusher, ok := sw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+func HttpGetNodeLogs(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	opts := NodeLogsOptions{
+		Follow: r.URL.Query().Get("follow") == "true",
+		File:   r.URL.Query().Get("file"),
+	}
+
+	if tailParam := r.URL.Query().Get("tail"); tailParam != "" {
+		tail, err := strconv.Atoi(tailParam)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		opts.Tail = tail
+	}
+
+	out := &streamWriter{w: w}
+	err = streamNodeLogs(reqCtx, clusterID, nodeRef, opts, out)
+	if err != nil {
+		if out.written {
+			logErrorf(reqCtx, "Failed while streaming logs: %s", err)
+			return
+		}
+		writeJSONError(w, err)
+		return
+	}
+
+	if !out.written {
+		w.WriteHeader(200)
+	}
+}
+
+func HttpStartCollectInfo(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	collection, err := startCollectInfo(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, collection)
+}
+
+func HttpGetCollectInfo(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	collectionID := mux.Vars(r)["collection_id"]
+
+	collection, err := getCollectInfo(reqCtx, collectionID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, collection)
+}
+
+func HttpDownloadCollectInfo(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	collectionID := mux.Vars(r)["collection_id"]
+	nodeName := mux.Vars(r)["node"]
+
+	zipFile, err := openCollectInfoFile(reqCtx, collectionID, nodeName)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	defer zipFile.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"cbcollect-%s-%s.zip\"", collectionID, nodeName))
+	http.ServeContent(w, r, "", time.Time{}, zipFile)
+}
+
+func HttpDownloadBundle(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	files, err := getReproductionBundle(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"bundle-%s-%s.zip\"", clusterID, time.Now().Format("20060102-150405")))
+	err = writeBundleZip(clusterID, files, w)
+	if err != nil {
+		logErrorf(reqCtx, "Failed to write reproduction bundle: %s", err)
+	}
+}
+
+type LoadJSON struct {
+	Bucket     string `json:"bucket"`
+	Scope      string `json:"scope,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	NumItems   int    `json:"num_items"`
+	// DocSize is the size of each document in bytes, the loader's default
+	// range of sizes is used if it is 0.
+	DocSize int  `json:"doc_size,omitempty"`
+	Threads int  `json:"threads,omitempty"`
+	JSON    bool `json:"json"`
+	// Duration is how long to keep reading and writing documents for, such as
+	// 10m.  The documents are only written once if it is empty.
+	Duration string `json:"duration,omitempty"`
+}
+
+func HttpStartLoad(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData LoadJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	job, err := startLoad(reqCtx, clusterID, LoadOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+func HttpGetJob(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jobID := mux.Vars(r)["job_id"]
+
+	job, err := getJob(reqCtx, jobID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+type BackupJSON struct {
+	Repository string `json:"repository"`
+	// Buckets limits the backup to some buckets, every bucket is backed up if
+	// it is empty.
+	Buckets []string `json:"buckets,omitempty"`
+}
+
+type RestoreJSON struct {
+	Repository string `json:"repository"`
+	// Backup is the name of a backup of the repository to restore, all of
+	// the backups in it are restored if it is empty.
+	Backup            string `json:"backup,omitempty"`
+	AutoCreateBuckets bool   `json:"auto_create_buckets"`
+}
+
+func HttpStartBackup(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData BackupJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	job, err := startBackup(reqCtx, clusterID, BackupOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+func HttpStartRestore(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData RestoreJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	job, err := startRestore(reqCtx, clusterID, RestoreOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+func HttpGetBackupRepositories(w http.ResponseWriter, r *http.Request) {
+	_, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	repos, err := getBackupRepositories()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if repos == nil {
+		repos = make([]BackupRepository, 0)
+	}
+	writeJsonResponse(w, repos)
+}
+
+func HttpDeleteBackupRepository(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteBackupRepository(reqCtx, mux.Vars(r)["repository"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type ExecJSON struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type ExecResultJSON struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func HttpExecOnNode(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData ExecJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	result, err := execOnNode(reqCtx, clusterID, nodeRef, ExecOptions{
+		Command: reqData.Command,
+		Args:    reqData.Args,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, ExecResultJSON{
+		Stdout:   result.Stdout,
+		Stderr:   result.Stderr,
+		ExitCode: result.ExitCode,
+	})
+}
+
+type ClockSkewJSON struct {
+	// Offset is how far the clock of the node is shifted, such as -90s or
+	// 8760h.  Clocks are put back by an offset of 0.
+	Offset string `json:"offset"`
+}
+
+func HttpSetClockSkew(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData ClockSkewJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	offset, err := time.ParseDuration(reqData.Offset)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = setClockSkew(reqCtx, clusterID, nodeRef, offset)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpGetClockSkew(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	offset, err := getClockSkew(reqCtx, clusterID, nodeRef)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, ClockSkewJSON{
+		Offset: offset.String(),
+	})
+}
+
+func HttpRestoreClock(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	err = setClockSkew(reqCtx, clusterID, nodeRef, 0)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type LogEntryJSON struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Message   string `json:"msg"`
+	RequestID string `json:"request_id,omitempty"`
+	User      string `json:"user,omitempty"`
+	ClusterID string `json:"cluster_id,omitempty"`
+	Node      string `json:"node,omitempty"`
+}
+
+func HttpGetLogs(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	limit := 1000
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	entries, err := getRecentLogs(reqCtx, resolveClusterID(r.URL.Query().Get("cluster_id")), limit)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonEntries := make([]LogEntryJSON, 0)
+	for _, entry := range entries {
+		jsonEntries = append(jsonEntries, LogEntryJSON{
+			Time:      entry.Time.Format(time.RFC3339Nano),
+			Level:     entry.Level.String(),
+			Message:   entry.Message,
+			RequestID: entry.RequestID,
+			User:      entry.User,
+			ClusterID: entry.ClusterID,
+			Node:      entry.Node,
+		})
+	}
+
+	writeJsonResponse(w, jsonEntries)
+}
+
+func HttpHibernateCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = hibernateCluster(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpWakeCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = wakeCluster(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type AddBucketJSON struct {
+	Name         string `json:"name"`
+	StorageMode  string `json:"storage_mode"`
+	RamQuota     int    `json:"ram_quota"`
+	UseHostname  bool   `json:"use_hostname"`
+	ReplicaCount int    `json:"replica_count"`
+	BucketType   string `json:"bucket_type"`
+	// Scopes are created once the bucket exists, and waited for.
+	Scopes []CollectionScopeJSON `json:"scopes,omitempty"`
+}
+
+func HttpAddBucket(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddBucketJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = addBucket(reqCtx, clusterID, AddBucketOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type CollectionJSON struct {
+	Name   string `json:"name"`
+	MaxTTL int    `json:"max_ttl,omitempty"`
+}
+
+type CollectionScopeJSON struct {
+	Name        string           `json:"name"`
+	Collections []CollectionJSON `json:"collections"`
+}
+
+type AddCollectionsJSON struct {
+	Bucket string                `json:"bucket"`
+	Scopes []CollectionScopeJSON `json:"scopes"`
+	// Wait waits for the scopes and collections to be visible on every node.
+	Wait bool `json:"wait"`
+}
+
+func HttpAddCollections(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddCollectionsJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = addCollections(reqCtx, clusterID, AddCollectionsOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type CreateIndexJSON struct {
+	// Name may be left empty for primary indexes, which are then #primary.
+	Name       string   `json:"name"`
+	Bucket     string   `json:"bucket"`
+	Scope      string   `json:"scope,omitempty"`
+	Collection string   `json:"collection,omitempty"`
+	Primary    bool     `json:"primary"`
+	Fields     []string `json:"fields"`
+	Where      string   `json:"where,omitempty"`
+	// NumReplicas is the number of replicas of the index, which needs at
+	// least that many more index nodes.
+	NumReplicas int `json:"num_replicas,omitempty"`
+}
+
+type AddIndexesJSON struct {
+	Indexes []CreateIndexJSON `json:"indexes"`
+	// Wait waits for every index to be built and online.
+	Wait bool `json:"wait"`
+}
+
+func HttpAddIndexes(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddIndexesJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = addIndexes(reqCtx, clusterID, AddIndexesOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type AnalyticsLinkJSON struct {
+	Name string `json:"name"`
+	// RemoteCluster is the ID or alias of another cluster to link to, in
+	// which case the hostname and credentials don't need to be given.
+	RemoteCluster string `json:"remote_cluster,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+}
+
+type AnalyticsDatasetJSON struct {
+	Name       string `json:"name"`
+	Bucket     string `json:"bucket"`
+	Scope      string `json:"scope,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Where      string `json:"where,omitempty"`
+	// Link is the link which the bucket is on, the cluster itself if empty.
+	Link string `json:"link,omitempty"`
+}
+
+type AddAnalyticsJSON struct {
+	Links    []AnalyticsLinkJSON    `json:"links"`
+	Datasets []AnalyticsDatasetJSON `json:"datasets"`
+}
+
+func HttpAddAnalytics(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddAnalyticsJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = addAnalytics(reqCtx, clusterID, AddAnalyticsOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type EventingFunctionJSON struct {
+	Name string `json:"name"`
+	// Definition is the function as exported from the UI, including its code
+	// and its source and metadata keyspaces.
+	Definition json.RawMessage `json:"definition"`
+}
+
+type AddEventingFunctionsJSON struct {
+	Functions []EventingFunctionJSON `json:"functions"`
+	// Wait waits for every function to be deployed.
+	Wait bool `json:"wait"`
+}
+
+func HttpAddEventingFunctions(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddEventingFunctionsJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = addEventingFunctions(reqCtx, clusterID, AddEventingFunctionsOptions{
+		Conf: reqData,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type SetupClientCertAuthJSON struct {
+	UserName  string `json:"user"`
+	UserEmail string `json:"email"`
+}
+
+type CertAuthResultJSON struct {
+	CACert     []byte `json:"cacert"`
+	ClientKey  []byte `json:"client_key"`
+	ClientCert []byte `json:"client_cert"`
+}
+
+func HttpSetupClientCertAuth(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData SetupClientCertAuthJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	cluster, err := getCluster(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	certData, err := SetupCertAuth(SetupClientCertAuthOptions{
+		Nodes:       cluster.Nodes,
+		Conf:        reqData,
+		UseHostname: cluster.UseHostname,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, CertAuthResultJSON{
+		CACert:     certData.CACert,
+		ClientKey:  certData.ClientKey,
+		ClientCert: certData.ClientCert,
+	})
+	return
+}
+
+type AlternateAddressJSON struct {
+	// Node is the name, container name or container ID of the node.
+	Node     string `json:"node"`
+	Hostname string `json:"hostname"`
+	// Ports maps services, such as kv or mgmtSSL, to their external port.
+	// Services without one are reached on their usual port.
+	Ports map[string]int `json:"ports,omitempty"`
+}
+
+type SetAlternateAddressesJSON struct {
+	Nodes []AlternateAddressJSON `json:"nodes"`
+}
+
+func HttpSetAlternateAddresses(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData SetAlternateAddressesJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var addresses []AlternateAddress
+	for _, node := range reqData.Nodes {
+		addresses = append(addresses, AlternateAddress{
+			Node:     node.Node,
+			Hostname: node.Hostname,
+			Ports:    node.Ports,
+		})
+	}
+
+	err = setAlternateAddresses(reqCtx, clusterID, addresses)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpClearAlternateAddresses(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = clearAlternateAddresses(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type LDAPUserJSON struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// Roles are given to the user directly, users without any get them from
+	// their groups.
+	Roles []SetupUserRoleJSON `json:"roles,omitempty"`
+}
+
+// LDAPGroupJSON is an LDAP group, whose members are given its roles.
+type LDAPGroupJSON struct {
+	Name    string              `json:"name"`
+	Members []string            `json:"members"`
+	Roles   []SetupUserRoleJSON `json:"roles"`
+}
+
+type AddLDAPFixtureJSON struct {
+	Users  []LDAPUserJSON  `json:"users"`
+	Groups []LDAPGroupJSON `json:"groups,omitempty"`
+}
+
+type LDAPFixtureJSON struct {
+	ContainerID  string `json:"container_id"`
+	Address      string `json:"address"`
+	Port         int    `json:"port"`
+	BaseDN       string `json:"base_dn"`
+	UsersDN      string `json:"users_dn"`
+	GroupsDN     string `json:"groups_dn"`
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+}
+
+func jsonifyLDAPFixture(fixture *LDAPFixture) LDAPFixtureJSON {
+	return LDAPFixtureJSON{
+		ContainerID:  fixture.ContainerID,
+		Address:      fixture.Address,
+		Port:         ldapPort,
+		BaseDN:       ldapBaseDN,
+		UsersDN:      ldapUsersDN,
+		GroupsDN:     ldapGroupsDN,
+		BindDN:       ldapAdminDN,
+		BindPassword: fixture.BindPassword,
+	}
+}
+
+func HttpAddLDAPFixture(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddLDAPFixtureJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	fixture, err := addLDAPFixture(reqCtx, clusterID, reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyLDAPFixture(fixture))
+}
+
+func HttpGetLDAPFixture(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	fixture, err := getLDAPFixture(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyLDAPFixture(fixture))
+}
+
+func HttpRemoveLDAPFixture(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = removeLDAPFixture(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type AddHelperContainerJSON struct {
+	// Name is what the helper is known by, it is also part of its hostname.
+	Name       string            `json:"name"`
+	Image      string            `json:"image"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+type HelperContainerJSON struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"container_id"`
+	Image       string `json:"image"`
+	State       string `json:"state"`
+	IPv4Address string `json:"ipv4_address"`
+	Hostname    string `json:"hostname"`
+}
+
+func jsonifyHelperContainer(helperContainer *HelperContainer) HelperContainerJSON {
+	return HelperContainerJSON{
+		Name:        helperContainer.Name,
+		ContainerID: helperContainer.ContainerID,
+		Image:       helperContainer.Image,
+		State:       helperContainer.State,
+		IPv4Address: helperContainer.IPv4Address,
+		Hostname:    helperContainer.Hostname,
+	}
+}
+
+func HttpAddHelperContainer(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddHelperContainerJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	helperContainer, err := addHelperContainer(reqCtx, clusterID, HelperContainerOptions{
+		Name:       reqData.Name,
+		Image:      reqData.Image,
+		Entrypoint: reqData.Entrypoint,
+		Cmd:        reqData.Cmd,
+		Env:        reqData.Env,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyHelperContainer(helperContainer))
+}
+
+func HttpGetHelperContainers(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	helperContainers, err := getHelperContainers(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonHelpers := make([]HelperContainerJSON, 0)
+	for _, helperContainer := range helperContainers {
+		jsonHelpers = append(jsonHelpers, jsonifyHelperContainer(helperContainer))
+	}
+
+	writeJsonResponse(w, jsonHelpers)
+}
+
+func HttpRemoveHelperContainer(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = removeHelperContainer(reqCtx, clusterID, mux.Vars(r)["helper"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type AddToxiproxyJSON struct {
+	// Ports are the couchbase ports which are proxied on every node, 8091
+	// and 11210 if empty.
+	Ports []int `json:"ports,omitempty"`
+	// AlternateAddresses makes the nodes advertise the proxies as their
+	// alternate addresses, for clients using the external network.
+	AlternateAddresses bool `json:"alternate_addresses,omitempty"`
+}
+
+type ToxicJSON struct {
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Stream     string         `json:"stream"`
+	Toxicity   float64        `json:"toxicity"`
+	Attributes map[string]int `json:"attributes,omitempty"`
+}
+
+type ToxicProxyJSON struct {
+	Node     string      `json:"node"`
+	Port     int         `json:"port"`
+	Listen   string      `json:"listen"`
+	Upstream string      `json:"upstream"`
+	Toxics   []ToxicJSON `json:"toxics"`
+}
+
+type ToxiproxyJSON struct {
+	ContainerID        string           `json:"container_id"`
+	Address            string           `json:"address"`
+	APIPort            int              `json:"api_port"`
+	AlternateAddresses bool             `json:"alternate_addresses"`
+	Proxies            []ToxicProxyJSON `json:"proxies"`
+}
+
+// AddToxicJSON adds a toxic to the proxy in front of a port of a node, or to
+// every proxy of the node if no port is given.
+type AddToxicJSON struct {
+	Port       int            `json:"port,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Type       string         `json:"type"`
+	Stream     string         `json:"stream,omitempty"`
+	Toxicity   float64        `json:"toxicity,omitempty"`
+	Attributes map[string]int `json:"attributes,omitempty"`
+}
+
+func jsonifyToxic(toxic Toxic) ToxicJSON {
+	return ToxicJSON{
+		Name:       toxic.Name,
+		Type:       toxic.Type,
+		Stream:     toxic.Stream,
+		Toxicity:   toxic.Toxicity,
+		Attributes: toxic.Attributes,
+	}
+}
+
+func jsonifyToxiproxy(fixture *ToxiproxyFixture) ToxiproxyJSON {
+	jsonFixture := ToxiproxyJSON{
+		ContainerID:        fixture.ContainerID,
+		Address:            fixture.Address,
+		APIPort:            toxiproxyAPIPort,
+		AlternateAddresses: fixture.AlternateAddresses,
+		Proxies:            make([]ToxicProxyJSON, 0),
+	}
+	for _, proxy := range fixture.Proxies {
+		jsonProxy := ToxicProxyJSON{
+			Node:     proxy.Node,
+			Port:     proxy.Port,
+			Listen:   proxy.Listen,
+			Upstream: proxy.Upstream,
+			Toxics:   make([]ToxicJSON, 0),
+		}
+		for _, toxic := range proxy.Toxics {
+			jsonProxy.Toxics = append(jsonProxy.Toxics, jsonifyToxic(toxic))
+		}
+		jsonFixture.Proxies = append(jsonFixture.Proxies, jsonProxy)
+	}
+	return jsonFixture
+}
+
+func HttpAddToxiproxy(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData AddToxiproxyJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	fixture, err := addToxiproxy(reqCtx, clusterID, ToxiproxyOptions{
+		Ports:              reqData.Ports,
+		AlternateAddresses: reqData.AlternateAddresses,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyToxiproxy(fixture))
+}
+
+func HttpGetToxiproxy(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	fixture, err := getToxiproxy(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyToxiproxy(fixture))
+}
+
+func HttpRemoveToxiproxy(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	err = removeToxiproxy(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpAddToxic(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData AddToxicJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	toxic, err := addToxic(reqCtx, clusterID, nodeRef, ToxicOptions{
+		Port:       reqData.Port,
+		Name:       reqData.Name,
+		Type:       reqData.Type,
+		Stream:     reqData.Stream,
+		Toxicity:   reqData.Toxicity,
+		Attributes: reqData.Attributes,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyToxic(*toxic))
+}
+
+func HttpRemoveToxic(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	port, err := parseIntParam(r.URL.Query(), "port", 0)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = removeToxic(reqCtx, clusterID, nodeRef, mux.Vars(r)["toxic"], port)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type BlockPortsJSON struct {
+	Ports []int `json:"ports"`
+	// Action is drop to silently drop connections, or reject to refuse
+	// them.  Connections are dropped if it is empty.
+	Action string `json:"action,omitempty"`
+	// Duration is how long the ports are blocked for, 15m if empty.
+	Duration string `json:"duration,omitempty"`
+}
+
+type FirewallRuleJSON struct {
+	Node      string `json:"node"`
+	Port      int    `json:"port"`
+	Action    string `json:"action"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+func jsonifyFirewallRules(rules []FirewallRule) []FirewallRuleJSON {
+	jsonRules := make([]FirewallRuleJSON, 0)
+	for _, rule := range rules {
+		jsonRules = append(jsonRules, FirewallRuleJSON{
+			Node:      rule.Node,
+			Port:      rule.Port,
+			Action:    rule.Action,
+			CreatedAt: rule.CreatedAt.Format(time.RFC3339),
+			ExpiresAt: rule.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+	return jsonRules
+}
+
+func HttpBlockPorts(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData BlockPortsJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var duration time.Duration
+	if reqData.Duration != "" {
+		duration, err = time.ParseDuration(reqData.Duration)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	rules, err := blockPorts(reqCtx, clusterID, nodeRef, BlockPortsOptions{
+		Ports:    reqData.Ports,
+		Action:   reqData.Action,
+		Duration: duration,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyFirewallRules(rules))
+}
+
+func HttpUnblockPorts(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	port, err := parseIntParam(r.URL.Query(), "port", 0)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = unblockPorts(reqCtx, clusterID, nodeRef, port)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpGetFirewallRules(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	rules, err := getFirewallRules(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyFirewallRules(rules))
+}
+
+type ReplaceNodeJSON struct {
+	// ServerVersion is the version of the new node, it is the version the
+	// old node was created with if empty.
+	ServerVersion string `json:"server_version,omitempty"`
+}
+
+func HttpReplaceNode(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData ReplaceNodeJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	node, err := replaceNode(reqCtx, clusterID, nodeRef, ReplaceNodeOptions{
+		ServerVersion: reqData.ServerVersion,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyNode(node))
+}
+
+type RebalanceJSON struct {
+	// EjectNodes are the names or IDs of nodes to remove from the cluster,
+	// failed over nodes which aren't being recovered are always removed.
+	EjectNodes []string `json:"eject_nodes,omitempty"`
+}
+
+type FailoverJSON struct {
+	Graceful bool `json:"graceful"`
+}
+
+type RecoveryJSON struct {
+	// RecoveryType is either full or delta.
+	RecoveryType string `json:"recovery_type"`
+}
+
+func HttpStartRebalance(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	var reqData RebalanceJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	job, err := startRebalance(reqCtx, clusterID, RebalanceOptions{
+		EjectNodes: reqData.EjectNodes,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+func HttpStopRebalance(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+
+	job, err := stopRebalance(reqCtx, clusterID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+func HttpFailoverNode(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData FailoverJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	job, err := startFailover(reqCtx, clusterID, FailoverOptions{
+		Node:     nodeRef,
+		Graceful: reqData.Graceful,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+func HttpRecoverNode(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	clusterID := clusterIDFromRequest(r)
+	nodeRef := mux.Vars(r)["node"]
+
+	var reqData RecoveryJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	job, err := startRecovery(reqCtx, clusterID, RecoveryOptions{
+		Node:         nodeRef,
+		RecoveryType: reqData.RecoveryType,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, job)
+}
+
+type APITokenJSON struct {
+	User      string `json:"user"`
+	CreatedAt string `json:"created_at"`
+	Token     string `json:"token,omitempty"`
+}
+
+type IssueTokenJSON struct {
+	User string `json:"user"`
+}
+
+func jsonifyAPIToken(token *APIToken) APITokenJSON {
+	return APITokenJSON{
+		User:      token.User,
+		CreatedAt: token.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func HttpGetTokens(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !ContextIsAdmin(reqCtx) {
+		writeJSONError(w, errors.New("only admins can list API tokens"))
+		return
+	}
+
+	tokens, err := getAPITokens()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonTokens := make([]APITokenJSON, 0)
+	for _, token := range tokens {
+		jsonTokens = append(jsonTokens, jsonifyAPIToken(&token))
+	}
+
+	writeJsonResponse(w, jsonTokens)
+}
+
+func HttpIssueToken(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData IssueTokenJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	token, apiToken, err := issueAPIToken(reqCtx, reqData.User)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	// This is the only time the token itself is ever returned
+	jsonToken := jsonifyAPIToken(apiToken)
+	jsonToken.Token = token
+	writeJsonResponse(w, jsonToken)
+}
+
+func HttpRevokeToken(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !ContextIsAdmin(reqCtx) {
+		writeJSONError(w, errors.New("only admins can revoke API tokens"))
+		return
+	}
+
+	user := mux.Vars(r)["user"]
+	revoked, err := revokeAPIToken(user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if !revoked {
+		writeJSONError(w, errors.New("user has no API token"))
+		return
+	}
+
+	logInfof(reqCtx, "Revoked API token for %s", user)
+
+	w.WriteHeader(200)
+}
+
+type QuotaLimitsJSON struct {
+	MaxClusters        int `json:"max_clusters"`
+	MaxNodes           int `json:"max_nodes"`
+	MaxNodesPerCluster int `json:"max_nodes_per_cluster"`
+}
+
+type QuotaUsageJSON struct {
+	Clusters int `json:"clusters"`
+	Nodes    int `json:"nodes"`
+}
+
+type QuotaJSON struct {
+	User   string          `json:"user"`
+	Exempt bool            `json:"exempt"`
+	Limits QuotaLimitsJSON `json:"limits"`
+	Usage  QuotaUsageJSON  `json:"usage"`
+}
+
+func jsonifyQuota(quota Quota) QuotaLimitsJSON {
+	return QuotaLimitsJSON{
+		MaxClusters:        quota.MaxClusters,
+		MaxNodes:           quota.MaxNodes,
+		MaxNodesPerCluster: quota.MaxNodesPerCluster,
+	}
+}
+
+func HttpGetQuota(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user := ContextUser(reqCtx)
+	if queryUser := r.URL.Query().Get("user"); queryUser != "" && queryUser != user {
+		if !ContextIsAdmin(reqCtx) {
+			writeJSONError(w, errors.New("only admins can see the quotas of other users"))
+			return
+		}
+		user = queryUser
+	}
+
+	role, err := getUserRole(user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	quota, err := getUserQuota(user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	usage, err := getQuotaUsage(reqCtx, user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, QuotaJSON{
+		User:   user,
+		Exempt: role == RoleAdmin,
+		Limits: jsonifyQuota(quota),
+		Usage: QuotaUsageJSON{
+			Clusters: usage.Clusters,
+			Nodes:    usage.Nodes,
+		},
+	})
+}
+
+type UserJSON struct {
+	Name      string           `json:"name"`
+	Role      string           `json:"role"`
+	Quota     *QuotaLimitsJSON `json:"quota,omitempty"`
+	UpdatedAt string           `json:"updated_at"`
+	UpdatedBy string           `json:"updated_by"`
+}
+
+type SetUserRoleJSON struct {
+	Role string `json:"role"`
+}
+
+func jsonifyUser(user *UserRecord) UserJSON {
+	jsonUser := UserJSON{
+		Name:      user.Name,
+		Role:      string(user.Role),
+		UpdatedAt: user.UpdatedAt.Format(time.RFC3339),
+		UpdatedBy: user.UpdatedBy,
+	}
+	if user.Quota != nil {
+		jsonQuota := jsonifyQuota(*user.Quota)
+		jsonUser.Quota = &jsonQuota
+	}
+	return jsonUser
+}
+
+func HttpGetUsers(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	users, err := getUsers(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonUsers := make([]UserJSON, 0)
+	for _, user := range users {
+		jsonUsers = append(jsonUsers, jsonifyUser(&user))
+	}
+
+	writeJsonResponse(w, jsonUsers)
+}
+
+func HttpSetUserRole(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData SetUserRoleJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	role, err := parseRole(reqData.Role)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := setUserRole(reqCtx, mux.Vars(r)["user"], role)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyUser(user))
+}
+
+func HttpDeleteUser(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteUser(reqCtx, mux.Vars(r)["user"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpSetUserQuota(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData QuotaLimitsJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := setUserQuota(reqCtx, mux.Vars(r)["user"], &Quota{
+		MaxClusters:        reqData.MaxClusters,
+		MaxNodes:           reqData.MaxNodes,
+		MaxNodesPerCluster: reqData.MaxNodesPerCluster,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyUser(user))
+}
+
+func HttpResetUserQuota(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := setUserQuota(reqCtx, mux.Vars(r)["user"], nil)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyUser(user))
+}
+
+type ConfigJSON struct {
+	Settings        map[string]string `json:"settings"`
+	RuntimeSettings []string          `json:"runtime_settings"`
+	LoadedAt        string            `json:"loaded_at"`
+}
+
+func HttpGetConfig(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !ContextIsAdmin(reqCtx) {
+		writeJSONError(w, errors.New("only admins can see the daemon config"))
+		return
+	}
+
+	writeJsonResponse(w, ConfigJSON{
+		Settings:        effectiveSettings(),
+		RuntimeSettings: runtimeSettings,
+		LoadedAt:        getConfigLoadedAt().Format(time.RFC3339),
+	})
+}
+
+type IPReservationJSON struct {
+	Address    string `json:"address"`
+	ClusterID  string `json:"cluster_id"`
+	NodeName   string `json:"node_name"`
+	Static     bool   `json:"static"`
+	ReservedAt string `json:"reserved_at"`
+}
+
+type IPConflictJSON struct {
+	Address   string `json:"address"`
+	Container string `json:"container"`
+	Reason    string `json:"reason"`
+}
+
+type IPPoolJSON struct {
+	Ranges       []string            `json:"ranges"`
+	Reservations []IPReservationJSON `json:"reservations"`
+	Conflicts    []IPConflictJSON    `json:"conflicts"`
+}
+
+func HttpGetIPPool(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	status, err := getIPPoolStatus(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonPool := IPPoolJSON{
+		Ranges:       status.Ranges,
+		Reservations: []IPReservationJSON{},
+		Conflicts:    []IPConflictJSON{},
+	}
+	for _, reservation := range status.Reservations {
+		jsonPool.Reservations = append(jsonPool.Reservations, IPReservationJSON{
+			Address:    reservation.Address,
+			ClusterID:  reservation.ClusterID,
+			NodeName:   reservation.NodeName,
+			Static:     reservation.Static,
+			ReservedAt: reservation.ReservedAt.Format(time.RFC3339),
+		})
+	}
+	for _, conflict := range status.Conflicts {
+		jsonPool.Conflicts = append(jsonPool.Conflicts, IPConflictJSON{
+			Address:   conflict.Address,
+			Container: conflict.Container,
+			Reason:    conflict.Reason,
+		})
+	}
+
+	writeJsonResponse(w, jsonPool)
+}
+
+func HttpReleaseIP(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = releaseIP(reqCtx, mux.Vars(r)["address"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type DaemonInstanceJSON struct {
+	ID        string `json:"id"`
+	Hostname  string `json:"hostname"`
+	StartedAt string `json:"started_at"`
+	LastSeen  string `json:"last_seen"`
+	Alive     bool   `json:"alive"`
+	Leader    bool   `json:"leader"`
+	Self      bool   `json:"self"`
+}
+
+func HttpGetDaemonInstances(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !ContextIsAdmin(reqCtx) {
+		writeJSONError(w, errors.New("only admins can see the daemons"))
+		return
+	}
+
+	instances, err := getDaemonInstances()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var leaderID string
+	if lease, err := getLeaderLease(); err == nil && time.Now().Before(lease.ExpiresAt) {
+		leaderID = lease.Instance
+	}
+
+	jsonInstances := make([]DaemonInstanceJSON, 0)
+	for _, instance := range instances {
+		jsonInstances = append(jsonInstances, DaemonInstanceJSON{
+			ID:        instance.ID,
+			Hostname:  instance.Hostname,
+			StartedAt: instance.StartedAt.Format(time.RFC3339),
+			LastSeen:  instance.LastSeen.Format(time.RFC3339),
+			Alive:     instance.alive(),
+			Leader:    instance.ID == leaderID,
+			Self:      instance.ID == daemonInstanceID,
+		})
+	}
+
+	writeJsonResponse(w, jsonInstances)
+}
+
+type MetaRecordJSON struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type MetaExportJSON struct {
+	Version    int              `json:"version"`
+	ExportedAt string           `json:"exported_at"`
+	Records    []MetaRecordJSON `json:"records"`
+}
+
+type MetaImportResultJSON struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+func HttpExportMeta(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	export, err := exportMeta(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonExport := MetaExportJSON{
+		Version:    export.Version,
+		ExportedAt: export.ExportedAt.Format(time.RFC3339),
+		Records:    make([]MetaRecordJSON, 0),
+	}
+	for _, record := range export.Records {
+		jsonExport.Records = append(jsonExport.Records, MetaRecordJSON{
+			Key:   record.Key,
+			Value: record.Value,
+		})
+	}
+
+	writeJsonResponse(w, jsonExport)
+}
+
+func HttpImportMeta(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData MetaExportJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	export := &MetaExport{
+		Version: reqData.Version,
+	}
+	for _, record := range reqData.Records {
+		export.Records = append(export.Records, MetaRecord{
+			Key:   record.Key,
+			Value: record.Value,
+		})
+	}
+
+	skipExisting := r.URL.Query().Get("skip_existing") == "true"
+	result, err := importMeta(reqCtx, export, skipExisting)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, MetaImportResultJSON{
+		Imported: result.Imported,
+		Skipped:  result.Skipped,
+	})
+}
+
+type TeamJSON struct {
+	Name      string   `json:"name"`
+	Members   []string `json:"members"`
+	UpdatedAt string   `json:"updated_at"`
+	UpdatedBy string   `json:"updated_by"`
+}
+
+type SetTeamJSON struct {
+	Members []string `json:"members"`
+}
+
+func jsonifyTeam(team *Team) TeamJSON {
+	return TeamJSON{
+		Name:      team.Name,
+		Members:   team.Members,
+		UpdatedAt: team.UpdatedAt.Format(time.RFC3339),
+		UpdatedBy: team.UpdatedBy,
+	}
+}
+
+func HttpGetTeams(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !ContextIsAdmin(reqCtx) {
+		writeJSONError(w, errors.New("only admins can manage teams"))
+		return
+	}
+
+	teams, err := getAllTeams()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonTeams := make([]TeamJSON, 0)
+	for _, team := range teams {
+		jsonTeams = append(jsonTeams, jsonifyTeam(&team))
+	}
+
+	writeJsonResponse(w, jsonTeams)
+}
+
+func HttpSetTeam(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData SetTeamJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	team, err := setTeamMembers(reqCtx, mux.Vars(r)["team"], reqData.Members)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyTeam(team))
+}
+
+type TemplateJSON struct {
+	Name        string                  `json:"name"`
+	Description string                  `json:"description,omitempty"`
+	Timeout     string                  `json:"timeout,omitempty"`
+	Nodes       []CreateClusterNodeJSON `json:"nodes"`
+	Setup       *CreateClusterSetupJSON `json:"setup,omitempty"`
+	UpdatedAt   string                  `json:"updated_at"`
+	UpdatedBy   string                  `json:"updated_by"`
+}
+
+func jsonifyTemplate(template *ClusterTemplate) TemplateJSON {
+	return TemplateJSON{
+		Name:        template.Name,
+		Description: template.Description,
+		Timeout:     template.Timeout,
+		Nodes:       template.Nodes,
+		Setup:       template.Setup,
+		UpdatedAt:   template.UpdatedAt.Format(time.RFC3339),
+		UpdatedBy:   template.UpdatedBy,
+	}
+}
+
+type SetTemplateJSON struct {
+	Description string                  `json:"description"`
+	Timeout     string                  `json:"timeout"`
+	Nodes       []CreateClusterNodeJSON `json:"nodes"`
+	Setup       *CreateClusterSetupJSON `json:"setup"`
+}
+
+func HttpGetTemplates(w http.ResponseWriter, r *http.Request) {
+	_, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	templates, err := getAllTemplates()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonTemplates := make([]TemplateJSON, 0)
+	for _, template := range templates {
+		jsonTemplates = append(jsonTemplates, jsonifyTemplate(&template))
+	}
+
+	writeJsonResponse(w, jsonTemplates)
+}
+
+func HttpGetTemplate(w http.ResponseWriter, r *http.Request) {
+	_, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	template, err := getTemplate(mux.Vars(r)["template"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyTemplate(template))
+}
+
+func HttpSetTemplate(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData SetTemplateJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	template, err := setTemplate(reqCtx, ClusterTemplate{
+		Name:        mux.Vars(r)["template"],
+		Description: reqData.Description,
+		Timeout:     reqData.Timeout,
+		Nodes:       reqData.Nodes,
+		Setup:       reqData.Setup,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyTemplate(template))
+}
+
+func HttpDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteTemplate(reqCtx, mux.Vars(r)["template"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type ScheduleJSON struct {
+	Name          string          `json:"name"`
+	Owner         string          `json:"owner"`
+	Spec          ClusterSpecJSON `json:"spec"`
+	Days          []string        `json:"days"`
+	CreateAt      string          `json:"create_at"`
+	KillAt        string          `json:"kill_at"`
+	Timezone      string          `json:"timezone,omitempty"`
+	Paused        bool            `json:"paused"`
+	ClusterID     string          `json:"cluster_id,omitempty"`
+	LastCreatedAt string          `json:"last_created_at,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	UpdatedAt     string          `json:"updated_at"`
+}
+
+func jsonifySchedule(schedule *ClusterSchedule) ScheduleJSON {
+	jsonSchedule := ScheduleJSON{
+		Name:      schedule.Name,
+		Owner:     schedule.Owner,
+		Spec:      schedule.Spec,
+		Days:      schedule.Days,
+		CreateAt:  schedule.CreateAt,
+		KillAt:    schedule.KillAt,
+		Timezone:  schedule.Timezone,
+		Paused:    schedule.Paused,
+		ClusterID: schedule.ClusterID,
+		LastError: schedule.LastError,
+		UpdatedAt: schedule.UpdatedAt.Format(time.RFC3339),
+	}
+	if schedule.LastCreatedAt != nil {
+		jsonSchedule.LastCreatedAt = schedule.LastCreatedAt.Format(time.RFC3339)
+	}
+	return jsonSchedule
+}
+
+type SetScheduleJSON struct {
+	Spec     ClusterSpecJSON `json:"spec"`
+	Days     []string        `json:"days"`
+	CreateAt string          `json:"create_at"`
+	KillAt   string          `json:"kill_at"`
+	Timezone string          `json:"timezone"`
+	Paused   bool            `json:"paused"`
+}
+
+func HttpGetSchedules(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	schedules, err := getSchedules(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonSchedules := make([]ScheduleJSON, 0)
+	for _, schedule := range schedules {
+		jsonSchedules = append(jsonSchedules, jsonifySchedule(&schedule))
+	}
+
+	writeJsonResponse(w, jsonSchedules)
+}
+
+func HttpSetSchedule(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData SetScheduleJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	schedule, err := setSchedule(reqCtx, ClusterSchedule{
+		Name:     mux.Vars(r)["schedule"],
+		Spec:     reqData.Spec,
+		Days:     reqData.Days,
+		CreateAt: reqData.CreateAt,
+		KillAt:   reqData.KillAt,
+		Timezone: reqData.Timezone,
+		Paused:   reqData.Paused,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifySchedule(schedule))
+}
+
+func HttpDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteSchedule(reqCtx, mux.Vars(r)["schedule"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type ClusterSpecNodeJSON struct {
+	Name          string             `json:"name"`
+	Platform      string             `json:"platform"`
+	ServerVersion string             `json:"server_version"`
+	Services      []string           `json:"services"`
+	Overrides     *NodeOverridesJSON `json:"overrides,omitempty"`
+}
+
+type ClusterSpecUserJSON struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+type ClusterSpecXDCRJSON struct {
+	FromBucket    string `json:"from_bucket"`
+	RemoteCluster string `json:"remote_cluster"`
+	ToBucket      string `json:"to_bucket"`
+}
+
+type ClusterSpecTLSJSON struct {
+	ClientCertAuth *SetupClientCertAuthJSON `json:"client_cert_auth"`
+}
+
+type ClusterSpecJSON struct {
+	Timeout             string                 `json:"timeout"`
+	Team                string                 `json:"team"`
+	Tags                map[string]string      `json:"tags"`
+	Alias               string                 `json:"alias"`
+	Provider            string                 `json:"provider"`
+	Nodes               []ClusterSpecNodeJSON  `json:"nodes"`
+	StorageMode         string                 `json:"storage_mode"`
+	RamQuota            int                    `json:"ram_quota"`
+	UseHostname         bool                   `json:"use_hostname"`
+	UseIpv6             bool                   `json:"use_ipv6"`
+	UseDeveloperPreview bool                   `json:"developer_preview"`
+	Buckets             []AddBucketJSON        `json:"buckets"`
+	Users               []ClusterSpecUserJSON  `json:"users"`
+	XDCR                []ClusterSpecXDCRJSON  `json:"xdcr"`
+	TLS                 *ClusterSpecTLSJSON    `json:"tls"`
+	Indexes             []CreateIndexJSON      `json:"indexes"`
+	Analytics           *AddAnalyticsJSON      `json:"analytics"`
+	EventingFunctions   []EventingFunctionJSON `json:"eventing_functions"`
+}
+
+type ClusterSpecReportJSON struct {
+	Cluster           ClusterJSON         `json:"cluster"`
+	Buckets           []string            `json:"buckets"`
+	Users             []string            `json:"users"`
+	Replications      []string            `json:"xdcr"`
+	Indexes           []string            `json:"indexes"`
+	Datasets          []string            `json:"datasets"`
+	EventingFunctions []string            `json:"eventing_functions"`
+	ClientCert        *CertAuthResultJSON `json:"client_cert,omitempty"`
+}
+
+func jsonifyClusterSpecReport(report *ClusterSpecReport) ClusterSpecReportJSON {
+	jsonReport := ClusterSpecReportJSON{
+		Cluster:           jsonifyCluster(report.Cluster),
+		Buckets:           make([]string, 0),
+		Users:             make([]string, 0),
+		Replications:      make([]string, 0),
+		Indexes:           make([]string, 0),
+		Datasets:          make([]string, 0),
+		EventingFunctions: make([]string, 0),
+	}
+	jsonReport.Buckets = append(jsonReport.Buckets, report.Buckets...)
+	jsonReport.Users = append(jsonReport.Users, report.Users...)
+	jsonReport.Replications = append(jsonReport.Replications, report.Replications...)
+	jsonReport.Indexes = append(jsonReport.Indexes, report.Indexes...)
+	jsonReport.Datasets = append(jsonReport.Datasets, report.Datasets...)
+	jsonReport.EventingFunctions = append(jsonReport.EventingFunctions, report.EventingFunctions...)
+
+	if report.ClientCert != nil {
+		jsonReport.ClientCert = &CertAuthResultJSON{
+			CACert:     report.ClientCert.CACert,
+			ClientKey:  report.ClientCert.ClientKey,
+			ClientCert: report.ClientCert.ClientCert,
+		}
+	}
+
+	return jsonReport
+}
+
+func HttpApplyClusterSpec(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData ClusterSpecJSON
+	err = readJsonOrYamlRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	report, err := applyClusterSpec(reqCtx, reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, jsonifyClusterSpecReport(report))
+}
+
+type ClusterPoolJSON struct {
+	Name          string                 `json:"name"`
+	ServerVersion string                 `json:"server_version"`
+	Size          int                    `json:"size"`
+	Setup         CreateClusterSetupJSON `json:"setup"`
+	Available     int                    `json:"available"`
+	CheckedOut    int                    `json:"checked_out"`
+	UpdatedAt     string                 `json:"updated_at"`
+	UpdatedBy     string                 `json:"updated_by"`
+}
+
+func jsonifyClusterPool(pool *ClusterPool) ClusterPoolJSON {
+	return ClusterPoolJSON{
+		Name:          pool.Name,
+		ServerVersion: pool.ServerVersion,
+		Size:          pool.Size,
+		Setup:         pool.Setup,
+		UpdatedAt:     pool.UpdatedAt.Format(time.RFC3339),
+		UpdatedBy:     pool.UpdatedBy,
+	}
+}
+
+type SetClusterPoolJSON struct {
+	ServerVersion string                 `json:"server_version"`
+	Size          int                    `json:"size"`
+	Setup         CreateClusterSetupJSON `json:"setup"`
+}
+
+type CheckOutClusterJSON struct {
+	Timeout string `json:"timeout"`
+}
+
+func HttpGetClusterPools(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	statuses, err := getClusterPoolStatuses(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonPools := make([]ClusterPoolJSON, 0)
+	for _, status := range statuses {
+		jsonPool := jsonifyClusterPool(&status.ClusterPool)
+		jsonPool.Available = status.Available
+		jsonPool.CheckedOut = status.CheckedOut
+		jsonPools = append(jsonPools, jsonPool)
+	}
+
+	writeJsonResponse(w, jsonPools)
+}
+
+func HttpSetClusterPool(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData SetClusterPoolJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	pool, err := setClusterPool(reqCtx, ClusterPool{
+		Name:          mux.Vars(r)["pool"],
+		ServerVersion: reqData.ServerVersion,
+		Size:          reqData.Size,
+		Setup:         reqData.Setup,
+	})
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	clusterID := mux.Vars(r)["cluster_id"]
+	writeJsonResponse(w, jsonifyClusterPool(pool))
+}
 
-	var reqData AddBucketJSON
+func HttpDeleteClusterPool(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteClusterPool(reqCtx, mux.Vars(r)["pool"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func HttpCheckOutCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData CheckOutClusterJSON
 	err = readJsonRequest(r, &reqData)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	err = addBucket(reqCtx, clusterID, AddBucketOptions{
-		Conf: reqData,
-	})
+	timeout := getRuntimeConfig().DefaultClusterTimeout
+	if reqData.Timeout != "" {
+		timeout, err = time.ParseDuration(reqData.Timeout)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	cluster, err := checkOutCluster(reqCtx, mux.Vars(r)["pool"], timeout)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	setAuditClusterID(reqCtx, cluster.ID)
+
+	writeJsonResponse(w, jsonifyCluster(cluster))
+}
+
+func HttpCheckInCluster(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = checkInCluster(reqCtx, clusterIDFromRequest(r))
 	if err != nil {
 		writeJSONError(w, err)
 		return
@@ -483,68 +3998,538 @@ func HttpAddBucket(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-type SetupClientCertAuthJSON struct {
-	UserName  string `json:"user"`
-	UserEmail string `json:"email"`
+func HttpDeleteTeam(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteTeam(reqCtx, mux.Vars(r)["team"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
 }
 
-type CertAuthResultJSON struct {
-	CACert     []byte `json:"cacert"`
-	ClientKey  []byte `json:"client_key"`
-	ClientCert []byte `json:"client_cert"`
+type AuditEntryJSON struct {
+	Time      string `json:"time"`
+	User      string `json:"user"`
+	RequestID string `json:"request_id,omitempty"`
+	Operation string `json:"operation"`
+	ClusterID string `json:"cluster_id,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
 }
 
-func HttpSetupClientCertAuth(w http.ResponseWriter, r *http.Request) {
+func HttpGetAudit(w http.ResponseWriter, r *http.Request) {
 	reqCtx, err := getHttpContext(r)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	clusterID := mux.Vars(r)["cluster_id"]
+	query := r.URL.Query()
+	filter := AuditFilter{
+		User:      query.Get("user"),
+		ClusterID: resolveClusterID(query.Get("cluster_id")),
+		Limit:     1000,
+	}
 
-	var reqData SetupClientCertAuthJSON
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	entries, err := getAuditEntries(reqCtx, filter)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonEntries := make([]AuditEntryJSON, 0)
+	for _, entry := range entries {
+		jsonEntries = append(jsonEntries, AuditEntryJSON{
+			Time:      entry.Time.Format(time.RFC3339Nano),
+			User:      entry.User,
+			RequestID: entry.RequestID,
+			Operation: entry.Operation,
+			ClusterID: entry.ClusterID,
+			Node:      entry.Node,
+			Result:    entry.Result,
+			Error:     entry.Error,
+		})
+	}
+
+	writeJsonResponse(w, jsonEntries)
+}
+
+type UsageTotalJSON struct {
+	Name         string  `json:"name"`
+	Clusters     int     `json:"clusters"`
+	ClusterHours float64 `json:"cluster_hours"`
+	NodeHours    float64 `json:"node_hours"`
+}
+
+func HttpGetUsage(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := UsageFilter{
+		User:    query.Get("user"),
+		Team:    query.Get("team"),
+		GroupBy: query.Get("group_by"),
+	}
+
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	usage, err := getUsage(reqCtx, filter)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonUsage := make([]UsageTotalJSON, 0)
+	for _, total := range usage {
+		jsonUsage = append(jsonUsage, UsageTotalJSON{
+			Name:         total.Name,
+			Clusters:     total.Clusters,
+			ClusterHours: total.ClusterHours,
+			NodeHours:    total.NodeHours,
+		})
+	}
+
+	writeJsonResponse(w, jsonUsage)
+}
+
+type WebhookJSON struct {
+	ID        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	URL       string   `json:"url"`
+	ClusterID string   `json:"cluster_id,omitempty"`
+	Events    []string `json:"events,omitempty"`
+	Signed    bool     `json:"signed"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type CreateWebhookJSON struct {
+	URL       string   `json:"url"`
+	ClusterID string   `json:"cluster_id"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret"`
+}
+
+func jsonifyWebhook(hook *Webhook) WebhookJSON {
+	return WebhookJSON{
+		ID:        hook.ID,
+		Owner:     hook.Owner,
+		URL:       hook.URL,
+		ClusterID: hook.ClusterID,
+		Events:    hook.Events,
+		Signed:    hook.Secret != "",
+		CreatedAt: hook.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func HttpGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	hooks, err := getWebhooks(reqCtx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	jsonHooks := make([]WebhookJSON, 0)
+	for _, hook := range hooks {
+		jsonHooks = append(jsonHooks, jsonifyWebhook(&hook))
+	}
+
+	writeJsonResponse(w, jsonHooks)
+}
+
+func HttpCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var reqData CreateWebhookJSON
 	err = readJsonRequest(r, &reqData)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	cluster, err := getCluster(reqCtx, clusterID)
+	hook, err := createWebhook(reqCtx, WebhookOptions{
+		URL:       reqData.URL,
+		ClusterID: resolveClusterID(reqData.ClusterID),
+		Events:    reqData.Events,
+		Secret:    reqData.Secret,
+	})
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	certData, err := SetupCertAuth(SetupClientCertAuthOptions{
-		Nodes: cluster.Nodes,
-		Conf:  reqData,
+	writeJsonResponse(w, jsonifyWebhook(hook))
+}
+
+func HttpDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = deleteWebhook(reqCtx, mux.Vars(r)["webhook_id"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// eventHeartbeatInterval is how often an event stream is sent a comment when
+// there are no events, so that proxies don't close it for being idle.
+const eventHeartbeatInterval = 30 * time.Second
+
+func HttpStreamEvents(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	filter := EventFilter{
+		Owner:     r.URL.Query().Get("owner"),
+		ClusterID: r.URL.Query().Get("cluster_id"),
+		Types:     parseEventTypes(r.URL.Query().Get("events")),
+	}
+	err = validateEventFilter(filter)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, errors.New("streaming is not supported"))
+		return
+	}
+
+	events, unsubscribe := subscribeEvents(reqCtx, filter)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			var data []byte
+			data, err = json.Marshal(event)
+			if err != nil {
+				logErrorf(reqCtx, "Failed to marshal %s event: %s", event.Type, err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+type NotificationsJSON struct {
+	SlackWebhook string `json:"slack_webhook"`
+	Email        string `json:"email"`
+	Disabled     bool   `json:"disabled"`
+}
+
+func HttpGetNotifications(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	settings, err := getNotificationSettings(ContextUser(reqCtx))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJsonResponse(w, NotificationsJSON{
+		SlackWebhook: settings.SlackWebhook,
+		Email:        settings.Email,
+		Disabled:     settings.Disabled,
 	})
+}
+
+func HttpSetNotifications(w http.ResponseWriter, r *http.Request) {
+	reqCtx, err := getHttpContext(r)
 	if err != nil {
 		writeJSONError(w, err)
 		return
 	}
 
-	writeJsonResponse(w, CertAuthResultJSON{
-		CACert:     certData.CACert,
-		ClientKey:  certData.ClientKey,
-		ClientCert: certData.ClientCert,
+	var reqData NotificationsJSON
+	err = readJsonRequest(r, &reqData)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = setNotificationSettings(reqCtx, NotificationSettings{
+		SlackWebhook: reqData.SlackWebhook,
+		Email:        reqData.Email,
+		Disabled:     reqData.Disabled,
 	})
-	return
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+var refreshLinkPage = template.Must(template.New("refresh-link").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Refresh cluster {{.ClusterID}}</title></head>
+<body>
+{{if .Error}}<p>{{.Error}}</p>
+{{else if .Confirm}}<form method="POST">
+<input type="hidden" name="expires" value="{{.Expires}}">
+<input type="hidden" name="sig" value="{{.Sig}}">
+<p>Extend the lifetime of cluster {{.ClusterID}}?</p>
+<button type="submit">Refresh</button>
+</form>
+{{else}}<p>Cluster {{.ClusterID}} will now expire at {{.NewTimeout}}</p>
+{{end}}</body>
+</html>
+`))
+
+type refreshLinkPageData struct {
+	ClusterID  string
+	Confirm    bool
+	Expires    string
+	Sig        string
+	NewTimeout string
+	Error      string
+}
+
+func writeRefreshLinkPage(w http.ResponseWriter, status int, data refreshLinkPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	refreshLinkPage.Execute(w, data)
+}
+
+// HttpRefreshLink is followed from expiry notifications, so it responds with
+// a page asking for confirmation rather than refreshing the cluster, since
+// mail scanners and link previews follow links too.
+func HttpRefreshLink(w http.ResponseWriter, r *http.Request) {
+	clusterID := clusterIDFromRequest(r)
+	expires := r.URL.Query().Get("expires")
+	sig := r.URL.Query().Get("sig")
+
+	_, err := checkRefreshLink(clusterID, expires, sig)
+	if err != nil {
+		writeRefreshLinkPage(w, 400, refreshLinkPageData{ClusterID: clusterID, Error: err.Error()})
+		return
+	}
+
+	writeRefreshLinkPage(w, 200, refreshLinkPageData{ClusterID: clusterID, Confirm: true, Expires: expires, Sig: sig})
+}
+
+// HttpConfirmRefreshLink is posted by the page from HttpRefreshLink, and uses
+// up the link to refresh the cluster.
+func HttpConfirmRefreshLink(w http.ResponseWriter, r *http.Request) {
+	clusterID := clusterIDFromRequest(r)
+	linkCtx := NewContext(r.Context(), "refresh-link", false)
+
+	newTimeout, err := refreshClusterFromLink(linkCtx, clusterID, r.PostFormValue("expires"), r.PostFormValue("sig"))
+	recordAudit(linkCtx, "POST /cluster/{cluster_id}/refresh-link", clusterID, "", err)
+	if err != nil {
+		writeRefreshLinkPage(w, 400, refreshLinkPageData{ClusterID: clusterID, Error: err.Error()})
+		return
+	}
+
+	writeRefreshLinkPage(w, 200, refreshLinkPageData{ClusterID: clusterID, NewTimeout: newTimeout.Format(time.RFC1123)})
 }
 
 func createRESTRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
+	r.Use(tracingMiddleware)
+	r.Use(authMiddleware)
+	r.Use(rateLimitMiddleware)
+	r.Use(auditMiddleware)
 	r.HandleFunc("/", HttpRoot)
 	r.HandleFunc("/docker-host", HttpGetDockerHost).Methods("GET")
 	r.HandleFunc("/version", HttpGetVersion).Methods("GET")
+	r.Handle("/metrics", metricsHandler()).Methods("GET")
+	r.HandleFunc("/logs", HttpGetLogs).Methods("GET")
 	r.HandleFunc("/clusters", HttpGetClusters).Methods("GET")
 	r.HandleFunc("/clusters", HttpCreateCluster).Methods("POST")
+	r.HandleFunc("/clusters", HttpDeleteAllClusters).Methods("DELETE")
+	r.HandleFunc("/clusters/refresh-all", HttpRefreshAllClusters).Methods("POST")
+	r.HandleFunc("/clusters/spec", HttpApplyClusterSpec).Methods("POST")
+	r.HandleFunc("/leases/complete", HttpCompleteLease).Methods("POST")
 	r.HandleFunc("/cluster/{cluster_id}", HttpGetCluster).Methods("GET")
 	r.HandleFunc("/cluster/{cluster_id}", HttpUpdateCluster).Methods("PUT")
 	r.HandleFunc("/cluster/{cluster_id}/setup", HttpSetupCluster).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/status", HttpGetClusterStatus).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/stats", HttpGetClusterStats).Methods("GET")
 	r.HandleFunc("/cluster/{cluster_id}", HttpDeleteCluster).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/transfer", HttpTransferCluster).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/shared-with", HttpShareCluster).Methods("PUT")
+	r.HandleFunc("/cluster/{cluster_id}/team", HttpSetClusterTeam).Methods("PUT")
 	r.HandleFunc("/cluster/{cluster_id}/add-bucket", HttpAddBucket).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/add-collections", HttpAddCollections).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/add-indexes", HttpAddIndexes).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/add-analytics", HttpAddAnalytics).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/add-eventing-functions", HttpAddEventingFunctions).Methods("POST")
 	r.HandleFunc("/cluster/{cluster_id}/setup-cert-auth", HttpSetupClientCertAuth).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/alternate-addresses", HttpSetAlternateAddresses).Methods("PUT")
+	r.HandleFunc("/cluster/{cluster_id}/alternate-addresses", HttpClearAlternateAddresses).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/ldap", HttpAddLDAPFixture).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/ldap", HttpGetLDAPFixture).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/ldap", HttpRemoveLDAPFixture).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/helpers", HttpAddHelperContainer).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/helpers", HttpGetHelperContainers).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/helper/{helper}", HttpRemoveHelperContainer).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/toxiproxy", HttpAddToxiproxy).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/toxiproxy", HttpGetToxiproxy).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/toxiproxy", HttpRemoveToxiproxy).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/toxics", HttpAddToxic).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/toxic/{toxic}", HttpRemoveToxic).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/firewall", HttpGetFirewallRules).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/firewall", HttpBlockPorts).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/firewall", HttpUnblockPorts).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/clock", HttpGetClockSkew).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/clock", HttpSetClockSkew).Methods("PUT")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/clock", HttpRestoreClock).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/logs", HttpGetNodeLogs).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/exec", HttpExecOnNode).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/replace", HttpReplaceNode).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/failover", HttpFailoverNode).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/node/{node}/recovery", HttpRecoverNode).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/rebalance", HttpStartRebalance).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/rebalance/stop", HttpStopRebalance).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/collectinfo", HttpStartCollectInfo).Methods("POST")
+	r.HandleFunc("/collectinfo/{collection_id}", HttpGetCollectInfo).Methods("GET")
+	r.HandleFunc("/collectinfo/{collection_id}/{node}", HttpDownloadCollectInfo).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/bundle", HttpDownloadBundle).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/load", HttpStartLoad).Methods("POST")
+	r.HandleFunc("/job/{job_id}", HttpGetJob).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/backup", HttpStartBackup).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/restore", HttpStartRestore).Methods("POST")
+	r.HandleFunc("/backups", HttpGetBackupRepositories).Methods("GET")
+	r.HandleFunc("/backup/{repository}", HttpDeleteBackupRepository).Methods("DELETE")
+	r.HandleFunc("/cluster/{cluster_id}/hibernate", HttpHibernateCluster).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/wake", HttpWakeCluster).Methods("POST")
+	r.HandleFunc("/tokens", HttpGetTokens).Methods("GET")
+	r.HandleFunc("/tokens", HttpIssueToken).Methods("POST")
+	r.HandleFunc("/token/{user}", HttpRevokeToken).Methods("DELETE")
+	r.HandleFunc("/admin/users", HttpGetUsers).Methods("GET")
+	r.HandleFunc("/admin/users/{user}", HttpSetUserRole).Methods("PUT")
+	r.HandleFunc("/admin/users/{user}", HttpDeleteUser).Methods("DELETE")
+	r.HandleFunc("/admin/users/{user}/quota", HttpSetUserQuota).Methods("PUT")
+	r.HandleFunc("/admin/users/{user}/quota", HttpResetUserQuota).Methods("DELETE")
+	r.HandleFunc("/quota", HttpGetQuota).Methods("GET")
+	r.HandleFunc("/audit", HttpGetAudit).Methods("GET")
+	r.HandleFunc("/usage", HttpGetUsage).Methods("GET")
+	r.HandleFunc("/cluster/{cluster_id}/refresh-link", HttpRefreshLink).Methods("GET").Name("refresh-link")
+	r.HandleFunc("/cluster/{cluster_id}/refresh-link", HttpConfirmRefreshLink).Methods("POST").Name("refresh-link-confirm")
+	r.HandleFunc("/notifications", HttpGetNotifications).Methods("GET")
+	r.HandleFunc("/notifications", HttpSetNotifications).Methods("PUT")
+	r.HandleFunc("/webhooks", HttpGetWebhooks).Methods("GET")
+	r.HandleFunc("/webhooks", HttpCreateWebhook).Methods("POST")
+	r.HandleFunc("/webhook/{webhook_id}", HttpDeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/events", HttpStreamEvents).Methods("GET")
+	r.HandleFunc("/admin/config", HttpGetConfig).Methods("GET")
+	r.HandleFunc("/admin/instances", HttpGetDaemonInstances).Methods("GET")
+	r.HandleFunc("/admin/ip-pool", HttpGetIPPool).Methods("GET")
+	r.HandleFunc("/admin/ip-pool/{address}", HttpReleaseIP).Methods("DELETE")
+	r.HandleFunc("/admin/meta/export", HttpExportMeta).Methods("GET")
+	r.HandleFunc("/admin/meta/import", HttpImportMeta).Methods("POST")
+	r.HandleFunc("/admin/stats", HttpGetStatsByOwner).Methods("GET")
+	r.HandleFunc("/admin/overview", HttpGetOverview).Methods("GET")
+	r.HandleFunc("/admin/teams", HttpGetTeams).Methods("GET")
+	r.HandleFunc("/admin/teams/{team}", HttpSetTeam).Methods("PUT")
+	r.HandleFunc("/admin/teams/{team}", HttpDeleteTeam).Methods("DELETE")
+	r.HandleFunc("/pools", HttpGetClusterPools).Methods("GET")
+	r.HandleFunc("/pool/{pool}/checkout", HttpCheckOutCluster).Methods("POST")
+	r.HandleFunc("/cluster/{cluster_id}/checkin", HttpCheckInCluster).Methods("POST")
+	r.HandleFunc("/admin/pools/{pool}", HttpSetClusterPool).Methods("PUT")
+	r.HandleFunc("/admin/pools/{pool}", HttpDeleteClusterPool).Methods("DELETE")
+	r.HandleFunc("/templates", HttpGetTemplates).Methods("GET")
+	r.HandleFunc("/template/{template}", HttpGetTemplate).Methods("GET")
+	r.HandleFunc("/admin/templates/{template}", HttpSetTemplate).Methods("PUT")
+	r.HandleFunc("/admin/templates/{template}", HttpDeleteTemplate).Methods("DELETE")
+	r.HandleFunc("/schedules", HttpGetSchedules).Methods("GET")
+	r.HandleFunc("/schedule/{schedule}", HttpSetSchedule).Methods("PUT")
+	r.HandleFunc("/schedule/{schedule}", HttpDeleteSchedule).Methods("DELETE")
+	r.HandleFunc("/openapi.json", HttpGetOpenAPI(r)).Methods("GET").Name("openapi")
+	r.HandleFunc("/docs", swaggerui.PageHandler("cbdynclusterd API", "docs", "openapi.json")).Methods("GET").Name("docs")
+	r.HandleFunc("/docs/{asset}", swaggerui.AssetHandler()).Methods("GET").Name("docs-asset")
 	return r
 }
@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Role string
+
+const (
+	// RoleUser can only see and manage the clusters that they own.
+	RoleUser = Role("user")
+	// RoleAdmin can manage the clusters of every user, kill all clusters,
+	// exceed quotas and manage other users.
+	RoleAdmin = Role("admin")
+)
+
+func parseRole(role string) (Role, error) {
+	switch Role(role) {
+	case RoleUser, RoleAdmin:
+		return Role(role), nil
+	}
+	return "", errors.New("role must be one of user or admin")
+}
+
+// UserRecord holds the role assigned to a user, users without a record have
+// the user role.
+type UserRecord struct {
+	Name          string                `json:"name"`
+	Role          Role                  `json:"role"`
+	Quota         *Quota                `json:"quota,omitempty"`
+	Notifications *NotificationSettings `json:"notifications,omitempty"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+	UpdatedBy     string                `json:"updated_by"`
+}
+
+func userRecordKey(user string) string {
+	return "user-" + user
+}
+
+// getUserRecord loads the record of user, returning a default record for
+// users who have never had one stored.
+func getUserRecord(user string) (*UserRecord, error) {
+	var record UserRecord
+	err := metaStore.getRecord(userRecordKey(user), &record)
+	if err == ErrMetaNotFound {
+		return &UserRecord{Name: user, Role: RoleUser}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func getUserRole(user string) (Role, error) {
+	record, err := getUserRecord(user)
+	if err != nil {
+		return "", err
+	}
+
+	return record.Role, nil
+}
+
+// updateUserRecord changes the record of user with updateFunc, which may be
+// called again if another daemon changes the record in the meantime.
+func updateUserRecord(ctx context.Context, user string, updateFunc func(record *UserRecord)) (*UserRecord, error) {
+	var record *UserRecord
+	err := metaStore.createOrUpdateRawRecord(userRecordKey(user), func(recordBytes []byte) ([]byte, error) {
+		record = &UserRecord{Name: user, Role: RoleUser}
+		if recordBytes != nil {
+			err := json.Unmarshal(recordBytes, record)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		updateFunc(record)
+		record.UpdatedAt = time.Now()
+		record.UpdatedBy = ContextUser(ctx)
+
+		return json.Marshal(record)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func getUsers(ctx context.Context) ([]UserRecord, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can list users")
+	}
+
+	var users []UserRecord
+	err := metaStore.forEachRecord("user-", func(key string, recordBytes []byte) error {
+		var record UserRecord
+		err := json.Unmarshal(recordBytes, &record)
+		if err != nil {
+			return err
+		}
+
+		users = append(users, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func setUserRole(ctx context.Context, user string, role Role) (*UserRecord, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can assign roles")
+	}
+
+	if user == ContextUser(ctx) && role != RoleAdmin {
+		return nil, errors.New("cannot remove your own admin role")
+	}
+
+	record, err := updateUserRecord(ctx, user, func(record *UserRecord) {
+		record.Role = role
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Assigned role %s to %s", role, user)
+
+	return record, nil
+}
+
+func deleteUser(ctx context.Context, user string) error {
+	if !ContextIsAdmin(ctx) {
+		return errors.New("only admins can delete users")
+	}
+
+	if user == ContextUser(ctx) {
+		return errors.New("cannot delete yourself")
+	}
+
+	// Deleting a user also revokes their access, rather than just returning
+	// them to the user role.
+	hadToken, err := revokeAPIToken(user)
+	if err != nil {
+		return err
+	}
+
+	var record UserRecord
+	err = metaStore.getRecord(userRecordKey(user), &record)
+	if err == ErrMetaNotFound {
+		if !hadToken {
+			return errors.New("user not found")
+		}
+	} else if err != nil {
+		return err
+	} else {
+		err = metaStore.deleteRecord(userRecordKey(user))
+		if err != nil {
+			return err
+		}
+	}
+
+	logInfof(ctx, "Deleted user %s", user)
+
+	return nil
+}
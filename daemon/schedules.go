@@ -0,0 +1,372 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var scheduleNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// scheduleCheckInterval is how often schedules are checked, so clusters are
+// created and killed up to this late.
+const scheduleCheckInterval = time.Minute
+
+// scheduleTimeoutGrace is added to the timeout of scheduled clusters, so that
+// they are killed by their schedule rather than by expiring.
+const scheduleTimeoutGrace = 15 * time.Minute
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ClusterSchedule creates a cluster from a spec on certain days of the week
+// and kills it again later on, such as every weekday from 07:00 until 19:00.
+// A kill time before the create time is on the following day.
+type ClusterSchedule struct {
+	Name     string          `json:"name"`
+	Owner    string          `json:"owner"`
+	Spec     ClusterSpecJSON `json:"spec"`
+	Days     []string        `json:"days"`
+	CreateAt string          `json:"create_at"`
+	KillAt   string          `json:"kill_at"`
+	Timezone string          `json:"timezone,omitempty"`
+	Paused   bool            `json:"paused,omitempty"`
+
+	// ClusterID is the cluster which the schedule created and hasn't killed
+	// yet, if any.
+	ClusterID     string     `json:"cluster_id,omitempty"`
+	LastCreatedAt *time.Time `json:"last_created_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func scheduleKey(name string) string {
+	return "schedule-" + name
+}
+
+func getSchedule(name string) (*ClusterSchedule, error) {
+	var schedule ClusterSchedule
+	err := metaStore.getRecord(scheduleKey(name), &schedule)
+	if err == ErrMetaNotFound {
+		return nil, errors.Errorf("schedule %s not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &schedule, nil
+}
+
+// getSchedules returns the schedules of the user, or of everybody for admins.
+func getSchedules(ctx context.Context) ([]ClusterSchedule, error) {
+	var schedules []ClusterSchedule
+	err := metaStore.forEachRecord("schedule-", func(key string, recordBytes []byte) error {
+		var schedule ClusterSchedule
+		err := json.Unmarshal(recordBytes, &schedule)
+		if err != nil {
+			return err
+		}
+
+		if ContextIgnoreOwnership(ctx) || schedule.Owner == ContextUser(ctx) {
+			schedules = append(schedules, schedule)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return schedules, nil
+}
+
+func parseScheduleTime(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.Errorf("%q is not a time of day such as 07:00", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func (schedule *ClusterSchedule) runsOn(weekday time.Weekday) bool {
+	for _, day := range schedule.Days {
+		if scheduleDays[day] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (schedule *ClusterSchedule) location() (*time.Location, error) {
+	if schedule.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(schedule.Timezone)
+}
+
+// window returns when the cluster of the schedule should exist around now,
+// or nothing if it shouldn't exist at all.
+func (schedule *ClusterSchedule) window(now time.Time) (time.Time, time.Time, bool) {
+	loc, err := schedule.location()
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	createAt, err := parseScheduleTime(schedule.CreateAt)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	killAt, err := parseScheduleTime(schedule.KillAt)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	if killAt <= createAt {
+		killAt += 24 * time.Hour
+	}
+
+	// A window which goes past midnight could have started yesterday.
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+		if !schedule.runsOn(day.Weekday()) {
+			continue
+		}
+
+		start := day.Add(createAt)
+		end := day.Add(killAt)
+		if !now.Before(start) && now.Before(end) {
+			return start, end, true
+		}
+	}
+
+	return time.Time{}, time.Time{}, false
+}
+
+func validateSchedule(ctx context.Context, schedule *ClusterSchedule) error {
+	if !scheduleNameRegexp.MatchString(schedule.Name) {
+		return errors.New("schedule names must be lowercase letters, numbers, dots, dashes and underscores")
+	}
+
+	if len(schedule.Days) == 0 {
+		return errors.New("schedules must run on at least one day")
+	}
+	for i, day := range schedule.Days {
+		day = strings.ToLower(day)
+		if _, ok := scheduleDays[day]; !ok {
+			return errors.Errorf("%q is not a day, such as mon", day)
+		}
+		schedule.Days[i] = day
+	}
+
+	createAt, err := parseScheduleTime(schedule.CreateAt)
+	if err != nil {
+		return err
+	}
+	killAt, err := parseScheduleTime(schedule.KillAt)
+	if err != nil {
+		return err
+	}
+	if killAt <= createAt {
+		killAt += 24 * time.Hour
+	}
+	if maxTimeout := getRuntimeConfig().MaxClusterTimeout; killAt-createAt > maxTimeout {
+		return fmt.Errorf("cannot schedule clusters for longer than %s", maxTimeout)
+	}
+
+	_, err = schedule.location()
+	if err != nil {
+		return err
+	}
+
+	// The timeout comes from the schedule, and aliases can't be claimed by a
+	// cluster every day.
+	if schedule.Spec.Timeout != "" {
+		return errors.New("scheduled specs cannot have a timeout, it comes from the schedule")
+	}
+	if schedule.Spec.Alias != "" {
+		return errors.New("scheduled specs cannot have an alias")
+	}
+	if schedule.Spec.Team != "" && !ContextIgnoreOwnership(ctx) && !isTeamMember(schedule.Spec.Team, ContextUser(ctx)) {
+		return errors.New("cannot schedule clusters for teams you aren't in")
+	}
+	_, err = schedule.Spec.clusterOptions()
+	if err != nil {
+		return err
+	}
+	_, err = validateClusterSpec(ctx, &schedule.Spec)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setSchedule creates or replaces a schedule.  The cluster of a replaced
+// schedule is kept, and killed at the new kill time.
+func setSchedule(ctx context.Context, schedule ClusterSchedule) (*ClusterSchedule, error) {
+	existing, err := getSchedule(schedule.Name)
+	if err == nil {
+		if !ContextIgnoreOwnership(ctx) && existing.Owner != ContextUser(ctx) {
+			return nil, errors.Errorf("schedule %s belongs to %s", schedule.Name, existing.Owner)
+		}
+		schedule.Owner = existing.Owner
+		schedule.ClusterID = existing.ClusterID
+		schedule.LastCreatedAt = existing.LastCreatedAt
+	} else {
+		schedule.Owner = ContextUser(ctx)
+	}
+
+	err = validateSchedule(ctx, &schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule.UpdatedAt = time.Now()
+	err = metaStore.setRecord(scheduleKey(schedule.Name), &schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Saved cluster schedule %s", schedule.Name)
+
+	return &schedule, nil
+}
+
+// deleteSchedule removes a schedule, the cluster it created is left to
+// expire like any other.
+func deleteSchedule(ctx context.Context, name string) error {
+	schedule, err := getSchedule(name)
+	if err != nil {
+		return err
+	}
+	if !ContextIgnoreOwnership(ctx) && schedule.Owner != ContextUser(ctx) {
+		return errors.Errorf("schedule %s belongs to %s", name, schedule.Owner)
+	}
+
+	err = metaStore.deleteRecord(scheduleKey(name))
+	if err != nil {
+		return err
+	}
+
+	logInfof(ctx, "Deleted cluster schedule %s", name)
+
+	return nil
+}
+
+// runSchedule creates or kills the cluster of a schedule, as of now.
+func runSchedule(schedule *ClusterSchedule, now time.Time) error {
+	ctx := NewContext(systemCtx, schedule.Owner, false)
+	start, end, inWindow := schedule.window(now)
+
+	if schedule.ClusterID != "" {
+		cluster, err := getCluster(ctx, schedule.ClusterID)
+		if err != nil || cluster.Owner != schedule.Owner {
+			// Somebody already killed it, it expired or it was given away.
+			schedule.ClusterID = ""
+		} else if !inWindow {
+			logInfof(ctx, "Killing cluster %s of schedule %s", schedule.ClusterID, schedule.Name)
+			err = killCluster(ctx, schedule.ClusterID)
+			if err != nil {
+				return err
+			}
+			schedule.ClusterID = ""
+		}
+	}
+
+	// Each window gets a single cluster, if it is killed early it stays gone.
+	if schedule.ClusterID != "" || schedule.Paused || !inWindow {
+		return nil
+	}
+	if schedule.LastCreatedAt != nil && !schedule.LastCreatedAt.Before(start) {
+		return nil
+	}
+
+	spec := schedule.Spec
+	spec.Timeout = (end.Sub(now) + scheduleTimeoutGrace).String()
+	if spec.Tags == nil {
+		spec.Tags = make(map[string]string)
+	}
+	spec.Tags["schedule"] = schedule.Name
+
+	logInfof(ctx, "Creating cluster of schedule %s", schedule.Name)
+	createdAt := now
+	schedule.LastCreatedAt = &createdAt
+
+	report, err := applyClusterSpec(ctx, spec)
+	if err != nil {
+		return err
+	}
+	schedule.ClusterID = report.Cluster.ID
+
+	return nil
+}
+
+func runSchedules() error {
+	schedules, err := getSchedules(systemCtx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range schedules {
+		schedule := &schedules[i]
+
+		err := runSchedule(schedule, now)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to run cluster schedule %s: %s", schedule.Name, err)
+			schedule.LastError = err.Error()
+		} else if schedule.ClusterID != "" {
+			schedule.LastError = ""
+		}
+
+		// The schedule may have been changed or deleted while the cluster was
+		// being created, only what we did to it is kept.
+		current, err := getSchedule(schedule.Name)
+		if err != nil {
+			if schedule.ClusterID != "" {
+				logWarnf(systemCtx, "Cluster schedule %s was deleted while creating cluster %s", schedule.Name, schedule.ClusterID)
+			}
+			continue
+		}
+		current.ClusterID = schedule.ClusterID
+		current.LastCreatedAt = schedule.LastCreatedAt
+		current.LastError = schedule.LastError
+
+		err = metaStore.setRecord(scheduleKey(schedule.Name), current)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to save cluster schedule %s: %s", schedule.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// runClusterSchedules creates and kills the clusters of schedules as they
+// come due.
+func runClusterSchedules(shutdownSig chan struct{}) {
+	for {
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(scheduleCheckInterval):
+		}
+
+		if !isLeader() {
+			continue
+		}
+
+		err := runSchedules()
+		if err != nil {
+			logErrorf(systemCtx, "Failed to run cluster schedules: %s", err)
+		}
+	}
+}
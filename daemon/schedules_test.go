@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      time.Duration
+		wantError bool
+	}{
+		{value: "00:00", want: 0},
+		{value: "07:00", want: 7 * time.Hour},
+		{value: "19:30", want: 19*time.Hour + 30*time.Minute},
+		{value: "23:59", want: 23*time.Hour + 59*time.Minute},
+		{value: "7am", wantError: true},
+		{value: "24:00", wantError: true},
+		{value: "07:60", wantError: true},
+		{value: "", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseScheduleTime(test.value)
+			if test.wantError {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Fatalf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+
+	// 2021-06-07 is a Monday.
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2021, 6, 7, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		schedule  ClusterSchedule
+		now       time.Time
+		wantOK    bool
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "during the window",
+			schedule:  ClusterSchedule{Days: weekdays, CreateAt: "07:00", KillAt: "19:00"},
+			now:       monday(12, 0),
+			wantOK:    true,
+			wantStart: monday(7, 0),
+			wantEnd:   monday(19, 0),
+		},
+		{
+			name:      "at the create time",
+			schedule:  ClusterSchedule{Days: weekdays, CreateAt: "07:00", KillAt: "19:00"},
+			now:       monday(7, 0),
+			wantOK:    true,
+			wantStart: monday(7, 0),
+			wantEnd:   monday(19, 0),
+		},
+		{
+			name:     "at the kill time",
+			schedule: ClusterSchedule{Days: weekdays, CreateAt: "07:00", KillAt: "19:00"},
+			now:      monday(19, 0),
+		},
+		{
+			name:     "before the window",
+			schedule: ClusterSchedule{Days: weekdays, CreateAt: "07:00", KillAt: "19:00"},
+			now:      monday(6, 59),
+		},
+		{
+			name:     "on another day",
+			schedule: ClusterSchedule{Days: []string{"sat", "sun"}, CreateAt: "07:00", KillAt: "19:00"},
+			now:      monday(12, 0),
+		},
+		{
+			name:      "past midnight from the day before",
+			schedule:  ClusterSchedule{Days: []string{"sun"}, CreateAt: "22:00", KillAt: "02:00"},
+			now:       monday(1, 0),
+			wantOK:    true,
+			wantStart: monday(-2, 0),
+			wantEnd:   monday(2, 0),
+		},
+		{
+			name:     "past midnight after the kill time",
+			schedule: ClusterSchedule{Days: []string{"sun"}, CreateAt: "22:00", KillAt: "02:00"},
+			now:      monday(3, 0),
+		},
+		{
+			name:      "in another timezone",
+			schedule:  ClusterSchedule{Days: weekdays, CreateAt: "07:00", KillAt: "19:00", Timezone: "America/New_York"},
+			now:       monday(12, 0),
+			wantOK:    true,
+			wantStart: monday(11, 0),
+			wantEnd:   monday(23, 0),
+		},
+		{
+			name:     "an unknown timezone",
+			schedule: ClusterSchedule{Days: weekdays, CreateAt: "07:00", KillAt: "19:00", Timezone: "Nowhere/Special"},
+			now:      monday(12, 0),
+		},
+		{
+			name:     "an invalid time",
+			schedule: ClusterSchedule{Days: weekdays, CreateAt: "7am", KillAt: "19:00"},
+			now:      monday(12, 0),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, ok := test.schedule.window(test.now)
+			if ok != test.wantOK {
+				t.Fatalf("expected ok to be %t, got %t", test.wantOK, ok)
+			}
+			if !start.Equal(test.wantStart) || !end.Equal(test.wantEnd) {
+				t.Fatalf("expected window %s to %s, got %s to %s", test.wantStart, test.wantEnd, start, end)
+			}
+		})
+	}
+}
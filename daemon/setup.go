@@ -1,10 +1,13 @@
 package daemon
 
 import (
+	"context"
+	"regexp"
 	"strconv"
 
 	"github.com/couchbaselabs/cbdynclusterd/cluster"
 	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
 )
 
 type ClusterSetupOptions struct {
@@ -12,6 +15,119 @@ type ClusterSetupOptions struct {
 	Conf  CreateClusterSetupJSON
 }
 
+// setupCluster configures the couchbase server nodes of an allocated cluster
+// into a single cluster, returning it with its entry point filled in.
+func setupCluster(ctx context.Context, clusterID string, conf CreateClusterSetupJSON) (*Cluster, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Provider == ProviderCapella {
+		return nil, errors.New("capella clusters are already set up when they are allocated")
+	}
+	if len(cluster.Nodes) != len(conf.Services) {
+		return nil, errors.New("services does not map to number of nodes")
+	}
+	if _, err := setupUserOptions(conf.Users); err != nil {
+		return nil, err
+	}
+	if conf.UseHostname && dnsSvcHost == "" {
+		// Nothing else makes the hostnames of nodes resolve.
+		return nil, errors.New("use_hostname needs the daemon to be run with a dns-host")
+	}
+
+	_, span := startSpan(ctx, "setupCluster")
+	epnode, err := SetupCluster(&ClusterSetupOptions{
+		Nodes: cluster.Nodes,
+		Conf:  conf,
+	})
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster.EntryPoint = epnode
+
+	err = applyNodeSettings(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.UseHostname {
+		err = metaStore.UpdateClusterMeta(clusterID, func(meta ClusterMeta) (ClusterMeta, error) {
+			meta.UseHostname = true
+			return meta, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		cluster.UseHostname = true
+	}
+
+	publishClusterEvent(ctx, newClusterEvent(ctx, ClusterEventSetupComplete, cluster))
+
+	return cluster, nil
+}
+
+var roleNameRegexp = regexp.MustCompile(`^[a-z_]+$`)
+var roleBucketRegexp = regexp.MustCompile(`^(\*|[A-Za-z0-9_.%-]+)$`)
+
+// setupUserOptions validates the users to create on a cluster, and turns
+// their roles into the form that ns_server expects, such as
+// data_reader[default].
+func setupUserOptions(users []SetupUserJSON) ([]*helper.UserOption, error) {
+	var userOpts []*helper.UserOption
+	userNames := make(map[string]bool)
+	for _, user := range users {
+		if user.Name == "" || user.Password == "" {
+			return nil, errors.New("users must have a name and password")
+		}
+		if userNames[user.Name] {
+			return nil, errors.Errorf("user %s is specified more than once", user.Name)
+		}
+		userNames[user.Name] = true
+		roles, err := setupRoles(user.Roles, "user "+user.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		userOpts = append(userOpts, &helper.UserOption{
+			Name:     user.Name,
+			Password: user.Password,
+			Roles:    &roles,
+		})
+	}
+
+	return userOpts, nil
+}
+
+// setupRoles validates the roles of a user or group, and turns them into the
+// form that ns_server expects.
+func setupRoles(roles []SetupUserRoleJSON, owner string) ([]string, error) {
+	if len(roles) == 0 {
+		return nil, errors.Errorf("%s must have at least one role", owner)
+	}
+
+	var nsRoles []string
+	for _, role := range roles {
+		if !roleNameRegexp.MatchString(role.Role) {
+			return nil, errors.Errorf("%q is not a valid role for %s", role.Role, owner)
+		}
+		if role.Bucket == "" {
+			nsRoles = append(nsRoles, role.Role)
+			continue
+		}
+		if !roleBucketRegexp.MatchString(role.Bucket) {
+			return nil, errors.Errorf("%q is not a valid bucket for role %s of %s", role.Bucket, role.Role, owner)
+		}
+		nsRoles = append(nsRoles, role.Role+"["+role.Bucket+"]")
+	}
+
+	return nsRoles, nil
+}
+
 func SetupCluster(opts *ClusterSetupOptions) (string, error) {
 	services := opts.Conf.Services
 
@@ -21,27 +137,35 @@ func SetupCluster(opts *ClusterSetupOptions) (string, error) {
 		ipv4 := initialNodes[i].IPv4Address
 		hostname := ipv4
 		if opts.Conf.UseHostname {
-			hostname = initialNodes[i].ContainerName[1:] + helper.DomainPostfix
+			hostname = initialNodes[i].Hostname
 		} else if opts.Conf.UseIpv6 {
 			hostname = initialNodes[i].IPv6Address
 		}
 
 		nodeHost := &cluster.Node{
-			HostName:  hostname,
-			Port:      strconv.Itoa(helper.RestPort),
-			SshLogin:  &helper.Cred{Username: helper.SshUser, Password: helper.SshPass, Hostname: ipv4, Port: helper.SshPort},
-			RestLogin: &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.RestPort},
-			N1qlLogin: &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.N1qlPort},
-			FtsLogin:  &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.FtsPort},
-			Services:  services[i],
+			HostName:      hostname,
+			Port:          strconv.Itoa(helper.RestPort),
+			SshLogin:      &helper.Cred{Username: helper.SshUser, Password: helper.SshPass, Hostname: ipv4, Port: helper.SshPort},
+			RestLogin:     &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.RestPort},
+			N1qlLogin:     &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.N1qlPort},
+			FtsLogin:      &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.FtsPort},
+			CbasLogin:     &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.CbasPort},
+			EventingLogin: &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.EventingPort},
+			Services:      services[i],
 		}
 		nodes = append(nodes, nodeHost)
 	}
 
+	users, err := setupUserOptions(opts.Conf.Users)
+	if err != nil {
+		return "", err
+	}
+
 	config := cluster.Config{
 		MemoryQuota:   strconv.Itoa(opts.Conf.RamQuota),
 		StorageMode:   opts.Conf.StorageMode,
 		User:          opts.Conf.User,
+		Users:         users,
 		Bucket:        opts.Conf.Bucket,
 		UseHostname:   opts.Conf.UseHostname,
 		UseDevPreview: opts.Conf.UseDeveloperPreview,
@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// sidecarOutputLines is how many lines of a sidecar's output are kept, which
+// is enough to see how it finished or why it failed.
+const sidecarOutputLines = 50
+
+// SidecarOptions describes a short lived container which is run next to the
+// nodes of a cluster, to run tools against the cluster.
+type SidecarOptions struct {
+	Name       string
+	Image      string
+	Entrypoint []string
+	Args       []string
+	// Binds are volumes to mount into the container, as name:path.
+	Binds []string
+	// Timeout is how long the container can run for before it is stopped.
+	Timeout time.Duration
+}
+
+// SidecarResult is how a sidecar finished.
+type SidecarResult struct {
+	ExitCode int64
+	TimedOut bool
+	Output   string
+}
+
+// runSidecar runs a container on the same docker host and network as the
+// nodes of a cluster until it exits or its timeout passes.  The container is
+// removed once it has stopped.
+func runSidecar(ctx context.Context, host *DockerHost, opts SidecarOptions) (*SidecarResult, error) {
+	release, err := acquireDockerSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var dns []string
+	if dnsSvcHost != "" {
+		dns = append(dns, dnsSvcHost)
+	}
+	createResult, err := host.Client.ContainerCreate(context.Background(), &container.Config{
+		Image:      opts.Image,
+		Entrypoint: opts.Entrypoint,
+		Cmd:        opts.Args,
+		Labels: map[string]string{
+			"com.couchbase.dyncluster.sidecar_cluster_id": ContextClusterID(ctx),
+		},
+	}, &container.HostConfig{
+		NetworkMode: container.NetworkMode(NetworkName),
+		DNS:         dns,
+		Binds:       opts.Binds,
+	}, nil, opts.Name)
+	if err != nil {
+		release()
+		return nil, trackDockerError("container_create", err)
+	}
+	defer host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+
+	err = host.Client.ContainerStart(context.Background(), createResult.ID, types.ContainerStartOptions{})
+	release()
+	if err != nil {
+		return nil, trackDockerError("container_start", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	result := &SidecarResult{}
+	result.ExitCode, err = host.Client.ContainerWait(waitCtx, createResult.ID)
+	if err != nil {
+		if waitCtx.Err() == nil {
+			return nil, err
+		}
+
+		stopTimeout := 10 * time.Second
+		err = host.Client.ContainerStop(context.Background(), createResult.ID, &stopTimeout)
+		if err != nil {
+			return nil, err
+		}
+		result.ExitCode = 0
+		result.TimedOut = true
+	}
+
+	result.Output, err = containerOutput(host, createResult.ID)
+	if err != nil {
+		logWarnf(ctx, "Failed to read the output of %s: %s", opts.Name, err)
+	}
+
+	return result, nil
+}
+
+func containerOutput(host *DockerHost, containerID string) (string, error) {
+	logsReader, err := host.Client.ContainerLogs(context.Background(), containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(sidecarOutputLines),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer logsReader.Close()
+
+	var output bytes.Buffer
+	_, err = stdcopy.StdCopy(&output, &output, logsReader)
+	return output.String(), err
+}
@@ -0,0 +1,357 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/couchbaselabs/cbdynclusterd/helper"
+	"github.com/pkg/errors"
+)
+
+// ClusterSpecReport describes everything that was created while converging a
+// cluster spec.
+type ClusterSpecReport struct {
+	Cluster           *Cluster
+	Buckets           []string
+	Users             []string
+	Replications      []string
+	Indexes           []string
+	Datasets          []string
+	EventingFunctions []string
+	ClientCert        *CertAuthResult
+}
+
+func restNodeOf(node *Node) *cluster.Node {
+	ipv4 := node.IPv4Address
+	return &cluster.Node{
+		HostName:      ipv4,
+		Port:          strconv.Itoa(helper.RestPort),
+		SshLogin:      &helper.Cred{Username: helper.SshUser, Password: helper.SshPass, Hostname: ipv4, Port: helper.SshPort},
+		RestLogin:     &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.RestPort},
+		N1qlLogin:     &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.N1qlPort},
+		FtsLogin:      &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.FtsPort},
+		CbasLogin:     &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.CbasPort},
+		EventingLogin: &helper.Cred{Username: helper.RestUser, Password: helper.RestPass, Hostname: ipv4, Port: helper.EventingPort},
+	}
+}
+
+// findServiceNode returns a node of the cluster which runs a service, such as
+// n1ql or cbas.  The services of nodes aren't stored, so we ask the cluster
+// for them.
+func findServiceNode(nodes []*Node, service string) (*Node, error) {
+	hostnames, err := restNodeOf(nodes[0]).GetServiceHostnames(service)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the services of the cluster")
+	}
+
+	for _, hostname := range hostnames {
+		if node := nodeOfHostname(nodes, hostname); node != nil {
+			return node, nil
+		}
+	}
+
+	return nil, errors.Errorf("no nodes are running the %s service", service)
+}
+
+// nodeOfHostname returns the node which ns_server knows by a hostname, which
+// depends on how the cluster was set up.
+func nodeOfHostname(nodes []*Node, hostname string) *Node {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+
+	for _, node := range nodes {
+		if hostname == node.IPv4Address || hostname == node.IPv6Address || hostname == node.Hostname {
+			return node
+		}
+	}
+	return nil
+}
+
+func (spec *ClusterSpecJSON) clusterOptions() (ClusterOptions, error) {
+	clusterOpts := ClusterOptions{
+		Timeout:  getRuntimeConfig().DefaultClusterTimeout,
+		Team:     spec.Team,
+		Tags:     spec.Tags,
+		Alias:    spec.Alias,
+		Provider: spec.Provider,
+	}
+
+	if spec.Timeout != "" {
+		clusterTimeout, err := time.ParseDuration(spec.Timeout)
+		if err != nil {
+			return ClusterOptions{}, err
+		}
+		clusterOpts.Timeout = clusterTimeout
+	}
+
+	for _, node := range spec.Nodes {
+		nodeVersion, err := parseServerVersion(node.ServerVersion)
+		if err != nil {
+			return ClusterOptions{}, err
+		}
+
+		nodeOpts := NodeOptions{
+			Name:          node.Name,
+			Platform:      node.Platform,
+			ServerVersion: node.ServerVersion,
+			VersionInfo:   nodeVersion,
+		}
+		if node.Overrides != nil {
+			nodeOpts.Overrides = unjsonifyNodeOverrides(*node.Overrides)
+		}
+		clusterOpts.Nodes = append(clusterOpts.Nodes, nodeOpts)
+	}
+
+	return clusterOpts, nil
+}
+
+func validateClusterSpec(ctx context.Context, spec *ClusterSpecJSON) (map[string]*Cluster, error) {
+	if len(spec.Nodes) == 0 {
+		return nil, errors.New("specs must have at least one node")
+	}
+
+	bucketNames := make(map[string]bool)
+	for _, bucket := range spec.Buckets {
+		if bucket.Name == "" {
+			return nil, errors.New("buckets must have a name")
+		}
+		if bucketNames[bucket.Name] {
+			return nil, errors.Errorf("bucket %s is specified more than once", bucket.Name)
+		}
+		bucketNames[bucket.Name] = true
+		if err := validateCollectionScopes(bucket.Scopes); err != nil {
+			return nil, errors.Wrapf(err, "invalid scopes for bucket %s", bucket.Name)
+		}
+	}
+
+	for _, user := range spec.Users {
+		if user.Name == "" || user.Password == "" {
+			return nil, errors.New("users must have a name and password")
+		}
+	}
+
+	if err := validateIndexes(spec.Indexes); err != nil {
+		return nil, err
+	}
+	for _, index := range spec.Indexes {
+		if !bucketNames[index.Bucket] {
+			return nil, errors.Errorf("bucket %s of index %s is not in the spec", index.Bucket, indexName(index))
+		}
+	}
+
+	if spec.Analytics != nil {
+		if err := validateAnalytics(spec.Analytics); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateEventingFunctions(spec.EventingFunctions); err != nil {
+		return nil, err
+	}
+
+	// Replications go to other clusters the user can already see, so look
+	// them all up before allocating anything.
+	remotes := make(map[string]*Cluster)
+	for _, link := range spec.XDCR {
+		if !bucketNames[link.FromBucket] {
+			return nil, errors.Errorf("xdcr source bucket %s is not in the spec", link.FromBucket)
+		}
+
+		remoteID := resolveClusterID(link.RemoteCluster)
+		if _, ok := remotes[remoteID]; ok {
+			continue
+		}
+
+		remote, err := getCluster(ctx, remoteID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find xdcr remote cluster %s", link.RemoteCluster)
+		}
+		if len(remote.Nodes) == 0 {
+			return nil, errors.Errorf("xdcr remote cluster %s has no nodes", link.RemoteCluster)
+		}
+		remotes[remoteID] = remote
+	}
+
+	return remotes, nil
+}
+
+// applyClusterSpec allocates a cluster and converges it to a spec in one go.
+// If any step fails the cluster is killed again, so that callers never need
+// to clean up after a half built cluster.
+func applyClusterSpec(ctx context.Context, spec ClusterSpecJSON) (*ClusterSpecReport, error) {
+	clusterOpts, err := spec.clusterOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	remotes, err := validateClusterSpec(ctx, &spec)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterID, err := allocateCluster(ctx, clusterOpts)
+	if err != nil {
+		return nil, err
+	}
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	report, err := convergeClusterSpec(ctx, clusterID, &spec, remotes)
+	if err != nil {
+		killErr := killCluster(ctx, clusterID)
+		if killErr != nil {
+			logWarnf(ctx, "Failed to kill cluster after applying spec failed: %s", killErr)
+		}
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func convergeClusterSpec(ctx context.Context, clusterID string, spec *ClusterSpecJSON, remotes map[string]*Cluster) (*ClusterSpecReport, error) {
+	setupConf := CreateClusterSetupJSON{
+		StorageMode:         spec.StorageMode,
+		RamQuota:            spec.RamQuota,
+		UseHostname:         spec.UseHostname,
+		UseIpv6:             spec.UseIpv6,
+		UseDeveloperPreview: spec.UseDeveloperPreview,
+	}
+	for _, node := range spec.Nodes {
+		services := node.Services
+		if len(services) == 0 {
+			services = []string{"kv"}
+		}
+		setupConf.Services = append(setupConf.Services, strings.Join(services, ","))
+	}
+
+	c, err := setupCluster(ctx, clusterID, setupConf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set up cluster")
+	}
+
+	report := &ClusterSpecReport{
+		Cluster: c,
+	}
+
+	for _, bucket := range spec.Buckets {
+		bucket.UseHostname = bucket.UseHostname || spec.UseHostname
+		err := addBucket(ctx, clusterID, AddBucketOptions{
+			Conf: bucket,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create bucket %s", bucket.Name)
+		}
+		report.Buckets = append(report.Buckets, bucket.Name)
+	}
+
+	if len(spec.Indexes) > 0 {
+		err := addIndexes(ctx, clusterID, AddIndexesOptions{
+			Conf: AddIndexesJSON{
+				Indexes: spec.Indexes,
+				Wait:    true,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range spec.Indexes {
+			report.Indexes = append(report.Indexes, index.Bucket+"."+indexName(index))
+		}
+	}
+
+	if spec.Analytics != nil {
+		err := addAnalytics(ctx, clusterID, AddAnalyticsOptions{
+			Conf: *spec.Analytics,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, dataset := range spec.Analytics.Datasets {
+			report.Datasets = append(report.Datasets, dataset.Name)
+		}
+	}
+
+	if len(spec.EventingFunctions) > 0 {
+		err := addEventingFunctions(ctx, clusterID, AddEventingFunctionsOptions{
+			Conf: AddEventingFunctionsJSON{
+				Functions: spec.EventingFunctions,
+				Wait:      true,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, function := range spec.EventingFunctions {
+			report.EventingFunctions = append(report.EventingFunctions, function.Name)
+		}
+	}
+
+	restNode := restNodeOf(c.Nodes[0])
+
+	for _, user := range spec.Users {
+		userOpt := &helper.UserOption{
+			Name:     user.Name,
+			Password: user.Password,
+		}
+		if len(user.Roles) > 0 {
+			roles := user.Roles
+			userOpt.Roles = &roles
+		}
+
+		logInfof(ctx, "Creating user %s", user.Name)
+		err := restNode.CreateUser(userOpt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create user %s", user.Name)
+		}
+		report.Users = append(report.Users, user.Name)
+	}
+
+	if spec.TLS != nil && spec.TLS.ClientCertAuth != nil {
+		certData, err := SetupCertAuth(SetupClientCertAuthOptions{
+			Nodes:       c.Nodes,
+			Conf:        *spec.TLS.ClientCertAuth,
+			UseHostname: c.UseHostname,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to set up client certificate auth")
+		}
+		report.ClientCert = certData
+	}
+
+	addedRemotes := make(map[string]bool)
+	for _, link := range spec.XDCR {
+		remote := remotes[resolveClusterID(link.RemoteCluster)]
+
+		if !addedRemotes[remote.ID] {
+			remoteLogin := &helper.Cred{Username: helper.RestUser, Password: helper.RestPass}
+			remoteHost := fmt.Sprintf("%s:%d", remote.Nodes[0].IPv4Address, helper.RestPort)
+
+			logInfof(ctx, "Adding xdcr remote cluster %s", remote.ID)
+			err := restNode.AddRemoteCluster(remote.ID, remoteHost, remoteLogin)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to add xdcr remote cluster %s", remote.ID)
+			}
+			addedRemotes[remote.ID] = true
+		}
+
+		toBucket := link.ToBucket
+		if toBucket == "" {
+			toBucket = link.FromBucket
+		}
+
+		logInfof(ctx, "Creating xdcr replication from %s to %s/%s", link.FromBucket, remote.ID, toBucket)
+		err := restNode.CreateReplication(link.FromBucket, remote.ID, toBucket)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create xdcr replication of %s", link.FromBucket)
+		}
+		report.Replications = append(report.Replications,
+			fmt.Sprintf("%s -> %s/%s", link.FromBucket, remote.ID, toBucket))
+	}
+
+	return report, nil
+}
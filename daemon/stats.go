@@ -0,0 +1,192 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// ResourceUsage is what a container, or a group of them, is using on its
+// docker host.  Network and block IO are totals since the container started.
+type ResourceUsage struct {
+	CPUPercent   float64
+	MemoryUsage  uint64
+	MemoryLimit  uint64
+	NetworkRx    uint64
+	NetworkTx    uint64
+	BlockRead    uint64
+	BlockWritten uint64
+}
+
+func (usage *ResourceUsage) add(other ResourceUsage) {
+	usage.CPUPercent += other.CPUPercent
+	usage.MemoryUsage += other.MemoryUsage
+	usage.MemoryLimit += other.MemoryLimit
+	usage.NetworkRx += other.NetworkRx
+	usage.NetworkTx += other.NetworkTx
+	usage.BlockRead += other.BlockRead
+	usage.BlockWritten += other.BlockWritten
+}
+
+type NodeStats struct {
+	Name  string
+	Usage ResourceUsage
+}
+
+type ClusterStats struct {
+	ClusterID string
+	Owner     string
+	Nodes     []NodeStats
+	Total     ResourceUsage
+}
+
+// OwnerStats is the resource usage of every cluster of a user.
+type OwnerStats struct {
+	Owner    string
+	Clusters int
+	Nodes    int
+	Total    ResourceUsage
+}
+
+// getContainerUsage takes a single sample of the stats of a container.
+func getContainerUsage(ctx context.Context, containerID string) (ResourceUsage, error) {
+	statsResp, err := dockerFor(containerID).ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return ResourceUsage{}, trackDockerError("container_stats", err)
+	}
+	defer statsResp.Body.Close()
+
+	var stats types.StatsJSON
+	err = json.NewDecoder(statsResp.Body).Decode(&stats)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+
+	usage := ResourceUsage{
+		MemoryUsage: stats.MemoryStats.Usage,
+		MemoryLimit: stats.MemoryStats.Limit,
+	}
+
+	// This is the same calculation as docker stats, the percentage can go
+	// over 100 when more than one CPU is in use.
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		usage.CPUPercent = cpuDelta / systemDelta * float64(len(stats.CPUStats.CPUUsage.PercpuUsage)) * 100
+	}
+
+	for _, network := range stats.Networks {
+		usage.NetworkRx += network.RxBytes
+		usage.NetworkTx += network.TxBytes
+	}
+
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			usage.BlockRead += entry.Value
+		case "write":
+			usage.BlockWritten += entry.Value
+		}
+	}
+
+	return usage, nil
+}
+
+func statsOfCluster(ctx context.Context, cluster *Cluster) (*ClusterStats, error) {
+	clusterStats := &ClusterStats{
+		ClusterID: cluster.ID,
+		Owner:     cluster.Owner,
+		Nodes:     make([]NodeStats, len(cluster.Nodes)),
+	}
+
+	// Every sample takes a moment for docker to take, so take them at once.
+	var wg sync.WaitGroup
+	errs := make([]error, len(cluster.Nodes))
+	for i, node := range cluster.Nodes {
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			clusterStats.Nodes[i].Name = node.Name
+			clusterStats.Nodes[i].Usage, errs[i] = getContainerUsage(ctx, node.ContainerID)
+		}(i, node)
+	}
+	wg.Wait()
+
+	for i, node := range clusterStats.Nodes {
+		if errs[i] != nil {
+			return nil, errors.Wrapf(errs[i], "failed to get the stats of node %s", node.Name)
+		}
+		clusterStats.Total.add(node.Usage)
+	}
+
+	return clusterStats, nil
+}
+
+// getClusterStats returns what each node of a cluster is using on its
+// docker host.
+func getClusterStats(ctx context.Context, clusterID string) (*ClusterStats, error) {
+	cluster, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Hibernated {
+		return nil, errors.New("hibernated clusters are not using any resources")
+	}
+	err = requireDockerCluster(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return statsOfCluster(ctx, cluster)
+}
+
+// getStatsByOwner adds up what the docker clusters of each user are using,
+// so that admins can see who is using the docker hosts.
+func getStatsByOwner(ctx context.Context) ([]OwnerStats, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can see the resource usage of every user")
+	}
+
+	clusters, err := getAllClusters(NewContext(ctx, ContextUser(ctx), true))
+	if err != nil {
+		return nil, err
+	}
+
+	ownerStats := make(map[string]*OwnerStats)
+	for _, cluster := range clusters {
+		if cluster.Hibernated || requireDockerCluster(cluster) != nil {
+			continue
+		}
+
+		clusterStats, err := statsOfCluster(ctx, cluster)
+		if err != nil {
+			// Clusters can be killed while we are looking at them.
+			logWarnf(ContextWithClusterID(ctx, cluster.ID), "Failed to get cluster stats: %s", err)
+			continue
+		}
+
+		stats, ok := ownerStats[cluster.Owner]
+		if !ok {
+			stats = &OwnerStats{Owner: cluster.Owner}
+			ownerStats[cluster.Owner] = stats
+		}
+		stats.Clusters++
+		stats.Nodes += len(cluster.Nodes)
+		stats.Total.add(clusterStats.Total)
+	}
+
+	var allStats []OwnerStats
+	for _, stats := range ownerStats {
+		allStats = append(allStats, *stats)
+	}
+	sort.Slice(allStats, func(i, j int) bool {
+		return allStats[i].Total.MemoryUsage > allStats[j].Total.MemoryUsage
+	})
+
+	return allStats, nil
+}
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"context"
+	"sort"
+
+	"github.com/couchbaselabs/cbdynclusterd/cluster"
+	"github.com/pkg/errors"
+)
+
+type ClusterStatusNode struct {
+	// Name is the name of the node in the cluster, or empty if ns_server
+	// knows of a node which isn't part of the cluster.
+	Name       string
+	Hostname   string
+	Status     string
+	Membership string
+	Version    string
+	Services   []string
+}
+
+type ClusterStatusBucket struct {
+	Name  string
+	Ready bool
+	// NodeStatuses is the status of the bucket on each node, by hostname.
+	NodeStatuses map[string]string
+}
+
+// ClusterStatus is the health of a cluster as ns_server reports it.
+type ClusterStatus struct {
+	Healthy           bool
+	Balanced          bool
+	RebalanceStatus   string
+	RebalanceProgress float64
+	RebalanceError    string
+	Nodes             []ClusterStatusNode
+	// Services lists the hostnames of the nodes running each service.
+	Services        map[string][]string
+	Buckets         []ClusterStatusBucket
+	FailedOverNodes []string
+}
+
+// getClusterStatus asks ns_server for the health of a cluster.  A cluster is
+// healthy when every node is healthy and active, no rebalance is running and
+// every bucket is ready on every node.
+func getClusterStatus(ctx context.Context, clusterID string) (*ClusterStatus, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if c.Provider == ProviderCapella {
+		return nil, errors.New("the status of capella clusters is not available")
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot get the status of a hibernated cluster")
+	}
+	if len(c.Nodes) == 0 {
+		return nil, errors.New("no nodes available")
+	}
+
+	// Any node can answer for the whole cluster, but some of them may be
+	// down, which is exactly when the status is interesting.
+	var restNode *cluster.Node
+	var pool *cluster.PoolStatus
+	for _, node := range c.Nodes {
+		restNode = restNodeOf(node)
+		pool, err = restNode.GetPoolStatus()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the status of the cluster from ns_server")
+	}
+
+	status := &ClusterStatus{
+		Healthy:  true,
+		Balanced: pool.Balanced,
+		Services: make(map[string][]string),
+	}
+
+	for _, poolNode := range pool.Nodes {
+		statusNode := ClusterStatusNode{
+			Hostname:   poolNode.Hostname,
+			Status:     poolNode.Status,
+			Membership: poolNode.ClusterMembership,
+			Version:    poolNode.Version,
+			Services:   poolNode.Services,
+		}
+		if node := nodeOfHostname(c.Nodes, poolNode.Hostname); node != nil {
+			statusNode.Name = node.Name
+		}
+		status.Nodes = append(status.Nodes, statusNode)
+
+		if poolNode.ClusterMembership == "inactiveFailed" {
+			status.FailedOverNodes = append(status.FailedOverNodes, poolNode.Hostname)
+		}
+		if poolNode.Status != "healthy" || poolNode.ClusterMembership != "active" {
+			status.Healthy = false
+		}
+
+		for _, service := range poolNode.Services {
+			status.Services[service] = append(status.Services[service], poolNode.Hostname)
+		}
+	}
+
+	progress, err := restNode.GetRebalanceProgress()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the rebalance progress from ns_server")
+	}
+	status.RebalanceStatus = progress.Status
+	status.RebalanceProgress = progress.Progress
+	status.RebalanceError = progress.Error
+	if progress.Status != "none" {
+		status.Healthy = false
+	}
+
+	buckets, err := restNode.GetBucketStatuses()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the buckets from ns_server")
+	}
+	for _, bucket := range buckets {
+		statusBucket := ClusterStatusBucket{
+			Name:         bucket.Name,
+			Ready:        len(bucket.Nodes) > 0,
+			NodeStatuses: make(map[string]string),
+		}
+		for _, bucketNode := range bucket.Nodes {
+			statusBucket.NodeStatuses[bucketNode.Hostname] = bucketNode.Status
+			if bucketNode.Status != "healthy" {
+				statusBucket.Ready = false
+			}
+		}
+		if !statusBucket.Ready {
+			status.Healthy = false
+		}
+		status.Buckets = append(status.Buckets, statusBucket)
+	}
+	sort.Slice(status.Buckets, func(i, j int) bool {
+		return status.Buckets[i].Name < status.Buckets[j].Name
+	})
+
+	return status, nil
+}
@@ -0,0 +1,135 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var teamNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Team is a named group of users who jointly own the clusters assigned to it.
+type Team struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+func teamKey(name string) string {
+	return "team-" + name
+}
+
+func getTeam(name string) (*Team, error) {
+	var team Team
+	err := metaStore.getRecord(teamKey(name), &team)
+	if err == ErrMetaNotFound {
+		return nil, errors.New("team not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &team, nil
+}
+
+func getAllTeams() ([]Team, error) {
+	var teams []Team
+	err := metaStore.forEachRecord("team-", func(key string, recordBytes []byte) error {
+		var team Team
+		err := json.Unmarshal(recordBytes, &team)
+		if err != nil {
+			return err
+		}
+
+		teams = append(teams, team)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return teams, nil
+}
+
+// getTeamsOfUser returns the names of all the teams that user is a member of.
+func getTeamsOfUser(user string) (map[string]bool, error) {
+	teams, err := getAllTeams()
+	if err != nil {
+		return nil, err
+	}
+
+	userTeams := make(map[string]bool)
+	for _, team := range teams {
+		if containsString(team.Members, user) {
+			userTeams[team.Name] = true
+		}
+	}
+
+	return userTeams, nil
+}
+
+func isTeamMember(teamName, user string) bool {
+	if teamName == "" {
+		return false
+	}
+
+	team, err := getTeam(teamName)
+	if err != nil {
+		return false
+	}
+
+	return containsString(team.Members, user)
+}
+
+func setTeamMembers(ctx context.Context, name string, members []string) (*Team, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can manage teams")
+	}
+
+	if !teamNameRegexp.MatchString(name) {
+		return nil, errors.New("team names must be lowercase letters, numbers, dashes and underscores")
+	}
+
+	team := &Team{
+		Name:      name,
+		UpdatedAt: time.Now(),
+		UpdatedBy: ContextUser(ctx),
+	}
+	for _, member := range members {
+		if !containsString(team.Members, member) {
+			team.Members = append(team.Members, member)
+		}
+	}
+
+	err := metaStore.setRecord(teamKey(name), team)
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Set members of team %s to %v", name, team.Members)
+
+	return team, nil
+}
+
+func deleteTeam(ctx context.Context, name string) error {
+	if !ContextIsAdmin(ctx) {
+		return errors.New("only admins can manage teams")
+	}
+
+	_, err := getTeam(name)
+	if err != nil {
+		return err
+	}
+
+	err = metaStore.deleteRecord(teamKey(name))
+	if err != nil {
+		return err
+	}
+
+	logInfof(ctx, "Deleted team %s", name)
+
+	return nil
+}
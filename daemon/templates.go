@@ -0,0 +1,156 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var templateNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// ClusterTemplate is a named cluster shape which users can allocate without
+// having to describe every node themselves.
+type ClusterTemplate struct {
+	Name        string                  `json:"name"`
+	Description string                  `json:"description,omitempty"`
+	Timeout     string                  `json:"timeout,omitempty"`
+	Nodes       []CreateClusterNodeJSON `json:"nodes"`
+	Setup       *CreateClusterSetupJSON `json:"setup,omitempty"`
+	UpdatedAt   time.Time               `json:"updated_at"`
+	UpdatedBy   string                  `json:"updated_by"`
+}
+
+func templateKey(name string) string {
+	return "template-" + name
+}
+
+func getTemplate(name string) (*ClusterTemplate, error) {
+	var template ClusterTemplate
+	err := metaStore.getRecord(templateKey(name), &template)
+	if err == ErrMetaNotFound {
+		return nil, errors.Errorf("template %s not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+func getAllTemplates() ([]ClusterTemplate, error) {
+	var templates []ClusterTemplate
+	err := metaStore.forEachRecord("template-", func(key string, recordBytes []byte) error {
+		var template ClusterTemplate
+		err := json.Unmarshal(recordBytes, &template)
+		if err != nil {
+			return err
+		}
+
+		templates = append(templates, template)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return templates, nil
+}
+
+func validateTemplate(template *ClusterTemplate) error {
+	if !templateNameRegexp.MatchString(template.Name) {
+		return errors.New("template names must be lowercase letters, numbers, dots, dashes and underscores")
+	}
+
+	if len(template.Nodes) == 0 {
+		return errors.New("templates must have at least one node")
+	}
+
+	if template.Timeout != "" {
+		_, err := time.ParseDuration(template.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, node := range template.Nodes {
+		_, err := parseServerVersion(node.ServerVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	if template.Setup != nil && len(template.Setup.Services) != len(template.Nodes) {
+		return errors.New("services does not map to number of nodes")
+	}
+
+	return nil
+}
+
+func setTemplate(ctx context.Context, template ClusterTemplate) (*ClusterTemplate, error) {
+	if !ContextIsAdmin(ctx) {
+		return nil, errors.New("only admins can manage templates")
+	}
+
+	err := validateTemplate(&template)
+	if err != nil {
+		return nil, err
+	}
+
+	template.UpdatedAt = time.Now()
+	template.UpdatedBy = ContextUser(ctx)
+
+	err = metaStore.setRecord(templateKey(template.Name), &template)
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Saved cluster template %s", template.Name)
+
+	return &template, nil
+}
+
+func deleteTemplate(ctx context.Context, name string) error {
+	if !ContextIsAdmin(ctx) {
+		return errors.New("only admins can manage templates")
+	}
+
+	_, err := getTemplate(name)
+	if err != nil {
+		return err
+	}
+
+	err = metaStore.deleteRecord(templateKey(name))
+	if err != nil {
+		return err
+	}
+
+	logInfof(ctx, "Deleted cluster template %s", name)
+
+	return nil
+}
+
+// applyClusterTemplate fills in whatever a create request left out from a
+// template, anything the request does specify overrides the template.
+func applyClusterTemplate(reqData *CreateClusterJSON, templateName string) error {
+	template, err := getTemplate(templateName)
+	if err != nil {
+		return err
+	}
+
+	if reqData.Timeout == "" {
+		reqData.Timeout = template.Timeout
+	}
+
+	if len(reqData.Nodes) == 0 {
+		reqData.Nodes = append([]CreateClusterNodeJSON(nil), template.Nodes...)
+	}
+
+	if reqData.Setup == nil && template.Setup != nil {
+		setup := *template.Setup
+		reqData.Setup = &setup
+	}
+
+	return nil
+}
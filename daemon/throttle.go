@@ -0,0 +1,55 @@
+package daemon
+
+import (
+	"context"
+)
+
+// dockerConcurrency is how many Docker heavy operations, such as pulling
+// images and creating containers, can run at once.  0 means no limit.
+var dockerConcurrency = 8
+
+// nodeAllocationConcurrency is how many nodes can be allocated at once across
+// all clusters, which also bounds the load put on the DNS service.  0 means
+// no limit.
+var nodeAllocationConcurrency = 16
+
+// slotLimiter bounds how many of an operation can run at once.
+type slotLimiter struct {
+	slots chan struct{}
+}
+
+func newSlotLimiter(limit int) *slotLimiter {
+	if limit <= 0 {
+		return &slotLimiter{}
+	}
+	return &slotLimiter{slots: make(chan struct{}, limit)}
+}
+
+// acquire waits for the operation to be allowed to run, the returned function
+// must be called once it has finished.
+func (limiter *slotLimiter) acquire(ctx context.Context) (func(), error) {
+	if limiter == nil || limiter.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return func() {
+			<-limiter.slots
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var dockerSlots *slotLimiter
+var nodeAllocationSlots *slotLimiter
+
+func initSlotLimiters() {
+	dockerSlots = newSlotLimiter(dockerConcurrency)
+	nodeAllocationSlots = newSlotLimiter(nodeAllocationConcurrency)
+}
+
+func acquireDockerSlot(ctx context.Context) (func(), error) {
+	return dockerSlots.acquire(ctx)
+}
@@ -0,0 +1,590 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+)
+
+// A toxiproxy fixture is a toxiproxy server which is run next to the nodes of
+// a cluster, with a proxy in front of some of the ports of each node, so that
+// network faults can be injected between clients and particular nodes and
+// services.
+
+const toxiproxyImage = "ghcr.io/shopify/toxiproxy:2.5.0"
+const toxiproxyAPIPort = 8474
+
+// toxiproxyAlternateLabel marks toxiproxy fixtures which the nodes of the
+// cluster advertise as their alternate addresses.
+const toxiproxyAlternateLabel = "com.couchbase.dyncluster.toxiproxy_alternate_addresses"
+
+// toxiproxyStartTimeout is how long the server has to start listening once
+// its container has been started.
+const toxiproxyStartTimeout = 1 * time.Minute
+
+// defaultToxiproxyPorts are proxied when no ports are asked for, which is
+// enough for SDKs to bootstrap and use the data service.
+var defaultToxiproxyPorts = []int{8091, 11210}
+
+// toxiproxyPortNames are the couchbase ports which can be proxied, by the
+// name that ns_server gives them in alternate addresses.
+var toxiproxyPortNames = map[int]string{
+	8091:  "mgmt",
+	18091: "mgmtSSL",
+	11210: "kv",
+	11207: "kvSSL",
+	8092:  "capi",
+	18092: "capiSSL",
+	8093:  "n1ql",
+	18093: "n1qlSSL",
+	8094:  "fts",
+	18094: "ftsSSL",
+	8095:  "cbas",
+	18095: "cbasSSL",
+	8096:  "eventingAdminPort",
+	18096: "eventingSSL",
+}
+
+// toxicAttributes are the toxics which can be added, and the attributes that
+// each of them takes.
+var toxicAttributes = map[string][]string{
+	"latency":    {"latency", "jitter"},
+	"bandwidth":  {"rate"},
+	"reset_peer": {"timeout"},
+	"timeout":    {"timeout"},
+}
+
+type ToxiproxyOptions struct {
+	// Ports are proxied on every node.
+	Ports []int
+	// AlternateAddresses makes each node advertise the proxies in front of
+	// it as its alternate address, so that clients which use alternate
+	// addresses only talk to the cluster through the proxies.
+	AlternateAddresses bool
+}
+
+type ToxicOptions struct {
+	// Port picks the proxy of the node to add the toxic to, every proxy of
+	// the node if it is zero.
+	Port       int
+	Name       string
+	Type       string
+	Stream     string
+	Toxicity   float64
+	Attributes map[string]int
+}
+
+// Toxic is a fault which a proxy applies to the connections through it, as
+// the toxiproxy API describes it.
+type Toxic struct {
+	Name       string         `json:"name"`
+	Type       string         `json:"type"`
+	Stream     string         `json:"stream"`
+	Toxicity   float64        `json:"toxicity"`
+	Attributes map[string]int `json:"attributes"`
+}
+
+// toxiproxyProxy is a proxy as the toxiproxy API describes it.
+type toxiproxyProxy struct {
+	Name     string  `json:"name"`
+	Listen   string  `json:"listen"`
+	Upstream string  `json:"upstream"`
+	Enabled  bool    `json:"enabled"`
+	Toxics   []Toxic `json:"toxics,omitempty"`
+}
+
+// ToxicProxy is a proxy in front of one port of a node.  Listen is where
+// clients connect to the proxy.
+type ToxicProxy struct {
+	Node     string
+	Port     int
+	Listen   string
+	Upstream string
+	Toxics   []Toxic
+}
+
+type ToxiproxyFixture struct {
+	ContainerID        string
+	Address            string
+	AlternateAddresses bool
+	Proxies            []ToxicProxy
+}
+
+func toxiproxyName(nodeName string, port int) string {
+	return fmt.Sprintf("%s-%d", nodeName, port)
+}
+
+// parseToxiproxyName splits the name of a proxy back into the node and port
+// which it is in front of.
+func parseToxiproxyName(name string) (string, int) {
+	sep := strings.LastIndex(name, "-")
+	if sep < 0 {
+		return name, 0
+	}
+	port, _ := strconv.Atoi(name[sep+1:])
+	return name[:sep], port
+}
+
+var toxiproxyClient = &http.Client{Timeout: 10 * time.Second}
+
+// toxiproxyCall makes a request to the API of a toxiproxy server, decoding
+// the response into out if it is set.
+func toxiproxyCall(address, method, path string, body, out interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(address, strconv.Itoa(toxiproxyAPIPort)), path)
+	req, err := http.NewRequest(method, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := toxiproxyClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not reach toxiproxy")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("toxiproxy returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+func toxiproxyCluster(ctx context.Context, clusterID string) (*Cluster, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageCluster(ctx, c) {
+		return nil, errors.New("cannot change clusters you don't own")
+	}
+	err = requireDockerCluster(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Hibernated {
+		return nil, errors.New("cannot change the proxies of a hibernated cluster")
+	}
+
+	return c, nil
+}
+
+func findToxiproxyFixture(ctx context.Context, clusterID string) (*types.Container, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", fixtureClusterIDLabel+"="+clusterID)
+	filterArgs.Add("label", "com.couchbase.dyncluster.fixture_type=toxiproxy")
+
+	containers, err := listContainers(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterArgs,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, errors.New("cluster has no toxiproxy")
+	}
+
+	return &containers[0], nil
+}
+
+// startToxiproxyFixture runs a toxiproxy server on the same docker host and
+// network as the nodes of a cluster, and waits for its API to start
+// listening.
+func startToxiproxyFixture(ctx context.Context, host *DockerHost, clusterID string, alternateAddresses bool) (*ToxiproxyFixture, error) {
+	logInfof(ctx, "Pulling %s image", toxiproxyImage)
+	err := imagePull(ctx, host, toxiproxyImage)
+	if err != nil {
+		// The image may have been loaded onto the host by hand.
+		logWarnf(ctx, "Failed to pull %s: %s", toxiproxyImage, err)
+	}
+
+	release, err := acquireDockerSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	createResult, err := host.Client.ContainerCreate(context.Background(), &container.Config{
+		Image: toxiproxyImage,
+		Cmd:   []string{"-host", "0.0.0.0"},
+		Labels: map[string]string{
+			fixtureClusterIDLabel:                   clusterID,
+			"com.couchbase.dyncluster.fixture_type": "toxiproxy",
+			toxiproxyAlternateLabel:                 strconv.FormatBool(alternateAddresses),
+		},
+	}, &container.HostConfig{
+		AutoRemove:  true,
+		NetworkMode: container.NetworkMode(NetworkName),
+	}, nil, fmt.Sprintf("dynclsr-%s-toxiproxy", clusterID))
+	if err != nil {
+		release()
+		return nil, trackDockerError("container_create", err)
+	}
+	rememberContainerHost(createResult.ID, host)
+
+	removeContainer := func() {
+		host.Client.ContainerRemove(context.Background(), createResult.ID, types.ContainerRemoveOptions{Force: true})
+	}
+
+	err = host.Client.ContainerStart(context.Background(), createResult.ID, types.ContainerStartOptions{})
+	release()
+	if err != nil {
+		removeContainer()
+		return nil, trackDockerError("container_start", err)
+	}
+
+	containerJSON, err := host.Client.ContainerInspect(context.Background(), createResult.ID)
+	if err != nil {
+		removeContainer()
+		return nil, trackDockerError("container_inspect", err)
+	}
+
+	fixture := &ToxiproxyFixture{
+		ContainerID:        createResult.ID[0:12],
+		Address:            containerJSON.NetworkSettings.Networks[NetworkName].IPAddress,
+		AlternateAddresses: alternateAddresses,
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, toxiproxyStartTimeout)
+	defer cancel()
+	err = waitForPort(startCtx, net.JoinHostPort(fixture.Address, strconv.Itoa(toxiproxyAPIPort)))
+	if err != nil {
+		removeContainer()
+		return nil, err
+	}
+
+	return fixture, nil
+}
+
+// addToxiproxy starts a toxiproxy server for a cluster with a proxy in front
+// of each of the ports of every node.  The server is removed again if the
+// proxies can't all be created.
+func addToxiproxy(ctx context.Context, clusterID string, opts ToxiproxyOptions) (*ToxiproxyFixture, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	ports := opts.Ports
+	if len(ports) == 0 {
+		ports = defaultToxiproxyPorts
+	}
+	logInfof(ctx, "Adding toxiproxy in front of ports %v", ports)
+
+	seenPorts := make(map[int]bool)
+	for _, port := range ports {
+		if toxiproxyPortNames[port] == "" {
+			return nil, errors.Errorf("%d is not a couchbase port which can be proxied", port)
+		}
+		if seenPorts[port] {
+			return nil, errors.Errorf("port %d is given more than once", port)
+		}
+		seenPorts[port] = true
+	}
+
+	c, err := toxiproxyCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nodes) == 0 {
+		return nil, errors.New("no nodes available")
+	}
+
+	_, err = findToxiproxyFixture(ctx, clusterID)
+	if err == nil {
+		return nil, errors.New("cluster already has a toxiproxy")
+	}
+
+	host := dockerHostOf(c.Nodes[0].ContainerID)
+	fixture, err := startToxiproxyFixture(ctx, host, clusterID, opts.AlternateAddresses)
+	if err != nil {
+		return nil, err
+	}
+
+	removeFixture := func() {
+		host.Client.ContainerRemove(context.Background(), fixture.ContainerID, types.ContainerRemoveOptions{Force: true})
+		forgetContainerHost(fixture.ContainerID)
+	}
+
+	var alternateAddresses []AlternateAddress
+	for _, node := range c.Nodes {
+		alternateAddress := AlternateAddress{
+			Node:     node.Name,
+			Hostname: fixture.Address,
+			Ports:    make(map[string]int),
+		}
+
+		for _, port := range ports {
+			// Listening on port 0 lets toxiproxy pick a free port.
+			var proxy toxiproxyProxy
+			err = toxiproxyCall(fixture.Address, "POST", "/proxies", toxiproxyProxy{
+				Name:     toxiproxyName(node.Name, port),
+				Listen:   "0.0.0.0:0",
+				Upstream: net.JoinHostPort(node.IPv4Address, strconv.Itoa(port)),
+				Enabled:  true,
+			}, &proxy)
+			if err != nil {
+				removeFixture()
+				return nil, errors.Wrapf(err, "failed to proxy port %d of node %s", port, node.Name)
+			}
+
+			_, listenPort, err := net.SplitHostPort(proxy.Listen)
+			if err == nil {
+				alternateAddress.Ports[toxiproxyPortNames[port]], err = strconv.Atoi(listenPort)
+			}
+			if err != nil {
+				removeFixture()
+				return nil, errors.Wrapf(err, "toxiproxy is listening on an invalid address %s", proxy.Listen)
+			}
+		}
+
+		alternateAddresses = append(alternateAddresses, alternateAddress)
+	}
+
+	if opts.AlternateAddresses {
+		err = setAlternateAddresses(ctx, clusterID, alternateAddresses)
+		if err != nil {
+			removeFixture()
+			return nil, err
+		}
+	}
+
+	return getToxiproxy(ctx, clusterID)
+}
+
+// getToxiproxy returns the toxiproxy server of a cluster, with its proxies
+// and their toxics.
+func getToxiproxy(ctx context.Context, clusterID string) (*ToxiproxyFixture, error) {
+	c, err := getCluster(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtureContainer, err := findToxiproxyFixture(ctx, c.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := &ToxiproxyFixture{
+		ContainerID:        fixtureContainer.ID[0:12],
+		AlternateAddresses: fixtureContainer.Labels[toxiproxyAlternateLabel] == "true",
+	}
+	if eth0Net := fixtureContainer.NetworkSettings.Networks[NetworkName]; eth0Net != nil {
+		fixture.Address = eth0Net.IPAddress
+	}
+
+	var proxies map[string]toxiproxyProxy
+	err = toxiproxyCall(fixture.Address, "GET", "/proxies", nil, &proxies)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, proxy := range proxies {
+		nodeName, port := parseToxiproxyName(proxy.Name)
+		fixture.Proxies = append(fixture.Proxies, ToxicProxy{
+			Node:     nodeName,
+			Port:     port,
+			Listen:   proxy.Listen,
+			Upstream: proxy.Upstream,
+			Toxics:   proxy.Toxics,
+		})
+	}
+	sort.Slice(fixture.Proxies, func(i, j int) bool {
+		if fixture.Proxies[i].Node != fixture.Proxies[j].Node {
+			return fixture.Proxies[i].Node < fixture.Proxies[j].Node
+		}
+		return fixture.Proxies[i].Port < fixture.Proxies[j].Port
+	})
+
+	return fixture, nil
+}
+
+// removeToxiproxy removes the toxiproxy server of a cluster, pointing clients
+// back at the nodes themselves if it was their alternate address.
+func removeToxiproxy(ctx context.Context, clusterID string) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+	logInfof(ctx, "Removing toxiproxy")
+
+	_, err := toxiproxyCluster(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	fixtureContainer, err := findToxiproxyFixture(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	if fixtureContainer.Labels[toxiproxyAlternateLabel] == "true" {
+		err = clearAlternateAddresses(ctx, clusterID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return removeFixtureContainers([]types.Container{*fixtureContainer})
+}
+
+// toxicProxiesOf finds the proxies in front of a node, only the one in front
+// of a single port if it is given.
+func toxicProxiesOf(ctx context.Context, clusterID, nodeRef string, port int) (*ToxiproxyFixture, []ToxicProxy, error) {
+	c, err := toxiproxyCluster(ctx, clusterID)
+	if err != nil {
+		return nil, nil, err
+	}
+	node, err := findNode(c, nodeRef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fixture, err := getToxiproxy(ctx, clusterID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var proxies []ToxicProxy
+	for _, proxy := range fixture.Proxies {
+		if proxy.Node == node.Name && (port == 0 || proxy.Port == port) {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if len(proxies) == 0 {
+		if port != 0 {
+			return nil, nil, errors.Errorf("port %d of node %s is not proxied", port, node.Name)
+		}
+		return nil, nil, errors.Errorf("node %s is not proxied", node.Name)
+	}
+
+	return fixture, proxies, nil
+}
+
+func validateToxic(opts ToxicOptions) (Toxic, error) {
+	attributes, ok := toxicAttributes[opts.Type]
+	if !ok {
+		var toxicTypes []string
+		for toxicType := range toxicAttributes {
+			toxicTypes = append(toxicTypes, toxicType)
+		}
+		sort.Strings(toxicTypes)
+		return Toxic{}, errors.Errorf("toxic type must be one of %s", strings.Join(toxicTypes, ", "))
+	}
+
+	toxic := Toxic{
+		Name:       opts.Name,
+		Type:       opts.Type,
+		Stream:     opts.Stream,
+		Toxicity:   opts.Toxicity,
+		Attributes: opts.Attributes,
+	}
+	if toxic.Stream == "" {
+		toxic.Stream = "downstream"
+	}
+	if toxic.Stream != "upstream" && toxic.Stream != "downstream" {
+		return Toxic{}, errors.New("toxic stream must be upstream or downstream")
+	}
+	if toxic.Name == "" {
+		toxic.Name = toxic.Type + "_" + toxic.Stream
+	}
+	if toxic.Toxicity == 0 {
+		toxic.Toxicity = 1
+	}
+	if toxic.Toxicity < 0 || toxic.Toxicity > 1 {
+		return Toxic{}, errors.New("toxicity must be between 0 and 1")
+	}
+	for name, value := range toxic.Attributes {
+		if !containsString(attributes, name) {
+			return Toxic{}, errors.Errorf("%s toxics don't have a %s attribute", toxic.Type, name)
+		}
+		if value < 0 {
+			return Toxic{}, errors.Errorf("attribute %s can't be negative", name)
+		}
+	}
+
+	return toxic, nil
+}
+
+// addToxic adds a toxic to the proxies in front of a node.
+func addToxic(ctx context.Context, clusterID, nodeRef string, opts ToxicOptions) (*Toxic, error) {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	toxic, err := validateToxic(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fixture, proxies, err := toxicProxiesOf(ctx, clusterID, nodeRef, opts.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, proxy := range proxies {
+		name := toxiproxyName(proxy.Node, proxy.Port)
+		logInfof(ContextWithNode(ctx, proxy.Node), "Adding %s toxic %s to port %d", toxic.Type, toxic.Name, proxy.Port)
+		err = toxiproxyCall(fixture.Address, "POST", "/proxies/"+name+"/toxics", toxic, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to add toxic to port %d of node %s", proxy.Port, proxy.Node)
+		}
+	}
+
+	return &toxic, nil
+}
+
+// removeToxic removes a toxic from the proxies in front of a node which
+// have it.
+func removeToxic(ctx context.Context, clusterID, nodeRef, toxicName string, port int) error {
+	ctx = ContextWithClusterID(ctx, clusterID)
+
+	fixture, proxies, err := toxicProxiesOf(ctx, clusterID, nodeRef, port)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for _, proxy := range proxies {
+		for _, toxic := range proxy.Toxics {
+			if toxic.Name != toxicName {
+				continue
+			}
+
+			name := toxiproxyName(proxy.Node, proxy.Port)
+			logInfof(ContextWithNode(ctx, proxy.Node), "Removing toxic %s from port %d", toxicName, proxy.Port)
+			err = toxiproxyCall(fixture.Address, "DELETE", "/proxies/"+name+"/toxics/"+toxicName, nil, nil)
+			if err != nil {
+				return errors.Wrapf(err, "failed to remove toxic from port %d of node %s", proxy.Port, proxy.Node)
+			}
+			removed = true
+		}
+	}
+	if !removed {
+		return errors.Errorf("toxic %s not found", toxicName)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Toy builds are one-off packages of couchbase server, such as those built
+// from a branch which is under review, which nodes can be allocated from as
+// well as releases and builds from the build server.  Once registered, a toy
+// build is known by a server version such as 7.0.0-toy-0123456789ab, so that
+// it can be used wherever any other version can, while its images are kept
+// apart from those of official builds.
+
+const toyBuildMarker = "toy"
+
+// toyBuildIDLength is how much of the checksum of a package identifies its
+// toy build.
+const toyBuildIDLength = 12
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type ToyBuild struct {
+	Version    string    `json:"version"`
+	PackageURL string    `json:"package_url"`
+	Checksum   string    `json:"checksum"`
+	Creator    string    `json:"creator"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func toyBuildKey(id string) string {
+	return "toybuild-" + id
+}
+
+func getToyBuild(id string) (*ToyBuild, error) {
+	var build ToyBuild
+	err := metaStore.getRecord(toyBuildKey(id), &build)
+	if err == ErrMetaNotFound {
+		return nil, errors.Errorf("toy build %s has not been registered", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+// registerToyBuild records where the package of a toy build can be found and
+// returns the server version which it is known by.  The checksum is the
+// SHA-256 of the package, which it is checked against when its image is
+// built.
+func registerToyBuild(ctx context.Context, version, packageURL, checksum string) (string, error) {
+	if version == "" || strings.Contains(version, "-") {
+		return "", errors.New("toy builds need the version that they were built from, such as 7.0.0")
+	}
+	_, err := flavorFromVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	parsedURL, err := url.Parse(packageURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" ||
+		strings.ContainsAny(packageURL, "'\" \t\n") {
+		return "", errors.Errorf("%q is not a valid package url", packageURL)
+	}
+	switch path.Ext(parsedURL.Path) {
+	case ".rpm":
+	case ".deb":
+		return "", errors.New("nodes run centos7, so toy builds must be rpm packages")
+	default:
+		return "", errors.New("toy builds must be rpm packages")
+	}
+
+	checksum = strings.ToLower(checksum)
+	if !sha256Regexp.MatchString(checksum) {
+		return "", errors.New("toy builds need the sha256 checksum of their package")
+	}
+
+	id := checksum[:toyBuildIDLength]
+	existing, err := getToyBuild(id)
+	if err == nil && existing.Checksum != checksum {
+		return "", errors.Errorf("a different package has already been registered as toy build %s", id)
+	}
+
+	logInfof(ctx, "Registering toy build %s from %s", id, packageURL)
+	err = metaStore.setRecord(toyBuildKey(id), ToyBuild{
+		Version:    version,
+		PackageURL: packageURL,
+		Checksum:   checksum,
+		Creator:    ContextUser(ctx),
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%s-%s", version, toyBuildMarker, id), nil
+}
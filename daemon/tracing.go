@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/couchbaselabs/cbdynclusterd/daemon"
+
+// traceContext reads and writes the W3C traceparent header, so that the
+// spans of a request join the trace of whoever sent it.
+var traceContext = propagation.TraceContext{}
+
+// newTraceProvider sets up exporting of spans to an OpenTelemetry collector
+// using OTLP over HTTP.  endpoint is the base URL of the collector, such as
+// http://127.0.0.1:4318, which spans are sent to under /v1/traces.
+func newTraceProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	parsedURL, err := url.Parse(endpoint)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return nil, errors.Errorf("%q is not a valid otlp endpoint", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(parsedURL.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(parsedURL.Path, "/") + "/v1/traces"),
+	}
+	if parsedURL.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("cbdynclusterd"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider, nil
+}
+
+// startSpan starts a tracing span tagged with the request details stored in
+// ctx, the caller must end the returned span.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startSpanOfKind(ctx, name, trace.SpanKindInternal, attrs...)
+}
+
+func startSpanOfKind(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if requestID := ContextRequestID(ctx); requestID != "" {
+		attrs = append(attrs, attribute.String("cbdyncluster.request_id", requestID))
+	}
+	if user := ContextUser(ctx); user != "" {
+		attrs = append(attrs, attribute.String("cbdyncluster.user", user))
+	}
+	if clusterID := ContextClusterID(ctx); clusterID != "" {
+		attrs = append(attrs, attribute.String("cbdyncluster.cluster_id", clusterID))
+	}
+	if node := ContextNode(ctx); node != "" {
+		attrs = append(attrs, attribute.String("cbdyncluster.node", node))
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// endSpan finishes a span, marking it as failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// tracingMiddleware starts a server span for each request, joining the
+// caller's trace if it sent a traceparent header.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if currentRoute := mux.CurrentRoute(r); currentRoute != nil {
+			if template, err := currentRoute.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := startSpanOfKind(ctx, r.Method+" "+route, trace.SpanKindServer,
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route))
+
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(rec.status))
+		if rec.status >= 400 {
+			endSpan(span, errHTTPStatus(rec.status))
+			return
+		}
+		endSpan(span, nil)
+	})
+}
+
+type errHTTPStatus int
+
+func (status errHTTPStatus) Error() string {
+	return http.StatusText(int(status))
+}
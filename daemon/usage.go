@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// usageSampleInterval is how often the clusters which exist are counted
+// towards the usage of their owners.  Usage is only as accurate as this.
+const usageSampleInterval = time.Minute
+
+const (
+	UsageGroupByUser = "user"
+	UsageGroupByTeam = "team"
+)
+
+// UsageRecord is how long a cluster ran for during an hour.  Hibernated
+// clusters aren't running and so don't count.
+type UsageRecord struct {
+	Hour           time.Time `json:"hour"`
+	ClusterID      string    `json:"cluster_id"`
+	Owner          string    `json:"owner"`
+	Team           string    `json:"team,omitempty"`
+	Provider       string    `json:"provider,omitempty"`
+	ClusterSeconds float64   `json:"cluster_seconds"`
+	NodeSeconds    float64   `json:"node_seconds"`
+}
+
+// usageKey orders records by the hour they are for, so that a report only
+// has to look at the hours it covers.
+func usageKey(hour time.Time, clusterID string) string {
+	return fmt.Sprintf("usage-%020d-%s", hour.UnixNano(), clusterID)
+}
+
+// recordUsage counts every running cluster as having run for elapsed, in
+// the hour which now is in.
+func recordUsage(ctx context.Context, now time.Time, elapsed time.Duration) error {
+	clusters, err := getAllClusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	hour := now.UTC().Truncate(time.Hour)
+	for _, cluster := range clusters {
+		if cluster.Hibernated {
+			continue
+		}
+
+		key := usageKey(hour, cluster.ID)
+		var record UsageRecord
+		err := metaStore.getRecord(key, &record)
+		if err != nil {
+			record = UsageRecord{
+				Hour:      hour,
+				ClusterID: cluster.ID,
+			}
+		}
+
+		// The owner and team at the end of the hour get the whole hour, which
+		// is close enough given how rarely clusters change hands.
+		record.Owner = cluster.Owner
+		record.Team = cluster.Team
+		record.Provider = cluster.Provider
+		record.ClusterSeconds += elapsed.Seconds()
+		record.NodeSeconds += elapsed.Seconds() * float64(len(cluster.Nodes))
+
+		err = metaStore.setRecord(key, &record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runUsageAccounting periodically counts the clusters which exist towards
+// the usage of their owners.
+func runUsageAccounting(shutdownSig chan struct{}) {
+	for {
+		select {
+		case <-shutdownSig:
+			return
+		case <-time.After(usageSampleInterval):
+		}
+
+		if !isLeader() {
+			continue
+		}
+
+		err := recordUsage(systemCtx, time.Now(), usageSampleInterval)
+		if err != nil {
+			logErrorf(systemCtx, "Failed to record cluster usage: %s", err)
+		}
+	}
+}
+
+type UsageFilter struct {
+	User    string
+	Team    string
+	Since   time.Time
+	Until   time.Time
+	GroupBy string
+}
+
+// UsageTotal is the usage of a single user or team.
+type UsageTotal struct {
+	Name         string
+	Clusters     int
+	ClusterHours float64
+	NodeHours    float64
+}
+
+// getUsage totals the usage matching filter by user or by team, the most
+// used first.  Usage is kept by the hour, so any hour which overlaps with the
+// time range counts in full.  Users who aren't admins can only look at their
+// own usage, or at that of a team they are in.
+func getUsage(ctx context.Context, filter UsageFilter) ([]UsageTotal, error) {
+	user := ContextUser(ctx)
+	if !ContextIsAdmin(ctx) && filter.User != user && (filter.Team == "" || !isTeamMember(filter.Team, user)) {
+		return nil, errors.New("must specify yourself as the user or a team you are in")
+	}
+
+	groupBy := filter.GroupBy
+	if groupBy == "" {
+		groupBy = UsageGroupByUser
+	}
+	if groupBy != UsageGroupByUser && groupBy != UsageGroupByTeam {
+		return nil, errors.Errorf("cannot group usage by %q", groupBy)
+	}
+
+	totals := make(map[string]*UsageTotal)
+	clusters := make(map[string]map[string]bool)
+	err := metaStore.forEachRecord("usage-", func(key string, recordBytes []byte) error {
+		var record UsageRecord
+		err := json.Unmarshal(recordBytes, &record)
+		if err != nil {
+			return err
+		}
+
+		if filter.User != "" && record.Owner != filter.User {
+			return nil
+		}
+		if filter.Team != "" && record.Team != filter.Team {
+			return nil
+		}
+		if !filter.Since.IsZero() && !record.Hour.Add(time.Hour).After(filter.Since) {
+			return nil
+		}
+		if !filter.Until.IsZero() && record.Hour.After(filter.Until) {
+			return nil
+		}
+
+		name := record.Owner
+		if groupBy == UsageGroupByTeam {
+			name = record.Team
+		}
+
+		total, ok := totals[name]
+		if !ok {
+			total = &UsageTotal{Name: name}
+			totals[name] = total
+			clusters[name] = make(map[string]bool)
+		}
+		if !clusters[name][record.ClusterID] {
+			clusters[name][record.ClusterID] = true
+			total.Clusters++
+		}
+		total.ClusterHours += record.ClusterSeconds / time.Hour.Seconds()
+		total.NodeHours += record.NodeSeconds / time.Hour.Seconds()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []UsageTotal
+	for _, total := range totals {
+		usage = append(usage, *total)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].NodeHours > usage[j].NodeHours
+	})
+
+	return usage, nil
+}
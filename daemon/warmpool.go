@@ -0,0 +1,353 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// warmPoolSizes is how many idle nodes are kept started on each docker host
+// for each server version, so that allocations can skip starting containers.
+var warmPoolSizes = make(map[string]int)
+
+const poolLabel = "com.couchbase.dyncluster.pool"
+
+// PoolClaim records which cluster a pooled container was handed to.  Docker
+// can't change the labels of a container once it is created, so these stand
+// in for the labels that nodes created for a cluster are given.
+type PoolClaim struct {
+	ClusterID string `json:"cluster_id"`
+	NodeName  string `json:"node_name"`
+	Creator   string `json:"creator"`
+}
+
+func poolClaimKey(containerID string) string {
+	return "poolclaim-" + containerID
+}
+
+// parseWarmPoolSizes parses pool sizes in the form 7.0.2=2,6.6.5=1.
+func parseWarmPoolSizes(sizesStr string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	if sizesStr == "" {
+		return sizes, nil
+	}
+
+	for _, sizeStr := range strings.Split(sizesStr, ",") {
+		sizeParts := strings.SplitN(strings.TrimSpace(sizeStr), "=", 2)
+		if len(sizeParts) != 2 {
+			return nil, fmt.Errorf("warm pool sizes must be version=count, not %s", sizeStr)
+		}
+
+		_, err := parseServerVersion(sizeParts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(sizeParts[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid warm pool size for %s", sizeParts[0])
+		}
+
+		sizes[sizeParts[0]] = size
+	}
+
+	return sizes, nil
+}
+
+func getPoolClaims() (map[string]PoolClaim, error) {
+	claims := make(map[string]PoolClaim)
+	err := metaStore.forEachRecord("poolclaim-", func(key string, recordBytes []byte) error {
+		var claim PoolClaim
+		err := json.Unmarshal(recordBytes, &claim)
+		if err != nil {
+			return err
+		}
+
+		claims[strings.TrimPrefix(key, "poolclaim-")] = claim
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// effectiveLabels returns the labels of a container, with pooled containers
+// given the labels of the cluster which claimed them.
+func effectiveLabels(container types.Container, claims map[string]PoolClaim) map[string]string {
+	if container.Labels[poolLabel] != "true" {
+		return container.Labels
+	}
+
+	claim, ok := claims[container.ID[0:12]]
+	if !ok {
+		return container.Labels
+	}
+
+	labels := make(map[string]string)
+	for key, value := range container.Labels {
+		labels[key] = value
+	}
+	labels["com.couchbase.dyncluster.cluster_id"] = claim.ClusterID
+	labels["com.couchbase.dyncluster.node_name"] = claim.NodeName
+	labels["com.couchbase.dyncluster.creator"] = claim.Creator
+
+	return labels
+}
+
+func releasePoolClaim(ctx context.Context, containerID string) {
+	err := metaStore.deleteRecord(poolClaimKey(containerID))
+	if err != nil {
+		logWarnf(ctx, "Failed to remove pool claim: %s", err)
+	}
+}
+
+// getIdlePoolNodes returns the running pooled containers on a host which
+// haven't been claimed, by server version.
+func getIdlePoolNodes(ctx context.Context, host *DockerHost) (map[string][]types.Container, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", poolLabel+"=true")
+
+	containers, err := host.Client.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filterArgs,
+	})
+	if err != nil {
+		return nil, trackDockerError("container_list", err)
+	}
+
+	claims, err := getPoolClaims()
+	if err != nil {
+		return nil, err
+	}
+
+	idleNodes := make(map[string][]types.Container)
+	for _, container := range containers {
+		if _, ok := claims[container.ID[0:12]]; ok || container.State != "running" {
+			continue
+		}
+
+		rememberContainerHost(container.ID, host)
+		serverVersion := container.Labels["com.couchbase.dyncluster.initial_server_version"]
+		idleNodes[serverVersion] = append(idleNodes[serverVersion], container)
+	}
+
+	return idleNodes, nil
+}
+
+var warmPoolReplenishSig = make(chan struct{}, 1)
+
+// claimIdlePoolNode claims an idle container for a cluster.  Claims are
+// created rather than set, so that when allocations on several daemons race
+// for the same container only one of them gets it and the others move on to
+// the next.
+func claimIdlePoolNode(ctx context.Context, clusterID string, opts NodeOptions) (*types.Container, error) {
+	host := opts.host
+	if host == nil {
+		host = primaryDockerHost()
+	}
+
+	idleNodes, err := getIdlePoolNodes(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	claimBytes, err := json.Marshal(PoolClaim{
+		ClusterID: clusterID,
+		NodeName:  opts.Name,
+		Creator:   ContextUser(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range idleNodes[opts.ServerVersion] {
+		err = metaStore.createRawRecord(poolClaimKey(container.ID[0:12]), claimBytes)
+		if err == ErrMetaExists {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &container, nil
+	}
+
+	return nil, nil
+}
+
+// claimPooledNode hands an idle pooled container to a cluster, returning false
+// if there isn't one for the version requested.
+func claimPooledNode(ctx context.Context, clusterID string, opts NodeOptions) (string, bool) {
+	if warmPoolSizes[opts.ServerVersion] == 0 {
+		return "", false
+	}
+
+	container, err := claimIdlePoolNode(ctx, clusterID, opts)
+	if err != nil {
+		logWarnf(ctx, "Failed to claim node from warm pool: %s", err)
+		return "", false
+	}
+	if container == nil {
+		logInfof(ctx, "Warm pool for %s is empty", opts.ServerVersion)
+		return "", false
+	}
+
+	containerID := container.ID[0:12]
+	logInfof(ctx, "Claimed node %s from warm pool", containerID)
+
+	// Give the container the name it would have had if it had been created
+	// for this cluster, so that hostnames are the same either way.
+	containerName := fmt.Sprintf("dynclsr-%s-%s", clusterID, opts.Name)
+	err = dockerFor(containerID).ContainerRename(context.Background(), containerID, containerName)
+	if err != nil {
+		logWarnf(ctx, "Failed to rename pooled node: %s", trackDockerError("container_rename", err))
+		containerName = strings.TrimPrefix(container.Names[0], "/")
+	}
+
+	network := container.NetworkSettings.Networks[NetworkName]
+	if network != nil {
+		registerNodeDNS(ctx, containerName, network.IPAddress, network.GlobalIPv6Address)
+	}
+
+	select {
+	case warmPoolReplenishSig <- struct{}{}:
+	default:
+	}
+
+	return containerID, true
+}
+
+func createPoolNode(ctx context.Context, host *DockerHost, serverVersion string) error {
+	nodeVersion, err := parseServerVersion(serverVersion)
+	if err != nil {
+		return err
+	}
+
+	err = ensureImage(ctx, host, "", nodeVersion)
+	if err != nil {
+		return err
+	}
+
+	poolUUID, _ := uuid.NewRandom()
+	containerName := "dynclsr-pool-" + poolUUID.String()[0:8]
+
+	_, err = startNodeContainer(ctx, host, containerName, nodeVersion.toImageName(), map[string]string{
+		poolLabel:                          "true",
+		"com.couchbase.dyncluster.creator": "system",
+		"com.couchbase.dyncluster.initial_server_version": serverVersion,
+	}, NodeOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// replenishWarmPool starts nodes for any version whose pool has been drawn
+// down on any host, and stops idle nodes which are no longer wanted.
+func replenishWarmPool(ctx context.Context) error {
+	for _, host := range getDockerHosts() {
+		err := replenishHostWarmPool(ctx, host)
+		if err != nil {
+			return errors.Wrapf(err, "failed to replenish warm pool on %s", host.Name)
+		}
+	}
+
+	return nil
+}
+
+func replenishHostWarmPool(ctx context.Context, host *DockerHost) error {
+	idleNodes, err := getIdlePoolNodes(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for serverVersion, size := range warmPoolSizes {
+		for i := len(idleNodes[serverVersion]); i < size; i++ {
+			logInfof(ctx, "Starting warm pool node for %s on %s", serverVersion, host.Name)
+			err := createPoolNode(ctx, host, serverVersion)
+			if err != nil {
+				return errors.Wrapf(err, "failed to start warm pool node for %s", serverVersion)
+			}
+		}
+	}
+
+	claimBytes, err := json.Marshal(PoolClaim{Creator: "system"})
+	if err != nil {
+		return err
+	}
+
+	for serverVersion, containers := range idleNodes {
+		for i := warmPoolSizes[serverVersion]; i < len(containers); i++ {
+			// Claim the node like an allocation would, so that it isn't
+			// killed after an allocation has just been handed it.
+			containerID := containers[i].ID[0:12]
+			err := metaStore.createRawRecord(poolClaimKey(containerID), claimBytes)
+			if err == ErrMetaExists {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			logInfof(ctx, "Stopping surplus warm pool node for %s on %s", serverVersion, host.Name)
+			err = killNode(ctx, containerID)
+			if err != nil {
+				releasePoolClaim(ctx, containerID)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func runWarmPool(shutdownSig chan struct{}) {
+	for {
+		if isLeader() {
+			err := replenishWarmPool(systemCtx)
+			if err != nil {
+				logErrorf(systemCtx, "Failed to replenish warm pool: %s", err)
+			}
+		}
+
+		select {
+		case <-shutdownSig:
+			return
+		case <-warmPoolReplenishSig:
+		case <-time.After(1 * time.Minute):
+		}
+	}
+}
+
+func collectWarmPoolNodes() (map[string]float64, error) {
+	if len(warmPoolSizes) == 0 {
+		return nil, nil
+	}
+
+	idleNodes := make(map[string]float64)
+	for serverVersion := range warmPoolSizes {
+		idleNodes[serverVersion] = 0
+	}
+	for _, host := range getDockerHosts() {
+		hostIdleNodes, err := getIdlePoolNodes(context.Background(), host)
+		if err != nil {
+			return nil, err
+		}
+
+		for serverVersion, containers := range hostIdleNodes {
+			if _, ok := warmPoolSizes[serverVersion]; ok {
+				idleNodes[serverVersion] += float64(len(containers))
+			}
+		}
+	}
+
+	return idleNodes, nil
+}
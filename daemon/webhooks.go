@@ -0,0 +1,318 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	ClusterEventAllocated     = "allocated"
+	ClusterEventSetupComplete = "setup_complete"
+	ClusterEventExpiringSoon  = "expiring_soon"
+	ClusterEventExpired       = "expired"
+	ClusterEventKilled        = "killed"
+	ClusterEventNodeDied      = "node_died"
+	ClusterEventImageBuilt    = "image_built"
+)
+
+var clusterEventTypes = []string{
+	ClusterEventAllocated,
+	ClusterEventSetupComplete,
+	ClusterEventExpiringSoon,
+	ClusterEventExpired,
+	ClusterEventKilled,
+	ClusterEventNodeDied,
+	ClusterEventImageBuilt,
+}
+
+// expiryWarningPeriod is how long before its timeout a cluster is considered
+// to be expiring soon.
+var expiryWarningPeriod = 30 * time.Minute
+
+// ClusterEvent is the body posted to webhooks and sent to event streams.
+type ClusterEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	ClusterID string    `json:"cluster_id"`
+	Owner     string    `json:"owner"`
+	Team      string    `json:"team,omitempty"`
+	Timeout   time.Time `json:"timeout"`
+	Actor     string    `json:"actor"`
+	// Node is the node which died for node_died events.
+	Node string `json:"node,omitempty"`
+	// Image is the image which was built for image_built events.
+	Image string `json:"image,omitempty"`
+
+	sharedWith []string
+}
+
+func newClusterEvent(ctx context.Context, eventType string, cluster *Cluster) *ClusterEvent {
+	return &ClusterEvent{
+		Type:       eventType,
+		Time:       time.Now(),
+		ClusterID:  cluster.ID,
+		Owner:      cluster.Owner,
+		Team:       cluster.Team,
+		Timeout:    cluster.Timeout,
+		Actor:      ContextUser(ctx),
+		sharedWith: cluster.SharedWith,
+	}
+}
+
+// newImageBuiltEvent is the event for an image having been built for the
+// cluster in ctx.  Images aren't owned by anyone, so the event has no owner.
+func newImageBuiltEvent(ctx context.Context, image string) *ClusterEvent {
+	return &ClusterEvent{
+		Type:      ClusterEventImageBuilt,
+		Time:      time.Now(),
+		ClusterID: ContextClusterID(ctx),
+		Actor:     ContextUser(ctx),
+		Image:     image,
+	}
+}
+
+// Webhook receives events about a single cluster, or about every cluster its
+// owner has access to if ClusterID is empty.
+type Webhook struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	URL       string    `json:"url"`
+	ClusterID string    `json:"cluster_id,omitempty"`
+	Events    []string  `json:"events,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func webhookKey(webhookID string) string {
+	return "webhook-" + webhookID
+}
+
+func (hook *Webhook) wants(event *ClusterEvent) bool {
+	if len(hook.Events) > 0 && !containsString(hook.Events, event.Type) {
+		return false
+	}
+
+	if hook.ClusterID != "" {
+		return hook.ClusterID == event.ClusterID
+	}
+
+	return hook.Owner == event.Owner || containsString(event.sharedWith, hook.Owner) ||
+		isTeamMember(event.Team, hook.Owner)
+}
+
+type WebhookOptions struct {
+	URL       string
+	ClusterID string
+	Events    []string
+	Secret    string
+}
+
+func createWebhook(ctx context.Context, opts WebhookOptions) (*Webhook, error) {
+	hookURL, err := url.Parse(opts.URL)
+	if err != nil || (hookURL.Scheme != "http" && hookURL.Scheme != "https") || hookURL.Host == "" {
+		return nil, errors.New("webhook url must be an absolute http or https url")
+	}
+
+	for _, eventType := range opts.Events {
+		if !containsString(clusterEventTypes, eventType) {
+			return nil, errors.Errorf("unknown event type %s", eventType)
+		}
+	}
+
+	if opts.ClusterID != "" {
+		// Make sure that the user can actually see the cluster
+		_, err := getCluster(ctx, opts.ClusterID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hookUUID, _ := uuid.NewRandom()
+	hook := &Webhook{
+		ID:        hookUUID.String()[0:8],
+		Owner:     ContextUser(ctx),
+		URL:       opts.URL,
+		ClusterID: opts.ClusterID,
+		Events:    opts.Events,
+		Secret:    opts.Secret,
+		CreatedAt: time.Now(),
+	}
+
+	err = metaStore.setRecord(webhookKey(hook.ID), hook)
+	if err != nil {
+		return nil, err
+	}
+
+	logInfof(ctx, "Registered webhook %s to %s", hook.ID, hook.URL)
+
+	return hook, nil
+}
+
+func getAllWebhooks() ([]Webhook, error) {
+	var hooks []Webhook
+	err := metaStore.forEachRecord("webhook-", func(key string, recordBytes []byte) error {
+		var hook Webhook
+		err := json.Unmarshal(recordBytes, &hook)
+		if err != nil {
+			return err
+		}
+
+		hooks = append(hooks, hook)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+func getWebhooks(ctx context.Context) ([]Webhook, error) {
+	hooks, err := getAllWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	var userHooks []Webhook
+	for _, hook := range hooks {
+		if ContextIgnoreOwnership(ctx) || hook.Owner == ContextUser(ctx) {
+			userHooks = append(userHooks, hook)
+		}
+	}
+
+	return userHooks, nil
+}
+
+func deleteWebhook(ctx context.Context, webhookID string) error {
+	var hook Webhook
+	err := metaStore.getRecord(webhookKey(webhookID), &hook)
+	if err != nil {
+		return errors.New("webhook not found")
+	}
+
+	if !ContextIgnoreOwnership(ctx) && hook.Owner != ContextUser(ctx) {
+		return errors.New("webhook not found")
+	}
+
+	return metaStore.deleteRecord(webhookKey(webhookID))
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// deliverWebhook posts an event to a webhook, retrying a few times since the
+// receivers are often CI systems which come and go.
+func deliverWebhook(ctx context.Context, hook Webhook, body []byte) {
+	backoff := 1 * time.Second
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("cbdn-webhook-id", hook.ID)
+		if hook.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(hook.Secret))
+			mac.Write(body)
+			req.Header.Set("cbdn-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return
+		}
+		err = errors.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	logWarnf(ctx, "Failed to deliver webhook %s to %s: %s", hook.ID, hook.URL, err)
+}
+
+// publishClusterEvent delivers an event to every interested webhook in the
+// background, so that slow receivers never hold up cluster operations.
+func publishClusterEvent(ctx context.Context, event *ClusterEvent) {
+	ctx = ContextWithClusterID(ctx, event.ClusterID)
+	broadcastEvent(event)
+
+	hooks, err := getAllWebhooks()
+	if err != nil {
+		logErrorf(ctx, "Failed to load webhooks for %s event: %s", event.Type, err)
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logErrorf(ctx, "Failed to marshal %s event: %s", event.Type, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if hook.wants(event) {
+			go deliverWebhook(ctx, hook, body)
+		}
+
+		// Hooks for a single cluster have nothing left to do once it is gone
+		if event.Type == ClusterEventKilled && hook.ClusterID == event.ClusterID {
+			err := metaStore.deleteRecord(webhookKey(hook.ID))
+			if err != nil {
+				logWarnf(ctx, "Failed to remove webhook %s: %s", hook.ID, err)
+			}
+		}
+	}
+}
+
+// expiryWarnings remembers which timeout each cluster was last warned about,
+// so that refreshed clusters get warned again when they near their new one.
+var expiryWarnings = make(map[string]time.Time)
+var expiryWarningsLock sync.Mutex
+
+func warnExpiringClusters(clusters []*Cluster) {
+	expiryWarningsLock.Lock()
+	defer expiryWarningsLock.Unlock()
+
+	seen := make(map[string]bool)
+	for _, cluster := range clusters {
+		seen[cluster.ID] = true
+
+		timeLeft := time.Until(cluster.Timeout)
+		if timeLeft <= 0 || timeLeft > expiryWarningPeriod {
+			continue
+		}
+
+		if warnedFor, ok := expiryWarnings[cluster.ID]; ok && warnedFor.Equal(cluster.Timeout) {
+			continue
+		}
+		expiryWarnings[cluster.ID] = cluster.Timeout
+
+		publishClusterEvent(systemCtx, newClusterEvent(systemCtx, ClusterEventExpiringSoon, cluster))
+		go notifyExpiringCluster(systemCtx, cluster)
+	}
+
+	for clusterID := range expiryWarnings {
+		if !seen[clusterID] {
+			delete(expiryWarnings, clusterID)
+		}
+	}
+}
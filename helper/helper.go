@@ -39,6 +39,8 @@ const (
 	RestPort           = 8091
 	N1qlPort           = 8093
 	FtsPort            = 8094
+	CbasPort           = 8095
+	EventingPort       = 8096
 	SshUser            = "root"
 	SshPass            = "couchbase"
 	RestUser           = "Administrator"
@@ -51,11 +53,16 @@ const (
 	PPoolsNodes        = "/pools/nodes"
 	PBuckets           = "/pools/default/buckets"
 	PFailover          = "/controller/failOver"
+	PGracefulFailover  = "/controller/startGracefulFailover"
+	PRecoveryType      = "/controller/setRecoveryType"
 	PEject             = "/controller/ejectNode"
 	PSetupServices     = "/node/controller/setupServices"
 	PPoolsDefault      = "/pools/default"
 	PSettingsWeb       = "/settings/web"
 	PRbacUsers         = "/settings/rbac/users/local"
+	PRbacExternalUsers = "/settings/rbac/users/external"
+	PRbacGroups        = "/settings/rbac/groups"
+	PSettingsLDAP      = "/settings/ldap"
 	PAddNode           = "/controller/addNode"
 	PNodesSelf         = "/nodes/self"
 	PRebalance         = "/controller/rebalance"
@@ -65,6 +72,13 @@ const (
 	PFts               = "/api/index"
 	PRename            = "/node/controller/rename"
 	PDeveloperPreview  = "/settings/developerPreview"
+	PRemoteClusters    = "/pools/default/remoteClusters"
+	PReplication       = "/controller/createReplication"
+	PCbas              = "/analytics/service"
+	PCbasLink          = "/analytics/link"
+	PEventingFunctions = "/api/v1/functions"
+	PEventingStatus    = "/api/v1/status"
+	PAlternateAddress  = "/node/controller/setupAlternateAddresses/external"
 
 	Domain        = "/domain"
 	DomainPostfix = ".couchbase.com"
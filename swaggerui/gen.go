@@ -0,0 +1,67 @@
+//go:build ignore
+// +build ignore
+
+// gen.go writes assets.go from the files in dist, gzipped so that the
+// daemon doesn't carry several megabytes of javascript in its binary.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+var assetNames = []string{
+	"swagger-ui.css",
+	"swagger-ui-bundle.js",
+}
+
+func main() {
+	sort.Strings(assetNames)
+
+	var out bytes.Buffer
+	out.WriteString("// Code generated by gen.go from the files in dist; DO NOT EDIT.\n\n")
+	out.WriteString("package swaggerui\n\n")
+	out.WriteString("var gzippedAssets = map[string]string{\n")
+
+	for _, name := range assetNames {
+		content, err := ioutil.ReadFile(filepath.Join("dist", name))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var gzipped bytes.Buffer
+		writer, err := gzip.NewWriterLevel(&gzipped, gzip.BestCompression)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = writer.Write(content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(&out, "\t%q: %q,\n", name, base64.StdEncoding.EncodeToString(gzipped.Bytes()))
+	}
+
+	out.WriteString("}\n")
+
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("assets.go", source, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,125 @@
+// Package swaggerui serves Swagger UI from assets built into the daemon, so
+// that the API can be browsed without loading anything from the internet.
+//
+// The assets in dist are those of swagger-ui-dist 5.18.2, which is licensed
+// under the Apache License 2.0 in dist/LICENSE.  To update them, replace the
+// files in dist and run go generate.
+package swaggerui
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+const page = `<!DOCTYPE html>
+<html>
+<head>
+  <title>%[1]s</title>
+  <link rel="stylesheet" href="%[2]s/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="%[2]s/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = function() {
+      SwaggerUIBundle({
+        url: "%[3]s",
+        dom_id: "#swagger-ui",
+      });
+    };
+  </script>
+</body>
+</html>
+`
+
+// PageHandler serves the page which loads Swagger UI from assetsURL, pointed
+// at the document at specURL.  Both URLs can be relative to the page.
+func PageHandler(title, assetsURL, specURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, page, title, assetsURL, specURL)
+	}
+}
+
+var assetTypes = map[string]string{
+	".css": "text/css; charset=utf-8",
+	".js":  "application/javascript; charset=utf-8",
+}
+
+var assetsLock sync.Mutex
+var assets = make(map[string][]byte)
+
+// asset returns an asset, gzipped or not.  Assets are only unzipped for the
+// odd client which doesn't accept gzip, and are kept once they have been.
+func asset(name string, gzipped bool) ([]byte, bool, error) {
+	encoded, ok := gzippedAssets[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	assetsLock.Lock()
+	defer assetsLock.Unlock()
+
+	key := name
+	if gzipped {
+		key += ".gz"
+	}
+	if content, ok := assets[key]; ok {
+		return content, true, nil
+	}
+
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !gzipped {
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, false, err
+		}
+
+		content, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	assets[key] = content
+	return content, true, nil
+}
+
+// AssetHandler serves the asset named by the last element of the path.
+func AssetHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		gzipped := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+
+		content, ok, err := asset(name, gzipped)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", assetTypes[path.Ext(name)])
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if gzipped {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Write(content)
+	}
+}